@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -332,7 +333,7 @@ func (c *CognitoFlow) Username(w http.ResponseWriter, r *http.Request) {
 		awsErr, ok := err.(awserr.Error)
 		if ok {
 			if awsErr.Code() == cognitoidentityprovider.ErrCodeUserNotFoundException {
-				log.Info("Username %s is free", &userd.Username)
+				log.Infof("Username %s is free", userd.Username)
 				return
 			}
 		} else {
@@ -342,7 +343,7 @@ func (c *CognitoFlow) Username(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	log.Info("Username %s is taken.", &userd.Username)
+	log.Infof("Username %s is taken.", userd.Username)
 	http.Error(w, "taken", http.StatusConflict)
 }
 
@@ -461,7 +462,15 @@ type tokendata struct {
 	Accestoken string `json:"access_token"`
 }
 
-//ValidateAccessToken verifies that the access token used is valid
+//Identity who an access token belongs to, a user is a member of the group named by their sub and of
+//any cognito groups they were added to
+type Identity struct {
+	Sub      string   `json:"sub"`
+	Username string   `json:"username"`
+	Groups   []string `json:"groups"`
+}
+
+//ValidateAccessToken verifies that the access token used is valid and answers with the identity behind it
 func ValidateAccessToken(w http.ResponseWriter, r *http.Request) {
 	var token tokendata
 	authHeader := r.Header.Get("Authorization")
@@ -477,18 +486,37 @@ func ValidateAccessToken(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			log.Error(err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
+	} else {
+		token.Accestoken = strings.TrimSpace(strings.TrimPrefix(authHeader, "Bearer "))
 	}
-	token.Accestoken = authHeader
-	_, err := token.Validate()
+	identity, err := token.Identity()
 	if err != nil {
 		log.Error(err)
 		http.Error(w, "", http.StatusForbidden)
 		return
 	}
+	data, err := json.Marshal(identity)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
 }
 
 func (token *tokendata) Validate() (string, error) {
+	identity, err := token.Identity()
+	if err != nil {
+		return "", err
+	}
+	return identity.Sub, nil
+}
+
+//Identity verify the token and read the identity out of its claims
+func (token *tokendata) Identity() (*Identity, error) {
 	tok, err := jwt.Parse(token.Accestoken, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
 			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
@@ -505,31 +533,34 @@ func (token *tokendata) Validate() (string, error) {
 		var raw interface{}
 		return raw, keys[0].Raw(&raw)
 	})
-	if err != nil || !tok.Valid {
+	if err != nil || !tok.Valid { //Parse already rejects expired tokens
 		log.Error(err)
 		if err == nil {
-			return "", fmt.Errorf("Token validity: %t", tok.Valid)
+			return nil, fmt.Errorf("Token validity: %t", tok.Valid)
 		}
-		return "", err
+		return nil, err
 	}
 	if claims, ok := tok.Claims.(jwt.MapClaims); ok {
-		exp, ok := claims["exp"].(int64)
-		if !ok {
-			return "", fmt.Errorf("Token validity: %t", ok)
-		}
-
-		if exp > time.Now().Unix() {
-			log.Info("Token epxired")
-			return "", fmt.Errorf("Token expired %d", exp)
+		if _, ok := claims["exp"].(float64); !ok {
+			return nil, errors.New("Token missing exp")
 		}
 
 		sub, ok := claims["sub"].(string)
 		if !ok {
-			return "", fmt.Errorf("Token missing sub")
+			return nil, fmt.Errorf("Token missing sub")
+		}
+		identity := &Identity{Sub: sub, Groups: []string{sub}}
+		identity.Username, _ = claims["username"].(string)
+		if groups, ok := claims["cognito:groups"].([]interface{}); ok {
+			for _, group := range groups {
+				if name, ok := group.(string); ok {
+					identity.Groups = append(identity.Groups, name)
+				}
+			}
 		}
-		return sub, nil
+		return identity, nil
 	}
-	return "", fmt.Errorf("Something went wrong parsing token")
+	return nil, fmt.Errorf("Something went wrong parsing token")
 }
 
 //Signout  sign out of the platform
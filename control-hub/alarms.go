@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+)
+
+const (
+	eventsStream    = "EVENTS"
+	readingsSubject = eventsStream + ".*.*.readings"
+	recipesDurable  = "control-hub-recipes"
+	alarmsPrefix    = "alarms/"
+	alarmsChannel   = "alarms"
+	stepsChannel    = "steps"
+	estopChannel    = "estop"
+
+	alarmPitHigh = "pit_high"
+	alarmPitLow  = "pit_low"
+	pitNormal    = "normal"
+	pitSensor    = "pit"
+)
+
+//SensorReading what a device publishes to its readings channel, one per sensor: the pit or one of its probes
+type SensorReading struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Running bool     `json:"running"`
+	F       *float64 `json:"f"`
+	C       *float64 `json:"c"`
+}
+
+//pit whether the reading is of the pit, firmware from before the sensors were named only has the one
+func (r *SensorReading) pit() bool {
+	return r.Name == pitSensor || r.Name == ""
+}
+
+//probe whether the reading is of the named probe, matched on the name of the sensor or its id
+func (r *SensorReading) probe(name string) bool {
+	return name != "" && (r.Name == name || r.ID == name)
+}
+
+//Alarm published to the alarms channel of a device when its pit leaves the range of the recipe it's running
+type Alarm struct {
+	Alarm     string  `json:"alarm"`
+	Temp      float64 `json:"temp"`
+	Threshold float64 `json:"threshold"`
+	Recipe    string  `json:"recipe"`
+	Timestamp int64   `json:"timestamp"`
+}
+
+//recipeRun the part of a config that says whether a device is running a recipe and which step it's on
+type recipeRun struct {
+	Pwr         bool    `json:"pwr"`
+	Recipe      *Recipe `json:"recipe"`
+	Step        int     `json:"recipe_step"`
+	StepStarted int64   `json:"step_started"`
+}
+
+//running whether there's a recipe to run
+func (run *recipeRun) running() bool {
+	return run.Pwr && run.Recipe != nil && len(run.Recipe.Steps) > 0
+}
+
+func alarmsKey(group string) string {
+	return alarmsPrefix + group
+}
+
+//publishDeviceEvent publish an event about a device to one of its channels. The channels control-hub publishes
+//to are reserved in pub-hub so a device can't make the events up
+func publishDeviceEvent(group, device, channel string, event interface{}) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = js.Publish(eventsStream+"."+group+"."+device+"."+channel, data)
+	return err
+}
+
+//pitState where a pit temperature sits against the alarms of a recipe, last is the state of the previous
+//reading. A pit still coming up to temperature isn't low until it has been in range once
+func pitState(alarms *Alarms, temp float64, last string) string {
+	switch {
+	case alarms.PitHigh > 0 && temp >= alarms.PitHigh:
+		return alarmPitHigh
+	case alarms.PitLow > 0 && temp <= alarms.PitLow:
+		if last == "" {
+			return ""
+		}
+		return alarmPitLow
+	}
+	return pitNormal
+}
+
+//checkAlarms compare the pit temperature of a reading to the alarms of the recipe the device is running and
+//raise an alarm when the pit leaves the range. The state of every device is kept so an alarm fires once rather
+//than on every reading
+func checkAlarms(group, device string, run *recipeRun, pit float64) error {
+	last, err := store.GetEntry(alarmsKey(group), device)
+	if err == errNotFound {
+		last = nil
+	} else if err != nil {
+		return err
+	}
+	if !run.running() || run.Recipe.Alarms == nil {
+		if last != nil { //The cook is over, the next one starts cold
+			_, err := store.DeleteEntries(alarmsKey(group), device)
+			return err
+		}
+		return nil
+	}
+	state := pitState(run.Recipe.Alarms, pit, string(last))
+	if state == string(last) {
+		return nil
+	}
+	if err := store.PutEntry(alarmsKey(group), device, []byte(state)); err != nil {
+		return err
+	}
+	alarm := &Alarm{Alarm: state, Temp: pit, Recipe: run.Recipe.Name, Timestamp: time.Now().Unix()}
+	switch state {
+	case alarmPitHigh:
+		alarm.Threshold = run.Recipe.Alarms.PitHigh
+	case alarmPitLow:
+		alarm.Threshold = run.Recipe.Alarms.PitLow
+	default:
+		return nil
+	}
+	log.Warnf("%v/%v %v at %v", group, device, state, pit)
+	return publishDeviceEvent(group, device, alarmsChannel, alarm)
+}
+
+//watchReading run the recipe a device is running against the reading of one of its sensors. Only the pit
+//sensor is held to the alarms, probes can end a step
+func watchReading(group, device string, data []byte) error {
+	var reading SensorReading
+	if err := json.Unmarshal(data, &reading); err != nil {
+		return nil
+	}
+	var run recipeRun
+	config, rev, err := store.ReadConfig(group, device, recipeConfig)
+	if err != nil && err != errNotFound {
+		return err
+	} else if err == nil {
+		json.Unmarshal(config, &run)
+	}
+	if reading.pit() && reading.F != nil {
+		if err := checkAlarms(group, device, &run, *reading.F); err != nil {
+			return err
+		}
+	}
+	if !run.running() {
+		return nil
+	}
+	return advanceStep(group, device, config, rev, &run, &reading, time.Now())
+}
+
+//RunRecipes watch the readings of every device for the alarms and steps of the recipe it's running, the
+//consumer is shared by the replicas
+func RunRecipes() {
+	sub := pullSubscribe(readingsSubject, recipesDurable)
+	for {
+		msgs, err := sub.Fetch(webhookBatch, nats.MaxWait(webhookWait))
+		if idleFetch(err) {
+			continue
+		} else if err != nil {
+			log.Error(err)
+			time.Sleep(webhookWait)
+			continue
+		}
+		for _, m := range msgs {
+			parts := strings.Split(m.Subject, ".") //EVENTS.<group>.<device>.readings
+			if len(parts) == 4 {
+				if err := watchReading(parts[1], parts[2], m.Data); err != nil {
+					log.Error(err)
+					m.Nak()
+					continue
+				}
+			}
+			m.Ack()
+		}
+	}
+}
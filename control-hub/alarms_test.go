@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestPitState(t *testing.T) {
+	alarms := &Alarms{PitHigh: 300, PitLow: 200}
+	for _, test := range []struct {
+		temp float64
+		last string
+		want string
+	}{
+		{150, "", ""},
+		{250, "", pitNormal},
+		{150, pitNormal, alarmPitLow},
+		{310, "", alarmPitHigh},
+		{300, pitNormal, alarmPitHigh},
+		{150, alarmPitHigh, alarmPitLow},
+		{250, alarmPitLow, pitNormal},
+	} {
+		if state := pitState(alarms, test.temp, test.last); state != test.want {
+			t.Fatalf("%v after %q: %q, want %q", test.temp, test.last, state, test.want)
+		}
+	}
+	if state := pitState(&Alarms{PitHigh: 300}, 100, pitNormal); state != pitNormal {
+		t.Fatalf("without a low alarm: %q", state)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+const (
+	auditStream   = "AUDIT"
+	auditPrefix   = "audit/"
+	maxAudit      = 1000
+	defaultAudits = 100
+)
+
+//Actions a config write is audited as
+const (
+	actionSet      = "set"
+	actionRollback = "rollback"
+	actionBulk     = "bulk"
+	actionEstop    = "estop"
+	actionRecipe   = "recipe"
+	actionSchedule = "schedule"
+)
+
+//Resources audited besides configs and what can be done to them
+const (
+	resourceSchedule   = "schedule"
+	resourceHold       = "hold"
+	resourceWebhook    = "webhook"
+	resourceType       = "type"
+	resourceRegistry   = "registry"
+	resourceRecipe     = "recipe"
+	resourceDeviceType = "devicetype"
+
+	actionCreate   = "create"
+	actionUpdate   = "update"
+	actionDelete   = "delete"
+	actionCancel   = "cancel"
+	actionRelease  = "release"
+	actionAssign   = "assign"
+	actionUnassign = "unassign"
+)
+
+//Sources a config write came in through
+const (
+	sourceHTTP      = "http"
+	sourceGRPC      = "grpc"
+	sourceScheduler = "scheduler"
+)
+
+//AuditEntry a config write as it happened, the actor is who was authenticated making it, the author is who
+//the revision is credited to and may differ when the caller named someone. Changes to schedules, holds,
+//webhooks, type assignments, the registry, recipes and device types name the resource instead of a config
+type AuditEntry struct {
+	ID         string          `json:"id"`
+	Timestamp  int64           `json:"timestamp"`
+	Group      string          `json:"group"`
+	Device     string          `json:"device"`
+	Config     string          `json:"config"`
+	Revision   uint64          `json:"revision"`
+	Action     string          `json:"action"`
+	Source     string          `json:"source"`
+	Actor      string          `json:"actor"`
+	Author     string          `json:"author"`
+	RollbackOf uint64          `json:"rollback_of,omitempty"`
+	Schedule   string          `json:"schedule,omitempty"`
+	Resource   string          `json:"resource,omitempty"`
+	Before     json.RawMessage `json:"before"`
+	After      json.RawMessage `json:"after"`
+}
+
+//Subject the AUDIT subject of an entry, AUDIT.<group>.<device>.<config> for config writes and
+//AUDIT.<group>.<device>.<resource>.<action> for other changes. Changes to a whole group have the device _ and
+//changes outside of any group, to device types, the group _ as well
+func (entry *AuditEntry) Subject() string {
+	subject := auditStream + "." + subjectToken(entry.Group) + "." + subjectToken(entry.Device)
+	if entry.Resource != "" {
+		return subject + "." + entry.Resource + "." + entry.Action
+	}
+	return subject + "." + subjectToken(entry.Config)
+}
+
+//subjectToken a name as a single subject token. Dots would split it, wildcards and whitespace aren't allowed
+//so they're percent encoded along with the percent sign. An empty name is _ and a name of _ is encoded
+func subjectToken(name string) string {
+	switch name {
+	case "":
+		return "_"
+	case "_":
+		return "%5F"
+	}
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		switch ch := name[i]; {
+		case ch == '.' || ch == '*' || ch == '>' || ch == '%' || ch <= ' ' || ch == 0x7f:
+			fmt.Fprintf(&b, "%%%02X", ch)
+		default:
+			b.WriteByte(ch)
+		}
+	}
+	return b.String()
+}
+
+func auditDeviceKey(group, device string) string {
+	return auditPrefix + group + "/devices/" + device
+}
+
+func auditUserKey(group, actor string) string {
+	return auditPrefix + group + "/users/" + actor
+}
+
+//Audit record a config write. The AUDIT stream is the append only record, redis keeps the latest entries of
+//every device and user of a group to query. A failure is logged, the write already happened
+func Audit(group, device, config string, rev uint64, revision *Revision, before []byte) {
+	entry := &AuditEntry{
+		ID:         nuid.Next(),
+		Timestamp:  revision.Timestamp,
+		Group:      group,
+		Device:     device,
+		Config:     config,
+		Revision:   rev,
+		Action:     revision.Action,
+		Source:     revision.Source,
+		Actor:      revision.Actor,
+		Author:     revision.Author,
+		RollbackOf: revision.RollbackOf,
+		Schedule:   revision.Schedule,
+		Before:     before,
+		After:      revision.Config,
+	}
+	if entry.Action == "" {
+		entry.Action = actionSet
+	}
+	publishAudit(entry)
+}
+
+//AuditChange record a change made through the api to something other than a config, before and after are
+//what it was and became, nil when it didn't exist. device is empty for changes to the whole group
+func AuditChange(c *gin.Context, group, device, resource, action string, before, after interface{}) {
+	entry := &AuditEntry{
+		ID:        nuid.Next(),
+		Timestamp: time.Now().Unix(),
+		Group:     group,
+		Device:    device,
+		Action:    action,
+		Source:    sourceHTTP,
+		Actor:     actor(c),
+		Author:    actor(c),
+		Resource:  resource,
+		Before:    auditDocument(before),
+		After:     auditDocument(after),
+	}
+	publishAudit(entry)
+}
+
+//auditDocument the JSON of a resource for an audit entry
+func auditDocument(doc interface{}) json.RawMessage {
+	if doc == nil {
+		return nil
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	return data
+}
+
+//publishAudit publish an entry to the AUDIT stream and index it under its device and actor
+func publishAudit(entry *AuditEntry) {
+	if entry.Actor == "" {
+		entry.Actor = entry.Author
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if _, err := js.Publish(entry.Subject(), data, nats.MsgId(entry.ID)); err != nil {
+		log.Errorf("unable to publish audit entry %v: %v", entry.ID, err)
+	}
+	keys := []string{auditUserKey(entry.Group, entry.Actor)}
+	if entry.Device != "" {
+		keys = append(keys, auditDeviceKey(entry.Group, entry.Device))
+	}
+	for _, key := range keys {
+		if err := store.AppendLog(key, data, maxAudit); err != nil {
+			log.Errorf("unable to index audit entry %v: %v", entry.ID, err)
+		}
+	}
+}
+
+//loadAudit the latest entries under a key, newest first. Filtered to a config and time range when given
+func loadAudit(key, config string, since int64, limit int) ([]AuditEntry, error) {
+	vals, err := store.ReadLog(key, maxAudit)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]AuditEntry, 0, limit)
+	for _, val := range vals {
+		var entry AuditEntry
+		if err := json.Unmarshal(val, &entry); err != nil {
+			log.Error(err)
+			continue
+		}
+		if entry.Timestamp < since {
+			break
+		}
+		if config != "" && entry.Config != config {
+			continue
+		}
+		entries = append(entries, entry)
+		if len(entries) == limit {
+			break
+		}
+	}
+	return entries, nil
+}
+
+//auditResponse answer an audit query, ?config= ?since=<unix seconds> and ?limit= narrow it down
+func auditResponse(c *gin.Context, key string) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultAudits)))
+	if err != nil || limit < 1 || limit > maxAudit {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and " + strconv.Itoa(maxAudit)})
+		return
+	}
+	var since int64
+	if val := c.Query("since"); val != "" {
+		if since, err = strconv.ParseInt(val, 10, 64); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "since must be a unix timestamp"})
+			return
+		}
+	}
+	entries, err := loadAudit(key, c.Query("config"), since, limit)
+	if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, entries)
+}
+
+//GetDeviceAudit the config writes of a device, newest first
+func GetDeviceAudit(c *gin.Context) {
+	auditResponse(c, auditDeviceKey(c.Param("group"), c.Param("deviceid")))
+}
+
+//GetUserAudit the config writes a user made in a group, newest first
+func GetUserAudit(c *gin.Context) {
+	auditResponse(c, auditUserKey(c.Param("group"), c.Param("user")))
+}
+
+//GetAdminAudit the changes a user made outside of any group, to device types, newest first
+func GetAdminAudit(c *gin.Context) {
+	auditResponse(c, auditUserKey("", c.Param("user")))
+}
+
+//actor who is making a request, the authenticated identity or the address it came from
+func actor(c *gin.Context) string {
+	return author(c, "")
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestAuditSubject(t *testing.T) {
+	for _, test := range []struct {
+		entry   AuditEntry
+		subject string
+	}{
+		{AuditEntry{Group: "home", Device: "smoker", Config: "configs"}, "AUDIT.home.smoker.configs"},
+		{AuditEntry{Group: "home", Device: "smoker.pi", Config: "v1.configs"}, "AUDIT.home.smoker%2Epi.v1%2Econfigs"},
+		{AuditEntry{Group: "a*b", Device: "c>d", Config: "e f%"}, "AUDIT.a%2Ab.c%3Ed.e%20f%25"},
+		{AuditEntry{Group: "home", Device: "smoker", Resource: resourceSchedule, Action: actionCancel}, "AUDIT.home.smoker.schedule.cancel"},
+		{AuditEntry{Group: "home", Resource: resourceWebhook, Action: actionCreate}, "AUDIT.home._.webhook.create"},
+		{AuditEntry{Group: "home", Device: "_", Resource: resourceHold, Action: actionRelease}, "AUDIT.home.%5F.hold.release"},
+		{AuditEntry{Resource: resourceDeviceType, Action: actionDelete}, "AUDIT._._.devicetype.delete"},
+	} {
+		if subject := test.entry.Subject(); subject != test.subject {
+			t.Fatalf("subject of %+v: %v", test.entry, subject)
+		}
+	}
+}
+
+//auditActions the resource and action of each entry an audit query answers, oldest first
+func auditActions(t *testing.T, path, token string) []string {
+	t.Helper()
+	rec := serve(t, http.MethodGet, path, token, nil, nil)
+	var entries []AuditEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &entries); rec.Code != http.StatusOK || err != nil {
+		t.Fatalf("%v: %d %s", path, rec.Code, rec.Body)
+	}
+	actions := make([]string, len(entries))
+	for i := range entries {
+		actions[len(entries)-1-i] = entries[i].Resource + "." + entries[i].Action
+		if entries[i].Before == nil && entries[i].After == nil {
+			t.Fatalf("%v: entry without a before or after %+v", path, entries[i])
+		}
+	}
+	return actions
+}
+
+func sameActions(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestAuditChanges(t *testing.T) {
+	token := "auditor@changes"
+	if err := store.PutEntry(credentialPrefix+"changes", "smoker", []byte(`{"secret": "changes-secret"}`)); err != nil {
+		t.Fatal(err)
+	}
+	recipe := []byte(`{"steps": [{"name": "smoke", "setpoint": 225, "minutes": 60}]}`)
+	heartbeat := []byte(`{"firmware": "v1.0.0"}`)
+	for _, req := range []struct {
+		method, path, token string
+		body                []byte
+	}{
+		{http.MethodPost, "/registry/changes", token, []byte(`{"device": "smoker", "model": "homebrew"}`)},
+		{http.MethodPut, "/registry/changes/smoker", token, []byte(`{"model": "homebrew", "location": "deck"}`)},
+		{http.MethodPatch, "/registry/changes/smoker", token, []byte(`{"display_name": "Deck"}`)},
+		{http.MethodPost, "/registry/changes/smoker/heartbeat", "changes-secret", heartbeat},
+		{http.MethodPost, "/registry/changes/smoker/heartbeat", "changes-secret", heartbeat},
+		{http.MethodDelete, "/registry/changes/smoker", token, nil},
+		{http.MethodPut, "/recipes/changes/brisket", token, recipe},
+		{http.MethodPost, "/recipes/changes", token, []byte(`[{"name": "brisket", "steps": [{"name": "smoke", "setpoint": 250}]}, {"name": "ribs", "steps": [{"name": "smoke", "setpoint": 225}]}]`)},
+		{http.MethodDelete, "/recipes/changes/brisket", token, nil},
+		{http.MethodPut, "/admin/types/audited", testAdminToken, []byte(`{"configs": {"configs": {"type": "object"}}}`)},
+		{http.MethodPut, "/admin/types/audited", testAdminToken, []byte(`{"description": "edited", "configs": {"configs": {"type": "object"}}}`)},
+		{http.MethodDelete, "/admin/types/audited", testAdminToken, nil},
+	} {
+		if rec := serve(t, req.method, req.path, req.token, req.body, nil); rec.Code >= http.StatusBadRequest {
+			t.Fatalf("%v %v: %d %s", req.method, req.path, rec.Code, rec.Body)
+		}
+	}
+
+	device := auditActions(t, "/audit/changes/devices/smoker", token)
+	if want := []string{"registry.create", "registry.update", "registry.update", "registry.update", "registry.delete"}; !sameActions(device, want) {
+		t.Fatalf("registry changes %v, want %v", device, want)
+	}
+	user := auditActions(t, "/audit/changes/users/auditor", token)
+	if want := []string{"registry.create", "registry.update", "registry.update", "registry.delete", "recipe.create", "recipe.update", "recipe.create", "recipe.delete"}; !sameActions(user, want) {
+		t.Fatalf("changes of the user %v, want %v", user, want)
+	}
+	admin := auditActions(t, "/admin/audit/users/192.0.2.1", testAdminToken)
+	if want := []string{"devicetype.create", "devicetype.update", "devicetype.delete"}; !sameActions(admin, want) {
+		t.Fatalf("device type changes %v, want %v", admin, want)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	credentialPrefix = "credentials/"
+	identityKey      = "identity"
+	identityTTL      = time.Minute
+)
+
+var (
+	errAdminUnavailable = errors.New("admin api disabled, no admin token configured")
+	errBadCredential    = errors.New("invalid credential")
+	errMissingToken     = errors.New("missing bearer token")
+	errNotMember        = errors.New("not a member of the group")
+	errReservedGroup    = errors.New("group name is reserved")
+	authClient          = &http.Client{Timeout: 5 * time.Second}
+	identities          = &identityCache{entries: make(map[string]cachedIdentity)}
+)
+
+//Identity who made a request as told by auth-service, devices using their pub-hub credential only name the device
+type Identity struct {
+	Sub      string   `json:"sub"`
+	Username string   `json:"username"`
+	Groups   []string `json:"groups"`
+	Device   string   `json:"device,omitempty"`
+}
+
+//Name how the identity shows up as the author of a change
+func (id *Identity) Name() string {
+	switch {
+	case id.Username != "":
+		return id.Username
+	case id.Device != "":
+		return "device:" + id.Device
+	}
+	return id.Sub
+}
+
+//Member whether the identity belongs to the group
+func (id *Identity) Member(group string) bool {
+	for _, g := range id.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+type cachedIdentity struct {
+	identity *Identity
+	expires  time.Time
+}
+
+//identityCache identities auth-service vouched for, keyed by a hash of the token so pollers don't
+//cost a round trip each
+type identityCache struct {
+	sync.Mutex
+	entries map[string]cachedIdentity
+}
+
+func (cache *identityCache) get(key string) *Identity {
+	cache.Lock()
+	defer cache.Unlock()
+	entry, ok := cache.entries[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(entry.expires) {
+		delete(cache.entries, key)
+		return nil
+	}
+	return entry.identity
+}
+
+func (cache *identityCache) put(key string, identity *Identity) {
+	cache.Lock()
+	defer cache.Unlock()
+	now := time.Now()
+	for k, entry := range cache.entries { //Only ever as big as the active sessions, sweep while we're here
+		if now.After(entry.expires) {
+			delete(cache.entries, k)
+		}
+	}
+	cache.entries[key] = cachedIdentity{identity: identity, expires: now.Add(identityTTL)}
+}
+
+//bearerToken token of an "Authorization: Bearer <token>" header
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+}
+
+//lookupIdentity ask auth-service who an access token belongs to
+func lookupIdentity(token string) (*Identity, error) {
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+	if identity := identities.get(key); identity != nil {
+		return identity, nil
+	}
+	req, err := http.NewRequest(http.MethodPost, authURL+"/validate", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := authClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, errBadCredential
+	default:
+		return nil, errors.New("auth-service answered " + resp.Status)
+	}
+	var identity Identity
+	if err := json.NewDecoder(resp.Body).Decode(&identity); err != nil {
+		return nil, err
+	}
+	identities.put(key, &identity)
+	return &identity, nil
+}
+
+//deviceCredential whether the token is the credential pub-hub issued the device
+func deviceCredential(group, device, token string) (bool, error) {
+	return pubHub.VerifyCredential(group, device, token)
+}
+
+//authorize check the token may act on the group. Users have to be a member of it, devices may use their
+//own credential where deviceAllowed, that's reading their configs and reporting their state
+func authorize(token, group, device string, deviceAllowed bool) (*Identity, error) {
+	if reservedGroups[group] {
+		return nil, errReservedGroup
+	}
+	if token == "" {
+		return nil, errMissingToken
+	}
+	if deviceAllowed && device != "" {
+		ok, err := deviceCredential(group, device, token)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return &Identity{Device: device, Groups: []string{group}}, nil
+		}
+	}
+	identity, err := lookupIdentity(token)
+	if err != nil {
+		return nil, err
+	}
+	if !identity.Member(group) {
+		return nil, errNotMember
+	}
+	return identity, nil
+}
+
+//authStatus http status of a failed authorization
+func authStatus(err error) int {
+	switch err {
+	case errMissingToken, errBadCredential:
+		return http.StatusUnauthorized
+	case errNotMember:
+		return http.StatusForbidden
+	case errReservedGroup:
+		return http.StatusBadRequest
+	}
+	return http.StatusServiceUnavailable
+}
+
+//GroupAuth middleware that only lets members of the :group in the path through
+func GroupAuth(c *gin.Context) {
+	path := c.FullPath()
+	deviceAllowed := c.Request.Method == http.MethodGet || strings.HasSuffix(path, reportedSuffix) || strings.HasSuffix(path, heartbeatSuffix)
+	identity, err := authorize(bearerToken(c.Request), c.Param("group"), c.Param("deviceid"), deviceAllowed)
+	if err != nil {
+		code := authStatus(err)
+		if code == http.StatusServiceUnavailable {
+			log.Error(err)
+		}
+		c.AbortWithStatusJSON(code, gin.H{"error": err.Error()})
+		return
+	}
+	c.Set(identityKey, identity)
+	c.Next()
+}
+
+//AdminAuth middleware guarding the admin api with the configured admin token, routes naming a :group
+//refuse the reserved ones like the rest of the api
+func AdminAuth(c *gin.Context) {
+	if adminToken == "" {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": errAdminUnavailable.Error()})
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(bearerToken(c.Request)), []byte(adminToken)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": errBadCredential.Error()})
+		return
+	}
+	if reservedGroups[c.Param("group")] {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": errReservedGroup.Error()})
+		return
+	}
+	c.Next()
+}
+
+type identityContextKey struct{}
+
+//groupRequest every Control request names the group and device it's for
+type groupRequest interface {
+	GetGroup() string
+	GetDevice() string
+}
+
+//deviceMethods Control calls a device may make with its own credential
+var deviceMethods = map[string]bool{
+	"/grillbernetes.Control/GetConfig":   true,
+	"/grillbernetes.Control/GetShadow":   true,
+	"/grillbernetes.Control/ReportState": true,
+}
+
+//grpcAuth interceptor authorizing Control calls like GroupAuth does http requests, the token is taken
+//from "authorization: Bearer <token>" metadata
+func grpcAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	gr, ok := req.(groupRequest)
+	if !ok {
+		return nil, status.Error(codes.PermissionDenied, "request names no group")
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	var token string
+	if vals := md.Get("authorization"); len(vals) > 0 && strings.HasPrefix(vals[0], "Bearer ") {
+		token = strings.TrimSpace(strings.TrimPrefix(vals[0], "Bearer "))
+	}
+	identity, err := authorize(token, gr.GetGroup(), gr.GetDevice(), deviceMethods[info.FullMethod])
+	if err != nil {
+		switch authStatus(err) {
+		case http.StatusUnauthorized:
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		case http.StatusForbidden:
+			return nil, status.Error(codes.PermissionDenied, err.Error())
+		case http.StatusBadRequest:
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		log.Error(err)
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return handler(context.WithValue(ctx, identityContextKey{}, identity), req)
+}
+
+//contextIdentity the identity grpcAuth put on the context of a call
+func contextIdentity(ctx context.Context) *Identity {
+	identity, _ := ctx.Value(identityContextKey{}).(*Identity)
+	return identity
+}
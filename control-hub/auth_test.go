@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGroupAuth(t *testing.T) {
+	if err := store.PutEntry(credentialPrefix+"authz", "smoker", []byte(`{"secret": "smoker-secret"}`)); err != nil {
+		t.Fatal(err)
+	}
+	reported := []byte(`{"revision": 1, "reported": {"pwr": false}}`)
+	config := []byte(`{"config": {"pwr": false, "temp": 0}}`)
+	for _, test := range []struct {
+		name, method, path, token string
+		body                      []byte
+		code                      int
+	}{
+		{"no token", http.MethodGet, "/config/authz/smoker/configs", "", nil, http.StatusUnauthorized},
+		{"unknown token", http.MethodGet, "/config/authz/smoker/configs", "nobody", nil, http.StatusUnauthorized},
+		{"member", http.MethodGet, "/config/authz/smoker/configs", "cook@authz", nil, http.StatusOK},
+		{"member of several groups", http.MethodPost, "/config/authz/smoker/configs", "cook@other,authz", config, http.StatusOK},
+		{"not a member", http.MethodGet, "/config/authz/smoker/configs", "cook@other", nil, http.StatusForbidden},
+		{"not a member writing", http.MethodPost, "/config/authz/smoker/configs", "cook@other", config, http.StatusForbidden},
+		{"device reading its config", http.MethodGet, "/config/authz/smoker/configs", "smoker-secret", nil, http.StatusOK},
+		{"device reporting its state", http.MethodPost, "/config/authz/smoker/configs/reported", "smoker-secret", reported, http.StatusOK},
+		{"device sending a heartbeat", http.MethodPost, "/registry/authz/smoker/heartbeat", "smoker-secret", []byte(`{}`), http.StatusOK},
+		{"device writing its config", http.MethodPost, "/config/authz/smoker/configs", "smoker-secret", config, http.StatusUnauthorized},
+		{"device reading another device", http.MethodGet, "/config/authz/other/configs", "smoker-secret", nil, http.StatusUnauthorized},
+		{"device listing the group", http.MethodGet, "/devices/authz", "smoker-secret", nil, http.StatusUnauthorized},
+		{"reserved group", http.MethodGet, "/config/schedules/authz/smoker", "cook@schedules", nil, http.StatusBadRequest},
+		{"reserved group on the admin api", http.MethodPut, "/admin/devices/devicetypes/smoker/type", testAdminToken, []byte(`{"type": "pismoker"}`), http.StatusBadRequest},
+	} {
+		if rec := serve(t, test.method, test.path, test.token, test.body, nil); rec.Code != test.code {
+			t.Fatalf("%v: %d %s", test.name, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestIdentityCache(t *testing.T) {
+	calls := atomic.LoadInt64(&authCalls)
+	for i := 0; i < 3; i++ {
+		if rec := serve(t, http.MethodGet, "/config/cache/smoker/configs", "cached@cache", nil, nil); rec.Code != http.StatusOK {
+			t.Fatalf("request %d: %d %s", i, rec.Code, rec.Body)
+		}
+	}
+	if got := atomic.LoadInt64(&authCalls) - calls; got != 1 {
+		t.Fatalf("auth-service asked %d times for the same token", got)
+	}
+
+	identities.put("expired", &Identity{Sub: "expired"})
+	identities.Lock()
+	entry := identities.entries["expired"]
+	entry.expires = time.Now().Add(-time.Second)
+	identities.entries["expired"] = entry
+	identities.Unlock()
+	if identity := identities.get("expired"); identity != nil {
+		t.Fatalf("expired identity still cached: %+v", identity)
+	}
+	if identity := identities.get("cached"); identity != nil {
+		t.Fatal("identity cached under the token instead of its hash")
+	}
+}
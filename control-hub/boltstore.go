@@ -0,0 +1,546 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	configsBucket   = []byte("configs")
+	revisionsBucket = []byte("revisions")
+	reportedBucket  = []byte("reported")
+	registryBucket  = []byte("registry")
+	schedulesBucket = []byte("schedules")
+	dueBucket       = []byte("due")
+	tablesBucket    = []byte("tables")
+	logsBucket      = []byte("logs")
+)
+
+//storedConfig a config kept in bbolt along with its revision
+type storedConfig struct {
+	Revision uint64          `json:"revision"`
+	Config   json.RawMessage `json:"config"`
+}
+
+//boltStore keeps everything in a bbolt file, the configs and reported buckets are keyed like the redis keys and
+//revisions has a bucket per config keyed by the big endian revision number. registry has a bucket per group
+//keyed by device, schedules a bucket per device keyed by id and due the next run of every schedule keyed by
+//its due member. tables and logs hold a bucket per table or log, log entries are keyed by their sequence
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{configsBucket, revisionsBucket, reportedBucket, registryBucket, schedulesBucket, dueBucket, tablesBucket, logsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func revisionID(rev uint64) []byte {
+	id := make([]byte, 8)
+	binary.BigEndian.PutUint64(id, rev)
+	return id
+}
+
+func readStoredConfig(tx *bolt.Tx, key string) (*storedConfig, error) {
+	val := tx.Bucket(configsBucket).Get([]byte(key))
+	if val == nil {
+		return nil, errNotFound
+	}
+	var stored storedConfig
+	if err := json.Unmarshal(val, &stored); err != nil {
+		return nil, err
+	}
+	return &stored, nil
+}
+
+func (bs *boltStore) ReadConfig(group, device, config string) ([]byte, uint64, error) {
+	var stored *storedConfig
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		var err error
+		stored, err = readStoredConfig(tx, configKey(group, device, config))
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return stored.Config, stored.Revision, nil
+}
+
+func (bs *boltStore) WriteConfig(group, device, config string, entry *Revision, expected string) (uint64, []byte, error) {
+	key := configKey(group, device, config)
+	var rev uint64
+	var before []byte
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		current, err := readStoredConfig(tx, key)
+		if err == errNotFound {
+			current = &storedConfig{}
+		} else if err != nil {
+			return err
+		}
+		if err := checkExpected(expected, current.Revision); err != nil {
+			return err
+		}
+		before = current.Config
+		rev = current.Revision + 1
+		data, err := json.Marshal(&storedConfig{Revision: rev, Config: entry.Config})
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(configsBucket).Put([]byte(key), data); err != nil {
+			return err
+		}
+		revisions, err := tx.Bucket(revisionsBucket).CreateBucketIfNotExists([]byte(key))
+		if err != nil {
+			return err
+		}
+		if data, err = json.Marshal(numbered(entry, rev)); err != nil {
+			return err
+		}
+		if err := revisions.Put(revisionID(rev), data); err != nil {
+			return err
+		}
+		if rev > maxRevisions {
+			return revisions.Delete(revisionID(rev - maxRevisions))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	return rev, before, nil
+}
+
+func (bs *boltStore) GetRevision(group, device, config string, rev uint64) (*Revision, error) {
+	var revision Revision
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		revisions := tx.Bucket(revisionsBucket).Bucket([]byte(configKey(group, device, config)))
+		if revisions == nil {
+			return errRevisionNotFound
+		}
+		val := revisions.Get(revisionID(rev))
+		if val == nil {
+			return errRevisionNotFound
+		}
+		return json.Unmarshal(val, &revision)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &revision, nil
+}
+
+func (bs *boltStore) ListRevisions(group, device, config string) ([]Revision, error) {
+	revisions := make([]Revision, 0)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(revisionsBucket).Bucket([]byte(configKey(group, device, config)))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(_, val []byte) error {
+			var revision Revision
+			if err := json.Unmarshal(val, &revision); err != nil {
+				log.Error(err)
+				return nil
+			}
+			revisions = append(revisions, revision)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return revisions, nil
+}
+
+func (bs *boltStore) ReadReported(group, device, config string) (*Reported, error) {
+	var reported Reported
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(reportedBucket).Get([]byte(configKey(group, device, config)))
+		if val == nil {
+			return errNotFound
+		}
+		return json.Unmarshal(val, &reported)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &reported, nil
+}
+
+func (bs *boltStore) WriteReported(group, device, config string, reported *Reported) error {
+	data, err := json.Marshal(reported)
+	if err != nil {
+		return err
+	}
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(reportedBucket).Put([]byte(configKey(group, device, config)), data)
+	})
+}
+
+func (bs *boltStore) ReadDeviceRecord(group, device string) (*DeviceRecord, error) {
+	var record DeviceRecord
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		records := tx.Bucket(registryBucket).Bucket([]byte(group))
+		if records == nil {
+			return errNotFound
+		}
+		val := records.Get([]byte(device))
+		if val == nil {
+			return errNotFound
+		}
+		return json.Unmarshal(val, &record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func (bs *boltStore) ListDeviceRecords(group string) ([]DeviceRecord, error) {
+	records := make([]DeviceRecord, 0)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(registryBucket).Bucket([]byte(group))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(_, val []byte) error {
+			var record DeviceRecord
+			if err := json.Unmarshal(val, &record); err != nil {
+				log.Error(err)
+				return nil
+			}
+			records = append(records, record)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func (bs *boltStore) UpdateDeviceRecord(group, device string, update func(*DeviceRecord) (*DeviceRecord, error)) (*DeviceRecord, error) {
+	var updated *DeviceRecord
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		records, err := tx.Bucket(registryBucket).CreateBucketIfNotExists([]byte(group))
+		if err != nil {
+			return err
+		}
+		var current *DeviceRecord
+		if val := records.Get([]byte(device)); val != nil {
+			current = &DeviceRecord{}
+			if err := json.Unmarshal(val, current); err != nil {
+				return err
+			}
+		}
+		if updated, err = update(current); err != nil {
+			return err
+		}
+		data, err := json.Marshal(updated)
+		if err != nil {
+			return err
+		}
+		return records.Put([]byte(device), data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+func (bs *boltStore) DeleteDeviceRecord(group, device string) (bool, error) {
+	var removed bool
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		records := tx.Bucket(registryBucket).Bucket([]byte(group))
+		if records == nil || records.Get([]byte(device)) == nil {
+			return nil
+		}
+		removed = true
+		return records.Delete([]byte(device))
+	})
+	return removed, err
+}
+
+func (bs *boltStore) GetSchedule(group, device, id string) (*Schedule, error) {
+	var s Schedule
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		schedules := tx.Bucket(schedulesBucket).Bucket([]byte(schedulesKey(group, device)))
+		if schedules == nil {
+			return errScheduleNotFound
+		}
+		val := schedules.Get([]byte(id))
+		if val == nil {
+			return errScheduleNotFound
+		}
+		return json.Unmarshal(val, &s)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (bs *boltStore) ListSchedules(group, device string) ([]Schedule, error) {
+	schedules := make([]Schedule, 0)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(schedulesBucket).Bucket([]byte(schedulesKey(group, device)))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(_, val []byte) error {
+			var s Schedule
+			if err := json.Unmarshal(val, &s); err != nil {
+				log.Error(err)
+				return nil
+			}
+			schedules = append(schedules, s)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return schedules, nil
+}
+
+func (bs *boltStore) PutSchedule(s *Schedule) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		schedules, err := tx.Bucket(schedulesBucket).CreateBucketIfNotExists([]byte(schedulesKey(s.Group, s.Device)))
+		if err != nil {
+			return err
+		}
+		if err := schedules.Put([]byte(s.ID), data); err != nil {
+			return err
+		}
+		return tx.Bucket(dueBucket).Put([]byte(dueMember(s.Group, s.Device, s.ID)), revisionID(uint64(s.NextRun)))
+	})
+}
+
+func (bs *boltStore) UpdateSchedule(s *Schedule) (bool, error) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return false, err
+	}
+	var updated bool
+	err = bs.db.Update(func(tx *bolt.Tx) error {
+		schedules := tx.Bucket(schedulesBucket).Bucket([]byte(schedulesKey(s.Group, s.Device)))
+		if schedules == nil || schedules.Get([]byte(s.ID)) == nil {
+			return nil
+		}
+		updated = true
+		if err := schedules.Put([]byte(s.ID), data); err != nil {
+			return err
+		}
+		member := []byte(dueMember(s.Group, s.Device, s.ID))
+		if s.NextRun > 0 {
+			return tx.Bucket(dueBucket).Put(member, revisionID(uint64(s.NextRun)))
+		}
+		return tx.Bucket(dueBucket).Delete(member)
+	})
+	return updated, err
+}
+
+func (bs *boltStore) DeleteSchedule(group, device, id string) (bool, error) {
+	var removed bool
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(dueBucket).Delete([]byte(dueMember(group, device, id))); err != nil {
+			return err
+		}
+		schedules := tx.Bucket(schedulesBucket).Bucket([]byte(schedulesKey(group, device)))
+		if schedules == nil || schedules.Get([]byte(id)) == nil {
+			return nil
+		}
+		removed = true
+		return schedules.Delete([]byte(id))
+	})
+	return removed, err
+}
+
+func (bs *boltStore) ClaimSchedules(now, until int64, count int) ([]string, error) {
+	var members []string
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(dueBucket)
+		due := make(map[string]int64)
+		err := bucket.ForEach(func(member, at []byte) error {
+			due[string(member)] = int64(binary.BigEndian.Uint64(at))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		members = dueMembers(due, now, count)
+		for _, member := range members {
+			if err := bucket.Put([]byte(member), revisionID(uint64(until))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return members, err
+}
+
+func (bs *boltStore) GetEntry(table, id string) ([]byte, error) {
+	var data []byte
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		entries := tx.Bucket(tablesBucket).Bucket([]byte(table))
+		if entries == nil {
+			return errNotFound
+		}
+		val := entries.Get([]byte(id))
+		if val == nil {
+			return errNotFound
+		}
+		data = append([]byte(nil), val...)
+		return nil
+	})
+	return data, err
+}
+
+func (bs *boltStore) PutEntry(table, id string, data []byte) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		entries, err := tx.Bucket(tablesBucket).CreateBucketIfNotExists([]byte(table))
+		if err != nil {
+			return err
+		}
+		return entries.Put([]byte(id), data)
+	})
+}
+
+func (bs *boltStore) DeleteEntries(table string, ids ...string) (int64, error) {
+	var removed int64
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		entries := tx.Bucket(tablesBucket).Bucket([]byte(table))
+		if entries == nil {
+			return nil
+		}
+		if len(ids) == 0 {
+			removed = int64(entries.Stats().KeyN)
+			return tx.Bucket(tablesBucket).DeleteBucket([]byte(table))
+		}
+		for _, id := range ids {
+			if entries.Get([]byte(id)) == nil {
+				continue
+			}
+			removed++
+			if err := entries.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return removed, err
+}
+
+//ScanEntries pages through the table in key order, the cursor is the last id of the page before
+func (bs *boltStore) ScanEntries(table, cursor string, count int) ([]Entry, string, error) {
+	entries := make([]Entry, 0)
+	next := ""
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(tablesBucket).Bucket([]byte(table))
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		id, val := c.First()
+		if cursor != "" {
+			if id, val = c.Seek([]byte(cursor)); id != nil && string(id) == cursor {
+				id, val = c.Next()
+			}
+		}
+		for ; id != nil; id, val = c.Next() {
+			if len(entries) == count {
+				next = entries[count-1].ID
+				return nil
+			}
+			entries = append(entries, Entry{ID: string(id), Data: append([]byte(nil), val...)})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return entries, next, nil
+}
+
+func (bs *boltStore) CountEntries(table string) (int64, error) {
+	var count int64
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		if entries := tx.Bucket(tablesBucket).Bucket([]byte(table)); entries != nil {
+			count = int64(entries.Stats().KeyN)
+		}
+		return nil
+	})
+	return count, err
+}
+
+func (bs *boltStore) AppendLog(name string, entry []byte, max int) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		entries, err := tx.Bucket(logsBucket).CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return err
+		}
+		seq, err := entries.NextSequence()
+		if err != nil {
+			return err
+		}
+		if err := entries.Put(revisionID(seq), entry); err != nil {
+			return err
+		}
+		if seq > uint64(max) {
+			return entries.Delete(revisionID(seq - uint64(max)))
+		}
+		return nil
+	})
+}
+
+func (bs *boltStore) ReadLog(name string, count int) ([][]byte, error) {
+	entries := make([][]byte, 0)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(logsBucket).Bucket([]byte(name))
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		for seq, val := c.Last(); seq != nil && len(entries) < count; seq, val = c.Prev() {
+			entries = append(entries, append([]byte(nil), val...))
+		}
+		return nil
+	})
+	return entries, err
+}
+
+func (bs *boltStore) DeleteLog(name string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(logsBucket).DeleteBucket([]byte(name))
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+func (bs *boltStore) Ping() error {
+	return bs.db.View(func(tx *bolt.Tx) error { return nil })
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/charles-d-burton/grillbernetes/validation"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	holdsPrefix = "holds/"
+	estopConfig = "configs"
+)
+
+var (
+	//estopWait how long the answer to an emergency stop waits for the writes
+	estopWait = 10 * time.Second
+	//estopBackoff and estopMaxBackoff the pause between attempts to write a stop, doubling after each one
+	estopBackoff    = 100 * time.Millisecond
+	estopMaxBackoff = 5 * time.Second
+	//estopGiveUp how long a stop is retried before it's given up on
+	estopGiveUp = 5 * time.Minute
+)
+
+//estopPatch what an emergency stop merges into the config of every device
+var estopPatch = json.RawMessage(`{"pwr":false}`)
+
+//BulkRequest a config to apply to several devices of a group, every device of the group when none are listed
+type BulkRequest struct {
+	Devices []string        `json:"devices"`
+	Data    json.RawMessage `json:"config"`
+	Merge   bool            `json:"merge"`
+	Author  string          `json:"author"`
+}
+
+//BulkResult outcome of a bulk write for one device
+type BulkResult struct {
+	Device   string                 `json:"device"`
+	Status   string                 `json:"status"`
+	Revision uint64                 `json:"revision,omitempty"`
+	Error    string                 `json:"error,omitempty"`
+	Details  []validation.Violation `json:"details,omitempty"`
+}
+
+//Hold a device held off by an emergency stop, schedules don't touch it until the hold is released
+type Hold struct {
+	Device string `json:"device"`
+	Since  int64  `json:"since"`
+	Author string `json:"author"`
+}
+
+//EmergencyStop published to the estop channel of a device so it can switch off before its next poll
+type EmergencyStop struct {
+	Author    string `json:"author"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+func holdsKey(group string) string {
+	return holdsPrefix + group
+}
+
+//groupDevices every device of a group, that's every device pub-hub tracks in the group hashtable
+func groupDevices(group string) ([]string, error) {
+	devices := make([]string, 0)
+	cursor := ""
+	for {
+		entries, next, err := pubHub.ScanDevices(group, cursor, deviceScanBatch)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			devices = append(devices, entry.ID)
+		}
+		if cursor = next; cursor == "" {
+			break
+		}
+	}
+	sort.Strings(devices)
+	return devices, nil
+}
+
+//targets the devices a bulk request is for, the whole group when it lists none
+func targets(group string, devices []string) ([]string, error) {
+	if len(devices) == 0 {
+		return groupDevices(group)
+	}
+	seen := make(map[string]bool, len(devices))
+	unique := make([]string, 0, len(devices))
+	for _, device := range devices {
+		if device != "" && !seen[device] {
+			seen[device] = true
+			unique = append(unique, device)
+		}
+	}
+	return unique, nil
+}
+
+//Held whether a device is held off by an emergency stop
+func Held(group, device string) (bool, error) {
+	_, err := store.GetEntry(holdsKey(group), device)
+	if err == errNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+//applyBulk write the config of a revision to every device at once, the results are in the order of the devices
+func applyBulk(group, config string, devices []string, revision Revision, merge bool) []BulkResult {
+	results := make([]BulkResult, len(devices))
+	var wg sync.WaitGroup
+	for i, device := range devices {
+		wg.Add(1)
+		go func(result *BulkResult, device string, revision Revision) {
+			defer wg.Done()
+			result.Device = device
+			rev, err := ApplyConfig(group, device, config, &revision, merge)
+			switch verr := err.(type) {
+			case nil:
+				result.Status = "accepted"
+				result.Revision = rev
+			case *ValidationError:
+				result.Status = "rejected"
+				result.Error = verr.Error()
+				result.Details = verr.Details
+			default:
+				log.Error(err)
+				result.Status = "failed"
+				result.Error = err.Error()
+			}
+		}(&results[i], device, revision)
+	}
+	wg.Wait()
+	return results
+}
+
+//bulkResponse answer a bulk write with the outcome for every device
+func bulkResponse(c *gin.Context, results []BulkResult) {
+	failed := 0
+	for _, result := range results {
+		if result.Status != "accepted" {
+			failed++
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"accepted": len(results) - failed,
+		"failed":   failed,
+		"results":  results,
+	})
+}
+
+//PostBulk apply a config to every device of a group or to the devices listed
+func PostBulk(c *gin.Context) {
+	var req BulkRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.Data) == 0 || !json.Valid(req.Data) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "config is required"})
+		return
+	}
+	group := c.Param("group")
+	devices, err := targets(group, req.Devices)
+	if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	if len(devices) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no devices to apply the config to"})
+		return
+	}
+	revision := Revision{Author: author(c, req.Author), Action: actionBulk, Source: sourceHTTP, Actor: actor(c), Config: req.Data}
+	results := applyBulk(group, c.Param("config"), devices, revision, req.Merge)
+	log.Infof("applied %v to %d devices of %v", c.Param("config"), len(devices), group)
+	bulkResponse(c, results)
+}
+
+//stopConfig the config of a device with the emergency stop merged in. A config that can't be read is
+//replaced by the stop alone, the device has to be switched off whatever it held
+func stopConfig(current []byte) []byte {
+	data, err := mergeDocument(current, estopPatch)
+	if err != nil {
+		log.Error(err)
+		return estopPatch
+	}
+	return data
+}
+
+//writeStop merge the emergency stop over the config of a device and write it. It isn't validated against the
+//device type, a config the type rejects still has to be switched off, and it's written against the revision
+//it was merged over so a change made in the meantime isn't lost
+func writeStop(group, device string, revision *Revision) (uint64, error) {
+	current, rev, err := ReadConfig(group, device, estopConfig)
+	if err != nil && err != errNotFound {
+		return 0, err
+	}
+	revision.Config = stopConfig(current)
+	return WriteConfig(group, device, estopConfig, revision, strconv.FormatUint(rev, 10))
+}
+
+//stopDevice write the emergency stop to the config of a device, backing off between attempts whether the
+//write failed or lost the race to another writer. It's given up on after estopGiveUp
+func stopDevice(group, device string, revision Revision) (uint64, error) {
+	backoff := estopBackoff
+	deadline := time.Now().Add(estopGiveUp)
+	for {
+		rev, err := writeStop(group, device, &revision)
+		if err == nil {
+			return rev, nil
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			log.Errorf("gave up the emergency stop of %v after %v: %v", configKey(group, device, estopConfig), estopGiveUp, err)
+			return 0, err
+		}
+		if _, ok := err.(*ConflictError); ok {
+			log.Warnf("emergency stop of %v raced another write, merging over it", configKey(group, device, estopConfig))
+		} else {
+			log.Errorf("emergency stop of %v: %v", configKey(group, device, estopConfig), err)
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > estopMaxBackoff {
+			backoff = estopMaxBackoff
+		}
+	}
+}
+
+//stopDevices write the emergency stop to every device at once. The answer waits for the writes up to
+//estopWait, devices that aren't written by then are reported retrying and are retried in the background.
+//Devices given up on before then are reported failed
+func stopDevices(group string, devices []string, revision Revision) []BulkResult {
+	type stopped struct {
+		index    int
+		revision uint64
+		err      error
+	}
+	done := make(chan stopped, len(devices))
+	results := make([]BulkResult, len(devices))
+	for i, device := range devices {
+		results[i] = BulkResult{Device: device, Status: "retrying"}
+		go func(i int, device string) {
+			rev, err := stopDevice(group, device, revision)
+			done <- stopped{i, rev, err}
+		}(i, device)
+	}
+	timeout := time.NewTimer(estopWait)
+	defer timeout.Stop()
+	for range devices {
+		select {
+		case s := <-done:
+			if s.err != nil {
+				results[s.index].Status, results[s.index].Error = "failed", s.err.Error()
+				continue
+			}
+			results[s.index].Status = "accepted"
+			results[s.index].Revision = s.revision
+		case <-timeout.C:
+			return results
+		}
+	}
+	return results
+}
+
+//PostEmergencyStop switch devices off right away, bypassing If-Match, validation and schedules. The devices
+//are held first so a schedule coming due can't switch them back on, until the hold is released, and told
+//on their estop channel so they don't wait for their next poll
+func PostEmergencyStop(c *gin.Context) {
+	var req BulkRequest
+	c.ShouldBindJSON(&req) //Body is optional, no devices means the whole group
+	group := c.Param("group")
+	devices, err := targets(group, req.Devices)
+	if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	if len(devices) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no devices to stop"})
+		return
+	}
+	who, now := author(c, req.Author), time.Now().Unix()
+	for _, device := range devices {
+		if err := publishDeviceEvent(group, device, estopChannel, &EmergencyStop{Author: who, Timestamp: now}); err != nil {
+			log.Error(err) //The config is still written, the device picks it up on its next poll
+		}
+		hold, _ := json.Marshal(&Hold{Device: device, Since: now, Author: who})
+		if err := store.PutEntry(holdsKey(group), device, hold); err != nil {
+			log.Error(err) //Still stop them, a missing hold only means schedules keep running
+		}
+	}
+	revision := Revision{Author: who, Action: actionEstop, Source: sourceHTTP, Actor: actor(c)}
+	results := stopDevices(group, devices, revision)
+	log.Warnf("emergency stop of %d devices of %v by %v", len(devices), group, who)
+	counts := make(map[string]int)
+	for _, result := range results {
+		counts[result.Status]++
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"accepted": counts["accepted"],
+		"retrying": counts["retrying"],
+		"failed":   counts["failed"],
+		"results":  results,
+	})
+}
+
+//GetHolds list the devices of a group held by an emergency stop
+func GetHolds(c *gin.Context) {
+	entries, err := allEntries(holdsKey(c.Param("group")))
+	if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	holds := make([]Hold, 0, len(entries))
+	for _, entry := range entries {
+		var hold Hold
+		if err := json.Unmarshal(entry.Data, &hold); err != nil {
+			log.Error(err)
+			continue
+		}
+		holds = append(holds, hold)
+	}
+	sort.Slice(holds, func(i, j int) bool {
+		return holds[i].Device < holds[j].Device
+	})
+	c.JSON(http.StatusOK, holds)
+}
+
+//DeleteHolds release the holds of the devices listed, or of the whole group. Devices stay off until
+//something switches them on, releasing only lets schedules run again
+func DeleteHolds(c *gin.Context) {
+	var req BulkRequest
+	c.ShouldBindJSON(&req)
+	group := c.Param("group")
+	holds, err := allEntries(holdsKey(group))
+	if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	released, err := store.DeleteEntries(holdsKey(group), req.Devices...)
+	if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	listed := make(map[string]bool, len(req.Devices))
+	for _, device := range req.Devices {
+		listed[device] = true
+	}
+	for _, hold := range holds {
+		if len(listed) == 0 || listed[hold.ID] {
+			AuditChange(c, group, hold.ID, resourceHold, actionRelease, json.RawMessage(hold.Data), nil)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "released", "released": released})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStopConfig(t *testing.T) {
+	for _, test := range []struct {
+		current string
+		want    map[string]interface{}
+	}{
+		{`{"pwr":true,"temp":225,"recipe":{"name":"pork-butt"}}`, map[string]interface{}{"pwr": false, "temp": 225.0, "recipe": map[string]interface{}{"name": "pork-butt"}}},
+		{"", map[string]interface{}{"pwr": false}},
+		{`{"pwr":tru`, map[string]interface{}{"pwr": false}},
+	} {
+		var current []byte
+		if test.current != "" {
+			current = []byte(test.current)
+		}
+		var got map[string]interface{}
+		if err := json.Unmarshal(stopConfig(current), &got); err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(test.want) || got["pwr"] != false || got["temp"] != test.want["temp"] {
+			t.Fatalf("stop of %v: %v", test.current, got)
+		}
+	}
+}
+
+//racingStore a store where another writer changes a config right before each conditional write to it, for
+//as many races as it's given
+type racingStore struct {
+	Store
+	sync.Mutex
+	races map[string]int
+}
+
+func (rs *racingStore) WriteConfig(group, device, config string, entry *Revision, expected string) (uint64, []byte, error) {
+	rs.Lock()
+	race := expected != "" && rs.races[device] > 0
+	if race {
+		rs.races[device]--
+	}
+	rs.Unlock()
+	if race {
+		racer := &Revision{Author: "racer", Config: []byte(`{"pwr":true,"temp":300}`)}
+		if _, _, err := rs.Store.WriteConfig(group, device, config, racer, ""); err != nil {
+			return 0, nil, err
+		}
+	}
+	return rs.Store.WriteConfig(group, device, config, entry, expected)
+}
+
+//raceStops run the test with the writes of stops racing another writer and short estop timings
+func raceStops(t *testing.T, races map[string]int) {
+	saved, backoff, maxBackoff, giveUp := store, estopBackoff, estopMaxBackoff, estopGiveUp
+	t.Cleanup(func() {
+		store, estopBackoff, estopMaxBackoff, estopGiveUp = saved, backoff, maxBackoff, giveUp
+	})
+	store = &racingStore{Store: saved, races: races}
+	estopBackoff, estopMaxBackoff, estopGiveUp = 10*time.Millisecond, 20*time.Millisecond, 300*time.Millisecond
+}
+
+func TestStopDeviceRacing(t *testing.T) {
+	raceStops(t, map[string]int{"smoker": 3, "contended": 1 << 20})
+	start := time.Now()
+	rev, err := stopDevice("race", "smoker", Revision{Author: "tester", Action: actionEstop})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("retried three conflicts in %v without backing off", elapsed)
+	}
+	data, current, err := ReadConfig("race", "smoker", estopConfig)
+	var config map[string]interface{}
+	if err != nil || current != rev || json.Unmarshal(data, &config) != nil || config["pwr"] != false || config["temp"] != 300.0 {
+		t.Fatalf("stopped config at %v: %s %v", current, data, err)
+	}
+
+	start = time.Now()
+	if _, err := stopDevice("race", "contended", Revision{Author: "tester", Action: actionEstop}); err == nil {
+		t.Fatal("a stop that always lost the race went through")
+	} else if _, ok := err.(*ConflictError); !ok {
+		t.Fatalf("gave up with %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > estopGiveUp+estopMaxBackoff+time.Second {
+		t.Fatalf("gave up after %v", elapsed)
+	}
+}
+
+func TestPostEmergencyStop(t *testing.T) {
+	raceStops(t, map[string]int{"contended": 1 << 20})
+	body := []byte(`{"devices": ["smoker", "contended", "smoker"]}`)
+	rec := serve(t, http.MethodPost, "/estop/stop", "cook@stop", body, nil)
+	var res struct {
+		Accepted int          `json:"accepted"`
+		Retrying int          `json:"retrying"`
+		Failed   int          `json:"failed"`
+		Results  []BulkResult `json:"results"`
+	}
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &res) != nil || res.Accepted != 1 || res.Failed != 1 || res.Retrying != 0 {
+		t.Fatalf("emergency stop: %d %s", rec.Code, rec.Body)
+	}
+	if res.Results[1].Device != "contended" || res.Results[1].Status != "failed" || res.Results[1].Error == "" {
+		t.Fatalf("stop of the contended device: %+v", res.Results[1])
+	}
+	for _, device := range []string{"smoker", "contended"} {
+		if held, err := Held("stop", device); err != nil || !held {
+			t.Fatalf("%v held %v %v", device, held, err)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultDevicePage = 50
+	maxDevicePage     = 500
+	deviceScanBatch   = 500
+	sortName          = "name"
+	sortLastContact   = "last_contact"
+	sortNone          = "none"
+)
+
+var errBadCursor = errors.New("cursor is not valid for this listing")
+
+//DevicePage a page of the devices of a group. Total counts every device of the group, matched the ones
+//passing the filters and is only known for sorted listings. The cursor is empty on the last page
+type DevicePage struct {
+	Devices    []DeviceStatus `json:"devices"`
+	Count      int            `json:"count"`
+	Total      int64          `json:"total"`
+	Matched    *int           `json:"matched,omitempty"`
+	NextCursor string         `json:"next_cursor"`
+}
+
+//DeviceFilter narrows down the devices listed, zero values match everything. A device is on a channel when
+//it was last heard from on it or its registry record lists the channel among those it publishes on
+type DeviceFilter struct {
+	Channel    string
+	Presence   string
+	Since      int64
+	Until      int64
+	Publishers map[string]bool
+}
+
+//Match whether a device passes the filter
+func (f *DeviceFilter) Match(device *DeviceStatus) bool {
+	if f.Channel != "" && device.Channel != f.Channel && !f.Publishers[device.Device] {
+		return false
+	}
+	if f.Presence != "" && device.Presence != f.Presence {
+		return false
+	}
+	if f.Since > 0 && device.TimeSeconds < f.Since {
+		return false
+	}
+	if f.Until > 0 && device.TimeSeconds > f.Until {
+		return false
+	}
+	return true
+}
+
+//pageCursor where the next page starts, opaque to clients. Unsorted listings resume the scan of the group,
+//sorted ones resume after the last device listed so devices coming and going don't shift the pages
+type pageCursor struct {
+	Sort    string `json:"o"`
+	Scan    string `json:"s,omitempty"`
+	Device  string `json:"d,omitempty"`
+	Contact int64  `json:"c,omitempty"`
+}
+
+func (pc *pageCursor) encode() string {
+	data, _ := json.Marshal(pc)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(val, order string) (*pageCursor, error) {
+	if val == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(val)
+	if err != nil {
+		return nil, errBadCursor
+	}
+	var pc pageCursor
+	if err := json.Unmarshal(data, &pc); err != nil || pc.Sort != order {
+		return nil, errBadCursor
+	}
+	return &pc, nil
+}
+
+//decodeDevices the device statuses of a batch of the group table
+func decodeDevices(entries []Entry, filter *DeviceFilter, devices []DeviceStatus) []DeviceStatus {
+	for _, entry := range entries {
+		var device DeviceStatus
+		if err := json.Unmarshal(entry.Data, &device); err != nil {
+			log.Error(err)
+			continue
+		}
+		if device.Presence == "" {
+			device.Presence = presenceUnknown
+		}
+		if filter.Match(&device) {
+			devices = append(devices, device)
+		}
+	}
+	return devices
+}
+
+//scanDevices continue a scan of the group until at least limit devices matched or the scan is done.
+//A batch can't be split without losing its place, so a page can run over the limit
+func scanDevices(group string, filter *DeviceFilter, cursor string, limit int) ([]DeviceStatus, string, error) {
+	devices := make([]DeviceStatus, 0, limit)
+	for {
+		entries, next, err := pubHub.ScanDevices(group, cursor, limit)
+		if err != nil {
+			return nil, "", err
+		}
+		devices = decodeDevices(entries, filter, devices)
+		cursor = next
+		if cursor == "" || len(devices) >= limit {
+			return devices, cursor, nil
+		}
+	}
+}
+
+//allDevices every device of the group passing the filter, scanned in batches so a large group doesn't
+//block redis the way an HGETALL would
+func allDevices(group string, filter *DeviceFilter) ([]DeviceStatus, error) {
+	devices := make([]DeviceStatus, 0)
+	cursor := ""
+	for {
+		entries, next, err := pubHub.ScanDevices(group, cursor, deviceScanBatch)
+		if err != nil {
+			return nil, err
+		}
+		devices = decodeDevices(entries, filter, devices)
+		if cursor = next; cursor == "" {
+			return devices, nil
+		}
+	}
+}
+
+//before whether device a is listed before device b, by name or most recent contact first
+func before(order string, a, b *DeviceStatus) bool {
+	if order == sortLastContact && a.TimeSeconds != b.TimeSeconds {
+		return a.TimeSeconds > b.TimeSeconds
+	}
+	return a.Device < b.Device
+}
+
+//sortedPage the page of sorted devices following the cursor, and the cursor of the page after it
+func sortedPage(devices []DeviceStatus, order string, after *pageCursor, limit int) ([]DeviceStatus, string) {
+	sort.Slice(devices, func(i, j int) bool {
+		return before(order, &devices[i], &devices[j])
+	})
+	start := 0
+	if after != nil {
+		last := &DeviceStatus{Device: after.Device, TimeSeconds: after.Contact}
+		start = sort.Search(len(devices), func(i int) bool {
+			return before(order, last, &devices[i])
+		})
+	}
+	end := start + limit
+	if end >= len(devices) {
+		return devices[start:], ""
+	}
+	last := devices[end-1]
+	next := &pageCursor{Sort: order, Device: last.Device, Contact: last.TimeSeconds}
+	return devices[start:end], next.encode()
+}
+
+//deviceFilter the filters of a device listing, ?channel= ?presence= and the last contact window ?since= ?until=
+func deviceFilter(c *gin.Context) (*DeviceFilter, error) {
+	filter := &DeviceFilter{Channel: c.Query("channel"), Presence: c.Query("presence")}
+	switch filter.Presence {
+	case "", "online", "offline", presenceUnknown:
+	default:
+		return nil, errors.New("presence must be one of online, offline or unknown")
+	}
+	var err error
+	if val := c.Query("since"); val != "" {
+		if filter.Since, err = strconv.ParseInt(val, 10, 64); err != nil {
+			return nil, errors.New("since must be a unix timestamp")
+		}
+	}
+	if val := c.Query("until"); val != "" {
+		if filter.Until, err = strconv.ParseInt(val, 10, 64); err != nil {
+			return nil, errors.New("until must be a unix timestamp")
+		}
+	}
+	return filter, nil
+}
+
+//channelPublishers the devices of the group whose registry record lists the channel of the filter, pub-hub
+//only knows the channel a device was last heard from on
+func channelPublishers(group string, filter *DeviceFilter) error {
+	if filter.Channel == "" {
+		return nil
+	}
+	records, err := store.ListDeviceRecords(group)
+	if err != nil {
+		return err
+	}
+	filter.Publishers = make(map[string]bool)
+	for i := range records {
+		if hasString(records[i].Channels, filter.Channel) {
+			filter.Publishers[records[i].Device] = true
+		}
+	}
+	return nil
+}
+
+//GetDevices list the devices of a group a page at a time, straight through the scan of the group so a page
+//costs the same however large the group is. ?sort=name or last_contact, most recent first, reads the whole
+//group for every page and is meant for groups small enough to sort
+func GetDevices(c *gin.Context) {
+	group := c.Param("group")
+	order := c.DefaultQuery("sort", sortNone)
+	if order != sortName && order != sortLastContact && order != sortNone {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sort must be one of name, last_contact or none"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultDevicePage)))
+	if err != nil || limit < 1 || limit > maxDevicePage {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and " + strconv.Itoa(maxDevicePage)})
+		return
+	}
+	filter, err := deviceFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	after, err := decodeCursor(c.Query("cursor"), order)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := channelPublishers(group, filter); err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	total, err := pubHub.CountDevices(group)
+	if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	page := &DevicePage{Total: total}
+	if order == sortNone {
+		cursor := ""
+		if after != nil {
+			cursor = after.Scan
+		}
+		var next string
+		page.Devices, next, err = scanDevices(group, filter, cursor, limit)
+		if next != "" {
+			page.NextCursor = (&pageCursor{Sort: order, Scan: next}).encode()
+		}
+	} else {
+		var devices []DeviceStatus
+		if devices, err = allDevices(group, filter); err == nil {
+			matched := len(devices)
+			page.Matched = &matched
+			page.Devices, page.NextCursor = sortedPage(devices, order, after, limit)
+		}
+	}
+	if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	page.Count = len(page.Devices)
+	c.JSON(http.StatusOK, page)
+}
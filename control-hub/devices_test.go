@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+//putDevices store the statuses pub-hub keeps for the devices of a group
+func putDevices(t *testing.T, group string, devices ...DeviceStatus) {
+	t.Helper()
+	for _, device := range devices {
+		data, _ := json.Marshal(&device)
+		if err := store.PutEntry(group, device.Device, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+//names the devices of a listing in order
+func names(devices []DeviceStatus) []string {
+	out := make([]string, len(devices))
+	for i := range devices {
+		out[i] = devices[i].Device
+	}
+	return out
+}
+
+func TestDecodeCursor(t *testing.T) {
+	pc := &pageCursor{Sort: sortLastContact, Device: "smoker", Contact: 1601234567}
+	decoded, err := decodeCursor(pc.encode(), sortLastContact)
+	if err != nil || *decoded != *pc {
+		t.Fatalf("round trip: %+v %v", decoded, err)
+	}
+	if decoded, err := decodeCursor("", sortName); decoded != nil || err != nil {
+		t.Fatalf("no cursor: %+v %v", decoded, err)
+	}
+	for name, val := range map[string]string{
+		"not base64":       "!!!",
+		"not json":         "bm90IGpzb24",
+		"another ordering": pc.encode(),
+	} {
+		if _, err := decodeCursor(val, sortName); err != errBadCursor {
+			t.Fatalf("%v: %v", name, err)
+		}
+	}
+}
+
+func TestSortedPage(t *testing.T) {
+	devices := func() []DeviceStatus {
+		return []DeviceStatus{
+			{Device: "d", TimeSeconds: 30},
+			{Device: "a", TimeSeconds: 10},
+			{Device: "e", TimeSeconds: 20},
+			{Device: "c", TimeSeconds: 30},
+			{Device: "b", TimeSeconds: 40},
+		}
+	}
+	for _, test := range []struct {
+		order string
+		pages [][]string
+	}{
+		{sortName, [][]string{{"a", "b"}, {"c", "d"}, {"e"}}},
+		{sortLastContact, [][]string{{"b", "c"}, {"d", "e"}, {"a"}}},
+	} {
+		var after *pageCursor
+		for i, want := range test.pages {
+			page, next := sortedPage(devices(), test.order, after, 2)
+			if got := names(page); !equalStrings(got, want) {
+				t.Fatalf("%v page %d: %v", test.order, i, got)
+			}
+			if last := i == len(test.pages)-1; last != (next == "") {
+				t.Fatalf("%v page %d: cursor %q", test.order, i, next)
+			}
+			if next == "" {
+				break
+			}
+			var err error
+			if after, err = decodeCursor(next, test.order); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	//The device a cursor points after went away, the next page starts where it would have been
+	remaining := []DeviceStatus{{Device: "a"}, {Device: "c"}, {Device: "d"}}
+	page, next := sortedPage(remaining, sortName, &pageCursor{Sort: sortName, Device: "b"}, 2)
+	if got := names(page); !equalStrings(got, []string{"c", "d"}) || next != "" {
+		t.Fatalf("resume after a removed device: %v %q", got, next)
+	}
+}
+
+//equalStrings whether two lists hold the same strings in the same order
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestScanDevices(t *testing.T) {
+	for i := 0; i < 9; i++ {
+		presence := "offline"
+		if i%3 == 0 {
+			presence = "online"
+		}
+		putDevices(t, "scan", DeviceStatus{Device: "smoker" + strconv.Itoa(i), Presence: presence})
+	}
+	seen := make(map[string]bool)
+	cursor, pages := "", 0
+	for {
+		devices, next, err := scanDevices("scan", &DeviceFilter{Presence: "online"}, cursor, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages++
+		for _, device := range devices {
+			if device.Presence != "online" || seen[device.Device] {
+				t.Fatalf("page %d: %+v", pages, devices)
+			}
+			seen[device.Device] = true
+		}
+		if next != "" && len(devices) < 2 {
+			t.Fatalf("page %d stopped short of the limit with more to scan: %v", pages, names(devices))
+		}
+		if cursor = next; cursor == "" {
+			break
+		}
+	}
+	if len(seen) != 3 || pages != 2 {
+		t.Fatalf("scanned %d devices in %d pages", len(seen), pages)
+	}
+}
+
+func TestGetDevices(t *testing.T) {
+	putDevices(t, "listing",
+		DeviceStatus{Device: "smoker", TimeSeconds: 300, Channel: "temp", Presence: "online"},
+		DeviceStatus{Device: "fridge", TimeSeconds: 200, Channel: "readings", Presence: "offline"},
+		DeviceStatus{Device: "oven", TimeSeconds: 100, Channel: "temp"},
+	)
+	if err := store.PutEntry(credentialPrefix+"listing", "smoker", []byte(`{"secret": "listing-secret"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if rec := serve(t, http.MethodPost, "/registry/listing/smoker/heartbeat", "listing-secret", []byte(`{"channels": ["temp", "readings"]}`), nil); rec.Code != http.StatusOK {
+		t.Fatalf("heartbeat: %d %s", rec.Code, rec.Body)
+	}
+
+	list := func(query url.Values) *DevicePage {
+		t.Helper()
+		rec := serve(t, http.MethodGet, "/devices/listing?"+query.Encode(), "cook@listing", nil, nil)
+		var page DevicePage
+		if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &page) != nil {
+			t.Fatalf("%v: %d %s", query, rec.Code, rec.Body)
+		}
+		return &page
+	}
+	for _, test := range []struct {
+		query url.Values
+		want  []string
+	}{
+		{url.Values{"sort": {sortName}}, []string{"fridge", "oven", "smoker"}},
+		{url.Values{"sort": {sortLastContact}}, []string{"smoker", "fridge", "oven"}},
+		{url.Values{"sort": {sortName}, "channel": {"readings"}}, []string{"fridge", "smoker"}},
+		{url.Values{"sort": {sortName}, "channel": {"temp"}}, []string{"oven", "smoker"}},
+		{url.Values{"sort": {sortName}, "presence": {presenceUnknown}}, []string{"oven"}},
+		{url.Values{"sort": {sortName}, "since": {"150"}, "until": {"250"}}, []string{"fridge"}},
+	} {
+		page := list(test.query)
+		if got := names(page.Devices); !equalStrings(got, test.want) || page.Total != 3 || page.Matched == nil || *page.Matched != len(test.want) {
+			t.Fatalf("%v: %v %+v", test.query, got, page)
+		}
+	}
+
+	first := list(url.Values{"sort": {sortName}, "limit": {"2"}})
+	if first.Count != 2 || first.NextCursor == "" {
+		t.Fatalf("first page: %+v", first)
+	}
+	second := list(url.Values{"sort": {sortName}, "limit": {"2"}, "cursor": {first.NextCursor}})
+	if got := names(second.Devices); !equalStrings(got, []string{"smoker"}) || second.NextCursor != "" {
+		t.Fatalf("second page: %+v", second)
+	}
+	if page := list(url.Values{"limit": {"2"}}); page.Matched != nil || page.Count != 2 || page.NextCursor == "" {
+		t.Fatalf("unsorted page: %+v", page)
+	}
+
+	for _, query := range []url.Values{
+		{"sort": {"size"}},
+		{"limit": {"0"}},
+		{"limit": {"501"}},
+		{"presence": {"away"}},
+		{"since": {"yesterday"}},
+		{"sort": {sortName}, "cursor": {first.NextCursor + "x"}},
+		{"sort": {sortLastContact}, "cursor": {first.NextCursor}},
+	} {
+		if rec := serve(t, http.MethodGet, "/devices/listing?"+query.Encode(), "cook@listing", nil, nil); rec.Code != http.StatusBadRequest {
+			t.Fatalf("%v: %d %s", query, rec.Code, rec.Body)
+		}
+	}
+}
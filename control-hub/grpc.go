@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	pb "github.com/charles-d-burton/grillbernetes/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const grpcAddr = ":7778"
+
+//controlServer the Control api, reads and writes the same configs as the http endpoints
+type controlServer struct {
+	pb.UnimplementedControlServer
+}
+
+//ServeGRPC serve the Control api next to the http endpoints
+func ServeGRPC() {
+	lis, err := net.Listen("tcp", grpcAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv := grpc.NewServer(grpc.UnaryInterceptor(grpcAuth))
+	pb.RegisterControlServer(srv, &controlServer{})
+	log.Infof("serving grpc on %v", grpcAddr)
+	if err := srv.Serve(lis); err != nil {
+		log.Fatal(err)
+	}
+}
+
+//GetConfig retrieve a device config along with its revision
+func (srv *controlServer) GetConfig(ctx context.Context, key *pb.ConfigKey) (*pb.Config, error) {
+	if key.Group == "" || key.Device == "" || key.Config == "" {
+		return nil, status.Error(codes.InvalidArgument, "group, device and config are required")
+	}
+	val, rev, err := ReadConfig(key.Group, key.Device, key.Config)
+	if err == errNotFound {
+		return nil, status.Errorf(codes.NotFound, "no config %v for %v", key.Config, key.Device)
+	} else if err != nil {
+		log.Error(err)
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return &pb.Config{Group: key.Group, Device: key.Device, Config: key.Config, Json: val, Revision: rev}, nil
+}
+
+//SetConfig store a device config as a new revision, a config naming a revision is only written if
+//that's still the current one
+func (srv *controlServer) SetConfig(ctx context.Context, config *pb.Config) (*pb.Config, error) {
+	if config.Group == "" || config.Device == "" || config.Config == "" {
+		return nil, status.Error(codes.InvalidArgument, "group, device and config are required")
+	}
+	if !json.Valid(config.Json) {
+		return nil, status.Error(codes.InvalidArgument, "config is not valid JSON")
+	}
+	if err := types.Validate(config.Group, config.Device, config.Config, config.Json); err != nil {
+		if verr, ok := err.(*ValidationError); ok {
+			return nil, status.Error(codes.InvalidArgument, violationMessage(verr))
+		}
+		log.Error(err)
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	var expected string
+	if config.Revision > 0 {
+		expected = strconv.FormatUint(config.Revision, 10)
+	}
+	author := config.Author
+	if author == "" {
+		author = contextIdentity(ctx).Name()
+	}
+	revision := &Revision{Author: author, Source: sourceGRPC, Actor: contextIdentity(ctx).Name(), Config: config.Json}
+	rev, err := WriteConfig(config.Group, config.Device, config.Config, revision, expected)
+	if _, ok := err.(*ConflictError); ok {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	} else if err != nil {
+		log.Error(err)
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return &pb.Config{
+		Group:    config.Group,
+		Device:   config.Device,
+		Config:   config.Config,
+		Json:     config.Json,
+		Revision: rev,
+		Author:   author,
+	}, nil
+}
+
+//violationMessage a validation error with every offending field, status messages are all a gRPC client sees
+func violationMessage(verr *ValidationError) string {
+	if len(verr.Details) == 0 {
+		return verr.Error()
+	}
+	fields := make([]string, 0, len(verr.Details))
+	for _, v := range verr.Details {
+		fields = append(fields, v.Field+": "+v.Error)
+	}
+	return fmt.Sprintf("config %v is not valid for %v: %v", verr.Config, verr.Type, strings.Join(fields, "; "))
+}
+
+//shadowMessage the protobuf form of the shadow of a config
+func shadowMessage(key *pb.ConfigKey, shadow *DeviceShadow) *pb.Shadow {
+	return &pb.Shadow{
+		Group:            key.Group,
+		Device:           key.Device,
+		Config:           key.Config,
+		Desired:          shadow.Desired,
+		DesiredRevision:  shadow.DesiredRevision,
+		Reported:         shadow.Reported,
+		ReportedRevision: shadow.ReportedRevision,
+		ReportedAt:       shadow.ReportedAt,
+		Delta:            shadow.Delta,
+		Status:           shadow.Status,
+	}
+}
+
+//GetShadow desired and reported state of a device config
+func (srv *controlServer) GetShadow(ctx context.Context, key *pb.ConfigKey) (*pb.Shadow, error) {
+	if key.Group == "" || key.Device == "" || key.Config == "" {
+		return nil, status.Error(codes.InvalidArgument, "group, device and config are required")
+	}
+	shadow, err := ReadShadow(key.Group, key.Device, key.Config)
+	if err != nil {
+		log.Error(err)
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return shadowMessage(key, shadow), nil
+}
+
+//ReportState store the state a device reports and answer with the resulting shadow
+func (srv *controlServer) ReportState(ctx context.Context, state *pb.ReportedState) (*pb.Shadow, error) {
+	if state.Group == "" || state.Device == "" || state.Config == "" {
+		return nil, status.Error(codes.InvalidArgument, "group, device and config are required")
+	}
+	if len(state.Json) == 0 || !json.Valid(state.Json) {
+		return nil, status.Error(codes.InvalidArgument, "reported state is not valid JSON")
+	}
+	if err := WriteReported(state.Group, state.Device, state.Config, &Reported{Revision: state.Revision, State: state.Json}); err != nil {
+		log.Error(err)
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return srv.GetShadow(ctx, &pb.ConfigKey{Group: state.Group, Device: state.Device, Config: state.Config})
+}
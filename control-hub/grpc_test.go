@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	pb "github.com/charles-d-burton/grillbernetes/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+//dialControl a client of the Control api served over an in memory listener behind the same interceptor as ServeGRPC
+func dialControl(t *testing.T) pb.ControlClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(grpc.UnaryInterceptor(grpcAuth))
+	pb.RegisterControlServer(srv, &controlServer{})
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewControlClient(conn)
+}
+
+//bearer a call context carrying the token in the metadata grpcAuth reads it from
+func bearer(token string) context.Context {
+	if token == "" {
+		return context.Background()
+	}
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+}
+
+func TestGRPCAuth(t *testing.T) {
+	if err := store.PutEntry(credentialPrefix+"grpcauth", "smoker", []byte(`{"secret": "smoker-secret"}`)); err != nil {
+		t.Fatal(err)
+	}
+	client := dialControl(t)
+	key := &pb.ConfigKey{Group: "grpcauth", Device: "smoker", Config: "configs"}
+	config := &pb.Config{Group: "grpcauth", Device: "smoker", Config: "configs", Json: []byte(`{"pwr": false}`)}
+	state := &pb.ReportedState{Group: "grpcauth", Device: "smoker", Config: "configs", Revision: 1, Json: []byte(`{"pwr": false}`)}
+
+	written, err := client.SetConfig(bearer("cook@grpcauth"), config)
+	if err != nil || written.Revision != 1 || written.Author != "cook" {
+		t.Fatalf("member writing a config: %+v %v", written, err)
+	}
+	for _, test := range []struct {
+		name  string
+		token string
+		call  func(ctx context.Context) error
+		code  codes.Code
+	}{
+		{"no token", "", func(ctx context.Context) error { _, err := client.GetConfig(ctx, key); return err }, codes.Unauthenticated},
+		{"unknown token", "nobody", func(ctx context.Context) error { _, err := client.GetConfig(ctx, key); return err }, codes.Unauthenticated},
+		{"member", "cook@grpcauth", func(ctx context.Context) error { _, err := client.GetConfig(ctx, key); return err }, codes.OK},
+		{"member of several groups", "cook@other,grpcauth", func(ctx context.Context) error { _, err := client.GetShadow(ctx, key); return err }, codes.OK},
+		{"not a member", "cook@other", func(ctx context.Context) error { _, err := client.GetConfig(ctx, key); return err }, codes.PermissionDenied},
+		{"not a member writing", "cook@other", func(ctx context.Context) error { _, err := client.SetConfig(ctx, config); return err }, codes.PermissionDenied},
+		{"device reading its config", "smoker-secret", func(ctx context.Context) error { _, err := client.GetConfig(ctx, key); return err }, codes.OK},
+		{"device reading its shadow", "smoker-secret", func(ctx context.Context) error { _, err := client.GetShadow(ctx, key); return err }, codes.OK},
+		{"device reporting its state", "smoker-secret", func(ctx context.Context) error { _, err := client.ReportState(ctx, state); return err }, codes.OK},
+		{"device writing its config", "smoker-secret", func(ctx context.Context) error { _, err := client.SetConfig(ctx, config); return err }, codes.Unauthenticated},
+		{"device reading another device", "smoker-secret", func(ctx context.Context) error {
+			_, err := client.GetConfig(ctx, &pb.ConfigKey{Group: "grpcauth", Device: "other", Config: "configs"})
+			return err
+		}, codes.Unauthenticated},
+		{"reserved group", "cook@schedules", func(ctx context.Context) error {
+			_, err := client.GetConfig(ctx, &pb.ConfigKey{Group: "schedules", Device: "smoker", Config: "configs"})
+			return err
+		}, codes.InvalidArgument},
+	} {
+		if err := test.call(bearer(test.token)); status.Code(err) != test.code {
+			t.Fatalf("%v: %v %v", test.name, status.Code(err), err)
+		}
+	}
+}
+
+func TestGRPCConfig(t *testing.T) {
+	client := dialControl(t)
+	token := bearer("cook@grpcconfig")
+	key := &pb.ConfigKey{Group: "grpcconfig", Device: "smoker", Config: "configs"}
+	if _, err := client.GetConfig(token, key); status.Code(err) != codes.NotFound {
+		t.Fatalf("config never written: %v", err)
+	}
+	config := &pb.Config{Group: "grpcconfig", Device: "smoker", Config: "configs", Json: []byte(`{"pwr": true}`), Author: "pitmaster"}
+	written, err := client.SetConfig(token, config)
+	if err != nil || written.Revision != 1 || written.Author != "pitmaster" {
+		t.Fatalf("write: %+v %v", written, err)
+	}
+	read, err := client.GetConfig(token, key)
+	if err != nil || read.Revision != 1 || string(read.Json) != `{"pwr": true}` {
+		t.Fatalf("read: %+v %v", read, err)
+	}
+	config.Revision = 5
+	if _, err := client.SetConfig(token, config); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("write against a stale revision: %v", err)
+	}
+	config.Revision, config.Json = 0, []byte(`{"pwr":`)
+	if _, err := client.SetConfig(token, config); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("write that isn't json: %v", err)
+	}
+
+	state := &pb.ReportedState{Group: "grpcconfig", Device: "smoker", Config: "configs", Revision: 1, Json: []byte(`{"pwr": true}`)}
+	shadow, err := client.ReportState(token, state)
+	if err != nil || shadow.DesiredRevision != 1 || shadow.ReportedRevision != 1 || shadow.ReportedAt == 0 {
+		t.Fatalf("report: %+v %v", shadow, err)
+	}
+	state.Json = nil
+	if _, err := client.ReportState(token, state); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("report without a state: %v", err)
+	}
+}
@@ -5,48 +5,171 @@ import (
 	"flag"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis"
+	nats "github.com/nats-io/nats.go"
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	presenceUnknown = "unknown"
+)
+
 var (
 	usageStr = `
 Usage: pismoker [options]
 Options:
 	-rh, --redis-host       <NATSHost>     Start the controller connecting to the defined NATS Streaming server
+	-nh, --nats-host        <NATS_HOST>    NATS server with the AUDIT stream control actions are published to
+	-at, --admin-token      <ADMIN_TOKEN>  Bearer token required to use the admin api
+	-au, --auth-url         <AUTH_URL>     auth-service that vouches for the bearer tokens of users
+	-sg, --schedule-grace   <Duration>     How late a scheduled change may still be applied, later runs are skipped
+	-st, --storage          <STORAGE>      Where everything is kept: redis, bolt or memory
+	-sp, --storage-path     <STORAGE_PATH> File of the bolt storage
+	-ph, --pub-hub-url      <PUB_HUB_URL>  pub-hub to ask for devices and their credentials, needed unless both share redis
+	-pt, --pub-hub-token    <PUB_HUB_TOKEN> Admin token of pub-hub
+	-rt, --require-type     <REQUIRE_TYPE> Reject config writes to devices that have no device type
 `
-	log = logrus.New()
-	rc  *redis.Client
+	log           = logrus.New()
+	rc            *redis.Client
+	store         Store
+	storage       string
+	js            nats.JetStreamContext
+	pubHub        DeviceSource
+	adminToken    string
+	authURL       string
+	scheduleGrace time.Duration
 )
 
 //Message data to publish to server
 type Message struct {
-	Data json.RawMessage `json:"config"`
+	Data   json.RawMessage `json:"config"`
+	Author string          `json:"author,omitempty"`
+}
+
+//DeviceStatus entry pub-hub keeps for each device in the group hashtable
+type DeviceStatus struct {
+	Device      string `json:"device"`
+	TimeSeconds int64  `json:"time_seconds"`
+	Channel     string `json:"channel"`
+	Presence    string `json:"presence"`
+	Since       int64  `json:"presence_since,omitempty"`
 }
 
-func init() {
+//setup read the options and connect to nats and the storage
+func setup() {
 	log.SetFormatter(&logrus.JSONFormatter{})
 	var redisHost string
+	var natsHost string
+	var storagePath, pubHubURL, pubHubToken string
 	flag.StringVar(&redisHost, "rd", "", "Start the controller connecting to the redis cluster")
 	flag.StringVar(&redisHost, "redis-host", "", "Start the controller connecting to the redis cluster")
+	flag.StringVar(&natsHost, "nh", "", "NATS server with the AUDIT stream control actions are published to")
+	flag.StringVar(&natsHost, "nats-host", "", "NATS server with the AUDIT stream control actions are published to")
+	flag.StringVar(&adminToken, "at", "", "Bearer token required to use the admin api")
+	flag.StringVar(&adminToken, "admin-token", "", "Bearer token required to use the admin api")
+	flag.StringVar(&authURL, "au", "", "auth-service that vouches for the bearer tokens of users")
+	flag.StringVar(&authURL, "auth-url", "", "auth-service that vouches for the bearer tokens of users")
+	flag.DurationVar(&scheduleGrace, "sg", 15*time.Minute, "How late a scheduled change may still be applied")
+	flag.DurationVar(&scheduleGrace, "schedule-grace", 15*time.Minute, "How late a scheduled change may still be applied")
+	flag.StringVar(&storage, "st", "", "Where everything is kept: redis, bolt or memory")
+	flag.StringVar(&storage, "storage", "", "Where everything is kept: redis, bolt or memory")
+	flag.StringVar(&storagePath, "sp", "", "File of the bolt storage")
+	flag.StringVar(&storagePath, "storage-path", "", "File of the bolt storage")
+	flag.StringVar(&pubHubURL, "ph", "", "pub-hub to ask for devices and their credentials")
+	flag.StringVar(&pubHubURL, "pub-hub-url", "", "pub-hub to ask for devices and their credentials")
+	flag.StringVar(&pubHubToken, "pt", "", "Admin token of pub-hub")
+	flag.StringVar(&pubHubToken, "pub-hub-token", "", "Admin token of pub-hub")
+	flag.BoolVar(&requireType, "rt", false, "Reject config writes to devices that have no device type")
+	flag.BoolVar(&requireType, "require-type", false, "Reject config writes to devices that have no device type")
 	flag.Parse()
+	if natsHost == "" {
+		natsHost = os.Getenv("NATS_HOST")
+		if natsHost == "" {
+			usage()
+		}
+	}
+	if authURL == "" {
+		authURL = os.Getenv("AUTH_URL")
+		if authURL == "" {
+			usage()
+		}
+	}
+	if storage == "" {
+		storage = os.Getenv("STORAGE")
+		if storage == "" {
+			storage = storageRedis
+		}
+	}
 	if redisHost == "" {
 		redisHost = os.Getenv("REDIS_HOST")
 		log.Debug(redisHost)
 	}
-	if redisHost == "" {
+	if redisHost == "" && storage == storageRedis { //Only redis storage needs it
 		usage()
 	}
-	rc = redis.NewClient(&redis.Options{
-		Addr:         redisHost,
-		Password:     "",
-		DB:           0,
-		MinIdleConns: 1,
-		MaxRetries:   5,
-	})
-	rc.Ping()
+	if storagePath == "" {
+		storagePath = os.Getenv("STORAGE_PATH")
+		if storagePath == "" {
+			storagePath = "control-hub.db"
+		}
+	}
+	if adminToken == "" {
+		adminToken = os.Getenv("ADMIN_TOKEN")
+		if adminToken == "" {
+			log.Warn("ADMIN_TOKEN Undefined, admin api is disabled")
+		}
+	}
+	if !requireType {
+		requireType, _ = strconv.ParseBool(os.Getenv("REQUIRE_TYPE"))
+	}
+	if pubHubURL == "" {
+		pubHubURL = os.Getenv("PUB_HUB_URL")
+	}
+	if pubHubToken == "" {
+		pubHubToken = os.Getenv("PUB_HUB_TOKEN")
+	}
+	switch {
+	case pubHubURL != "":
+		pubHub = newPubHubClient(pubHubURL, pubHubToken)
+	case storage == storageRedis: //pub-hub's keys are in the same redis
+		pubHub = sharedDevices{}
+	default:
+		log.Fatalf("%v storage can't see the devices pub-hub keeps, set --pub-hub-url or PUB_HUB_URL", storage)
+	}
+	log.Infof("connecting to nats host: %q", natsHost)
+	conn, err := nats.Connect(natsHost,
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			log.Error(err)
+		}),
+		nats.DisconnectHandler(func(_ *nats.Conn) {
+			log.Error("unexpectedly disconnected from nats")
+		}),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	js, err = conn.JetStream()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if storage == storageRedis {
+		rc = redis.NewClient(&redis.Options{
+			Addr:         redisHost,
+			Password:     "",
+			DB:           0,
+			MinIdleConns: 1,
+			MaxRetries:   5,
+		})
+		rc.Ping()
+	}
+	if store, err = openStore(storage, storagePath); err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("keeping everything in %v storage", storage)
 }
 
 func usage() {
@@ -54,38 +177,120 @@ func usage() {
 }
 
 func main() {
+	setup()
+	if err := SeedDeviceTypes(); err != nil {
+		log.Error(err)
+	}
+	router := routes()
+	if storage == storageRedis {
+		MigrateKeys()
+	}
+	types.Watch()
+	go RunSchedules()
+	RunWebhooks()
+	go RunRecipes()
+	go ServeGRPC()
+	router.Run(":7777")
+}
+
+//routes the http api
+func routes() *gin.Engine {
 	router := gin.Default()
 	router.GET("/healthz", HealthCheck)
-	router.GET("/config/:group/:deviceid/:config", GetConfig)
-	router.POST("/config/:group/:deviceid/:config", SetConfig)
-	router.GET("/devices/:group", GetDevices)
-	router.Run(":7777")
+	api := router.Group("/", GroupAuth)
+	api.GET("/config/:group/:deviceid/:config", GetConfig)
+	api.POST("/config/:group/:deviceid/:config", SetConfig)
+	api.GET("/config/:group/:deviceid/:config/revisions", GetRevisions)
+	api.GET("/config/:group/:deviceid/:config/revisions/:revision", GetConfigRevision)
+	api.POST("/config/:group/:deviceid/:config/revisions/:revision/rollback", PostRollback)
+	api.GET("/config/:group/:deviceid/:config/shadow", GetShadow)
+	api.POST("/config/:group/:deviceid/:config/reported", PostReported)
+	api.GET("/config/:group/:deviceid/:config/schedules", GetSchedules)
+	api.POST("/config/:group/:deviceid/:config/schedules", PostSchedule)
+	api.GET("/schedules/:group/:deviceid", GetSchedules)
+	api.GET("/schedules/:group/:deviceid/:id", GetSchedule)
+	api.DELETE("/schedules/:group/:deviceid/:id", DeleteSchedule)
+	api.GET("/recipes/:group", GetRecipes)
+	api.POST("/recipes/:group", PostRecipes)
+	api.GET("/recipes/:group/:name", GetRecipe)
+	api.PUT("/recipes/:group/:name", PutRecipe)
+	api.DELETE("/recipes/:group/:name", DeleteRecipe)
+	api.POST("/recipes/:group/:name/apply/:deviceid", PostApplyRecipe)
+	api.POST("/bulk/:group/:config", PostBulk)
+	api.POST("/estop/:group", PostEmergencyStop)
+	api.GET("/estop/:group", GetHolds)
+	api.DELETE("/estop/:group", DeleteHolds)
+	api.GET("/devices/:group", GetDevices)
+	api.GET("/registry/:group", GetRegistry)
+	api.POST("/registry/:group", PostRegistry)
+	api.GET("/registry/:group/:deviceid", GetDeviceRecord)
+	api.PUT("/registry/:group/:deviceid", PutDeviceRecord)
+	api.PATCH("/registry/:group/:deviceid", PatchDeviceRecord)
+	api.DELETE("/registry/:group/:deviceid", DeleteDeviceRecord)
+	api.POST("/registry/:group/:deviceid/heartbeat", PostHeartbeat)
+	api.GET("/webhooks/:group", GetWebhooks)
+	api.POST("/webhooks/:group", PostWebhook)
+	api.GET("/webhooks/:group/:id", GetWebhook)
+	api.PUT("/webhooks/:group/:id", PutWebhook)
+	api.DELETE("/webhooks/:group/:id", DeleteWebhook)
+	api.GET("/webhooks/:group/:id/deliveries", GetDeliveries)
+	api.POST("/webhooks/:group/:id/ping", PostPing)
+	api.GET("/audit/:group/devices/:deviceid", GetDeviceAudit)
+	api.GET("/audit/:group/users/:user", GetUserAudit)
+	admin := router.Group("/admin", AdminAuth)
+	admin.GET("/types", GetDeviceTypes)
+	admin.GET("/types/:type", GetDeviceType)
+	admin.PUT("/types/:type", PutDeviceType)
+	admin.DELETE("/types/:type", DeleteDeviceType)
+	admin.GET("/devices/:group/:deviceid/type", GetDeviceAssignment)
+	admin.PUT("/devices/:group/:deviceid/type", PutDeviceAssignment)
+	admin.DELETE("/devices/:group/:deviceid/type", DeleteDeviceAssignment)
+	admin.POST("/migrate/:group/:deviceid", PostMigrate)
+	admin.GET("/audit/users/:user", GetAdminAudit)
+	return router
 }
 
 //HealthCheck k8s healthcheck path
 func HealthCheck(c *gin.Context) {
-	res, err := rc.Ping().Result()
-	if err != nil || res != "PONG" {
-		log.Error("redis connection failed")
-		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "redis died"})
+	if err := store.Ping(); err != nil {
+		log.Error("storage connection failed: ", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "storage died"})
+		return
 	}
 	c.JSON(http.StatusOK, gin.H{"status": "alive"})
 }
 
-//GetConfig retrieve a config from Redis
+//reservedGroups the names that start the keys control-hub and pub-hub keep outside of any group. Group keys
+//start with the group, so a group named after one of them would share its keys and is refused
+var reservedGroups = map[string]bool{
+	"alarms": true, "assignments": true, "audit": true, "credentials": true, "deadletter": true,
+	"devicetypes": true, "heartbeats": true, "holds": true, "migrations": true, "presence": true,
+	"recipes": true, "registry": true, "revisions": true, "schedules": true, "schemas": true, "webhooks": true,
+}
+
+//configKey redis key a device config is stored under, namespaced by group so tenants can't collide. Groups
+//named after the other keys are refused by reservedGroups
+func configKey(group, device, config string) string {
+	return group + "/" + device + "/" + config
+}
+
+//GetConfig retrieve a config from Redis, the ETag is the revision to send back in If-Match when changing it
 func GetConfig(c *gin.Context) {
-	val, err := rc.Get(c.Param("deviceid") + "/" + c.Param("config")).Result()
-	if err == redis.Nil {
-		log.Info("No data for key: ", c.Param("deviceid")+"/"+c.Param("config"))
+	val, rev, err := ReadConfig(c.Param("group"), c.Param("deviceid"), c.Param("config"))
+	if err == errNotFound {
+		log.Info("No data for key: ", configKey(c.Param("group"), c.Param("deviceid"), c.Param("config")))
 	} else if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		log.Fatal(err)
+		log.Error(err)
 		return
+	} else {
+		c.Header("ETag", etag(rev))
 	}
-	c.Data(http.StatusOK, "application/json", []byte(val))
+	c.Data(http.StatusOK, "application/json", val)
 }
 
-//SetConfig sets the config for a given device
+//SetConfig sets the config for a given device as a new revision, with If-Match the write only goes
+//through if the config is still at that revision. Configs of typed devices have to match the type's schema
 func SetConfig(c *gin.Context) {
 	var msg Message
 	if err := c.ShouldBindJSON(&msg); err != nil {
@@ -93,34 +298,12 @@ func SetConfig(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	log.Info("Message parsed, sending to Redis")
-	err := rc.Set(c.Param("deviceid")+"/"+c.Param("config"), []byte(msg.Data), 0).Err()
-	if err != nil {
-		c.JSON(http.StatusRequestTimeout, gin.H{"error": err.Error()})
-		log.Fatal(err)
-		return
-	}
-	c.JSON(http.StatusOK, gin.H{"status": "accepted"})
-}
-
-//TODO: Add pagination
-//GetDevices Get all the devices and return them to the client
-func GetDevices(c *gin.Context) {
-	devices, err := rc.HGetAll(c.Param("group")).Result()
-	devicesArr := make([]json.RawMessage, 0)
-	if err != nil {
-		c.JSON(http.StatusRequestTimeout, gin.H{"error": err.Error()})
-		log.Info(err)
+	if err := types.Validate(c.Param("group"), c.Param("deviceid"), c.Param("config"), msg.Data); err != nil {
+		validationResponse(c, err)
 		return
 	}
-	for _, value := range devices {
-		devicesArr = append(devicesArr, json.RawMessage(value))
-	}
-	data, err := json.Marshal(devicesArr)
-	if err != nil {
-		c.JSON(http.StatusRequestTimeout, gin.H{"error": err.Error()})
-		log.Fatal(err)
-		return
-	}
-	c.JSON(http.StatusOK, json.RawMessage(data))
+	log.Info("Message parsed, sending to Redis")
+	revision := &Revision{Author: author(c, msg.Author), Source: sourceHTTP, Actor: actor(c), Config: msg.Data}
+	rev, err := WriteConfig(c.Param("group"), c.Param("deviceid"), c.Param("config"), revision, ifMatch(c))
+	writeResponse(c, rev, err)
 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nats-io/nats-server/v2/server"
+	nats "github.com/nats-io/nats.go"
+)
+
+const testAdminToken = "admin"
+
+//authCalls how many times the stand in for auth-service was asked
+var authCalls int64
+
+//TestMain run the tests against an embedded JetStream server with the EVENTS and AUDIT streams, memory
+//storage with the shipped device types and a stand in for auth-service
+func TestMain(m *testing.M) {
+	os.Exit(runTests(m))
+}
+
+func runTests(m *testing.M) int {
+	log.SetOutput(ioutil.Discard)
+	gin.SetMode(gin.TestMode)
+	dir, err := ioutil.TempDir("", "control-hub")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	ns, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: dir})
+	if err != nil {
+		panic(err)
+	}
+	go ns.Start()
+	defer ns.Shutdown()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		panic("embedded nats server didn't start")
+	}
+	conn, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+	if js, err = conn.JetStream(); err != nil {
+		panic(err)
+	}
+	for _, name := range []string{eventsStream, auditStream} {
+		if _, err := js.AddStream(&nats.StreamConfig{Name: name, Subjects: []string{name + ".>"}}); err != nil {
+			panic(err)
+		}
+	}
+	auth := httptest.NewServer(http.HandlerFunc(fakeAuth))
+	defer auth.Close()
+	authURL = auth.URL
+	store, storage, pubHub = newMemoryStore(), storageMemory, sharedDevices{}
+	adminToken = testAdminToken
+	if err := SeedDeviceTypes(); err != nil {
+		panic(err)
+	}
+	return m.Run()
+}
+
+//fakeAuth auth-service for the tests, the token <user>@<group>,<group> belongs to a user who is a member
+//of those groups and anything else is refused
+func fakeAuth(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&authCalls, 1)
+	token := bearerToken(r)
+	at := strings.LastIndex(token, "@")
+	if r.URL.Path != "/validate" || at < 1 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	user := token[:at]
+	json.NewEncoder(w).Encode(&Identity{Sub: user, Username: user, Groups: strings.Split(token[at+1:], ",")})
+}
+
+//serve a request against the http api
+func serve(t *testing.T, method, path, token string, body []byte, headers map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for key, val := range headers {
+		req.Header.Set(key, val)
+	}
+	rec := httptest.NewRecorder()
+	routes().ServeHTTP(rec, req)
+	return rec
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+//memoryConfig a config and the revisions of it still kept
+type memoryConfig struct {
+	revision  uint64
+	config    []byte
+	revisions map[uint64]*Revision
+}
+
+//memoryStore keeps everything in memory, it's gone on restart
+type memoryStore struct {
+	sync.RWMutex
+	configs   map[string]*memoryConfig
+	reported  map[string]Reported
+	registry  map[string]map[string]DeviceRecord
+	schedules map[string]map[string]Schedule
+	due       map[string]int64
+	tables    map[string]map[string][]byte
+	logs      map[string][][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		configs:   make(map[string]*memoryConfig),
+		reported:  make(map[string]Reported),
+		registry:  make(map[string]map[string]DeviceRecord),
+		schedules: make(map[string]map[string]Schedule),
+		due:       make(map[string]int64),
+		tables:    make(map[string]map[string][]byte),
+		logs:      make(map[string][][]byte),
+	}
+}
+
+func (ms *memoryStore) ReadConfig(group, device, config string) ([]byte, uint64, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	stored, ok := ms.configs[configKey(group, device, config)]
+	if !ok {
+		return nil, 0, errNotFound
+	}
+	return stored.config, stored.revision, nil
+}
+
+func (ms *memoryStore) WriteConfig(group, device, config string, entry *Revision, expected string) (uint64, []byte, error) {
+	key := configKey(group, device, config)
+	ms.Lock()
+	defer ms.Unlock()
+	stored, ok := ms.configs[key]
+	if !ok {
+		stored = &memoryConfig{revisions: make(map[uint64]*Revision)}
+	}
+	if err := checkExpected(expected, stored.revision); err != nil {
+		return 0, nil, err
+	}
+	before := stored.config
+	stored.revision++
+	stored.config = append([]byte(nil), entry.Config...)
+	stored.revisions[stored.revision] = numbered(entry, stored.revision)
+	if stored.revision > maxRevisions {
+		delete(stored.revisions, stored.revision-maxRevisions)
+	}
+	ms.configs[key] = stored
+	return stored.revision, before, nil
+}
+
+func (ms *memoryStore) GetRevision(group, device, config string, rev uint64) (*Revision, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	stored, ok := ms.configs[configKey(group, device, config)]
+	if !ok {
+		return nil, errRevisionNotFound
+	}
+	revision, ok := stored.revisions[rev]
+	if !ok {
+		return nil, errRevisionNotFound
+	}
+	copied := *revision
+	return &copied, nil
+}
+
+func (ms *memoryStore) ListRevisions(group, device, config string) ([]Revision, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	revisions := make([]Revision, 0)
+	if stored, ok := ms.configs[configKey(group, device, config)]; ok {
+		for _, revision := range stored.revisions {
+			revisions = append(revisions, *revision)
+		}
+	}
+	return revisions, nil
+}
+
+func (ms *memoryStore) ReadReported(group, device, config string) (*Reported, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	reported, ok := ms.reported[configKey(group, device, config)]
+	if !ok {
+		return nil, errNotFound
+	}
+	return &reported, nil
+}
+
+func (ms *memoryStore) WriteReported(group, device, config string, reported *Reported) error {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.reported[configKey(group, device, config)] = *reported
+	return nil
+}
+
+func (ms *memoryStore) ReadDeviceRecord(group, device string) (*DeviceRecord, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	record, ok := ms.registry[group][device]
+	if !ok {
+		return nil, errNotFound
+	}
+	return &record, nil
+}
+
+func (ms *memoryStore) ListDeviceRecords(group string) ([]DeviceRecord, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	records := make([]DeviceRecord, 0, len(ms.registry[group]))
+	for _, record := range ms.registry[group] {
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func (ms *memoryStore) UpdateDeviceRecord(group, device string, update func(*DeviceRecord) (*DeviceRecord, error)) (*DeviceRecord, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	var current *DeviceRecord
+	if record, ok := ms.registry[group][device]; ok {
+		current = &record
+	}
+	updated, err := update(current)
+	if err != nil {
+		return nil, err
+	}
+	records, ok := ms.registry[group]
+	if !ok {
+		records = make(map[string]DeviceRecord)
+		ms.registry[group] = records
+	}
+	records[device] = *updated
+	return updated, nil
+}
+
+func (ms *memoryStore) DeleteDeviceRecord(group, device string) (bool, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	_, ok := ms.registry[group][device]
+	delete(ms.registry[group], device)
+	return ok, nil
+}
+
+func (ms *memoryStore) GetSchedule(group, device, id string) (*Schedule, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	s, ok := ms.schedules[schedulesKey(group, device)][id]
+	if !ok {
+		return nil, errScheduleNotFound
+	}
+	return &s, nil
+}
+
+func (ms *memoryStore) ListSchedules(group, device string) ([]Schedule, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	schedules := make([]Schedule, 0, len(ms.schedules[schedulesKey(group, device)]))
+	for _, s := range ms.schedules[schedulesKey(group, device)] {
+		schedules = append(schedules, s)
+	}
+	return schedules, nil
+}
+
+func (ms *memoryStore) PutSchedule(s *Schedule) error {
+	ms.Lock()
+	defer ms.Unlock()
+	key := schedulesKey(s.Group, s.Device)
+	if ms.schedules[key] == nil {
+		ms.schedules[key] = make(map[string]Schedule)
+	}
+	ms.schedules[key][s.ID] = *s
+	ms.due[dueMember(s.Group, s.Device, s.ID)] = s.NextRun
+	return nil
+}
+
+func (ms *memoryStore) UpdateSchedule(s *Schedule) (bool, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	key := schedulesKey(s.Group, s.Device)
+	if _, ok := ms.schedules[key][s.ID]; !ok {
+		return false, nil
+	}
+	ms.schedules[key][s.ID] = *s
+	if s.NextRun > 0 {
+		ms.due[dueMember(s.Group, s.Device, s.ID)] = s.NextRun
+	} else {
+		delete(ms.due, dueMember(s.Group, s.Device, s.ID))
+	}
+	return true, nil
+}
+
+func (ms *memoryStore) DeleteSchedule(group, device, id string) (bool, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	key := schedulesKey(group, device)
+	_, ok := ms.schedules[key][id]
+	delete(ms.schedules[key], id)
+	delete(ms.due, dueMember(group, device, id))
+	return ok, nil
+}
+
+func (ms *memoryStore) ClaimSchedules(now, until int64, count int) ([]string, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	members := dueMembers(ms.due, now, count)
+	for _, member := range members {
+		ms.due[member] = until
+	}
+	return members, nil
+}
+
+//dueMembers the members of a due set at or before now, soonest first
+func dueMembers(due map[string]int64, now int64, count int) []string {
+	members := make([]string, 0)
+	for member, at := range due {
+		if at <= now {
+			members = append(members, member)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if due[members[i]] == due[members[j]] {
+			return members[i] < members[j]
+		}
+		return due[members[i]] < due[members[j]]
+	})
+	if len(members) > count {
+		members = members[:count]
+	}
+	return members
+}
+
+func (ms *memoryStore) GetEntry(table, id string) ([]byte, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	data, ok := ms.tables[table][id]
+	if !ok {
+		return nil, errNotFound
+	}
+	return data, nil
+}
+
+func (ms *memoryStore) PutEntry(table, id string, data []byte) error {
+	ms.Lock()
+	defer ms.Unlock()
+	if ms.tables[table] == nil {
+		ms.tables[table] = make(map[string][]byte)
+	}
+	ms.tables[table][id] = append([]byte(nil), data...)
+	return nil
+}
+
+func (ms *memoryStore) DeleteEntries(table string, ids ...string) (int64, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	entries := ms.tables[table]
+	if len(ids) == 0 {
+		delete(ms.tables, table)
+		return int64(len(entries)), nil
+	}
+	var removed int64
+	for _, id := range ids {
+		if _, ok := entries[id]; ok {
+			delete(entries, id)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+//ScanEntries pages through the ids of the table in order, the cursor is the last id of the page before
+func (ms *memoryStore) ScanEntries(table, cursor string, count int) ([]Entry, string, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	ids := make([]string, 0, len(ms.tables[table]))
+	for id := range ms.tables[table] {
+		if id > cursor {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	next := ""
+	if len(ids) > count {
+		ids = ids[:count]
+		next = ids[count-1]
+	}
+	entries := make([]Entry, len(ids))
+	for i, id := range ids {
+		entries[i] = Entry{ID: id, Data: ms.tables[table][id]}
+	}
+	return entries, next, nil
+}
+
+func (ms *memoryStore) CountEntries(table string) (int64, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	return int64(len(ms.tables[table])), nil
+}
+
+func (ms *memoryStore) AppendLog(name string, entry []byte, max int) error {
+	ms.Lock()
+	defer ms.Unlock()
+	entries := append([][]byte{append([]byte(nil), entry...)}, ms.logs[name]...)
+	if len(entries) > max {
+		entries = entries[:max]
+	}
+	ms.logs[name] = entries
+	return nil
+}
+
+func (ms *memoryStore) ReadLog(name string, count int) ([][]byte, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	entries := ms.logs[name]
+	if len(entries) > count {
+		entries = entries[:count]
+	}
+	return append([][]byte(nil), entries...), nil
+}
+
+func (ms *memoryStore) DeleteLog(name string) error {
+	ms.Lock()
+	defer ms.Unlock()
+	delete(ms.logs, name)
+	return nil
+}
+
+func (ms *memoryStore) Ping() error {
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis"
+)
+
+//migratedKey set once every device pub-hub tracked has been migrated, later startups skip the migration
+const migratedKey = "migrations/group-keys"
+
+//moveScript rename a key unless something already lives under the new name. KEYS old, new.
+//Returns 1 when moved, 0 when there was nothing to move and -1 when the new key is taken
+var moveScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+if redis.call('EXISTS', KEYS[2]) == 1 then
+	return -1
+end
+redis.call('RENAME', KEYS[1], KEYS[2])
+return 1
+`)
+
+//legacyTarget the group scoped key of a key from before configs were namespaced by group. Legacy keys were
+//<device>/<config>, <device>/<config>/revision, <device>/<config>/reported and revisions/<device>/<config>
+func legacyTarget(group, device, key string) (string, bool) {
+	if strings.HasPrefix(key, revisionsPrefix+device+"/") {
+		config := key[len(revisionsPrefix+device+"/"):]
+		if config == "" || strings.Contains(config, "/") {
+			return "", false
+		}
+		return revisionsKey(group, device, config), true
+	}
+	parts := strings.Split(strings.TrimPrefix(key, device+"/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] != "":
+		return configKey(group, device, parts[0]), true
+	case len(parts) == 2 && (parts[1] == revisionSuffix[1:] || parts[1] == reportedSuffix[1:]):
+		return configKey(group, device, parts[0]) + "/" + parts[1], true
+	}
+	return "", false
+}
+
+//globEscape quote the characters redis treats as a pattern in a key, so a device id with them only
+//matches its own keys
+func globEscape(key string) string {
+	var b strings.Builder
+	for _, r := range key {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+//scanKeys every key matching the pattern
+func scanKeys(pattern string) ([]string, error) {
+	found := make([]string, 0)
+	var cursor uint64
+	for {
+		keys, next, err := rc.Scan(cursor, pattern, 100).Result()
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, keys...)
+		cursor = next
+		if cursor == 0 {
+			return found, nil
+		}
+	}
+}
+
+//MigrateDevice move the legacy keys of a device under its group, returns how many were moved
+func MigrateDevice(group, device string) (int, error) {
+	keys, err := scanKeys(globEscape(device) + "/*")
+	if err != nil {
+		return 0, err
+	}
+	revisions, err := scanKeys(revisionsPrefix + globEscape(device) + "/*")
+	if err != nil {
+		return 0, err
+	}
+	moved := 0
+	for _, key := range append(keys, revisions...) {
+		target, ok := legacyTarget(group, device, key)
+		if !ok {
+			continue
+		}
+		res, err := moveScript.Run(rc, []string{key, target}).Int()
+		if err != nil {
+			return moved, err
+		}
+		switch res {
+		case 1:
+			moved++
+		case -1:
+			log.Warnf("not migrating %v, %v already exists", key, target)
+		}
+	}
+	if moved > 0 {
+		log.Infof("migrated %d keys of %v into group %v", moved, device, group)
+	}
+	return moved, nil
+}
+
+//legacyGroups the hashtables pub-hub has kept the devices of every group in since before configs were
+//namespaced by group. They're named after the group itself, so they're the hashes without a / other than
+//the ones with a reserved name such as devicetypes
+func legacyGroups() ([]string, error) {
+	keys, err := scanKeys("*")
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]string, 0)
+	for _, key := range keys {
+		if strings.Contains(key, "/") || reservedGroups[key] {
+			continue
+		}
+		kind, err := rc.Type(key).Result()
+		if err != nil {
+			return nil, err
+		}
+		if kind == "hash" {
+			groups = append(groups, key)
+		}
+	}
+	return groups, nil
+}
+
+//MigrateKeys move the legacy keys of every device pub-hub tracks under the device's group. A device id
+//tracked in more than one group is ambiguous and left for an admin to migrate by hand. Once every device
+//is done that's recorded and later startups don't scan again
+func MigrateKeys() {
+	if done, err := rc.Exists(migratedKey).Result(); err != nil {
+		log.Error(err)
+		return
+	} else if done == 1 {
+		return
+	}
+	in, err := legacyGroups()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	groups := make(map[string][]string)
+	for _, group := range in {
+		devices, err := rc.HKeys(group).Result()
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		for _, device := range devices {
+			groups[device] = append(groups[device], group)
+		}
+	}
+	failed := false
+	for device, in := range groups {
+		if len(in) > 1 {
+			log.Warnf("device %v is tracked in groups %v, migrate it with /admin/migrate", device, in)
+			continue
+		}
+		if _, err := MigrateDevice(in[0], device); err != nil {
+			log.Error(err)
+			failed = true
+		}
+	}
+	if failed {
+		return //Tried again on the next startup
+	}
+	if err := rc.Set(migratedKey, strconv.FormatInt(time.Now().Unix(), 10), 0).Err(); err != nil {
+		log.Error(err)
+	}
+}
+
+//PostMigrate move the legacy keys of a device under the group in the path
+func PostMigrate(c *gin.Context) {
+	if storage != storageRedis {
+		c.JSON(http.StatusConflict, gin.H{"error": "only redis storage has keys to migrate"})
+		return
+	}
+	moved, err := MigrateDevice(c.Param("group"), c.Param("deviceid"))
+	if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error(), "moved": moved})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "migrated", "moved": moved})
+}
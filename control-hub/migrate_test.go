@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+)
+
+func TestMigrateKeys(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	rc = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	mr.HSet("home", "smoker", `{"device":"smoker"}`)
+	mr.HSet("home", "smok*", `{"device":"smok*"}`)
+	mr.HSet("shared", "twin", `{"device":"twin"}`)
+	mr.HSet("other", "twin", `{"device":"twin"}`)
+	for _, key := range []string{"smoker/configs", "smoker/configs/revision", "smok*/configs", "twin/configs", "pismoker/configs"} {
+		mr.Set(key, key)
+	}
+	mr.HSet(revisionsPrefix+"smoker/configs", "1", "r1")
+	mr.HSet(deviceTypesKey, "pismoker", `{"name":"pismoker"}`)
+
+	MigrateKeys()
+	for key, val := range map[string]string{"home/smoker/configs": "smoker/configs", "home/smoker/configs/revision": "smoker/configs/revision", "home/smok*/configs": "smok*/configs", "twin/configs": "twin/configs"} {
+		if got, err := mr.Get(key); err != nil || got != val {
+			t.Fatalf("%v: %v %v", key, got, err)
+		}
+	}
+	if !mr.Exists(revisionsPrefix+"home/smoker/configs") || mr.Exists("smoker/configs") {
+		t.Fatal("legacy keys of smoker weren't moved")
+	}
+	if mr.Exists(deviceTypesKey+"/pismoker/configs") || !mr.Exists("pismoker/configs") {
+		t.Fatal("the device types hash was migrated as a group")
+	}
+	if !mr.Exists(migratedKey) {
+		t.Fatal("migration wasn't recorded")
+	}
+
+	mr.Set("smoker/configs", "again")
+	MigrateKeys()
+	if got, _ := mr.Get("smoker/configs"); got != "again" {
+		t.Fatal("migration ran again after it was recorded")
+	}
+}
+
+func TestGlobEscape(t *testing.T) {
+	for key, want := range map[string]string{"smoker": "smoker", "smok*": `smok\*`, "a?b": `a\?b`, "[x]": `\[x\]`, `a\b`: `a\\b`} {
+		if got := globEscape(key); got != want {
+			t.Fatalf("%v: %v", key, got)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+//DeviceSource what pub-hub keeps about the devices of a group, read for the device listing, bulk operations and
+//device credentials
+type DeviceSource interface {
+	//ScanDevices the entries of the devices of a group a batch at a time, "" starts the scan and the returned
+	//cursor is "" once it's done
+	ScanDevices(group, cursor string, count int) ([]Entry, string, error)
+	//CountDevices how many devices a group has
+	CountDevices(group string) (int64, error)
+	//VerifyCredential whether the secret is the credential pub-hub issued the device
+	VerifyCredential(group, device, secret string) (bool, error)
+}
+
+//sharedDevices reads pub-hub's keys straight out of the redis both share, the group hashtable and
+//credentials/<group>
+type sharedDevices struct{}
+
+func (sharedDevices) ScanDevices(group, cursor string, count int) ([]Entry, string, error) {
+	return store.ScanEntries(group, cursor, count)
+}
+
+func (sharedDevices) CountDevices(group string) (int64, error) {
+	return store.CountEntries(group)
+}
+
+func (sharedDevices) VerifyCredential(group, device, secret string) (bool, error) {
+	val, err := store.GetEntry(credentialPrefix+group, device)
+	if err == errNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	var cred struct {
+		Secret string `json:"secret"`
+	}
+	if err := json.Unmarshal(val, &cred); err != nil {
+		return false, err
+	}
+	return cred.Secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(cred.Secret)) == 1, nil
+}
+
+//pubHubClient asks the admin api of pub-hub, for when pub-hub keeps its devices somewhere control-hub can't read
+type pubHubClient struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func newPubHubClient(base, token string) *pubHubClient {
+	return &pubHubClient{url: base, token: token, client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+//do send a request to the admin api of pub-hub and decode the answer into out
+func (ph *pubHubClient) do(method, path string, body, out interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, ph.url+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+ph.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := ph.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("pub-hub answered " + resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (ph *pubHubClient) ScanDevices(group, cursor string, count int) ([]Entry, string, error) {
+	query := url.Values{"limit": {strconv.Itoa(count)}}
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+	var page struct {
+		Devices []struct {
+			Device string          `json:"device"`
+			Entry  json.RawMessage `json:"entry"`
+		} `json:"devices"`
+		NextCursor string `json:"next_cursor"`
+	}
+	if err := ph.do(http.MethodGet, "/admin/devices/"+url.PathEscape(group)+"?"+query.Encode(), nil, &page); err != nil {
+		return nil, "", err
+	}
+	entries := make([]Entry, len(page.Devices))
+	for i, device := range page.Devices {
+		entries[i] = Entry{ID: device.Device, Data: device.Entry}
+	}
+	return entries, page.NextCursor, nil
+}
+
+func (ph *pubHubClient) CountDevices(group string) (int64, error) {
+	var count struct {
+		Total int64 `json:"total"`
+	}
+	err := ph.do(http.MethodGet, "/admin/devices/"+url.PathEscape(group)+"/count", nil, &count)
+	return count.Total, err
+}
+
+func (ph *pubHubClient) VerifyCredential(group, device, secret string) (bool, error) {
+	var res struct {
+		Valid bool `json:"valid"`
+	}
+	path := "/admin/credentials/" + url.PathEscape(group) + "/" + url.PathEscape(device) + "/verify"
+	err := ph.do(http.MethodPost, path, map[string]string{"secret": secret}, &res)
+	return res.Valid, err
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+//fakePubHub the admin api of pub-hub over a group of 5 devices, in pages of at most 2
+func fakePubHub(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/devices/patio", func(w http.ResponseWriter, r *http.Request) {
+		start, _ := strconv.Atoi(r.URL.Query().Get("cursor"))
+		page := make(map[string]interface{})
+		devices := make([]map[string]interface{}, 0)
+		for i := start; i < start+2 && i < 5; i++ {
+			name := "smoker" + strconv.Itoa(i)
+			devices = append(devices, map[string]interface{}{"device": name, "entry": DeviceStatus{Device: name, Presence: "online"}})
+		}
+		page["devices"] = devices
+		if start+2 < 5 {
+			page["next_cursor"] = strconv.Itoa(start + 2)
+		}
+		json.NewEncoder(w).Encode(page)
+	})
+	mux.HandleFunc("/admin/devices/patio/count", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]int64{"total": 5})
+	})
+	mux.HandleFunc("/admin/credentials/patio/smoker0/verify", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Secret string `json:"secret"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		json.NewEncoder(w).Encode(map[string]bool{"valid": req.Secret == "secret"})
+	})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer pub-hub-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestPubHubClient(t *testing.T) {
+	srv := fakePubHub(t)
+	saved := pubHub
+	defer func() { pubHub = saved }()
+	pubHub = newPubHubClient(srv.URL, "pub-hub-token")
+
+	devices, err := allDevices("patio", &DeviceFilter{})
+	if err != nil || len(devices) != 5 || devices[4].Device != "smoker4" || devices[0].Presence != "online" {
+		t.Fatalf("devices through pub-hub: %+v %v", devices, err)
+	}
+	names, err := groupDevices("patio")
+	if err != nil || len(names) != 5 {
+		t.Fatalf("group devices through pub-hub: %v %v", names, err)
+	}
+	if total, err := pubHub.CountDevices("patio"); err != nil || total != 5 {
+		t.Fatalf("device count through pub-hub: %v %v", total, err)
+	}
+	for secret, want := range map[string]bool{"secret": true, "wrong": false} {
+		if ok, err := deviceCredential("patio", "smoker0", secret); err != nil || ok != want {
+			t.Fatalf("credential %q through pub-hub: %v %v", secret, ok, err)
+		}
+	}
+
+	pubHub = newPubHubClient(srv.URL, "wrong")
+	if _, err := deviceCredential("patio", "smoker0", "secret"); err == nil {
+		t.Fatal("pub-hub refusing the admin token didn't fail the lookup")
+	}
+}
+
+func TestSharedDevices(t *testing.T) {
+	saved, savedStore := pubHub, store
+	defer func() { pubHub, store = saved, savedStore }()
+	pubHub, store = sharedDevices{}, newMemoryStore()
+
+	status, _ := json.Marshal(DeviceStatus{Device: "smoker", Presence: "online"})
+	if err := store.PutEntry("shared", "smoker", status); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutEntry(credentialPrefix+"shared", "smoker", []byte(`{"secret":"secret"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if devices, err := allDevices("shared", &DeviceFilter{}); err != nil || len(devices) != 1 {
+		t.Fatalf("devices from the shared store: %+v %v", devices, err)
+	}
+	for _, tc := range []struct {
+		device, secret string
+		want           bool
+	}{{"smoker", "secret", true}, {"smoker", "wrong", false}, {"other", "secret", false}} {
+		if ok, err := deviceCredential("shared", tc.device, tc.secret); err != nil || ok != tc.want {
+			t.Fatalf("credential of %v %q from the shared store: %v %v", tc.device, tc.secret, ok, err)
+		}
+	}
+}
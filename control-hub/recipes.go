@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	recipesPrefix = "recipes/"
+	recipeConfig  = "configs"
+	yamlType      = "application/yaml"
+)
+
+var errRecipeNotFound = errors.New("recipe not found")
+
+//Recipe a cook profile that can be applied to a device. Temperatures are °F like the configs they turn into
+type Recipe struct {
+	Name        string             `json:"name" yaml:"name"`
+	Description string             `json:"description,omitempty" yaml:"description,omitempty"`
+	Steps       []RecipeStep       `json:"steps" yaml:"steps"`
+	Probes      map[string]float64 `json:"probes,omitempty" yaml:"probes,omitempty"`
+	Alarms      *Alarms            `json:"alarms,omitempty" yaml:"alarms,omitempty"`
+	Author      string             `json:"author,omitempty" yaml:"author,omitempty"`
+	Updated     int64              `json:"updated,omitempty" yaml:"updated,omitempty"`
+}
+
+//RecipeStep hold the pit at a setpoint until a probe reaches its target or for a number of minutes
+type RecipeStep struct {
+	Name     string  `json:"name" yaml:"name"`
+	Setpoint float64 `json:"setpoint" yaml:"setpoint"`
+	Probe    string  `json:"probe,omitempty" yaml:"probe,omitempty"`
+	Target   float64 `json:"target,omitempty" yaml:"target,omitempty"`
+	Minutes  int     `json:"minutes,omitempty" yaml:"minutes,omitempty"`
+}
+
+//StepChange published to the steps channel of a device when it moves on to a step of the recipe it's running,
+//done once the last step is over
+type StepChange struct {
+	Recipe    string  `json:"recipe"`
+	Step      int     `json:"step"`
+	Name      string  `json:"name,omitempty"`
+	Setpoint  float64 `json:"setpoint,omitempty"`
+	Done      bool    `json:"done,omitempty"`
+	Timestamp int64   `json:"timestamp"`
+}
+
+//Alarms thresholds the pit should stay between
+type Alarms struct {
+	PitHigh float64 `json:"pit_high,omitempty" yaml:"pit_high,omitempty"`
+	PitLow  float64 `json:"pit_low,omitempty" yaml:"pit_low,omitempty"`
+}
+
+func recipesKey(group, owner string) string {
+	return recipesPrefix + group + "/" + owner
+}
+
+//recipeOwner whose recipes a request works on, every user keeps their own in each group and shares them by
+//exporting and importing
+func recipeOwner(c *gin.Context) string {
+	if val, ok := c.Get(identityKey); ok {
+		if identity := val.(*Identity); identity.Sub != "" {
+			return identity.Sub
+		}
+	}
+	return author(c, "")
+}
+
+//Validate check a recipe makes sense before it's stored
+func (r *Recipe) Validate() error {
+	if r.Name == "" || strings.Contains(r.Name, "/") {
+		return errors.New("recipe needs a name without slashes")
+	}
+	if len(r.Steps) == 0 {
+		return errors.New("recipe needs at least one step")
+	}
+	for i, step := range r.Steps {
+		if step.Setpoint <= 0 {
+			return fmt.Errorf("step %d: setpoint must be above 0", i)
+		}
+		if (step.Probe == "") != (step.Target == 0) {
+			return fmt.Errorf("step %d: probe and target go together", i)
+		}
+		if step.Minutes < 0 {
+			return fmt.Errorf("step %d: minutes can't be negative", i)
+		}
+	}
+	for probe := range r.Probes {
+		if probe == "" {
+			return errors.New("probe targets need a probe name")
+		}
+	}
+	if r.Alarms != nil && r.Alarms.PitLow > 0 && r.Alarms.PitHigh > 0 && r.Alarms.PitLow >= r.Alarms.PitHigh {
+		return errors.New("alarms: pit_low must be below pit_high")
+	}
+	return nil
+}
+
+//Config the device config a recipe turns into, the device is switched on at the setpoint of the first step
+//and the recipe rides along with the step it's on for control-hub to run the steps and alarms
+func (r *Recipe) Config(started int64) ([]byte, error) {
+	recipe := *r
+	recipe.Author, recipe.Updated = "", 0
+	return json.Marshal(map[string]interface{}{
+		"pwr":          true,
+		"temp":         r.Steps[0].Setpoint,
+		"recipe":       &recipe,
+		"recipe_step":  0,
+		"step_started": started,
+	})
+}
+
+//isYAML whether a content type names YAML, there's no registered type so all the usual ones are accepted
+func isYAML(contentType string) bool {
+	switch contentType {
+	case yamlType, "application/x-yaml", "text/yaml", "text/x-yaml":
+		return true
+	}
+	return false
+}
+
+//wantsYAML whether the caller asked for YAML with ?format=yaml or its Accept header
+func wantsYAML(c *gin.Context) bool {
+	if format := c.Query("format"); format != "" {
+		return strings.EqualFold(format, "yaml")
+	}
+	for _, part := range strings.Split(c.GetHeader("Accept"), ",") {
+		if isYAML(strings.TrimSpace(strings.SplitN(part, ";", 2)[0])) {
+			return true
+		}
+	}
+	return false
+}
+
+//render answer in YAML or JSON, whichever the caller asked for
+func render(c *gin.Context, code int, val interface{}) {
+	if wantsYAML(c) {
+		data, err := yaml.Marshal(val)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Data(code, yamlType, data)
+		return
+	}
+	c.JSON(code, val)
+}
+
+//bind decode a JSON or YAML body into val
+func bind(c *gin.Context, val interface{}) error {
+	body, err := c.GetRawData()
+	if err != nil {
+		return err
+	}
+	if isYAML(c.ContentType()) {
+		return yaml.UnmarshalStrict(body, val)
+	}
+	return json.Unmarshal(body, val)
+}
+
+func loadRecipes(group, owner string) ([]Recipe, error) {
+	entries, err := allEntries(recipesKey(group, owner))
+	if err != nil {
+		return nil, err
+	}
+	recipes := make([]Recipe, 0, len(entries))
+	for _, entry := range entries {
+		var r Recipe
+		if err := json.Unmarshal(entry.Data, &r); err != nil {
+			log.Error(err)
+			continue
+		}
+		recipes = append(recipes, r)
+	}
+	sort.Slice(recipes, func(i, j int) bool {
+		return recipes[i].Name < recipes[j].Name
+	})
+	return recipes, nil
+}
+
+func loadRecipe(group, owner, name string) (*Recipe, error) {
+	val, err := store.GetEntry(recipesKey(group, owner), name)
+	if err == errNotFound {
+		return nil, errRecipeNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var r Recipe
+	if err := json.Unmarshal(val, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+//storeRecipe validate and save a recipe, replacing one of the same name
+func storeRecipe(c *gin.Context, group string, r *Recipe) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	r.Author = author(c, r.Author)
+	r.Updated = time.Now().Unix()
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	owner := recipeOwner(c)
+	before, err := loadRecipe(group, owner, r.Name)
+	if err != nil && err != errRecipeNotFound {
+		return err
+	}
+	if err := store.PutEntry(recipesKey(group, owner), r.Name, data); err != nil {
+		return err
+	}
+	if before == nil {
+		AuditChange(c, group, "", resourceRecipe, actionCreate, nil, r)
+	} else {
+		AuditChange(c, group, "", resourceRecipe, actionUpdate, before, r)
+	}
+	return nil
+}
+
+//GetRecipes export every recipe the caller keeps in a group
+func GetRecipes(c *gin.Context) {
+	recipes, err := loadRecipes(c.Param("group"), recipeOwner(c))
+	if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	render(c, http.StatusOK, recipes)
+}
+
+//GetRecipe export a single recipe
+func GetRecipe(c *gin.Context) {
+	r, err := loadRecipe(c.Param("group"), recipeOwner(c), c.Param("name"))
+	if err == errRecipeNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	render(c, http.StatusOK, r)
+}
+
+//PutRecipe save a recipe under the name in the path
+func PutRecipe(c *gin.Context) {
+	var r Recipe
+	if err := bind(c, &r); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	r.Name = c.Param("name")
+	if err := storeRecipe(c, c.Param("group"), &r); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	render(c, http.StatusOK, &r)
+}
+
+//PostRecipes import a list of recipes, say one exported from another group. Each is saved on its own and
+//the outcome reported by name
+func PostRecipes(c *gin.Context) {
+	var recipes []Recipe
+	if err := bind(c, &recipes); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	results := make([]gin.H, 0, len(recipes))
+	failed := 0
+	for i := range recipes {
+		if err := storeRecipe(c, c.Param("group"), &recipes[i]); err != nil {
+			failed++
+			results = append(results, gin.H{"name": recipes[i].Name, "status": "rejected", "error": err.Error()})
+			continue
+		}
+		results = append(results, gin.H{"name": recipes[i].Name, "status": "imported"})
+	}
+	c.JSON(http.StatusOK, gin.H{"imported": len(recipes) - failed, "failed": failed, "results": results})
+}
+
+//DeleteRecipe remove a recipe
+func DeleteRecipe(c *gin.Context) {
+	group, owner := c.Param("group"), recipeOwner(c)
+	before, err := loadRecipe(group, owner, c.Param("name"))
+	if err == errRecipeNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	removed, err := store.DeleteEntries(recipesKey(group, owner), c.Param("name"))
+	if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	if removed == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": errRecipeNotFound.Error()})
+		return
+	}
+	AuditChange(c, group, "", resourceRecipe, actionDelete, before, nil)
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
+//PostApplyRecipe turn a recipe into the config of a device, written as a new revision like any other.
+//Honors If-Match and the device type
+func PostApplyRecipe(c *gin.Context) {
+	group := c.Param("group")
+	device := c.Param("deviceid")
+	r, err := loadRecipe(group, recipeOwner(c), c.Param("name"))
+	if err == errRecipeNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	data, err := r.Config(time.Now().Unix())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	config := c.DefaultQuery("config", recipeConfig)
+	if err := types.Validate(group, device, config, data); err != nil {
+		validationResponse(c, err)
+		return
+	}
+	var msg Message
+	c.ShouldBindJSON(&msg) //Body is optional, it only names the author
+	revision := &Revision{Author: author(c, msg.Author), Action: actionRecipe, Source: sourceHTTP, Actor: actor(c), Config: data}
+	rev, err := WriteConfig(group, device, config, revision, ifMatch(c))
+	if err == nil {
+		log.Infof("applied recipe %v to %v", r.Name, configKey(group, device, config))
+		step := &StepChange{Recipe: r.Name, Name: r.Steps[0].Name, Setpoint: r.Steps[0].Setpoint, Timestamp: revision.Timestamp}
+		if err := publishDeviceEvent(group, device, stepsChannel, step); err != nil {
+			log.Errorf("unable to publish the first step of %v to %v: %v", r.Name, configKey(group, device, config), err)
+		}
+	}
+	writeResponse(c, rev, err)
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/go-redis/redis"
+)
+
+//writeScript store a config as the next revision if the current revision is the one the writer saw.
+//KEYS config, revision counter, revisions hash. ARGV expected revision or "" for any, config, revision
+//entry without its number, max revisions kept. Returns {1, new revision, config before} or {0, current revision}
+var writeScript = redis.NewScript(`
+local current = tonumber(redis.call('GET', KEYS[2]) or '0')
+if ARGV[1] ~= '' and tonumber(ARGV[1]) ~= current then
+	return {0, current}
+end
+local rev = current + 1
+local before = redis.call('GET', KEYS[1])
+redis.call('SET', KEYS[1], ARGV[2])
+redis.call('SET', KEYS[2], rev)
+redis.call('HSET', KEYS[3], rev, '{"revision":' .. rev .. ',' .. string.sub(ARGV[3], 2))
+local expired = rev - tonumber(ARGV[4])
+if expired > 0 then
+	redis.call('HDEL', KEYS[3], expired)
+end
+return {1, rev, before}
+`)
+
+//updateScript write back a schedule after it ran unless it was cancelled in the meantime, recurring
+//schedules go back on the due set and finished ones leave it. KEYS schedules hash, due set. ARGV id, entry,
+//due member, next run or 0
+var updateScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+if tonumber(ARGV[4]) > 0 then
+	redis.call('ZADD', KEYS[2], ARGV[4], ARGV[3])
+else
+	redis.call('ZREM', KEYS[2], ARGV[3])
+end
+return 1
+`)
+
+//claimScript lease the due members of the due set by moving their run to the end of the lease.
+//KEYS due set. ARGV now, end of the lease, count
+var claimScript = redis.NewScript(`
+local members = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[3])
+for _, member in ipairs(members) do
+	redis.call('ZADD', KEYS[1], ARGV[2], member)
+end
+return members
+`)
+
+//recordRetries how often an update of a device record is retried after losing a race
+const recordRetries = 5
+
+//redisStore keeps configs under the keys described in the README, shared by every replica
+type redisStore struct {
+	rc *redis.Client
+}
+
+func (rs *redisStore) ReadConfig(group, device, config string) ([]byte, uint64, error) {
+	vals, err := rs.rc.MGet(configKey(group, device, config), revisionKey(group, device, config)).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	data, ok := vals[0].(string)
+	if !ok {
+		return nil, 0, errNotFound
+	}
+	var rev uint64
+	if val, ok := vals[1].(string); ok {
+		rev, _ = strconv.ParseUint(val, 10, 64)
+	}
+	return []byte(data), rev, nil
+}
+
+func (rs *redisStore) WriteConfig(group, device, config string, entry *Revision, expected string) (uint64, []byte, error) {
+	data, err := json.Marshal(numbered(entry, 0)) //Numbered by the script
+	if err != nil {
+		return 0, nil, err
+	}
+	keys := []string{configKey(group, device, config), revisionKey(group, device, config), revisionsKey(group, device, config)}
+	res, err := writeScript.Run(rs.rc, keys, expected, string(entry.Config), string(data), maxRevisions).Result()
+	if err != nil {
+		return 0, nil, err
+	}
+	vals, ok := res.([]interface{})
+	if !ok || len(vals) < 2 {
+		return 0, nil, errors.New("unexpected reply from write script")
+	}
+	written, _ := vals[0].(int64)
+	rev, _ := vals[1].(int64)
+	if written == 0 {
+		return 0, nil, &ConflictError{Current: uint64(rev)}
+	}
+	var before []byte
+	if len(vals) > 2 {
+		if val, ok := vals[2].(string); ok {
+			before = []byte(val)
+		}
+	}
+	return uint64(rev), before, nil
+}
+
+func (rs *redisStore) GetRevision(group, device, config string, rev uint64) (*Revision, error) {
+	val, err := rs.rc.HGet(revisionsKey(group, device, config), strconv.FormatUint(rev, 10)).Result()
+	if err == redis.Nil {
+		return nil, errRevisionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var revision Revision
+	if err := json.Unmarshal([]byte(val), &revision); err != nil {
+		return nil, err
+	}
+	return &revision, nil
+}
+
+func (rs *redisStore) ListRevisions(group, device, config string) ([]Revision, error) {
+	vals, err := rs.rc.HGetAll(revisionsKey(group, device, config)).Result()
+	if err != nil {
+		return nil, err
+	}
+	revisions := make([]Revision, 0, len(vals))
+	for _, val := range vals {
+		var revision Revision
+		if err := json.Unmarshal([]byte(val), &revision); err != nil {
+			log.Error(err)
+			continue
+		}
+		revisions = append(revisions, revision)
+	}
+	return revisions, nil
+}
+
+func (rs *redisStore) ReadReported(group, device, config string) (*Reported, error) {
+	val, err := rs.rc.Get(reportedKey(group, device, config)).Bytes()
+	if err == redis.Nil {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var reported Reported
+	if err := json.Unmarshal(val, &reported); err != nil {
+		return nil, err
+	}
+	return &reported, nil
+}
+
+func (rs *redisStore) WriteReported(group, device, config string, reported *Reported) error {
+	data, err := json.Marshal(reported)
+	if err != nil {
+		return err
+	}
+	return rs.rc.Set(reportedKey(group, device, config), data, 0).Err()
+}
+
+func (rs *redisStore) ReadDeviceRecord(group, device string) (*DeviceRecord, error) {
+	return readDeviceRecord(rs.rc, group, device)
+}
+
+//readDeviceRecord the record of a device through a client or the transaction watching it
+func readDeviceRecord(cmd redis.Cmdable, group, device string) (*DeviceRecord, error) {
+	val, err := cmd.HGet(registryKey(group), device).Bytes()
+	if err == redis.Nil {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var record DeviceRecord
+	if err := json.Unmarshal(val, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func (rs *redisStore) ListDeviceRecords(group string) ([]DeviceRecord, error) {
+	vals, err := rs.rc.HVals(registryKey(group)).Result()
+	if err != nil {
+		return nil, err
+	}
+	records := make([]DeviceRecord, 0, len(vals))
+	for _, val := range vals {
+		var record DeviceRecord
+		if err := json.Unmarshal([]byte(val), &record); err != nil {
+			log.Error(err)
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+//UpdateDeviceRecord watches the registry of the group so a concurrent update makes the transaction fail
+//and the update run again on the record that won
+func (rs *redisStore) UpdateDeviceRecord(group, device string, update func(*DeviceRecord) (*DeviceRecord, error)) (*DeviceRecord, error) {
+	key := registryKey(group)
+	var updated *DeviceRecord
+	txf := func(tx *redis.Tx) error {
+		current, err := readDeviceRecord(tx, group, device)
+		if err == errNotFound {
+			current = nil
+		} else if err != nil {
+			return err
+		}
+		if updated, err = update(current); err != nil {
+			return err
+		}
+		data, err := json.Marshal(updated)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.HSet(key, device, string(data))
+			return nil
+		})
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		err := rs.rc.Watch(txf, key)
+		if err == redis.TxFailedErr && attempt < recordRetries {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return updated, nil
+	}
+}
+
+func (rs *redisStore) DeleteDeviceRecord(group, device string) (bool, error) {
+	removed, err := rs.rc.HDel(registryKey(group), device).Result()
+	return removed > 0, err
+}
+
+func (rs *redisStore) GetSchedule(group, device, id string) (*Schedule, error) {
+	val, err := rs.rc.HGet(schedulesKey(group, device), id).Bytes()
+	if err == redis.Nil {
+		return nil, errScheduleNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var s Schedule
+	if err := json.Unmarshal(val, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (rs *redisStore) ListSchedules(group, device string) ([]Schedule, error) {
+	vals, err := rs.rc.HVals(schedulesKey(group, device)).Result()
+	if err != nil {
+		return nil, err
+	}
+	schedules := make([]Schedule, 0, len(vals))
+	for _, val := range vals {
+		var s Schedule
+		if err := json.Unmarshal([]byte(val), &s); err != nil {
+			log.Error(err)
+			continue
+		}
+		schedules = append(schedules, s)
+	}
+	return schedules, nil
+}
+
+func (rs *redisStore) PutSchedule(s *Schedule) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	pipe := rs.rc.TxPipeline()
+	pipe.HSet(schedulesKey(s.Group, s.Device), s.ID, string(data))
+	pipe.ZAdd(schedulesDueKey, redis.Z{Score: float64(s.NextRun), Member: dueMember(s.Group, s.Device, s.ID)})
+	_, err = pipe.Exec()
+	return err
+}
+
+func (rs *redisStore) UpdateSchedule(s *Schedule) (bool, error) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return false, err
+	}
+	keys := []string{schedulesKey(s.Group, s.Device), schedulesDueKey}
+	updated, err := updateScript.Run(rs.rc, keys, s.ID, string(data), dueMember(s.Group, s.Device, s.ID), s.NextRun).Int()
+	return updated == 1, err
+}
+
+func (rs *redisStore) DeleteSchedule(group, device, id string) (bool, error) {
+	pipe := rs.rc.TxPipeline()
+	removed := pipe.HDel(schedulesKey(group, device), id)
+	pipe.ZRem(schedulesDueKey, dueMember(group, device, id))
+	if _, err := pipe.Exec(); err != nil {
+		return false, err
+	}
+	return removed.Val() > 0, nil
+}
+
+func (rs *redisStore) ClaimSchedules(now, until int64, count int) ([]string, error) {
+	vals, err := claimScript.Run(rs.rc, []string{schedulesDueKey}, now, until, count).Result()
+	if err == redis.Nil {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	raw, _ := vals.([]interface{})
+	members := make([]string, 0, len(raw))
+	for _, val := range raw {
+		if member, ok := val.(string); ok {
+			members = append(members, member)
+		}
+	}
+	return members, nil
+}
+
+func (rs *redisStore) GetEntry(table, id string) ([]byte, error) {
+	val, err := rs.rc.HGet(table, id).Bytes()
+	if err == redis.Nil {
+		return nil, errNotFound
+	}
+	return val, err
+}
+
+func (rs *redisStore) PutEntry(table, id string, data []byte) error {
+	return rs.rc.HSet(table, id, string(data)).Err()
+}
+
+func (rs *redisStore) DeleteEntries(table string, ids ...string) (int64, error) {
+	if len(ids) > 0 {
+		return rs.rc.HDel(table, ids...).Result()
+	}
+	pipe := rs.rc.TxPipeline()
+	count := pipe.HLen(table)
+	pipe.Del(table)
+	if _, err := pipe.Exec(); err != nil {
+		return 0, err
+	}
+	return count.Val(), nil
+}
+
+//ScanEntries resumes the HSCAN of the table, its cursor is the one redis handed out
+func (rs *redisStore) ScanEntries(table, cursor string, count int) ([]Entry, string, error) {
+	var scan uint64
+	if cursor != "" {
+		var err error
+		if scan, err = strconv.ParseUint(cursor, 10, 64); err != nil {
+			return nil, "", errBadCursor
+		}
+	}
+	vals, next, err := rs.rc.HScan(table, scan, "", int64(count)).Result()
+	if err != nil {
+		return nil, "", err
+	}
+	entries := make([]Entry, 0, len(vals)/2)
+	for i := 1; i < len(vals); i += 2 {
+		entries = append(entries, Entry{ID: vals[i-1], Data: []byte(vals[i])})
+	}
+	if next == 0 {
+		return entries, "", nil
+	}
+	return entries, strconv.FormatUint(next, 10), nil
+}
+
+func (rs *redisStore) CountEntries(table string) (int64, error) {
+	return rs.rc.HLen(table).Result()
+}
+
+func (rs *redisStore) AppendLog(name string, entry []byte, max int) error {
+	pipe := rs.rc.TxPipeline()
+	pipe.LPush(name, entry)
+	pipe.LTrim(name, 0, int64(max-1))
+	_, err := pipe.Exec()
+	return err
+}
+
+func (rs *redisStore) ReadLog(name string, count int) ([][]byte, error) {
+	vals, err := rs.rc.LRange(name, 0, int64(count-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([][]byte, len(vals))
+	for i, val := range vals {
+		entries[i] = []byte(val)
+	}
+	return entries, nil
+}
+
+func (rs *redisStore) DeleteLog(name string) error {
+	return rs.rc.Del(name).Err()
+}
+
+func (rs *redisStore) Ping() error {
+	return rs.rc.Ping().Err()
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	registryPrefix  = "registry/"
+	heartbeatSuffix = "/heartbeat"
+)
+
+var (
+	errDeviceRegistered    = errors.New("device is already registered")
+	errDeviceNotRegistered = errors.New("device is not registered")
+)
+
+//DeviceRecord what the registry knows about a device. Type is the device type it's assigned and read only,
+//everything else is set at provisioning, edited through the api or reported by the device in its heartbeat
+type DeviceRecord struct {
+	Device       string        `json:"device"`
+	Group        string        `json:"group"`
+	DisplayName  string        `json:"display_name,omitempty"`
+	Model        string        `json:"model,omitempty"`
+	Type         string        `json:"type,omitempty"`
+	Firmware     string        `json:"firmware,omitempty"`
+	Capabilities *Capabilities `json:"capabilities,omitempty"`
+	Channels     []string      `json:"channels"`
+	Location     string        `json:"location,omitempty"`
+	Tags         []string      `json:"tags"`
+	Created      int64         `json:"created"`
+	Updated      int64         `json:"updated"`
+	LastSeen     int64         `json:"last_seen,omitempty"`
+}
+
+//Capabilities the hardware of a device
+type Capabilities struct {
+	Probes   int    `json:"probes"`
+	Actuator string `json:"actuator,omitempty"`
+}
+
+//Heartbeat what a device says about itself when it checks in, empty fields leave the record alone
+type Heartbeat struct {
+	Model        string        `json:"model"`
+	Firmware     string        `json:"firmware"`
+	Capabilities *Capabilities `json:"capabilities"`
+	Channels     []string      `json:"channels"`
+}
+
+func registryKey(group string) string {
+	return registryPrefix + group
+}
+
+//normalize fill in what the caller doesn't get to set on a record
+func (dr *DeviceRecord) normalize(group, device string, current *DeviceRecord) {
+	dr.Group, dr.Device = group, device
+	dr.Type = ""
+	if dr.Channels == nil {
+		dr.Channels = []string{}
+	}
+	if dr.Tags == nil {
+		dr.Tags = []string{}
+	}
+	dr.Updated = time.Now().Unix()
+	dr.Created = dr.Updated
+	dr.LastSeen = 0
+	if current != nil {
+		dr.Created, dr.LastSeen = current.Created, current.LastSeen
+	}
+}
+
+//Apply update a record with a heartbeat, channels are added to the ones already known
+func (hb *Heartbeat) Apply(record *DeviceRecord) {
+	if hb.Model != "" {
+		record.Model = hb.Model
+	}
+	if hb.Firmware != "" {
+		record.Firmware = hb.Firmware
+	}
+	if hb.Capabilities != nil {
+		record.Capabilities = hb.Capabilities
+	}
+	for _, channel := range hb.Channels {
+		if channel != "" && !hasString(record.Channels, channel) {
+			record.Channels = append(record.Channels, channel)
+		}
+	}
+	record.LastSeen = time.Now().Unix()
+}
+
+func hasString(vals []string, val string) bool {
+	for _, v := range vals {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
+
+//withType a record along with the device type assigned to it
+func withType(record *DeviceRecord) *DeviceRecord {
+	name, err := store.GetEntry(assignmentsKey(record.Group), record.Device)
+	if err == nil {
+		record.Type = string(name)
+	}
+	return record
+}
+
+//assignModel give a device without a type the device type named after its model, so it's validated from the
+//moment it's provisioned or first checks in. A model no device type is named after leaves the device untyped
+func assignModel(c *gin.Context, record *DeviceRecord) error {
+	if record.Model == "" {
+		return nil
+	}
+	if _, err := store.GetEntry(assignmentsKey(record.Group), record.Device); err == nil {
+		return nil //Already assigned, an assignment made through the admin api wins
+	} else if err != errNotFound {
+		return err
+	}
+	if _, err := loadDeviceType(record.Model); err == errTypeNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := store.PutEntry(assignmentsKey(record.Group), record.Device, []byte(record.Model)); err != nil {
+		return err
+	}
+	AuditChange(c, record.Group, record.Device, resourceType, actionAssign, nil, Assignment{Type: record.Model})
+	log.Infof("assigned %v/%v the device type of its model %v", record.Group, record.Device, record.Model)
+	return nil
+}
+
+//auditRecord record a change to the registry, before is nil when the device wasn't registered
+func auditRecord(c *gin.Context, before, after *DeviceRecord) {
+	action := actionUpdate
+	if before == nil {
+		action = actionCreate
+	}
+	AuditChange(c, after.Group, after.Device, resourceRegistry, action, before, after)
+}
+
+//heartbeatChanged whether a heartbeat changed more of a record than when the device was last seen, a device
+//checking in with nothing new isn't audited
+func heartbeatChanged(before, after *DeviceRecord) bool {
+	seen := *before
+	seen.LastSeen = after.LastSeen
+	return !reflect.DeepEqual(&seen, after)
+}
+
+func registryError(c *gin.Context, err error) {
+	switch err {
+	case errNotFound, errDeviceNotRegistered:
+		c.JSON(http.StatusNotFound, gin.H{"error": errDeviceNotRegistered.Error()})
+	case errDeviceRegistered:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	}
+}
+
+//GetRegistry every device registered in a group sorted by device, ?tag= and ?model= narrow it down
+func GetRegistry(c *gin.Context) {
+	records, err := store.ListDeviceRecords(c.Param("group"))
+	if err != nil {
+		registryError(c, err)
+		return
+	}
+	tag, model := c.Query("tag"), c.Query("model")
+	matched := make([]DeviceRecord, 0, len(records))
+	for i := range records {
+		if tag != "" && !hasString(records[i].Tags, tag) {
+			continue
+		}
+		if model != "" && records[i].Model != model {
+			continue
+		}
+		matched = append(matched, *withType(&records[i]))
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].Device < matched[j].Device
+	})
+	c.JSON(http.StatusOK, matched)
+}
+
+//PostRegistry provision a device, the device id comes from the body. A device whose model names a device
+//type is assigned it
+func PostRegistry(c *gin.Context) {
+	var record DeviceRecord
+	if err := c.ShouldBindJSON(&record); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if record.Device == "" || strings.Contains(record.Device, "/") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "device needs an id without slashes"})
+		return
+	}
+	group := c.Param("group")
+	stored, err := store.UpdateDeviceRecord(group, record.Device, func(current *DeviceRecord) (*DeviceRecord, error) {
+		if current != nil {
+			return nil, errDeviceRegistered
+		}
+		record.normalize(group, record.Device, nil)
+		return &record, nil
+	})
+	if err != nil {
+		registryError(c, err)
+		return
+	}
+	auditRecord(c, nil, stored)
+	log.Infof("provisioned %v/%v", group, record.Device)
+	if err := assignModel(c, stored); err != nil {
+		registryError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, withType(stored))
+}
+
+//GetDeviceRecord a single device of the registry
+func GetDeviceRecord(c *gin.Context) {
+	record, err := store.ReadDeviceRecord(c.Param("group"), c.Param("deviceid"))
+	if err != nil {
+		registryError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, withType(record))
+}
+
+//PutDeviceRecord replace the record of a device, registering it if it's new. Timestamps are kept
+func PutDeviceRecord(c *gin.Context) {
+	var record DeviceRecord
+	if err := c.ShouldBindJSON(&record); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	group, device := c.Param("group"), c.Param("deviceid")
+	var before *DeviceRecord
+	stored, err := store.UpdateDeviceRecord(group, device, func(current *DeviceRecord) (*DeviceRecord, error) {
+		before = current
+		record.normalize(group, device, current)
+		return &record, nil
+	})
+	if err != nil {
+		registryError(c, err)
+		return
+	}
+	auditRecord(c, before, stored)
+	c.JSON(http.StatusOK, withType(stored))
+}
+
+//PatchDeviceRecord change some fields of a registered device with a JSON merge patch
+func PatchDeviceRecord(c *gin.Context) {
+	patch, err := c.GetRawData()
+	if err != nil || !json.Valid(patch) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "body must be a JSON merge patch"})
+		return
+	}
+	group, device := c.Param("group"), c.Param("deviceid")
+	var before *DeviceRecord
+	stored, err := store.UpdateDeviceRecord(group, device, func(current *DeviceRecord) (*DeviceRecord, error) {
+		if current == nil {
+			return nil, errDeviceNotRegistered
+		}
+		before = current
+		data, err := json.Marshal(current)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = mergeDocument(data, patch); err != nil {
+			return nil, err
+		}
+		var record DeviceRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return nil, err
+		}
+		record.normalize(group, device, current)
+		return &record, nil
+	})
+	if _, ok := err.(*json.UnmarshalTypeError); ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		registryError(c, err)
+		return
+	}
+	auditRecord(c, before, stored)
+	c.JSON(http.StatusOK, withType(stored))
+}
+
+//DeleteDeviceRecord remove a device from the registry, its configs and credentials are left alone
+func DeleteDeviceRecord(c *gin.Context) {
+	group, device := c.Param("group"), c.Param("deviceid")
+	before, err := store.ReadDeviceRecord(group, device)
+	if err != nil {
+		registryError(c, err)
+		return
+	}
+	removed, err := store.DeleteDeviceRecord(group, device)
+	if err != nil {
+		registryError(c, err)
+		return
+	}
+	if !removed {
+		registryError(c, errDeviceNotRegistered)
+		return
+	}
+	AuditChange(c, group, device, resourceRegistry, actionDelete, before, nil)
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
+//PostHeartbeat a device checking in with what it's running, registers devices that weren't provisioned and
+//assigns the device type of its model to devices without one
+func PostHeartbeat(c *gin.Context) {
+	var hb Heartbeat
+	if err := c.ShouldBindJSON(&hb); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	group, device := c.Param("group"), c.Param("deviceid")
+	var before *DeviceRecord
+	stored, err := store.UpdateDeviceRecord(group, device, func(current *DeviceRecord) (*DeviceRecord, error) {
+		record := current
+		if record == nil {
+			record = &DeviceRecord{}
+			record.normalize(group, device, nil)
+			log.Infof("registered %v/%v from its heartbeat", group, device)
+		} else {
+			copied := *current
+			before = &copied
+		}
+		hb.Apply(record)
+		return record, nil
+	})
+	if err == nil {
+		err = assignModel(c, stored)
+	}
+	if err != nil {
+		registryError(c, err)
+		return
+	}
+	if before == nil || heartbeatChanged(before, stored) {
+		auditRecord(c, before, stored)
+	}
+	c.JSON(http.StatusOK, withType(stored))
+}
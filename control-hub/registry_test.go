@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+//decodeRecord the device record of an answer
+func decodeRecord(t *testing.T, rec *httptest.ResponseRecorder) *DeviceRecord {
+	t.Helper()
+	var record DeviceRecord
+	if err := json.Unmarshal(rec.Body.Bytes(), &record); err != nil {
+		t.Fatalf("%d %s: %v", rec.Code, rec.Body, err)
+	}
+	return &record
+}
+
+func TestRegistryCRUD(t *testing.T) {
+	token := "cook@reg"
+	body := []byte(`{"device": "smoker", "model": "pismoker", "display_name": "Patio", "tags": ["patio"], "type": "other"}`)
+	rec := serve(t, http.MethodPost, "/registry/reg", token, body, nil)
+	created := decodeRecord(t, rec)
+	if rec.Code != http.StatusCreated || created.Group != "reg" || created.Type != "pismoker" || created.Created == 0 {
+		t.Fatalf("provision: %d %s", rec.Code, rec.Body)
+	}
+	if rec := serve(t, http.MethodPost, "/registry/reg", token, body, nil); rec.Code != http.StatusConflict {
+		t.Fatalf("provision twice: %d %s", rec.Code, rec.Body)
+	}
+	if rec := serve(t, http.MethodPost, "/registry/reg", token, []byte(`{"device": "a/b"}`), nil); rec.Code != http.StatusBadRequest {
+		t.Fatalf("provision with a slash: %d %s", rec.Code, rec.Body)
+	}
+	if rec := serve(t, http.MethodPost, "/registry/reg", "cook@other", body, nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("provision in another group: %d %s", rec.Code, rec.Body)
+	}
+
+	rec = serve(t, http.MethodPut, "/registry/reg/smoker", token, []byte(`{"model": "pismoker", "location": "deck", "type": "other", "created": 1}`), nil)
+	replaced := decodeRecord(t, rec)
+	if rec.Code != http.StatusOK || replaced.Location != "deck" || replaced.DisplayName != "" || replaced.Created != created.Created || replaced.Type != "pismoker" {
+		t.Fatalf("replace: %d %s", rec.Code, rec.Body)
+	}
+
+	rec = serve(t, http.MethodPatch, "/registry/reg/smoker", token, []byte(`{"display_name": "Deck", "location": null, "tags": ["deck"]}`), nil)
+	patched := decodeRecord(t, rec)
+	if rec.Code != http.StatusOK || patched.DisplayName != "Deck" || patched.Location != "" || patched.Model != "pismoker" || len(patched.Tags) != 1 {
+		t.Fatalf("patch: %d %s", rec.Code, rec.Body)
+	}
+	if rec := serve(t, http.MethodPatch, "/registry/reg/smoker", token, []byte(`{"tags": 5}`), nil); rec.Code != http.StatusBadRequest {
+		t.Fatalf("patch with the wrong type: %d %s", rec.Code, rec.Body)
+	}
+	if rec := serve(t, http.MethodPatch, "/registry/reg/smoker", token, []byte(`not json`), nil); rec.Code != http.StatusBadRequest {
+		t.Fatalf("patch that isn't json: %d %s", rec.Code, rec.Body)
+	}
+	if rec := serve(t, http.MethodPatch, "/registry/reg/missing", token, []byte(`{}`), nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("patch an unregistered device: %d %s", rec.Code, rec.Body)
+	}
+
+	serve(t, http.MethodPost, "/registry/reg", token, []byte(`{"device": "other", "model": "homebrew"}`), nil)
+	rec = serve(t, http.MethodGet, "/registry/reg?tag=deck", token, nil, nil)
+	var records []DeviceRecord
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &records) != nil || len(records) != 1 || records[0].Device != "smoker" {
+		t.Fatalf("list by tag: %d %s", rec.Code, rec.Body)
+	}
+	rec = serve(t, http.MethodGet, "/registry/reg?model=homebrew", token, nil, nil)
+	records = nil
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &records) != nil || len(records) != 1 || records[0].Type != "" {
+		t.Fatalf("list by model: %d %s", rec.Code, rec.Body)
+	}
+
+	if rec := serve(t, http.MethodDelete, "/registry/reg/smoker", token, nil, nil); rec.Code != http.StatusOK {
+		t.Fatalf("delete: %d %s", rec.Code, rec.Body)
+	}
+	if rec := serve(t, http.MethodDelete, "/registry/reg/smoker", token, nil, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("delete twice: %d %s", rec.Code, rec.Body)
+	}
+	if rec := serve(t, http.MethodGet, "/registry/reg/smoker", token, nil, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("read a deleted device: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestPostHeartbeat(t *testing.T) {
+	if err := store.PutEntry(credentialPrefix+"beat", "smoker", []byte(`{"secret": "device-secret"}`)); err != nil {
+		t.Fatal(err)
+	}
+	body := []byte(`{"model": "pismoker", "firmware": "v1.2.0", "channels": ["readings"], "capabilities": {"probes": 1, "actuator": "relay"}}`)
+	rec := serve(t, http.MethodPost, "/registry/beat/smoker/heartbeat", "device-secret", body, nil)
+	record := decodeRecord(t, rec)
+	if rec.Code != http.StatusOK || record.Type != "pismoker" || record.Firmware != "v1.2.0" || record.LastSeen == 0 || record.Capabilities == nil {
+		t.Fatalf("first heartbeat: %d %s", rec.Code, rec.Body)
+	}
+	rec = serve(t, http.MethodPost, "/registry/beat/smoker/heartbeat", "device-secret", []byte(`{"channels": ["readings", "alarms"]}`), nil)
+	record = decodeRecord(t, rec)
+	if rec.Code != http.StatusOK || len(record.Channels) != 2 || record.Model != "pismoker" || record.Firmware != "v1.2.0" {
+		t.Fatalf("second heartbeat: %d %s", rec.Code, rec.Body)
+	}
+	if rec := serve(t, http.MethodPost, "/registry/beat/other/heartbeat", "device-secret", body, nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("heartbeat with the credential of another device: %d %s", rec.Code, rec.Body)
+	}
+
+	custom := []byte(`{"configs": {"configs": {"type": "object"}}}`)
+	if rec := serve(t, http.MethodPut, "/admin/types/custom", testAdminToken, custom, nil); rec.Code != http.StatusOK {
+		t.Fatalf("register device type: %d %s", rec.Code, rec.Body)
+	}
+	assign(t, "beat", "custom", "custom")
+	rec = serve(t, http.MethodPost, "/registry/beat/custom/heartbeat", "cook@beat", body, nil)
+	if record := decodeRecord(t, rec); rec.Code != http.StatusOK || record.Type != "custom" {
+		t.Fatalf("heartbeat of a device assigned by hand: %d %s", rec.Code, rec.Body)
+	}
+	rec = serve(t, http.MethodPost, "/registry/beat/homebrew/heartbeat", "cook@beat", []byte(`{"model": "homebrew"}`), nil)
+	if record := decodeRecord(t, rec); rec.Code != http.StatusOK || record.Type != "" {
+		t.Fatalf("heartbeat of a model without a type: %d %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	revisionsPrefix = "revisions/"
+	revisionSuffix  = "/revision"
+	maxRevisions    = 100
+	mergeRetries    = 3
+)
+
+var errRevisionNotFound = errors.New("revision not found")
+
+//Revision a numbered write of a config
+type Revision struct {
+	Revision   uint64          `json:"revision,omitempty"`
+	Author     string          `json:"author"`
+	Timestamp  int64           `json:"timestamp"`
+	RollbackOf uint64          `json:"rollback_of,omitempty"`
+	Schedule   string          `json:"schedule,omitempty"`
+	Action     string          `json:"action,omitempty"`
+	Source     string          `json:"source,omitempty"`
+	Actor      string          `json:"actor,omitempty"`
+	Config     json.RawMessage `json:"config"`
+}
+
+//ConflictError the config changed since the writer last read it
+type ConflictError struct {
+	Current uint64
+}
+
+func (err *ConflictError) Error() string {
+	return "config was changed, current revision is " + strconv.FormatUint(err.Current, 10)
+}
+
+func revisionKey(group, device, config string) string {
+	return configKey(group, device, config) + revisionSuffix
+}
+
+func revisionsKey(group, device, config string) string {
+	return revisionsPrefix + configKey(group, device, config)
+}
+
+//etag quoted form of a revision for the ETag header
+func etag(rev uint64) string {
+	return `"` + strconv.FormatUint(rev, 10) + `"`
+}
+
+//ifMatch the revision an If-Match header expects, "" when the write is unconditional
+func ifMatch(c *gin.Context) string {
+	val := strings.TrimSpace(c.GetHeader("If-Match"))
+	if val == "" || val == "*" {
+		return ""
+	}
+	return strings.Trim(strings.TrimPrefix(val, "W/"), `"`)
+}
+
+//WriteConfig store the config of a revision as the next revision, expected is the revision the writer
+//based its change on or "" to write regardless. Every write is audited
+func WriteConfig(group, device, config string, revision *Revision, expected string) (uint64, error) {
+	revision.Timestamp = time.Now().Unix()
+	rev, before, err := store.WriteConfig(group, device, config, revision, expected)
+	if err != nil {
+		return 0, err
+	}
+	Audit(group, device, config, rev, revision, before)
+	return rev, nil
+}
+
+//mergePatch apply a JSON merge patch (RFC 7386), null removes a field and objects are merged recursively
+func mergePatch(target, patch interface{}) interface{} {
+	fields, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	doc, ok := target.(map[string]interface{})
+	if !ok {
+		doc = make(map[string]interface{})
+	}
+	for key, val := range fields {
+		if val == nil {
+			delete(doc, key)
+			continue
+		}
+		doc[key] = mergePatch(doc[key], val)
+	}
+	return doc
+}
+
+//mergeDocument a config with a merge patch applied, current is nil for a config that was never set
+func mergeDocument(current, patch []byte) ([]byte, error) {
+	var doc, fields interface{}
+	if current != nil {
+		if err := json.Unmarshal(current, &doc); err != nil {
+			return nil, err
+		}
+	}
+	if err := json.Unmarshal(patch, &fields); err != nil {
+		return nil, err
+	}
+	return json.Marshal(mergePatch(doc, fields))
+}
+
+//ApplyConfig validate and write the config of a revision, with merge it's a JSON merge patch over the
+//current config. A patch is written against the revision it was merged over and merged again if that
+//changed underneath it
+func ApplyConfig(group, device, config string, revision *Revision, merge bool) (uint64, error) {
+	if !merge {
+		if err := types.Validate(group, device, config, revision.Config); err != nil {
+			return 0, err
+		}
+		return WriteConfig(group, device, config, revision, "")
+	}
+	patch := revision.Config
+	for attempt := 0; ; attempt++ {
+		current, rev, err := ReadConfig(group, device, config)
+		if err != nil && err != errNotFound {
+			return 0, err
+		}
+		if revision.Config, err = mergeDocument(current, patch); err != nil {
+			return 0, err
+		}
+		if err := types.Validate(group, device, config, revision.Config); err != nil {
+			return 0, err
+		}
+		newRev, err := WriteConfig(group, device, config, revision, strconv.FormatUint(rev, 10))
+		if _, ok := err.(*ConflictError); ok && attempt < mergeRetries {
+			continue
+		}
+		return newRev, err
+	}
+}
+
+//ReadConfig the current config and its revision, errNotFound if it was never set
+func ReadConfig(group, device, config string) ([]byte, uint64, error) {
+	return store.ReadConfig(group, device, config)
+}
+
+//GetRevision look up a single revision of a config
+func GetRevision(group, device, config string, rev uint64) (*Revision, error) {
+	return store.GetRevision(group, device, config, rev)
+}
+
+//ListRevisions the kept revisions of a config, newest first
+func ListRevisions(group, device, config string) ([]Revision, error) {
+	revisions, err := store.ListRevisions(group, device, config)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].Revision > revisions[j].Revision
+	})
+	return revisions, nil
+}
+
+//author who made a change, the caller unless the request names someone
+func author(c *gin.Context, name string) string {
+	if name != "" {
+		return name
+	}
+	if identity, ok := c.Get(identityKey); ok {
+		return identity.(*Identity).Name()
+	}
+	return c.ClientIP()
+}
+
+//writeResponse answer a config write, 412 with the current revision when it lost a race
+func writeResponse(c *gin.Context, rev uint64, err error) {
+	if cerr, ok := err.(*ConflictError); ok {
+		c.Header("ETag", etag(cerr.Current))
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": err.Error(), "revision": cerr.Current})
+		return
+	} else if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("ETag", etag(rev))
+	c.JSON(http.StatusOK, gin.H{"status": "accepted", "revision": rev})
+}
+
+//GetRevisions list the revisions of a config
+func GetRevisions(c *gin.Context) {
+	revisions, err := ListRevisions(c.Param("group"), c.Param("deviceid"), c.Param("config"))
+	if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, revisions)
+}
+
+//GetConfigRevision fetch a single revision of a config
+func GetConfigRevision(c *gin.Context) {
+	rev, err := strconv.ParseUint(c.Param("revision"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid revision"})
+		return
+	}
+	revision, err := GetRevision(c.Param("group"), c.Param("deviceid"), c.Param("config"), rev)
+	if err == errRevisionNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, revision)
+}
+
+//PostRollback make an earlier revision of a config current again, it's written as a new revision
+//so the history still shows what was rolled back. Honors If-Match like any other write
+func PostRollback(c *gin.Context) {
+	rev, err := strconv.ParseUint(c.Param("revision"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid revision"})
+		return
+	}
+	group := c.Param("group")
+	device := c.Param("deviceid")
+	config := c.Param("config")
+	revision, err := GetRevision(group, device, config, rev)
+	if err == errRevisionNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	if err := types.Validate(group, device, config, revision.Config); err != nil {
+		validationResponse(c, err) //The device type may have changed since
+		return
+	}
+	var msg Message
+	c.ShouldBindJSON(&msg) //Body is optional, it only names the author
+	rollback := &Revision{
+		Author:     author(c, msg.Author),
+		RollbackOf: rev,
+		Action:     actionRollback,
+		Source:     sourceHTTP,
+		Actor:      actor(c),
+		Config:     revision.Config,
+	}
+	newRev, err := WriteConfig(group, device, config, rollback, ifMatch(c))
+	if err == nil {
+		log.Infof("rolled %v back to revision %d as revision %d", configKey(group, device, config), rev, newRev)
+	}
+	writeResponse(c, newRev, err)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestConfigETag(t *testing.T) {
+	path, token := "/config/etag/smoker/configs", "cook@etag"
+	if rec := serve(t, http.MethodGet, path, token, nil, nil); rec.Code != http.StatusOK || rec.Header().Get("ETag") != "" {
+		t.Fatalf("config never written: %d %q", rec.Code, rec.Header().Get("ETag"))
+	}
+	for i, want := range []string{`"1"`, `"2"`} {
+		rec := serve(t, http.MethodPost, path, token, []byte(`{"config": {"temp": 225}}`), nil)
+		if rec.Code != http.StatusOK || rec.Header().Get("ETag") != want {
+			t.Fatalf("write %d: %d %q %s", i, rec.Code, rec.Header().Get("ETag"), rec.Body)
+		}
+	}
+	rec := serve(t, http.MethodGet, path, token, nil, nil)
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") != `"2"` {
+		t.Fatalf("read: %d %q", rec.Code, rec.Header().Get("ETag"))
+	}
+
+	for _, test := range []struct {
+		name, ifMatch string
+		code          int
+	}{
+		{"stale revision", `"1"`, http.StatusPreconditionFailed},
+		{"revision that doesn't exist yet", `"9"`, http.StatusPreconditionFailed},
+		{"current revision", `"2"`, http.StatusOK},
+		{"weak tag of the current revision", `W/"3"`, http.StatusOK},
+		{"any revision", "*", http.StatusOK},
+	} {
+		rec := serve(t, http.MethodPost, path, token, []byte(`{"config": {"temp": 250}}`), map[string]string{"If-Match": test.ifMatch})
+		if rec.Code != test.code {
+			t.Fatalf("%v: %d %s", test.name, rec.Code, rec.Body)
+		}
+		if test.code != http.StatusPreconditionFailed {
+			continue
+		}
+		var body struct {
+			Revision uint64 `json:"revision"`
+		}
+		if json.Unmarshal(rec.Body.Bytes(), &body) != nil || body.Revision != 2 || rec.Header().Get("ETag") != `"2"` {
+			t.Fatalf("%v: conflict without the current revision %q %s", test.name, rec.Header().Get("ETag"), rec.Body)
+		}
+	}
+}
+
+func TestRevisions(t *testing.T) {
+	path, token := "/config/history/smoker/configs", "cook@history"
+	for _, body := range []string{`{"config": {"temp": 200}}`, `{"config": {"temp": 225}, "author": "pitmaster"}`, `{"config": {"temp": 250}}`} {
+		if rec := serve(t, http.MethodPost, path, token, []byte(body), nil); rec.Code != http.StatusOK {
+			t.Fatalf("write: %d %s", rec.Code, rec.Body)
+		}
+	}
+	rec := serve(t, http.MethodGet, path+"/revisions", token, nil, nil)
+	var revisions []Revision
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &revisions) != nil || len(revisions) != 3 {
+		t.Fatalf("revisions: %d %s", rec.Code, rec.Body)
+	}
+	if revisions[0].Revision != 3 || revisions[2].Revision != 1 || revisions[1].Author != "pitmaster" || revisions[0].Author != "cook" {
+		t.Fatalf("revisions out of order or misattributed: %+v", revisions)
+	}
+	if revisions[0].Source != sourceHTTP || revisions[0].Timestamp == 0 {
+		t.Fatalf("revision without a source or time: %+v", revisions[0])
+	}
+
+	rec = serve(t, http.MethodGet, path+"/revisions/2", token, nil, nil)
+	var revision Revision
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &revision) != nil || string(revision.Config) != `{"temp":225}` {
+		t.Fatalf("revision 2: %d %s", rec.Code, rec.Body)
+	}
+	if rec := serve(t, http.MethodGet, path+"/revisions/7", token, nil, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("revision that doesn't exist: %d %s", rec.Code, rec.Body)
+	}
+	if rec := serve(t, http.MethodGet, path+"/revisions/latest", token, nil, nil); rec.Code != http.StatusBadRequest {
+		t.Fatalf("revision that isn't a number: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestPostRollback(t *testing.T) {
+	path, token := "/config/rollback/smoker/configs", "cook@rollback"
+	for _, temp := range []string{"200", "275"} {
+		if rec := serve(t, http.MethodPost, path, token, []byte(`{"config": {"temp": `+temp+`}}`), nil); rec.Code != http.StatusOK {
+			t.Fatalf("write: %d %s", rec.Code, rec.Body)
+		}
+	}
+	if rec := serve(t, http.MethodPost, path+"/revisions/1/rollback", token, nil, map[string]string{"If-Match": `"1"`}); rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("rollback based on a stale revision: %d %s", rec.Code, rec.Body)
+	}
+	rec := serve(t, http.MethodPost, path+"/revisions/1/rollback", token, []byte(`{"author": "pitmaster"}`), map[string]string{"If-Match": `"2"`})
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") != `"3"` {
+		t.Fatalf("rollback: %d %s", rec.Code, rec.Body)
+	}
+	if rec := serve(t, http.MethodGet, path, token, nil, nil); rec.Body.String() != `{"temp": 200}` {
+		t.Fatalf("config after the rollback: %s", rec.Body)
+	}
+	rec = serve(t, http.MethodGet, path+"/revisions/3", token, nil, nil)
+	var revision Revision
+	if json.Unmarshal(rec.Body.Bytes(), &revision) != nil || revision.RollbackOf != 1 || revision.Action != actionRollback || revision.Author != "pitmaster" || revision.Actor != "cook" {
+		t.Fatalf("rollback revision: %s", rec.Body)
+	}
+	if rec := serve(t, http.MethodPost, path+"/revisions/9/rollback", token, nil, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("rollback to a revision that doesn't exist: %d %s", rec.Code, rec.Body)
+	}
+
+	assign(t, "rollback", "typed", "pismoker")
+	typed := "/config/rollback/typed/configs"
+	if rec := serve(t, http.MethodPost, typed, token, []byte(`{"config": {"pwr": true, "temp": 225}}`), nil); rec.Code != http.StatusOK {
+		t.Fatalf("typed write: %d %s", rec.Code, rec.Body)
+	}
+	//Written behind the back of validation, as if the schema had been tightened since
+	if _, _, err := store.WriteConfig("rollback", "typed", "configs", &Revision{Config: json.RawMessage(`{"pwr": true, "temp": 900}`)}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if rec := serve(t, http.MethodPost, typed+"/revisions/2/rollback", token, nil, nil); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("rollback to a config the type no longer allows: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestConcurrentIfMatch(t *testing.T) {
+	path, token := "/config/ifmatch/smoker/configs", "cook@ifmatch"
+	if rec := serve(t, http.MethodPost, path, token, []byte(`{"config": {"temp": 225}}`), nil); rec.Code != http.StatusOK {
+		t.Fatalf("write: %d %s", rec.Code, rec.Body)
+	}
+	codes := make([]int, 2)
+	start := make(chan bool)
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			body := []byte(`{"config": {"temp": ` + []string{"250", "275"}[i] + `}}`)
+			codes[i] = serve(t, http.MethodPost, path, token, body, map[string]string{"If-Match": `"1"`}).Code
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	if codes[0]+codes[1] != http.StatusOK+http.StatusPreconditionFailed {
+		t.Fatalf("two writers based on the same revision: %v", codes)
+	}
+	revisions, err := ListRevisions("ifmatch", "smoker", "configs")
+	if err != nil || len(revisions) != 2 {
+		t.Fatalf("revisions after the race: %+v %v", revisions, err)
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	_ "time/tzdata" //The scratch image has no zoneinfo for schedule timezones
+
+	"github.com/gin-gonic/gin"
+	"github.com/robfig/cron/v3"
+)
+
+const (
+	schedulesPrefix = "schedules/"
+	schedulesDueKey = "schedules/due"
+	scheduleTick    = time.Second
+	scheduleLease   = time.Minute
+
+	scheduleActive = "scheduled"
+	scheduleDone   = "done"
+	scheduleMissed = "missed"
+	scheduleFailed = "failed"
+)
+
+var errScheduleNotFound = errors.New("schedule not found")
+
+//Schedule a future change of a device config, either once at a time or recurring on a cron spec
+type Schedule struct {
+	ID           string          `json:"id"`
+	Group        string          `json:"group"`
+	Device       string          `json:"device"`
+	ConfigName   string          `json:"config_name"`
+	At           int64           `json:"at,omitempty"`
+	Cron         string          `json:"cron,omitempty"`
+	Timezone     string          `json:"timezone,omitempty"`
+	Data         json.RawMessage `json:"config"`
+	Merge        bool            `json:"merge,omitempty"`
+	Author       string          `json:"author,omitempty"`
+	Status       string          `json:"status"`
+	NextRun      int64           `json:"next_run,omitempty"`
+	LastRun      int64           `json:"last_run,omitempty"`
+	LastRevision uint64          `json:"last_revision,omitempty"`
+	LastError    string          `json:"last_error,omitempty"`
+	Created      int64           `json:"created"`
+}
+
+func schedulesKey(group, device string) string {
+	return schedulesPrefix + group + "/" + device
+}
+
+//dueMember member of the due set naming a schedule, ids and gin path params never hold a slash
+func dueMember(group, device, id string) string {
+	return group + "/" + device + "/" + id
+}
+
+func newScheduleID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+//parseCron a standard five field cron spec evaluated in the timezone of the schedule
+func parseCron(spec, timezone string) (cron.Schedule, error) {
+	if timezone != "" {
+		if _, err := time.LoadLocation(timezone); err != nil {
+			return nil, err
+		}
+		spec = "CRON_TZ=" + timezone + " " + spec
+	}
+	return cron.ParseStandard(spec)
+}
+
+//next the first run of the schedule after now, 0 once a one-shot schedule is used up
+func (s *Schedule) next(now time.Time) (int64, error) {
+	if s.Cron == "" {
+		if s.LastRun > 0 || s.Status != scheduleActive {
+			return 0, nil
+		}
+		return s.At, nil
+	}
+	sched, err := parseCron(s.Cron, s.Timezone)
+	if err != nil {
+		return 0, err
+	}
+	return sched.Next(now).Unix(), nil
+}
+
+//apply write the config of a schedule as a new revision
+func (s *Schedule) apply() (uint64, error) {
+	revision := &Revision{
+		Author:   s.Author,
+		Schedule: s.ID,
+		Action:   actionSchedule,
+		Source:   sourceScheduler,
+		Config:   s.Data,
+	}
+	return ApplyConfig(s.Group, s.Device, s.ConfigName, revision, s.Merge)
+}
+
+//loadSchedules every schedule of a device, soonest first
+func loadSchedules(group, device string) ([]Schedule, error) {
+	schedules, err := store.ListSchedules(group, device)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		if schedules[i].NextRun == schedules[j].NextRun {
+			return schedules[i].Created < schedules[j].Created
+		}
+		if schedules[i].NextRun == 0 || schedules[j].NextRun == 0 { //Finished schedules go last
+			return schedules[j].NextRun == 0
+		}
+		return schedules[i].NextRun < schedules[j].NextRun
+	})
+	return schedules, nil
+}
+
+//RunSchedules apply schedules as they come due. Every replica polls the due set and whoever claims a
+//schedule runs it, so a change is applied once no matter how many replicas there are. A claim is a lease:
+//a replica that dies before recording the run leaves the schedule to come due again once the lease is up
+func RunSchedules() {
+	ticker := time.NewTicker(scheduleTick)
+	for range ticker.C {
+		now := time.Now()
+		members, err := store.ClaimSchedules(now.Unix(), now.Add(scheduleLease).Unix(), 100)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		for _, member := range members {
+			runSchedule(member, now)
+		}
+	}
+}
+
+//runSchedule apply a claimed schedule and record the outcome. Runs missed by more than the grace period,
+//say while control-hub was down, are skipped rather than applied hours late. The schedule is left leased
+//when it can't be read so it's tried again once the lease is up
+func runSchedule(member string, now time.Time) {
+	parts := strings.SplitN(member, "/", 3)
+	if len(parts) != 3 {
+		log.Errorf("malformed schedule %q", member)
+		return
+	}
+	s, err := store.GetSchedule(parts[0], parts[1], parts[2])
+	if err == errScheduleNotFound { //Cancelled, drop anything left on the due set
+		if _, err := store.DeleteSchedule(parts[0], parts[1], parts[2]); err != nil {
+			log.Error(err)
+		}
+		return
+	} else if err != nil {
+		log.Error(err)
+		return
+	}
+	late := now.Sub(time.Unix(s.NextRun, 0))
+	s.LastRun = now.Unix()
+	s.LastError = ""
+	if late > scheduleGrace {
+		s.LastError = fmt.Sprintf("missed run at %v", time.Unix(s.NextRun, 0).UTC().Format(time.RFC3339))
+		log.Warnf("schedule %v: %v", member, s.LastError)
+		if s.Cron == "" {
+			s.Status = scheduleMissed
+		}
+	} else if held, err := Held(s.Group, s.Device); err != nil || held {
+		s.LastError = "device is held by an emergency stop"
+		if err != nil {
+			s.LastError = err.Error()
+		}
+		log.Warnf("schedule %v: %v", member, s.LastError)
+		if s.Cron == "" {
+			s.Status = scheduleFailed
+		}
+	} else if rev, err := s.apply(); err != nil {
+		s.LastError = err.Error()
+		log.Errorf("schedule %v: %v", member, err)
+		if s.Cron == "" {
+			s.Status = scheduleFailed
+		}
+	} else {
+		s.LastRevision = rev
+		log.Infof("schedule %v wrote revision %d", member, rev)
+		if s.Cron == "" {
+			s.Status = scheduleDone
+		}
+	}
+	if s.NextRun, err = s.next(now); err != nil {
+		log.Error(err)
+	}
+	if _, err := store.UpdateSchedule(s); err != nil {
+		log.Error(err)
+	}
+}
+
+//GetSchedules list the schedules of a device, or of one config when the path names it
+func GetSchedules(c *gin.Context) {
+	schedules, err := loadSchedules(c.Param("group"), c.Param("deviceid"))
+	if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	if config := c.Param("config"); config != "" {
+		filtered := make([]Schedule, 0, len(schedules))
+		for _, s := range schedules {
+			if s.ConfigName == config {
+				filtered = append(filtered, s)
+			}
+		}
+		schedules = filtered
+	}
+	c.JSON(http.StatusOK, schedules)
+}
+
+//GetSchedule fetch a single schedule
+func GetSchedule(c *gin.Context) {
+	s, err := store.GetSchedule(c.Param("group"), c.Param("deviceid"), c.Param("id"))
+	if err == errScheduleNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, s)
+}
+
+//PostSchedule schedule a change of a config, once at a unix time or recurring on a cron spec
+func PostSchedule(c *gin.Context) {
+	var s Schedule
+	if err := c.ShouldBindJSON(&s); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	now := time.Now()
+	s.Group = c.Param("group")
+	s.Device = c.Param("deviceid")
+	s.ConfigName = c.Param("config")
+	s.Author = author(c, s.Author)
+	s.Status = scheduleActive
+	s.Created = now.Unix()
+	s.LastRun, s.LastRevision, s.LastError = 0, 0, ""
+	if len(s.Data) == 0 || !json.Valid(s.Data) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "config is required"})
+		return
+	}
+	if (s.At == 0) == (s.Cron == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "a schedule needs exactly one of at or cron"})
+		return
+	}
+	if s.At > 0 && s.At <= now.Unix() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "at is in the past"})
+		return
+	}
+	next, err := s.next(now)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	s.NextRun = next
+	if !s.Merge { //Patches can only be checked once they're merged over the config of the day
+		if err := types.Validate(s.Group, s.Device, s.ConfigName, s.Data); err != nil {
+			validationResponse(c, err)
+			return
+		}
+	}
+	if s.ID, err = newScheduleID(); err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	if err := store.PutSchedule(&s); err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	log.Infof("scheduled %v for %v", dueMember(s.Group, s.Device, s.ID), time.Unix(s.NextRun, 0))
+	AuditChange(c, s.Group, s.Device, resourceSchedule, actionCreate, nil, &s)
+	c.JSON(http.StatusCreated, s)
+}
+
+//DeleteSchedule cancel a schedule
+func DeleteSchedule(c *gin.Context) {
+	group, device, id := c.Param("group"), c.Param("deviceid"), c.Param("id")
+	var before interface{}
+	if s, err := store.GetSchedule(group, device, id); err == nil {
+		before = s
+	}
+	removed, err := store.DeleteSchedule(group, device, id)
+	if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	if !removed {
+		c.JSON(http.StatusNotFound, gin.H{"error": errScheduleNotFound.Error()})
+		return
+	}
+	AuditChange(c, group, device, resourceSchedule, actionCancel, before, nil)
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
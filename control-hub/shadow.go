@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	reportedSuffix = "/reported"
+
+	shadowInSync  = "in_sync"
+	shadowPending = "pending"
+	shadowUnknown = "unknown"
+)
+
+//Reported state a device says it's running with after applying a config
+type Reported struct {
+	Revision  uint64          `json:"revision"`
+	Timestamp int64           `json:"timestamp"`
+	State     json.RawMessage `json:"reported"`
+}
+
+//DeviceShadow desired state of a config next to what the device last reported, delta holds every desired
+//field the device hasn't converged on yet. Status is unknown while there's nothing to compare
+type DeviceShadow struct {
+	Desired          json.RawMessage `json:"desired"`
+	DesiredRevision  uint64          `json:"desired_revision"`
+	Reported         json.RawMessage `json:"reported"`
+	ReportedRevision uint64          `json:"reported_revision"`
+	ReportedAt       int64           `json:"reported_at,omitempty"`
+	Delta            json.RawMessage `json:"delta"`
+	Status           string          `json:"status"`
+}
+
+func reportedKey(group, device, config string) string {
+	return configKey(group, device, config) + reportedSuffix
+}
+
+//delta the parts of desired that differ from reported, objects are compared field by field. Only the fields
+//a device reports are compared, it may report more than it was asked for and a config may hold more than it
+//reports, say a recipe. Returns nil when reported has caught up
+func delta(desired, reported interface{}) interface{} {
+	want, ok := desired.(map[string]interface{})
+	if !ok {
+		if reflect.DeepEqual(desired, reported) {
+			return nil
+		}
+		return desired
+	}
+	have, ok := reported.(map[string]interface{})
+	if !ok {
+		return desired
+	}
+	diff := make(map[string]interface{})
+	for key, val := range want {
+		reportedVal, reports := have[key]
+		if !reports {
+			continue
+		}
+		if d := delta(val, reportedVal); d != nil {
+			diff[key] = d
+		}
+	}
+	if len(diff) == 0 {
+		return nil
+	}
+	return diff
+}
+
+//ReadReported the state a device last reported for a config, errNotFound if it never did
+func ReadReported(group, device, config string) (*Reported, error) {
+	return store.ReadReported(group, device, config)
+}
+
+//WriteReported store the state a device reports
+func WriteReported(group, device, config string, reported *Reported) error {
+	reported.Timestamp = time.Now().Unix()
+	return store.WriteReported(group, device, config, reported)
+}
+
+//ReadShadow put together the shadow of a config
+func ReadShadow(group, device, config string) (*DeviceShadow, error) {
+	desired, rev, err := ReadConfig(group, device, config)
+	if err != nil && err != errNotFound {
+		return nil, err
+	}
+	shadow := &DeviceShadow{Desired: desired, DesiredRevision: rev, Status: shadowUnknown}
+	reported, err := ReadReported(group, device, config)
+	if err == errNotFound {
+		if desired != nil { //Nothing applied yet, all of it is outstanding
+			shadow.Delta = desired
+			shadow.Status = shadowPending
+		}
+		return shadow, nil
+	} else if err != nil {
+		return nil, err
+	}
+	shadow.Reported = reported.State
+	shadow.ReportedRevision = reported.Revision
+	shadow.ReportedAt = reported.Timestamp
+	if desired == nil {
+		return shadow, nil
+	}
+	var want, have interface{}
+	if err := json.Unmarshal(desired, &want); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(reported.State, &have); err != nil {
+		return nil, err
+	}
+	shadow.Status = shadowInSync
+	if diff := delta(want, have); diff != nil {
+		shadow.Status = shadowPending
+		if shadow.Delta, err = json.Marshal(diff); err != nil {
+			return nil, err
+		}
+	}
+	return shadow, nil
+}
+
+//GetShadow desired and reported state of a config, status is pending until the device converges
+func GetShadow(c *gin.Context) {
+	shadow, err := ReadShadow(c.Param("group"), c.Param("deviceid"), c.Param("config"))
+	if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	if shadow.DesiredRevision > 0 {
+		c.Header("ETag", etag(shadow.DesiredRevision))
+	}
+	c.JSON(http.StatusOK, shadow)
+}
+
+//PostReported a device reporting the state it's running with and the config revision it applied
+func PostReported(c *gin.Context) {
+	var reported Reported
+	if err := c.ShouldBindJSON(&reported); err != nil {
+		log.Error(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(reported.State) == 0 || !json.Valid(reported.State) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "reported state is required"})
+		return
+	}
+	group := c.Param("group")
+	device := c.Param("deviceid")
+	config := c.Param("config")
+	if err := WriteReported(group, device, config, &reported); err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	shadow, err := ReadShadow(group, device, config)
+	if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, shadow)
+}
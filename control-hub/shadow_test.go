@@ -0,0 +1,29 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDelta(t *testing.T) {
+	for _, test := range []struct {
+		desired  string
+		reported string
+		want     string
+	}{
+		{`{"pwr": true, "temp": 225}`, `{"pwr": true, "temp": 225, "relay": false, "firmware": "1.2"}`, `null`},
+		{`{"pwr": true, "temp": 250}`, `{"pwr": true, "temp": 225, "relay": true, "firmware": "1.2"}`, `{"temp": 250}`},
+		{`{"pwr": true, "temp": 225, "run_time": 60, "recipe": {"name": "pork-butt"}}`, `{"pwr": true, "temp": 225, "relay": true}`, `null`},
+		{`{"pwr": false, "probes": {"meat": 203, "pit": 225}}`, `{"pwr": true, "probes": {"meat": 190}}`, `{"pwr": false, "probes": {"meat": 203}}`},
+		{`{"probes": {"meat": 203}}`, `{"probes": 0}`, `{"probes": {"meat": 203}}`},
+	} {
+		var desired, reported, want interface{}
+		json.Unmarshal([]byte(test.desired), &desired)
+		json.Unmarshal([]byte(test.reported), &reported)
+		json.Unmarshal([]byte(test.want), &want)
+		if diff := delta(desired, reported); !reflect.DeepEqual(diff, want) {
+			t.Fatalf("delta of %s against %s: %v, want %s", test.desired, test.reported, diff, test.want)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+const recipeAuthor = "control-hub"
+
+//stepOver whether the step a recipe is on has ended: the reading of its probe reached the target or its
+//minutes are up. A step with neither holds the pit until the cook is switched off
+func stepOver(step *RecipeStep, started int64, reading *SensorReading, now time.Time) bool {
+	if reading.probe(step.Probe) && reading.F != nil && *reading.F >= step.Target {
+		return true
+	}
+	return step.Minutes > 0 && now.Unix()-started >= int64(step.Minutes)*60
+}
+
+//advanceStep move a device running a recipe on to its next step once the step it's on is over, by writing
+//the setpoint of the next step to its config. The write is conditional on the revision the run was read
+//at so a step is only taken once, whichever replica sees the reading. Devices held by an emergency stop stay
+//where they are
+func advanceStep(group, device string, config []byte, rev uint64, run *recipeRun, reading *SensorReading, now time.Time) error {
+	steps := run.Recipe.Steps
+	if run.Step < 0 || run.Step >= len(steps) || !stepOver(&steps[run.Step], run.StepStarted, reading, now) {
+		return nil
+	}
+	if held, err := Held(group, device); err != nil || held {
+		return err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(config, &doc); err != nil {
+		return err
+	}
+	next := run.Step + 1
+	change := &StepChange{Recipe: run.Recipe.Name, Step: next, Timestamp: now.Unix()}
+	doc["recipe_step"], doc["step_started"] = next, now.Unix()
+	if next < len(steps) {
+		doc["temp"] = steps[next].Setpoint
+		change.Name, change.Setpoint = steps[next].Name, steps[next].Setpoint
+	} else {
+		change.Done = true //The pit stays at the setpoint of the last step
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	if err := types.Validate(group, device, recipeConfig, data); err != nil {
+		log.Errorf("recipe %v can't move %v on: %v", run.Recipe.Name, configKey(group, device, recipeConfig), err)
+		return nil
+	}
+	revision := &Revision{Author: recipeAuthor, Action: actionRecipe, Source: sourceScheduler, Config: data}
+	newRev, err := WriteConfig(group, device, recipeConfig, revision, strconv.FormatUint(rev, 10))
+	if _, ok := err.(*ConflictError); ok {
+		return nil //Someone else moved it on or changed the config, the next reading sees the new one
+	} else if err != nil {
+		return err
+	}
+	log.Infof("recipe %v moved %v on to step %d in revision %d", run.Recipe.Name, configKey(group, device, recipeConfig), next, newRev)
+	return publishDeviceEvent(group, device, stepsChannel, change)
+}
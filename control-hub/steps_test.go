@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+//sensorReading decode a reading the way pismoker publishes it
+func sensorReading(t *testing.T, data string) *SensorReading {
+	t.Helper()
+	var reading SensorReading
+	if err := json.Unmarshal([]byte(data), &reading); err != nil {
+		t.Fatal(err)
+	}
+	return &reading
+}
+
+func TestStepOver(t *testing.T) {
+	now := time.Unix(10000, 0)
+	for _, test := range []struct {
+		name    string
+		step    RecipeStep
+		started int64
+		reading string
+		over    bool
+	}{
+		{"probe short of target", RecipeStep{Probe: "meat", Target: 165}, 0, `{"id":"28-01","name":"meat","running":true,"f":160,"c":71.1}`, false},
+		{"probe at target", RecipeStep{Probe: "meat", Target: 165}, 0, `{"id":"28-01","name":"meat","running":true,"f":165,"c":73.9}`, true},
+		{"probe matched on id", RecipeStep{Probe: "28-01", Target: 165}, 0, `{"id":"28-01","name":"","running":true,"f":170,"c":76.7}`, true},
+		{"pit past the probe target", RecipeStep{Probe: "meat", Target: 165}, 0, `{"id":"28-00","name":"pit","running":true,"f":250,"c":121.1}`, false},
+		{"other probe past the target", RecipeStep{Probe: "meat", Target: 165}, 0, `{"id":"28-02","name":"bird","running":true,"f":180,"c":82.2}`, false},
+		{"minutes not up", RecipeStep{Minutes: 60}, now.Unix() - 3599, `{"id":"28-00","name":"pit","f":225,"c":107.2}`, false},
+		{"minutes up", RecipeStep{Minutes: 60}, now.Unix() - 3600, `{"id":"28-00","name":"pit","f":225,"c":107.2}`, true},
+		{"minutes up before the probe", RecipeStep{Probe: "meat", Target: 203, Minutes: 60}, now.Unix() - 3600, `{"id":"28-01","name":"meat","f":190,"c":87.8}`, true},
+		{"hold", RecipeStep{Setpoint: 170}, 0, `{"id":"28-00","name":"pit","f":170,"c":76.7}`, false},
+	} {
+		if over := stepOver(&test.step, test.started, sensorReading(t, test.reading), now); over != test.over {
+			t.Fatalf("%v: over %v", test.name, over)
+		}
+	}
+}
+
+func TestSensorReadingPit(t *testing.T) {
+	for data, pit := range map[string]bool{
+		`{"id":"28-00","name":"pit","running":true,"f":225,"c":107.2}`:   true,
+		`{"id":"28-00","name":"","running":true,"f":225,"c":107.2}`:      true,
+		`{"id":"28-01","name":"meat","running":true,"f":165,"c":73.9}`:   false,
+		`{"id":"28-02","name":"ambient","running":true,"f":70,"c":21.1}`: false,
+	} {
+		if got := sensorReading(t, data).pit(); got != pit {
+			t.Fatalf("%v: pit %v", data, got)
+		}
+	}
+}
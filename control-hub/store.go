@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+const (
+	storageRedis  = "redis"
+	storageBolt   = "bolt"
+	storageMemory = "memory"
+	scanBatch     = 500
+)
+
+var errNotFound = errors.New("not found")
+
+//Entry an entry of a table along with its id
+type Entry struct {
+	ID   string
+	Data []byte
+}
+
+//Store where everything control-hub keeps is stored: configs, their revisions and the state devices report,
+//the device registry and schedules, and tables of JSON entries for recipes, device types and assignments,
+//holds and webhooks. Tables are named like the redis hashes they are stored in, logs like the redis lists,
+//so the device listing and credentials pub-hub writes can be read as tables. Redis is shared by every
+//replica and with pub-hub, a bbolt file or memory only suit a single replica
+type Store interface {
+	//ReadConfig the current config and its revision, errNotFound if it was never set
+	ReadConfig(group, device, config string) ([]byte, uint64, error)
+	//WriteConfig store the config of an entry as the next revision if the config is still at the expected
+	//revision, "" to write regardless. Returns the new revision and the config it replaced
+	WriteConfig(group, device, config string, entry *Revision, expected string) (uint64, []byte, error)
+	//GetRevision a single kept revision, errRevisionNotFound if it's gone or never was
+	GetRevision(group, device, config string, rev uint64) (*Revision, error)
+	//ListRevisions the kept revisions of a config in no particular order
+	ListRevisions(group, device, config string) ([]Revision, error)
+	//ReadReported the state a device last reported, errNotFound if it never did
+	ReadReported(group, device, config string) (*Reported, error)
+	//WriteReported replace the state a device reported
+	WriteReported(group, device, config string, reported *Reported) error
+	//ReadDeviceRecord the registry record of a device, errNotFound if it isn't registered
+	ReadDeviceRecord(group, device string) (*DeviceRecord, error)
+	//ListDeviceRecords every device registered in a group in no particular order
+	ListDeviceRecords(group string) ([]DeviceRecord, error)
+	//UpdateDeviceRecord change the record of a device atomically. update gets nil for a device that isn't
+	//registered and returns the record to store, or an error to leave it alone
+	UpdateDeviceRecord(group, device string, update func(*DeviceRecord) (*DeviceRecord, error)) (*DeviceRecord, error)
+	//DeleteDeviceRecord remove a device from the registry, false if it wasn't registered
+	DeleteDeviceRecord(group, device string) (bool, error)
+
+	//GetSchedule a single schedule of a device, errScheduleNotFound if there's none
+	GetSchedule(group, device, id string) (*Schedule, error)
+	//ListSchedules every schedule of a device in no particular order
+	ListSchedules(group, device string) ([]Schedule, error)
+	//PutSchedule store a new schedule and put it on the due set at its next run
+	PutSchedule(s *Schedule) error
+	//UpdateSchedule write back a schedule after it ran unless it was cancelled in the meantime, false if it
+	//was. In the same step recurring schedules go back on the due set at their next run and finished ones leave it
+	UpdateSchedule(s *Schedule) (bool, error)
+	//DeleteSchedule cancel a schedule, false if there was none
+	DeleteSchedule(group, device, id string) (bool, error)
+	//ClaimSchedules lease up to count members of the due set whose run is at or before now, soonest first. Their
+	//run is moved to until in the same step so no other replica claims them, and they come due again then
+	//unless UpdateSchedule is called before
+	ClaimSchedules(now, until int64, count int) ([]string, error)
+
+	//GetEntry an entry of a table, errNotFound if there's none
+	GetEntry(table, id string) ([]byte, error)
+	//PutEntry create or replace an entry of a table
+	PutEntry(table, id string, data []byte) error
+	//DeleteEntries remove entries of a table, the whole table when no ids are given. Returns how many there were
+	DeleteEntries(table string, ids ...string) (int64, error)
+	//ScanEntries the entries of a table a batch at a time in no particular order, "" starts the scan and
+	//the returned cursor is "" once it's done. A batch may hold more or fewer entries than count
+	ScanEntries(table, cursor string, count int) ([]Entry, string, error)
+	//CountEntries the number of entries of a table
+	CountEntries(table string) (int64, error)
+
+	//AppendLog put an entry at the head of a log, keeping the newest max entries
+	AppendLog(name string, entry []byte, max int) error
+	//ReadLog up to count entries of a log, newest first
+	ReadLog(name string, count int) ([][]byte, error)
+	//DeleteLog remove a log
+	DeleteLog(name string) error
+
+	//Ping whether the store can be reached
+	Ping() error
+}
+
+//openStore the store named by --storage, path is the file of the bbolt store
+func openStore(kind, path string) (Store, error) {
+	switch kind {
+	case storageRedis:
+		return &redisStore{rc: rc}, nil
+	case storageBolt:
+		return openBoltStore(path)
+	case storageMemory:
+		return newMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("storage must be one of %v, %v or %v", storageRedis, storageBolt, storageMemory)
+}
+
+//checkExpected whether a write expecting a revision may go ahead, the same check the redis write script makes
+func checkExpected(expected string, current uint64) error {
+	if expected == "" {
+		return nil
+	}
+	if want, err := strconv.ParseUint(expected, 10, 64); err != nil || want != current {
+		return &ConflictError{Current: current}
+	}
+	return nil
+}
+
+//numbered a copy of a revision entry under its number
+func numbered(entry *Revision, rev uint64) *Revision {
+	numbered := *entry
+	numbered.Revision = rev
+	return &numbered
+}
+
+//allEntries every entry of a table, scanned in batches
+func allEntries(table string) ([]Entry, error) {
+	entries := make([]Entry, 0)
+	cursor := ""
+	for {
+		batch, next, err := store.ScanEntries(table, cursor, scanBatch)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, batch...)
+		if cursor = next; cursor == "" {
+			return entries, nil
+		}
+	}
+}
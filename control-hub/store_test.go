@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+)
+
+//stores every Store implementation, each test runs against a fresh one of every kind
+var stores = []struct {
+	name string
+	open func(t *testing.T) Store
+}{
+	{storageRedis, func(t *testing.T) Store {
+		mr, err := miniredis.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(mr.Close)
+		return &redisStore{rc: redis.NewClient(&redis.Options{Addr: mr.Addr()})}
+	}},
+	{storageBolt, func(t *testing.T) Store {
+		bs, err := openBoltStore(filepath.Join(t.TempDir(), "control-hub.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { bs.db.Close() })
+		return bs
+	}},
+	{storageMemory, func(t *testing.T) Store {
+		return newMemoryStore()
+	}},
+}
+
+//conformance run a test against every kind of store
+func conformance(t *testing.T, test func(t *testing.T, s Store)) {
+	for _, kind := range stores {
+		t.Run(kind.name, func(t *testing.T) {
+			test(t, kind.open(t))
+		})
+	}
+}
+
+func TestStoreConfigs(t *testing.T) {
+	conformance(t, func(t *testing.T, s Store) {
+		if _, _, err := s.ReadConfig("g", "d", "c"); err != errNotFound {
+			t.Fatalf("read of a missing config: %v", err)
+		}
+		rev, before, err := s.WriteConfig("g", "d", "c", &Revision{Config: json.RawMessage(`{"a":1}`)}, "")
+		if err != nil || rev != 1 || len(before) != 0 {
+			t.Fatalf("first write: rev %d before %s err %v", rev, before, err)
+		}
+		if _, _, err := s.WriteConfig("g", "d", "c", &Revision{Config: json.RawMessage(`{"a":3}`)}, "5"); err == nil {
+			t.Fatal("write at a stale revision went through")
+		} else if conflict, ok := err.(*ConflictError); !ok || conflict.Current != 1 {
+			t.Fatalf("write at a stale revision: %v", err)
+		}
+		rev, before, err = s.WriteConfig("g", "d", "c", &Revision{Config: json.RawMessage(`{"a":2}`)}, "1")
+		if err != nil || rev != 2 || string(before) != `{"a":1}` {
+			t.Fatalf("second write: rev %d before %s err %v", rev, before, err)
+		}
+		config, rev, err := s.ReadConfig("g", "d", "c")
+		if err != nil || rev != 2 || string(config) != `{"a":2}` {
+			t.Fatalf("read: rev %d config %s err %v", rev, config, err)
+		}
+		revision, err := s.GetRevision("g", "d", "c", 1)
+		if err != nil || revision.Revision != 1 || string(revision.Config) != `{"a":1}` {
+			t.Fatalf("revision 1: %+v %v", revision, err)
+		}
+		if _, err := s.GetRevision("g", "d", "c", 3); err != errRevisionNotFound {
+			t.Fatalf("missing revision: %v", err)
+		}
+		if revisions, err := s.ListRevisions("g", "d", "c"); err != nil || len(revisions) != 2 {
+			t.Fatalf("revisions: %v %v", revisions, err)
+		}
+	})
+}
+
+func TestStoreReported(t *testing.T) {
+	conformance(t, func(t *testing.T, s Store) {
+		if _, err := s.ReadReported("g", "d", "c"); err != errNotFound {
+			t.Fatalf("read of missing state: %v", err)
+		}
+		if err := s.WriteReported("g", "d", "c", &Reported{Revision: 4, State: json.RawMessage(`{"pwr":true}`)}); err != nil {
+			t.Fatal(err)
+		}
+		reported, err := s.ReadReported("g", "d", "c")
+		if err != nil || reported.Revision != 4 || string(reported.State) != `{"pwr":true}` {
+			t.Fatalf("reported: %+v %v", reported, err)
+		}
+	})
+}
+
+func TestStoreDeviceRecords(t *testing.T) {
+	conformance(t, func(t *testing.T, s Store) {
+		if _, err := s.ReadDeviceRecord("g", "d"); err != errNotFound {
+			t.Fatalf("read of a missing record: %v", err)
+		}
+		create := func(current *DeviceRecord) (*DeviceRecord, error) {
+			if current != nil {
+				return nil, errDeviceRegistered
+			}
+			return &DeviceRecord{Device: "d", Group: "g", Model: "v1"}, nil
+		}
+		if _, err := s.UpdateDeviceRecord("g", "d", create); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.UpdateDeviceRecord("g", "d", create); err != errDeviceRegistered {
+			t.Fatalf("second create: %v", err)
+		}
+		record, err := s.ReadDeviceRecord("g", "d")
+		if err != nil || record.Model != "v1" {
+			t.Fatalf("record: %+v %v", record, err)
+		}
+		if records, err := s.ListDeviceRecords("g"); err != nil || len(records) != 1 {
+			t.Fatalf("records: %v %v", records, err)
+		}
+		if removed, err := s.DeleteDeviceRecord("g", "d"); err != nil || !removed {
+			t.Fatalf("delete: %v %v", removed, err)
+		}
+		if removed, err := s.DeleteDeviceRecord("g", "d"); err != nil || removed {
+			t.Fatalf("second delete: %v %v", removed, err)
+		}
+	})
+}
+
+func TestStoreSchedules(t *testing.T) {
+	conformance(t, func(t *testing.T, s Store) {
+		later := &Schedule{ID: "b", Group: "g", Device: "d", Status: scheduleActive, NextRun: 200}
+		sooner := &Schedule{ID: "a", Group: "g", Device: "d", Status: scheduleActive, NextRun: 100}
+		for _, sched := range []*Schedule{later, sooner} {
+			if err := s.PutSchedule(sched); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if schedules, err := s.ListSchedules("g", "d"); err != nil || len(schedules) != 2 {
+			t.Fatalf("schedules: %v %v", schedules, err)
+		}
+		due, err := s.ClaimSchedules(150, 210, 10)
+		if err != nil || len(due) != 1 || due[0] != dueMember("g", "d", "a") {
+			t.Fatalf("due at 150: %v %v", due, err)
+		}
+		if due, err := s.ClaimSchedules(150, 210, 10); err != nil || len(due) != 0 {
+			t.Fatalf("a leased schedule was claimed twice: %v %v", due, err)
+		}
+		due, err = s.ClaimSchedules(205, 265, 10)
+		if err != nil || len(due) != 1 || due[0] != dueMember("g", "d", "b") {
+			t.Fatalf("due at 205: %v %v", due, err)
+		}
+		if due, err := s.ClaimSchedules(215, 275, 10); err != nil || len(due) != 1 || due[0] != dueMember("g", "d", "a") {
+			t.Fatalf("a lease that ran out wasn't claimed again: %v %v", due, err)
+		}
+		sooner.Status, sooner.NextRun = scheduleDone, 0
+		if updated, err := s.UpdateSchedule(sooner); err != nil || !updated {
+			t.Fatalf("update: %v %v", updated, err)
+		}
+		if got, err := s.GetSchedule("g", "d", "a"); err != nil || got.Status != scheduleDone {
+			t.Fatalf("updated schedule: %+v %v", got, err)
+		}
+		later.NextRun = 400
+		if updated, err := s.UpdateSchedule(later); err != nil || !updated {
+			t.Fatalf("reschedule: %v %v", updated, err)
+		}
+		if due, err := s.ClaimSchedules(399, 500, 10); err != nil || len(due) != 0 {
+			t.Fatalf("a finished or rescheduled schedule came due: %v %v", due, err)
+		}
+		if due, err := s.ClaimSchedules(400, 500, 10); err != nil || len(due) != 1 || due[0] != dueMember("g", "d", "b") {
+			t.Fatalf("rescheduled run: %v %v", due, err)
+		}
+		if removed, err := s.DeleteSchedule("g", "d", "b"); err != nil || !removed {
+			t.Fatalf("delete: %v %v", removed, err)
+		}
+		if updated, err := s.UpdateSchedule(later); err != nil || updated {
+			t.Fatalf("update of a cancelled schedule: %v %v", updated, err)
+		}
+		if _, err := s.GetSchedule("g", "d", "b"); err != errScheduleNotFound {
+			t.Fatalf("cancelled schedule: %v", err)
+		}
+	})
+}
+
+func TestStoreEntries(t *testing.T) {
+	conformance(t, func(t *testing.T, s Store) {
+		if _, err := s.GetEntry("table", "x"); err != errNotFound {
+			t.Fatalf("missing entry: %v", err)
+		}
+		for i := 0; i < 25; i++ {
+			if err := s.PutEntry("table", strconv.Itoa(i), []byte(`{}`)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.PutEntry("table", "3", []byte(`{"n":3}`)); err != nil {
+			t.Fatal(err)
+		}
+		if val, err := s.GetEntry("table", "3"); err != nil || string(val) != `{"n":3}` {
+			t.Fatalf("entry: %s %v", val, err)
+		}
+		if count, err := s.CountEntries("table"); err != nil || count != 25 {
+			t.Fatalf("count: %d %v", count, err)
+		}
+		seen := make(map[string]bool)
+		cursor := ""
+		for {
+			entries, next, err := s.ScanEntries("table", cursor, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, entry := range entries {
+				seen[entry.ID] = true
+			}
+			if cursor = next; cursor == "" {
+				break
+			}
+		}
+		if len(seen) != 25 {
+			t.Fatalf("scan saw %d entries", len(seen))
+		}
+		if removed, err := s.DeleteEntries("table", "3", "missing"); err != nil || removed != 1 {
+			t.Fatalf("delete: %d %v", removed, err)
+		}
+		if removed, err := s.DeleteEntries("table"); err != nil || removed != 24 {
+			t.Fatalf("delete table: %d %v", removed, err)
+		}
+		if count, err := s.CountEntries("table"); err != nil || count != 0 {
+			t.Fatalf("count after delete: %d %v", count, err)
+		}
+	})
+}
+
+func TestStoreLogs(t *testing.T) {
+	conformance(t, func(t *testing.T, s Store) {
+		for i := 0; i < 5; i++ {
+			if err := s.AppendLog("log", []byte(strconv.Itoa(i)), 3); err != nil {
+				t.Fatal(err)
+			}
+		}
+		entries, err := s.ReadLog("log", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]string, len(entries))
+		for i, entry := range entries {
+			got[i] = string(entry)
+		}
+		if len(got) != 3 || got[0] != "4" || got[2] != "2" {
+			t.Fatalf("log: %v", got)
+		}
+		if entries, err := s.ReadLog("log", 2); err != nil || len(entries) != 2 {
+			t.Fatalf("partial read: %v %v", entries, err)
+		}
+		if err := s.DeleteLog("log"); err != nil {
+			t.Fatal(err)
+		}
+		if entries, err := s.ReadLog("log", 10); err != nil || len(entries) != 0 {
+			t.Fatalf("deleted log: %v %v", entries, err)
+		}
+		if err := s.Ping(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestDueMembers(t *testing.T) {
+	due := map[string]int64{"c": 30, "a": 10, "b": 10, "d": 40}
+	members := dueMembers(due, 30, 2)
+	if !sort.StringsAreSorted(members) || len(members) != 2 || members[0] != "a" || members[1] != "b" {
+		t.Fatalf("due members: %v", members)
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/charles-d-burton/grillbernetes/validation"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	deviceTypesKey     = "devicetypes"
+	assignmentsPrefix  = "assignments/"
+	deviceTypesRefresh = 30 * time.Second
+)
+
+var (
+	errTypeNotFound = errors.New("device type not found")
+	//requireType reject config writes to devices without a type instead of accepting anything
+	requireType bool
+	//shippedTypes the device types that come with control-hub, registered at startup unless they already are
+	//go:embed types/*.json
+	shippedTypes embed.FS
+)
+
+//DeviceType a kind of device and the JSON schema each of its configs has to match, the schema carries the
+//limits of the hardware such as the temperature range, the fields it understands and the programs it runs
+type DeviceType struct {
+	Name        string                     `json:"name"`
+	Description string                     `json:"description,omitempty"`
+	Configs     map[string]json.RawMessage `json:"configs"`
+	Created     int64                      `json:"created"`
+}
+
+//Assignment the device type a device was registered as
+type Assignment struct {
+	Type string `json:"type" binding:"required"`
+}
+
+//ValidationError config failed the schema of its device type
+type ValidationError struct {
+	Type    string                 `json:"type"`
+	Config  string                 `json:"config"`
+	Reason  string                 `json:"error"`
+	Details []validation.Violation `json:"details,omitempty"`
+}
+
+func (err *ValidationError) Error() string {
+	return fmt.Sprintf("config %v is not valid for %v: %v", err.Config, err.Type, err.Reason)
+}
+
+//TypeRegistry in memory copy of the compiled config schemas of every device type, keyed by type and named
+//after their config
+type TypeRegistry struct {
+	*validation.Registry
+}
+
+var types = &TypeRegistry{validation.NewRegistry(loadDefinitions, func(err error) { log.Error(err) })}
+
+func assignmentsKey(group string) string {
+	return assignmentsPrefix + group
+}
+
+//compile every config schema of a device type
+func (dt *DeviceType) compile() error {
+	for config, schema := range dt.Configs {
+		url := fmt.Sprintf("%v/%v/%v.json", deviceTypesKey, dt.Name, config)
+		if _, err := validation.Compile(url, schema); err != nil {
+			return fmt.Errorf("config %v: %v", config, err)
+		}
+	}
+	return nil
+}
+
+//loadDefinitions the config schemas of every device type
+func loadDefinitions() ([]validation.Definition, error) {
+	deviceTypes, err := loadDeviceTypes()
+	if err != nil {
+		return nil, err
+	}
+	var defs []validation.Definition
+	for _, dt := range deviceTypes {
+		for config, schema := range dt.Configs {
+			defs = append(defs, validation.Definition{Key: dt.Name, Name: config, Schema: schema})
+		}
+	}
+	return defs, nil
+}
+
+//Watch keep the registry in step with device types registered through other replicas
+func (reg *TypeRegistry) Watch() {
+	reg.Registry.Watch(deviceTypesRefresh)
+}
+
+//Validate check a config against the device type of the device. Devices without a type accept anything
+//unless requireType is set. A device type only accepts the configs it has a schema for
+func (reg *TypeRegistry) Validate(group, device, config string, data []byte) error {
+	val, err := store.GetEntry(assignmentsKey(group), device)
+	if err == errNotFound {
+		if requireType {
+			return &ValidationError{Config: config, Reason: "device has no type"}
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	name := string(val)
+	schemas, ok := reg.Schemas(name)
+	if !ok {
+		return &ValidationError{Type: name, Config: config, Reason: "device type is not registered"}
+	}
+	var schema *validation.Schema
+	for _, s := range schemas {
+		if s.Name == config {
+			schema = s
+		}
+	}
+	if schema == nil {
+		return &ValidationError{Type: name, Config: config, Reason: "device type has no config " + config}
+	}
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return &ValidationError{Type: name, Config: config, Reason: err.Error()}
+	}
+	if err := schema.Validate(doc); err != nil {
+		verr := &ValidationError{Type: name, Config: config, Reason: err.Error(), Details: validation.Violations(err)}
+		if len(verr.Details) > 0 {
+			verr.Reason = verr.Details[0].Field + ": " + verr.Details[0].Error
+		}
+		return verr
+	}
+	return nil
+}
+
+//SeedDeviceTypes register the device types shipped in types/, named after their file. Types already
+//registered are left alone so changes made through the admin api survive a restart
+func SeedDeviceTypes() error {
+	files, err := shippedTypes.ReadDir("types")
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(file.Name(), path.Ext(file.Name()))
+		if _, err := loadDeviceType(name); err != errTypeNotFound {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		data, err := shippedTypes.ReadFile("types/" + file.Name())
+		if err != nil {
+			return err
+		}
+		var dt DeviceType
+		if err := json.Unmarshal(data, &dt); err != nil {
+			return fmt.Errorf("device type %v: %v", name, err)
+		}
+		dt.Name, dt.Created = name, time.Now().Unix()
+		if err := dt.compile(); err != nil {
+			return fmt.Errorf("device type %v: %v", name, err)
+		}
+		if data, err = json.Marshal(&dt); err != nil {
+			return err
+		}
+		if err := store.PutEntry(deviceTypesKey, name, data); err != nil {
+			return err
+		}
+		log.Infof("registered shipped device type %v", name)
+	}
+	return types.Refresh()
+}
+
+func loadDeviceTypes() ([]DeviceType, error) {
+	entries, err := allEntries(deviceTypesKey)
+	if err != nil {
+		return nil, err
+	}
+	deviceTypes := make([]DeviceType, 0, len(entries))
+	for _, entry := range entries {
+		var dt DeviceType
+		if err := json.Unmarshal(entry.Data, &dt); err != nil {
+			log.Error(err)
+			continue
+		}
+		deviceTypes = append(deviceTypes, dt)
+	}
+	sort.Slice(deviceTypes, func(i, j int) bool {
+		return deviceTypes[i].Name < deviceTypes[j].Name
+	})
+	return deviceTypes, nil
+}
+
+func loadDeviceType(name string) (*DeviceType, error) {
+	val, err := store.GetEntry(deviceTypesKey, name)
+	if err == errNotFound {
+		return nil, errTypeNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var dt DeviceType
+	if err := json.Unmarshal(val, &dt); err != nil {
+		return nil, err
+	}
+	return &dt, nil
+}
+
+//validationResponse answer a config write that failed validation, 422 with the offending fields
+func validationResponse(c *gin.Context, err error) {
+	if verr, ok := err.(*ValidationError); ok {
+		c.JSON(http.StatusUnprocessableEntity, verr)
+		return
+	}
+	log.Error(err)
+	c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+}
+
+//GetDeviceTypes list the registered device types
+func GetDeviceTypes(c *gin.Context) {
+	deviceTypes, err := loadDeviceTypes()
+	if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, deviceTypes)
+}
+
+//GetDeviceType fetch a single device type
+func GetDeviceType(c *gin.Context) {
+	dt, err := loadDeviceType(c.Param("type"))
+	if err == errTypeNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, dt)
+}
+
+//PutDeviceType register a device type or replace its schemas, configs already stored aren't revalidated
+func PutDeviceType(c *gin.Context) {
+	var dt DeviceType
+	if err := c.ShouldBindJSON(&dt); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	dt.Name = c.Param("type")
+	dt.Created = time.Now().Unix()
+	if len(dt.Configs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "device type needs the schema of at least one config"})
+		return
+	}
+	if err := dt.compile(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	data, err := json.Marshal(&dt)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	before, err := loadDeviceType(dt.Name)
+	if err != nil && err != errTypeNotFound {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	if err := store.PutEntry(deviceTypesKey, dt.Name, data); err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	if err := types.Refresh(); err != nil {
+		log.Error(err)
+	}
+	if before == nil {
+		AuditChange(c, "", "", resourceDeviceType, actionCreate, nil, &dt)
+	} else {
+		AuditChange(c, "", "", resourceDeviceType, actionUpdate, before, &dt)
+	}
+	log.Infof("registered device type %v", dt.Name)
+	c.JSON(http.StatusOK, dt)
+}
+
+//DeleteDeviceType remove a device type, devices still assigned to it can't be configured until reassigned
+func DeleteDeviceType(c *gin.Context) {
+	before, err := loadDeviceType(c.Param("type"))
+	if err == errTypeNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	removed, err := store.DeleteEntries(deviceTypesKey, c.Param("type"))
+	if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	if removed == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": errTypeNotFound.Error()})
+		return
+	}
+	if err := types.Refresh(); err != nil {
+		log.Error(err)
+	}
+	AuditChange(c, "", "", resourceDeviceType, actionDelete, before, nil)
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
+//GetDeviceAssignment the device type of a device
+func GetDeviceAssignment(c *gin.Context) {
+	val, err := store.GetEntry(assignmentsKey(c.Param("group")), c.Param("deviceid"))
+	if err == errNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device has no type"})
+		return
+	} else if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, Assignment{Type: string(val)})
+}
+
+//PutDeviceAssignment register a device as a device type, its configs are validated from then on
+func PutDeviceAssignment(c *gin.Context) {
+	var assignment Assignment
+	if err := c.ShouldBindJSON(&assignment); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := loadDeviceType(assignment.Type); err == errTypeNotFound {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	group, device := c.Param("group"), c.Param("deviceid")
+	var before interface{}
+	if val, err := store.GetEntry(assignmentsKey(group), device); err == nil {
+		before = Assignment{Type: string(val)}
+	}
+	if err := store.PutEntry(assignmentsKey(group), device, []byte(assignment.Type)); err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	AuditChange(c, group, device, resourceType, actionAssign, before, assignment)
+	c.JSON(http.StatusOK, assignment)
+}
+
+//DeleteDeviceAssignment stop validating the configs of a device
+func DeleteDeviceAssignment(c *gin.Context) {
+	group, device := c.Param("group"), c.Param("deviceid")
+	val, err := store.GetEntry(assignmentsKey(group), device)
+	if err == errNotFound {
+		c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+		return
+	}
+	if err == nil {
+		_, err = store.DeleteEntries(assignmentsKey(group), device)
+	}
+	if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	AuditChange(c, group, device, resourceType, actionUnassign, Assignment{Type: string(val)}, nil)
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+//assign a device type to a device through the admin api
+func assign(t *testing.T, group, device, name string) {
+	t.Helper()
+	body, _ := json.Marshal(Assignment{Type: name})
+	if rec := serve(t, http.MethodPut, "/admin/devices/"+group+"/"+device+"/type", testAdminToken, body, nil); rec.Code != http.StatusOK {
+		t.Fatalf("assign %v to %v/%v: %d %s", name, group, device, rec.Code, rec.Body)
+	}
+}
+
+func TestSeedDeviceTypes(t *testing.T) {
+	rec := serve(t, http.MethodGet, "/admin/types/pismoker", testAdminToken, nil, nil)
+	var dt DeviceType
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &dt) != nil || dt.Configs["configs"] == nil {
+		t.Fatalf("shipped device type: %d %s", rec.Code, rec.Body)
+	}
+
+	edited := []byte(`{"description": "edited", "configs": {"configs": {"type": "object"}}}`)
+	shipped, _ := shippedTypes.ReadFile("types/pismoker.json")
+	defer func() {
+		store.PutEntry(deviceTypesKey, "pismoker", mustType(t, "pismoker", shipped))
+		types.Refresh()
+	}()
+	if err := store.PutEntry(deviceTypesKey, "pismoker", mustType(t, "pismoker", edited)); err != nil {
+		t.Fatal(err)
+	}
+	if err := SeedDeviceTypes(); err != nil {
+		t.Fatal(err)
+	}
+	if dt, err := loadDeviceType("pismoker"); err != nil || dt.Description != "edited" {
+		t.Fatalf("seeding replaced a registered type: %+v %v", dt, err)
+	}
+}
+
+//mustType the stored form of a device type
+func mustType(t *testing.T, name string, data []byte) []byte {
+	t.Helper()
+	var dt DeviceType
+	if err := json.Unmarshal(data, &dt); err != nil {
+		t.Fatal(err)
+	}
+	dt.Name = name
+	data, _ = json.Marshal(&dt)
+	return data
+}
+
+func TestSetConfigValidation(t *testing.T) {
+	assign(t, "typed", "smoker", "pismoker")
+	token := "cook@typed"
+	for _, test := range []struct {
+		name   string
+		config string
+		code   int
+		field  string
+	}{
+		{"valid", `{"pwr": true, "temp": 225}`, http.StatusOK, ""},
+		{"recipe fields", `{"pwr": true, "temp": 225, "recipe": {}, "recipe_step": 1, "step_started": 1601234567}`, http.StatusOK, ""},
+		{"too hot", `{"pwr": true, "temp": 900}`, http.StatusUnprocessableEntity, "/temp"},
+		{"unknown field", `{"pwr": true, "temp": 225, "fan": 3}`, http.StatusUnprocessableEntity, "/"},
+		{"missing field", `{"pwr": true}`, http.StatusUnprocessableEntity, "/"},
+	} {
+		rec := serve(t, http.MethodPost, "/config/typed/smoker/configs", token, []byte(`{"config": `+test.config+`}`), nil)
+		if rec.Code != test.code {
+			t.Fatalf("%v: %d %s", test.name, rec.Code, rec.Body)
+		}
+		if test.field == "" {
+			continue
+		}
+		var verr ValidationError
+		if err := json.Unmarshal(rec.Body.Bytes(), &verr); err != nil || verr.Type != "pismoker" || verr.Config != "configs" || len(verr.Details) == 0 {
+			t.Fatalf("%v: %s %v", test.name, rec.Body, err)
+		}
+		if verr.Details[0].Field != test.field || verr.Details[0].Error == "" {
+			t.Fatalf("%v: details %+v", test.name, verr.Details)
+		}
+	}
+	rec := serve(t, http.MethodPost, "/config/typed/smoker/other", token, []byte(`{"config": {}}`), nil)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("config the type has no schema for: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestRequireType(t *testing.T) {
+	body := []byte(`{"config": {"anything": true}}`)
+	if rec := serve(t, http.MethodPost, "/config/untyped/smoker/configs", "cook@untyped", body, nil); rec.Code != http.StatusOK {
+		t.Fatalf("untyped write: %d %s", rec.Code, rec.Body)
+	}
+	requireType = true
+	defer func() { requireType = false }()
+	rec := serve(t, http.MethodPost, "/config/untyped/smoker/configs", "cook@untyped", body, nil)
+	var verr ValidationError
+	if rec.Code != http.StatusUnprocessableEntity || json.Unmarshal(rec.Body.Bytes(), &verr) != nil || verr.Reason != "device has no type" {
+		t.Fatalf("untyped write with a type required: %d %s", rec.Code, rec.Body)
+	}
+}
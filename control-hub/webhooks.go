@@ -0,0 +1,659 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+const (
+	webhooksPrefix     = "webhooks/"
+	deliveriesSuffix   = "/deliveries"
+	maxDeliveries      = 100
+	webhookAttempts    = 6
+	webhookBackoff     = 2 * time.Second
+	webhookMaxBackoff  = time.Minute
+	webhookTimeout     = 10 * time.Second
+	webhookConcurrency = 4
+	webhookPending     = 1000
+	webhookBatch       = 20
+	webhookWait        = 5 * time.Second
+	webhookProgress    = 10 * time.Second
+
+	eventConfigChanged = "config.changed"
+	eventDeviceOffline = "device.offline"
+	eventAlarmFired    = "alarm.fired"
+	eventStepChanged   = "step.changed"
+	eventPing          = "ping"
+
+	eventHeader     = "X-Grill-Event"
+	deliveryHeader  = "X-Grill-Delivery"
+	timestampHeader = "X-Grill-Timestamp"
+	signatureHeader = "X-Grill-Signature"
+)
+
+var (
+	errWebhookNotFound = errors.New("webhook not found")
+	errPrivateAddress  = errors.New("webhooks can't be delivered to private, loopback or link-local addresses")
+
+	//sharedAddressSpace the range carriers put in front of their customers, private in all but name
+	sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+	//webhookEvents every event a webhook can ask for
+	webhookEvents = []string{eventConfigChanged, eventDeviceOffline, eventAlarmFired, eventStepChanged}
+
+	//webhookSources the stream subjects each event comes from, every source has its own durable pull consumer
+	//shared by the replicas so an event is only delivered once
+	webhookSources = []webhookSource{
+		{Event: eventConfigChanged, Subject: auditStream + ".>", Durable: "control-hub-webhooks-config"},
+		{Event: eventDeviceOffline, Subject: eventsStream + ".*.*.presence", Durable: "control-hub-webhooks-presence"},
+		{Event: eventAlarmFired, Subject: eventsStream + ".*.*." + alarmsChannel, Durable: "control-hub-webhooks-alarms"},
+		{Event: eventStepChanged, Subject: eventsStream + ".*.*." + stepsChannel, Durable: "control-hub-webhooks-steps"},
+	}
+
+	deliverer = &Deliverer{
+		Client:     &http.Client{Timeout: webhookTimeout, Transport: webhookTransport()},
+		Attempts:   webhookAttempts,
+		Backoff:    webhookBackoff,
+		MaxBackoff: webhookMaxBackoff,
+		Log:        logDelivery,
+	}
+
+	//webhookSlots the deliveries each webhook may have under way, so a slow receiver only holds up itself
+	webhookSlots   = make(map[string]chan struct{})
+	webhookSlotsMu sync.Mutex
+)
+
+//Webhook a url in a group told about the events it asked for. The secret signs every payload and is only
+//shown when the webhook is created or the secret changed
+type Webhook struct {
+	ID          string   `json:"id"`
+	URL         string   `json:"url" binding:"required"`
+	Events      []string `json:"events" binding:"required"`
+	Secret      string   `json:"secret,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Author      string   `json:"author,omitempty"`
+	Created     int64    `json:"created"`
+	Updated     int64    `json:"updated"`
+}
+
+//WebhookEvent the payload POSTed to a webhook, data is the message the event came from
+type WebhookEvent struct {
+	ID        string          `json:"id"`
+	Event     string          `json:"event"`
+	Group     string          `json:"group"`
+	Device    string          `json:"device,omitempty"`
+	Timestamp int64           `json:"timestamp"`
+	Data      json.RawMessage `json:"data,omitempty"`
+}
+
+//DeliveryAttempt a single POST of an event to a webhook as kept in the delivery log. Status is 0 when the
+//receiver couldn't be reached
+type DeliveryAttempt struct {
+	Event     string `json:"event_id"`
+	Type      string `json:"event"`
+	Attempt   int    `json:"attempt"`
+	Status    int    `json:"status"`
+	Error     string `json:"error,omitempty"`
+	Delivered bool   `json:"delivered"`
+	Final     bool   `json:"final"`
+	Duration  int64  `json:"duration_ms"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+//Deliverer POSTs events to webhooks, retrying failures with exponential backoff. Log is told about every
+//attempt, it may be nil
+type Deliverer struct {
+	Client     *http.Client
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Log        func(group, hook string, attempt *DeliveryAttempt)
+}
+
+//webhookSource where the events of a type come from
+type webhookSource struct {
+	Event   string
+	Subject string
+	Durable string
+}
+
+func webhooksKey(group string) string {
+	return webhooksPrefix + group
+}
+
+func deliveriesKey(group, id string) string {
+	return webhooksPrefix + group + "/" + id + deliveriesSuffix
+}
+
+//Sign the signature of a payload sent at timestamp, receivers compute the same over the X-Grill-Timestamp
+//header and the raw body and compare it to X-Grill-Signature
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+//publicIP whether an address is on the internet rather than inside the cluster or the host
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip))
+}
+
+//dialPublic refuse to connect anywhere but a public address. It runs once the name is resolved, right before
+//connecting, so neither a name that resolves inside nor a redirect gets around it
+func dialPublic(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+		return fmt.Errorf("%v: %w", host, errPrivateAddress)
+	}
+	return nil
+}
+
+//webhookTransport the transport deliveries go out through, it only connects to public addresses and ignores
+//proxy settings since the proxy is what would be checked
+func webhookTransport() *http.Transport {
+	dialer := &net.Dialer{Timeout: webhookTimeout, KeepAlive: 30 * time.Second, Control: dialPublic}
+	return &http.Transport{
+		DialContext:         dialer.DialContext,
+		MaxIdleConnsPerHost: webhookConcurrency,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: webhookTimeout,
+	}
+}
+
+//Wants whether the webhook asked for an event
+func (w *Webhook) Wants(event string) bool {
+	return event == eventPing || hasString(w.Events, event)
+}
+
+//Validate check a webhook can be delivered to
+func (w *Webhook) Validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an absolute http or https url")
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !publicIP(ip) {
+		return errPrivateAddress
+	}
+	if len(w.Events) == 0 {
+		return errors.New("webhook needs at least one event")
+	}
+	for _, event := range w.Events {
+		if !hasString(webhookEvents, event) {
+			return fmt.Errorf("event must be one of %v", strings.Join(webhookEvents, ", "))
+		}
+	}
+	return nil
+}
+
+//retryable whether a delivery that got a status is worth trying again, the receiver turning the payload
+//down won't change with another try
+func retryable(status int) bool {
+	return status == 0 || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests || status >= 500
+}
+
+//post send an event once
+func (d *Deliverer) post(hook *Webhook, event *WebhookEvent, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "control-hub-webhooks")
+	req.Header.Set(eventHeader, event.Event)
+	req.Header.Set(deliveryHeader, event.ID)
+	req.Header.Set(timestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(signatureHeader, Sign(hook.Secret, timestamp, body))
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10)) //Drain so the connection is reused
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, errors.New("receiver answered " + resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+//Deliver POST an event to a webhook until it's accepted, turned down or out of attempts. Returns the last attempt
+func (d *Deliverer) Deliver(group string, hook *Webhook, event *WebhookEvent) *DeliveryAttempt {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return &DeliveryAttempt{Event: event.ID, Type: event.Event, Error: err.Error(), Final: true}
+	}
+	backoff := d.Backoff
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		status, err := d.post(hook, event, body)
+		result := &DeliveryAttempt{
+			Event:     event.ID,
+			Type:      event.Event,
+			Attempt:   attempt,
+			Status:    status,
+			Delivered: err == nil,
+			Duration:  time.Since(start).Milliseconds(),
+			Timestamp: start.Unix(),
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		result.Final = err == nil || !retryable(status) || attempt >= d.Attempts
+		if d.Log != nil {
+			d.Log(group, hook.ID, result)
+		}
+		if result.Final {
+			return result
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > d.MaxBackoff {
+			backoff = d.MaxBackoff
+		}
+	}
+}
+
+//logDelivery keep an attempt in the delivery log of the webhook
+func logDelivery(group, hook string, attempt *DeliveryAttempt) {
+	if !attempt.Delivered {
+		log.Warnf("webhook %v/%v attempt %d for %v failed: %v", group, hook, attempt.Attempt, attempt.Event, attempt.Error)
+	}
+	data, err := json.Marshal(attempt)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if err := store.AppendLog(deliveriesKey(group, hook), data, maxDeliveries); err != nil {
+		log.Error(err)
+	}
+}
+
+func loadWebhooks(group string) ([]Webhook, error) {
+	entries, err := allEntries(webhooksKey(group))
+	if err != nil {
+		return nil, err
+	}
+	hooks := make([]Webhook, 0, len(entries))
+	for _, entry := range entries {
+		var hook Webhook
+		if err := json.Unmarshal(entry.Data, &hook); err != nil {
+			log.Error(err)
+			continue
+		}
+		hooks = append(hooks, hook)
+	}
+	sort.Slice(hooks, func(i, j int) bool {
+		return hooks[i].Created < hooks[j].Created
+	})
+	return hooks, nil
+}
+
+func loadWebhook(group, id string) (*Webhook, error) {
+	val, err := store.GetEntry(webhooksKey(group), id)
+	if err == errNotFound {
+		return nil, errWebhookNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var hook Webhook
+	if err := json.Unmarshal(val, &hook); err != nil {
+		return nil, err
+	}
+	return &hook, nil
+}
+
+func storeWebhook(group string, hook *Webhook) error {
+	data, err := json.Marshal(hook)
+	if err != nil {
+		return err
+	}
+	return store.PutEntry(webhooksKey(group), hook.ID, data)
+}
+
+//redacted a copy of a webhook without its secret
+func redacted(hook Webhook) Webhook {
+	hook.Secret = ""
+	return hook
+}
+
+//webhookEvent turn a stream message into the event webhooks are told about, nil for messages that aren't one.
+//The id stays the same when a message is redelivered so receivers can drop duplicates
+func webhookEvent(source *webhookSource, m *nats.Msg) *WebhookEvent {
+	event := &WebhookEvent{ID: nuid.Next(), Event: source.Event, Timestamp: time.Now().Unix(), Data: m.Data}
+	if meta, err := m.Metadata(); err == nil {
+		event.ID = fmt.Sprintf("%v-%d", meta.Stream, meta.Sequence.Stream)
+	}
+	switch source.Event {
+	case eventConfigChanged:
+		var entry AuditEntry
+		if err := json.Unmarshal(m.Data, &entry); err != nil {
+			log.Error(err)
+			return nil
+		}
+		if entry.Resource != "" { //Changes to anything but a config are audited but aren't config changes
+			return nil
+		}
+		event.ID, event.Group, event.Device = entry.ID, entry.Group, entry.Device
+		return event
+	case eventDeviceOffline:
+		var presence struct {
+			State string `json:"state"`
+		}
+		if err := json.Unmarshal(m.Data, &presence); err != nil || presence.State != "offline" {
+			return nil
+		}
+	}
+	parts := strings.Split(m.Subject, ".") //EVENTS.<group>.<device>.<channel>
+	if len(parts) != 4 {
+		return nil
+	}
+	event.Group, event.Device = parts[1], parts[2]
+	return event
+}
+
+//webhookSlot the slots of a webhook, made the first time it gets an event
+func webhookSlot(group, id string) chan struct{} {
+	webhookSlotsMu.Lock()
+	defer webhookSlotsMu.Unlock()
+	key := group + "/" + id
+	slots, ok := webhookSlots[key]
+	if !ok {
+		slots = make(chan struct{}, webhookConcurrency)
+		webhookSlots[key] = slots
+	}
+	return slots
+}
+
+//dispatch deliver an event to every webhook of its group that asked for it, returns once every delivery
+//was accepted, turned down or ran out of attempts
+func dispatch(event *WebhookEvent) error {
+	hooks, err := loadWebhooks(event.Group)
+	if err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	for i := range hooks {
+		if !hooks[i].Wants(event.Event) {
+			continue
+		}
+		hook := hooks[i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots := webhookSlot(event.Group, hook.ID)
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			deliverer.Deliver(event.Group, &hook, event)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+//handleWebhookMessage dispatch the event in a message and ack it once its deliveries are done. The message
+//stays in flight until then so a replica going away mid retry leaves it to be redelivered
+func handleWebhookMessage(source *webhookSource, m *nats.Msg) {
+	event := webhookEvent(source, m)
+	if event == nil {
+		m.Ack()
+		return
+	}
+	done := make(chan error, 1)
+	go func() { done <- dispatch(event) }()
+	progress := time.NewTicker(webhookProgress)
+	defer progress.Stop()
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				log.Error(err)
+				m.Nak()
+				return
+			}
+			m.Ack()
+			return
+		case <-progress.C:
+			m.InProgress()
+		}
+	}
+}
+
+//idleFetch whether a fetch failed only because nothing arrived in time, the server answers a pull that
+//expired with a 408 that this nats.go doesn't have an error for
+func idleFetch(err error) bool {
+	return err == nats.ErrTimeout || (err != nil && strings.HasSuffix(err.Error(), "Request Timeout"))
+}
+
+//pullSubscribe bind to a durable pull consumer, waiting for the stream to be there
+func pullSubscribe(subject, durable string, opts ...nats.SubOpt) *nats.Subscription {
+	opts = append([]nats.SubOpt{nats.DeliverNew(), nats.ManualAck(), nats.AckExplicit()}, opts...)
+	for {
+		sub, err := js.PullSubscribe(subject, durable, opts...)
+		if err == nil {
+			return sub
+		}
+		log.Errorf("can't consume %v: %v", subject, err)
+		time.Sleep(webhookWait)
+	}
+}
+
+//consumeWebhookSource pull the messages of a source and dispatch the events in them, each message on its own.
+//The consumer hands out at most webhookPending messages that haven't been acked
+func consumeWebhookSource(source webhookSource) {
+	sub := pullSubscribe(source.Subject, source.Durable, nats.MaxAckPending(webhookPending))
+	for {
+		msgs, err := sub.Fetch(webhookBatch, nats.MaxWait(webhookWait))
+		if idleFetch(err) {
+			continue
+		} else if err != nil {
+			log.Error(err)
+			time.Sleep(webhookWait)
+			continue
+		}
+		for _, m := range msgs {
+			go handleWebhookMessage(&source, m)
+		}
+	}
+}
+
+//RunWebhooks deliver events to webhooks
+func RunWebhooks() {
+	for _, source := range webhookSources {
+		go consumeWebhookSource(source)
+	}
+}
+
+//GetWebhooks every webhook of a group, without secrets
+func GetWebhooks(c *gin.Context) {
+	hooks, err := loadWebhooks(c.Param("group"))
+	if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	for i := range hooks {
+		hooks[i] = redacted(hooks[i])
+	}
+	c.JSON(http.StatusOK, hooks)
+}
+
+//PostWebhook register a webhook, a secret is made up unless one is given. The response is the only time
+//the secret is shown
+func PostWebhook(c *gin.Context) {
+	var hook Webhook
+	if err := c.ShouldBindJSON(&hook); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := hook.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if hook.Secret == "" {
+		secret, err := newSecret()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		hook.Secret = secret
+	}
+	hook.ID = nuid.Next()
+	hook.Author = author(c, hook.Author)
+	hook.Created = time.Now().Unix()
+	hook.Updated = hook.Created
+	if err := storeWebhook(c.Param("group"), &hook); err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	AuditChange(c, c.Param("group"), "", resourceWebhook, actionCreate, nil, redacted(hook))
+	c.JSON(http.StatusCreated, &hook)
+}
+
+func webhookError(c *gin.Context, err error) {
+	if err == errWebhookNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	log.Error(err)
+	c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+}
+
+//GetWebhook a single webhook, without its secret
+func GetWebhook(c *gin.Context) {
+	hook, err := loadWebhook(c.Param("group"), c.Param("id"))
+	if err != nil {
+		webhookError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, redacted(*hook))
+}
+
+//PutWebhook change the url, events or description of a webhook. The secret is kept unless a new one is given
+func PutWebhook(c *gin.Context) {
+	group := c.Param("group")
+	hook, err := loadWebhook(group, c.Param("id"))
+	if err != nil {
+		webhookError(c, err)
+		return
+	}
+	var update Webhook
+	if err := c.ShouldBindJSON(&update); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := update.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	update.ID, update.Author, update.Created = hook.ID, hook.Author, hook.Created
+	update.Updated = time.Now().Unix()
+	rotated := update.Secret != ""
+	if !rotated {
+		update.Secret = hook.Secret
+	}
+	if err := storeWebhook(group, &update); err != nil {
+		webhookError(c, err)
+		return
+	}
+	AuditChange(c, group, "", resourceWebhook, actionUpdate, redacted(*hook), redacted(update))
+	if rotated {
+		c.JSON(http.StatusOK, &update)
+		return
+	}
+	c.JSON(http.StatusOK, redacted(update))
+}
+
+//DeleteWebhook remove a webhook along with its delivery log
+func DeleteWebhook(c *gin.Context) {
+	group, id := c.Param("group"), c.Param("id")
+	var before interface{}
+	if hook, err := loadWebhook(group, id); err == nil {
+		before = redacted(*hook)
+	}
+	removed, err := store.DeleteEntries(webhooksKey(group), id)
+	if err != nil {
+		webhookError(c, err)
+		return
+	}
+	if removed == 0 {
+		webhookError(c, errWebhookNotFound)
+		return
+	}
+	if err := store.DeleteLog(deliveriesKey(group, id)); err != nil {
+		log.Error(err)
+	}
+	AuditChange(c, group, "", resourceWebhook, actionDelete, before, nil)
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
+//GetDeliveries the delivery log of a webhook, newest attempt first
+func GetDeliveries(c *gin.Context) {
+	group, id := c.Param("group"), c.Param("id")
+	if _, err := loadWebhook(group, id); err != nil {
+		webhookError(c, err)
+		return
+	}
+	vals, err := store.ReadLog(deliveriesKey(group, id), maxDeliveries)
+	if err != nil {
+		webhookError(c, err)
+		return
+	}
+	attempts := make([]DeliveryAttempt, 0, len(vals))
+	for _, val := range vals {
+		var attempt DeliveryAttempt
+		if err := json.Unmarshal(val, &attempt); err != nil {
+			log.Error(err)
+			continue
+		}
+		attempts = append(attempts, attempt)
+	}
+	c.JSON(http.StatusOK, attempts)
+}
+
+//PostPing send a ping event to a webhook right away, once, and answer with how it went
+func PostPing(c *gin.Context) {
+	group := c.Param("group")
+	hook, err := loadWebhook(group, c.Param("id"))
+	if err != nil {
+		webhookError(c, err)
+		return
+	}
+	event := &WebhookEvent{ID: nuid.Next(), Event: eventPing, Group: group, Timestamp: time.Now().Unix()}
+	once := *deliverer
+	once.Attempts = 1
+	c.JSON(http.StatusOK, once.Deliver(group, hook, event))
+}
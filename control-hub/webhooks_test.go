@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//testDeliverer a deliverer that retries right away and connects anywhere, httptest servers are on loopback
+func testDeliverer() *Deliverer {
+	return &Deliverer{
+		Client:     &http.Client{Timeout: time.Second},
+		Attempts:   3,
+		Backoff:    time.Millisecond,
+		MaxBackoff: 2 * time.Millisecond,
+	}
+}
+
+func TestDeliverSigned(t *testing.T) {
+	hook := &Webhook{ID: "h", URL: "", Secret: "s3cret"}
+	event := &WebhookEvent{ID: "EVENTS-1", Event: eventAlarmFired, Group: "g", Device: "d", Data: json.RawMessage(`{"alarm":"pit_high"}`)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		ts, err := strconv.ParseInt(r.Header.Get(timestampHeader), 10, 64)
+		if err != nil || r.Header.Get(signatureHeader) != Sign(hook.Secret, ts, body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get(eventHeader) != eventAlarmFired || r.Header.Get(deliveryHeader) != "EVENTS-1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	hook.URL = srv.URL
+	result := testDeliverer().Deliver("g", hook, event)
+	if !result.Delivered || result.Status != http.StatusNoContent || result.Attempt != 1 {
+		t.Fatalf("signed delivery: %+v", result)
+	}
+}
+
+func TestSign(t *testing.T) {
+	if sig := Sign("secret", 1601234567, []byte(`{}`)); sig != Sign("secret", 1601234567, []byte(`{}`)) || len(sig) != len("sha256=")+64 {
+		t.Fatalf("signature: %v", sig)
+	}
+	if Sign("secret", 1601234567, []byte(`{}`)) == Sign("other", 1601234567, []byte(`{}`)) {
+		t.Fatal("signature doesn't depend on the secret")
+	}
+	if Sign("secret", 1601234567, []byte(`{}`)) == Sign("secret", 1601234568, []byte(`{}`)) {
+		t.Fatal("signature doesn't depend on the timestamp")
+	}
+}
+
+func TestDeliverRetry(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	var attempts []*DeliveryAttempt
+	d := testDeliverer()
+	d.Log = func(group, hook string, attempt *DeliveryAttempt) {
+		attempts = append(attempts, attempt)
+	}
+	result := d.Deliver("g", &Webhook{ID: "h", URL: srv.URL}, &WebhookEvent{ID: "e", Event: eventPing})
+	if !result.Delivered || result.Attempt != 3 || len(attempts) != 3 {
+		t.Fatalf("retried delivery: %+v after %d attempts", result, len(attempts))
+	}
+	if attempts[0].Delivered || attempts[0].Final || attempts[0].Status != http.StatusServiceUnavailable || !attempts[2].Final {
+		t.Fatalf("attempts: %+v %+v", attempts[0], attempts[2])
+	}
+}
+
+func TestDeliverGivesUp(t *testing.T) {
+	for _, test := range []struct {
+		status   int
+		attempts int
+	}{
+		{http.StatusBadRequest, 1},
+		{http.StatusGone, 1},
+		{http.StatusTooManyRequests, 3},
+		{http.StatusBadGateway, 3},
+	} {
+		var calls int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			w.WriteHeader(test.status)
+		}))
+		result := testDeliverer().Deliver("g", &Webhook{ID: "h", URL: srv.URL}, &WebhookEvent{ID: "e", Event: eventPing})
+		srv.Close()
+		if result.Delivered || !result.Final || int(calls) != test.attempts {
+			t.Fatalf("status %d: %+v after %d calls", test.status, result, calls)
+		}
+	}
+}
+
+func TestDeliveryLog(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	d := testDeliverer()
+	d.Log = logDelivery
+	d.Deliver("g", &Webhook{ID: "h", URL: srv.URL}, &WebhookEvent{ID: "e", Event: eventPing})
+	vals, err := store.ReadLog(deliveriesKey("g", "h"), maxDeliveries)
+	if err != nil || len(vals) != 3 {
+		t.Fatalf("delivery log: %d entries %v", len(vals), err)
+	}
+	var newest DeliveryAttempt
+	if err := json.Unmarshal(vals[0], &newest); err != nil {
+		t.Fatal(err)
+	}
+	if newest.Attempt != 3 || !newest.Final || newest.Delivered || newest.Status != http.StatusInternalServerError || newest.Event != "e" {
+		t.Fatalf("newest attempt: %+v", newest)
+	}
+}
+
+func TestDeliverPrivateAddress(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer srv.Close()
+	once := *deliverer
+	once.Attempts, once.Log = 1, nil
+	result := once.Deliver("g", &Webhook{ID: "h", URL: srv.URL}, &WebhookEvent{ID: "e", Event: eventPing})
+	if result.Delivered || calls != 0 {
+		t.Fatalf("delivery to loopback: %+v", result)
+	}
+	if err := dialPublic("tcp", srv.Listener.Addr().String(), nil); !errors.Is(err, errPrivateAddress) {
+		t.Fatalf("dial to loopback: %v", err)
+	}
+	for _, addr := range []string{"10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254", "100.64.0.1", "0.0.0.0", "::1", "fe80::1", "fc00::1", "::ffff:127.0.0.1"} {
+		if publicIP(net.ParseIP(addr)) {
+			t.Fatalf("%v is treated as public", addr)
+		}
+	}
+	for _, addr := range []string{"93.184.216.34", "2606:2800:220:1:248:1893:25c8:1946"} {
+		if !publicIP(net.ParseIP(addr)) {
+			t.Fatalf("%v is treated as private", addr)
+		}
+	}
+	if err := (&Webhook{URL: "http://169.254.169.254/latest", Events: []string{eventAlarmFired}}).Validate(); err != errPrivateAddress {
+		t.Fatalf("webhook to the metadata service: %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	pb "github.com/charles-d-burton/grillbernetes/proto"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+//Encoding wire format a subscriber receives events in
+type Encoding string
+
+const (
+	encodingJSON     Encoding = "json"
+	encodingProtobuf Encoding = "protobuf"
+	encodingCBOR     Encoding = "cbor"
+)
+
+var mediaTypes = map[string]Encoding{
+	"application/json":       encodingJSON,
+	"application/protobuf":   encodingProtobuf,
+	"application/x-protobuf": encodingProtobuf,
+	"application/cbor":       encodingCBOR,
+}
+
+//cborEvent CBOR form of a Message
+type cborEvent struct {
+	Timestamp int64       `cbor:"timestamp"`
+	Sequence  uint64      `cbor:"seq,omitempty"`
+	Device    string      `cbor:"device,omitempty"`
+	Channel   string      `cbor:"channel,omitempty"`
+	Data      interface{} `cbor:"data"`
+}
+
+//negotiateEncoding pick the encoding of a subscriber, ?encoding= wins since browsers can't set headers on
+//EventSource or WebSocket, then the first media type of the Accept header we know. JSON unless asked otherwise
+func negotiateEncoding(c *gin.Context) (Encoding, error) {
+	if val := c.Query("encoding"); val != "" {
+		switch enc := Encoding(strings.ToLower(val)); enc {
+		case encodingJSON, encodingProtobuf, encodingCBOR:
+			return enc, nil
+		}
+		return "", fmt.Errorf("unknown encoding %q, must be json, protobuf or cbor", val)
+	}
+	for _, part := range strings.Split(c.GetHeader("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
+		if enc, ok := mediaTypes[strings.ToLower(mediaType)]; ok {
+			return enc, nil
+		}
+	}
+	return encodingJSON, nil
+}
+
+//Binary whether the encoding has to be framed as binary
+func (enc Encoding) Binary() bool {
+	return enc != encodingJSON
+}
+
+//ContentType media type of a stream of events in this encoding
+func (enc Encoding) ContentType() string {
+	switch enc {
+	case encodingProtobuf:
+		return "application/x-protobuf"
+	case encodingCBOR:
+		return "application/cbor-seq"
+	}
+	return "application/json"
+}
+
+//Encode translate a fanned out JSON message into the encoding
+func (enc Encoding) Encode(message []byte) ([]byte, error) {
+	if enc == encodingJSON {
+		return message, nil
+	}
+	var msg Message
+	if err := json.Unmarshal(message, &msg); err != nil {
+		return nil, err
+	}
+	switch enc {
+	case encodingProtobuf:
+		return proto.Marshal(msg.Event())
+	case encodingCBOR:
+		var data interface{}
+		if err := json.Unmarshal(msg.Datum, &data); err != nil {
+			return nil, err
+		}
+		return cbor.Marshal(&cborEvent{Timestamp: msg.Timestamp, Sequence: msg.Sequence, Device: msg.Device, Channel: msg.Channel, Data: data})
+	}
+	return nil, fmt.Errorf("unknown encoding %q", enc)
+}
+
+//Event the protobuf form of a message, payloads that aren't readings are passed through as their JSON
+func (msg *Message) Event() *pb.Event {
+	event := &pb.Event{Timestamp: msg.Timestamp, Seq: msg.Sequence, Device: msg.Device, Channel: msg.Channel}
+	var reading pb.Reading
+	if err := protojson.Unmarshal(msg.Datum, &reading); err == nil {
+		event.Data = &pb.Event_Reading{Reading: &reading}
+	} else {
+		event.Data = &pb.Event_Json{Json: msg.Datum}
+	}
+	return event
+}
+
+//Frame an encoded event for a plain HTTP stream. Protobuf messages aren't self delimiting so they're
+//prefixed with their varint length, CBOR items are and are sent back to back as a CBOR sequence
+func (enc Encoding) Frame(data []byte) []byte {
+	switch enc {
+	case encodingProtobuf:
+		return append(protowire.AppendVarint(nil, uint64(len(data))), data...)
+	case encodingCBOR:
+		return data
+	}
+	return append(data, '\n')
+}
+
+//SSEData an encoded event as the data of a server sent event, binary encodings are base64 since SSE is text
+func (enc Encoding) SSEData(data []byte) interface{} {
+	if enc.Binary() {
+		return base64.StdEncoding.EncodeToString(data)
+	}
+	return json.RawMessage(data)
+}
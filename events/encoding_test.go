@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	pb "github.com/charles-d-burton/grillbernetes/proto"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	for _, test := range []struct {
+		name, query, accept string
+		enc                 Encoding
+		fails               bool
+	}{
+		{"nothing asked for", "", "", encodingJSON, false},
+		{"browser default", "", "text/html,application/xhtml+xml,*/*;q=0.8", encodingJSON, false},
+		{"protobuf", "", "application/protobuf", encodingProtobuf, false},
+		{"legacy protobuf type", "", "application/x-protobuf", encodingProtobuf, false},
+		{"cbor with parameters", "", "application/cbor; q=0.9", encodingCBOR, false},
+		{"first known type wins", "", "text/plain, application/cbor, application/protobuf", encodingCBOR, false},
+		{"media types are case insensitive", "", "Application/CBOR", encodingCBOR, false},
+		{"query wins over the header", "encoding=protobuf", "application/cbor", encodingProtobuf, false},
+		{"query is case insensitive", "encoding=CBOR", "", encodingCBOR, false},
+		{"unknown encoding in the query", "encoding=xml", "", "", true},
+	} {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodGet, "/events/home/smoker?"+test.query, nil)
+		c.Request.Header.Set("Accept", test.accept)
+		enc, err := negotiateEncoding(c)
+		if (err != nil) != test.fails || enc != test.enc {
+			t.Fatalf("%v: %q %v", test.name, enc, err)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	reading := []byte(`{"timestamp":1601234567,"seq":42,"device":"smoker","channel":"readings","data":{"id":"28-0000","running":true,"name":"pit","f":225.5,"c":107.5}}`)
+	alarm := []byte(`{"timestamp":1601234568,"seq":43,"device":"smoker","channel":"alarms","data":{"alarm":"pit_high","limit":300}}`)
+
+	if data, err := encodingJSON.Encode(reading); err != nil || string(data) != string(reading) {
+		t.Fatalf("json: %s %v", data, err)
+	}
+
+	data, err := encodingProtobuf.Encode(reading)
+	var event pb.Event
+	if err != nil || proto.Unmarshal(data, &event) != nil {
+		t.Fatalf("protobuf reading: %v", err)
+	}
+	if event.Timestamp != 1601234567 || event.Seq != 42 || event.Device != "smoker" || event.GetReading().GetF() != 225.5 || event.GetReading().GetName() != "pit" {
+		t.Fatalf("protobuf reading: %+v", &event)
+	}
+	if data, err = encodingProtobuf.Encode(alarm); err != nil || proto.Unmarshal(data, &event) != nil {
+		t.Fatalf("protobuf alarm: %v", err)
+	}
+	if event.Channel != "alarms" || event.GetReading() != nil || string(event.GetJson()) != `{"alarm":"pit_high","limit":300}` {
+		t.Fatalf("payload that isn't a reading wasn't passed through as JSON: %+v", &event)
+	}
+
+	data, err = encodingCBOR.Encode(alarm)
+	var ce cborEvent
+	if err != nil || cbor.Unmarshal(data, &ce) != nil {
+		t.Fatalf("cbor: %v", err)
+	}
+	payload, _ := json.Marshal(ce.Data)
+	if ce.Timestamp != 1601234568 || ce.Sequence != 43 || ce.Channel != "alarms" || string(payload) != `{"alarm":"pit_high","limit":300}` {
+		t.Fatalf("cbor: %+v %s", ce, payload)
+	}
+
+	for _, enc := range []Encoding{encodingProtobuf, encodingCBOR} {
+		if _, err := enc.Encode([]byte("not json")); err == nil {
+			t.Fatalf("%v encoded a message that isn't json", enc)
+		}
+	}
+}
+
+func TestFrame(t *testing.T) {
+	data := []byte{0x08, 0x01}
+	framed := encodingProtobuf.Frame(data)
+	size, n := protowire.ConsumeVarint(framed)
+	if n < 1 || size != uint64(len(data)) || string(framed[n:]) != string(data) {
+		t.Fatalf("protobuf frame: %x", framed)
+	}
+	if framed := encodingCBOR.Frame(data); string(framed) != string(data) {
+		t.Fatalf("cbor frame: %x", framed)
+	}
+	if framed := encodingJSON.Frame([]byte(`{}`)); string(framed) != "{}\n" {
+		t.Fatalf("json frame: %q", framed)
+	}
+	if sse := encodingCBOR.SSEData(data); sse != base64.StdEncoding.EncodeToString(data) {
+		t.Fatalf("binary server sent event: %v", sse)
+	}
+	if sse, ok := encodingJSON.SSEData([]byte(`{}`)).(json.RawMessage); !ok || string(sse) != "{}" {
+		t.Fatalf("json server sent event: %v", sse)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+
+	pb "github.com/charles-d-burton/grillbernetes/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const grpcAddr = ":7778"
+
+//eventsServer the Events api, fed by the same subscribers as the SSE and WebSocket endpoints
+type eventsServer struct {
+	pb.UnimplementedEventsServer
+	env *Env
+}
+
+//ServeGRPC serve the Events api next to the http endpoints
+func (env *Env) ServeGRPC() {
+	lis, err := net.Listen("tcp", grpcAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	pb.RegisterEventsServer(srv, &eventsServer{env: env})
+	log.Infof("serving grpc on %v", grpcAddr)
+	if err := srv.Serve(lis); err != nil {
+		log.Fatal(err)
+	}
+}
+
+//Subscribe stream the events of a topic until the client goes away
+func (srv *eventsServer) Subscribe(req *pb.SubscribeRequest, stream pb.Events_SubscribeServer) error {
+	topic, err := topicFor(req.Group, req.Device, req.Channel)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	log.Info("Subscribing to topic: ", topic)
+	queue := make(chan []byte, queuelen)
+	subscriber, err := srv.env.natsConn.Subscribe(topic, nil, queue)
+	if err != nil {
+		return status.Error(codes.NotFound, err.Error())
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			subscriber.leave(queue) //Remove our client from the client list
+			return nil
+		case message := <-queue:
+			var msg Message
+			if err := json.Unmarshal(message, &msg); err != nil {
+				log.Error(err)
+				continue
+			}
+			if err := stream.Send(msg.Event()); err != nil {
+				subscriber.leave(queue)
+				return err
+			}
+		case <-subscriber.errors:
+			return status.Error(codes.Unavailable, "subscription lost")
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	pb "github.com/charles-d-burton/grillbernetes/proto"
+	"github.com/nats-io/nuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+//dialEvents a client of the Events api served over an in memory listener
+func dialEvents(t *testing.T) pb.EventsClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	pb.RegisterEventsServer(srv, &eventsServer{env: &Env{testConn}})
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewEventsClient(conn)
+}
+
+func TestGRPCSubscribe(t *testing.T) {
+	client := dialEvents(t)
+	group := nuid.Next()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.Subscribe(ctx, &pb.SubscribeRequest{Group: group, Device: "smoker", Channel: "readings"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//The subscription is made once the call reaches the server, keep publishing until the first event arrives
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			testJS.Publish(streamName+"."+group+".smoker.readings", []byte("0"))
+			select {
+			case <-done:
+				return
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+	}()
+	event, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Device != "smoker" || event.Channel != "readings" || event.Seq == 0 || string(event.GetJson()) != "0" {
+		t.Fatalf("event: %+v", event)
+	}
+
+	for _, test := range []struct {
+		name string
+		req  *pb.SubscribeRequest
+	}{
+		{"every group", &pb.SubscribeRequest{Group: "*"}},
+		{"bad device", &pb.SubscribeRequest{Group: group, Device: "smoker.pi"}},
+		{"bad channel", &pb.SubscribeRequest{Group: group, Device: "smoker", Channel: "readings.raw"}},
+	} {
+		stream, err := client.Subscribe(ctx, test.req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := stream.Recv(); status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"math/rand"
 	"net/http"
 	"os"
+	"strconv"
 	"sync"
 	"time"
 
@@ -19,10 +20,13 @@ import (
 )
 
 const (
-	queuelen   = 100
-	streamName = "EVENTS"
+	queuelen         = 100
+	streamName       = "EVENTS"
+	deviceTimeHeader = "Device-Timestamp"
 )
 
+var errSubscriberStopped = errors.New("subscription lost, try again")
+
 var (
 	usageStr = `
 Usage: pismoker [options]
@@ -52,9 +56,11 @@ type NATSConnection struct {
 	subscribers map[string]*Subscriber
 }
 
-//Subscriber non-blocking broker of NATS messages to HTTP clients
+//Subscriber non-blocking broker of NATS messages to HTTP clients. A subscriber replaying the stream serves
+//a single client and waits for it instead of dropping messages
 type Subscriber struct {
 	topic           string
+	replay          *Replay
 	sub             *nats.Subscription
 	connEstablished chan bool
 	clients         map[chan []byte]bool
@@ -62,11 +68,16 @@ type Subscriber struct {
 	defunctClients  chan chan []byte
 	messages        chan []byte
 	errors          chan error
+	done            chan bool
 }
 
-//Message message object to send back to subsriber
+//Message message object to send back to subsriber, seq is the stream sequence to resume from. Device and
+//channel say where it came from for wildcard topics
 type Message struct {
 	Timestamp int64           `json:"timestamp"`
+	Sequence  uint64          `json:"seq,omitempty"`
+	Device    string          `json:"device,omitempty"`
+	Channel   string          `json:"channel,omitempty"`
 	Datum     json.RawMessage `json:"data"`
 }
 
@@ -115,9 +126,14 @@ func main() {
 		nc.Connect()
 		env := &Env{nc}
 		router.GET("/events/:group/:device/:channel", env.SubscribeSSE)
+		router.GET("/events/:group/:device", env.SubscribeSSE)
 		router.GET("/stream/:group/:device/:channel", env.SubscribeSSE)
+		router.GET("/stream/:group/:device", env.SubscribeSSE)
 		router.GET("/ws/:group/:device/:channel", env.SubscribeWSS)
+		router.GET("/ws/:group/:device", env.SubscribeWSS)
+		router.GET("/ws", env.SubscribeMux)
 		router.GET("/healthz", env.HealthCheck)
+		go env.ServeGRPC()
 
 	}
 	router.Run(":7777")
@@ -151,31 +167,6 @@ func (conn *NATSConnection) Connect() {
 					sub.connEstablished <- true //Let the subscriptions know the connections was established
 				}
 			}
-			js, err := conn.Conn.JetStream()
-			if err != nil {
-				log.Fatal(err)
-			}
-			stream, err := js.StreamInfo(streamName)
-			if err != nil {
-				log.Error(err)
-			}
-			config := &nats.StreamConfig{
-				Name:     streamName,
-				Subjects: []string{streamName + ".>"},
-			}
-			if stream == nil {
-				log.Infof("creating stream %v", streamName)
-				_, err := js.AddStream(config)
-				if err != nil {
-					log.Fatal(err)
-				}
-			} else {
-				log.Infof("updating stream %v", streamName)
-				_, err := js.UpdateStream(config)
-				if err != nil {
-					log.Fatal(err)
-				}
-			}
 			<-cleanup //Wait for cleanup signal
 			return errors.New("connection lost")
 		}
@@ -202,29 +193,75 @@ func (conn *NATSConnection) GetSubscriber(topic string) (*Subscriber, error) {
 	}
 	log.Info("No subscriber found for topic: ", topic)
 	log.Info("Creating new subscriber")
-	subscriber = &Subscriber{
+	subscriber = newSubscriber(topic, nil)
+	err := subscriber.Start(conn)
+	if err != nil {
+		return nil, err
+	}
+	conn.subscribers[topic] = subscriber
+	return subscriber, nil
+}
+
+//ReplaySubscriber a subscriber of its own for a client replaying the stream, it isn't shared since every
+//client starts somewhere else. The client is added before subscribing so it gets the whole replay, and
+//carries on with new readings once it caught up
+func (conn *NATSConnection) ReplaySubscriber(topic string, replay *Replay, client chan []byte) (*Subscriber, error) {
+	log.Info("Creating replay subscriber for topic: ", topic)
+	subscriber := newSubscriber(topic, replay)
+	subscriber.clients[client] = true
+	if err := subscriber.Start(conn); err != nil {
+		return nil, err
+	}
+	return subscriber, nil
+}
+
+func newSubscriber(topic string, replay *Replay) *Subscriber {
+	return &Subscriber{
 		topic:           topic,
+		replay:          replay,
 		connEstablished: make(chan bool, 1),
 		clients:         make(map[chan []byte]bool, 10),
 		newClients:      make(chan (chan []byte)),
 		defunctClients:  make(chan (chan []byte)),
 		messages:        make(chan []byte, 10),
 		errors:          make(chan error, 1),
+		done:            make(chan bool),
 	}
-	err := subscriber.Start(conn)
+}
+
+//Subscribe add a client to the subscriber of a topic, or to a subscriber of its own when it replays the stream
+func (conn *NATSConnection) Subscribe(topic string, replay *Replay, client chan []byte) (*Subscriber, error) {
+	if replay != nil {
+		return conn.ReplaySubscriber(topic, replay, client)
+	}
+	subscriber, err := conn.GetSubscriber(topic)
 	if err != nil {
 		return nil, err
 	}
-	conn.subscribers[topic] = subscriber
+	select {
+	case subscriber.newClients <- client: //Add our new client to the recipient list
+	case <-subscriber.done:
+		return nil, errSubscriberStopped
+	}
 	return subscriber, nil
 }
 
+//leave remove a client from the subscriber, a subscriber that already stopped has nothing to remove it from
+func (subscriber *Subscriber) leave(client chan []byte) {
+	select {
+	case subscriber.defunctClients <- client:
+	case <-subscriber.done:
+	}
+}
+
 //DeleteSubscriber cleans up subscribers that have been removed
 func (conn *NATSConnection) DeleteSubscriber(subscriber *Subscriber) error {
 	log.Info("Locked connection, deleting subscriber")
 	conn.Lock()
 	defer conn.Unlock()
-	delete(conn.subscribers, subscriber.topic)
+	if conn.subscribers[subscriber.topic] == subscriber { //Replay subscribers aren't shared
+		delete(conn.subscribers, subscriber.topic)
+	}
 	err := subscriber.sub.Unsubscribe()
 	if err != nil {
 		return err
@@ -243,28 +280,28 @@ func (subscriber *Subscriber) Start(conn *NATSConnection) error {
 	}
 	subscriber.sub = sub
 	go func() {
+		defer close(subscriber.done)
 		for {
 			select {
 			case s := <-subscriber.newClients:
 				subscriber.clients[s] = true
 				log.Info("Added new subscriber to: ", subscriber.topic)
 			case s := <-subscriber.defunctClients:
-				delete(subscriber.clients, s)
-				log.Info("Removed subscriber from: ", subscriber.topic)
-				if len(subscriber.clients) == 0 { //No more clients to service, fully cleanup
-					log.Info("No more clients, removing subscriber")
-					if subscriber.sub != nil {
-						err := conn.DeleteSubscriber(subscriber)
-						if err != nil {
-							log.Error(err)
-							subscriber.errors <- err
-						}
-						log.Info("Connection cleaned up, exiting subscriber")
-					}
+				if subscriber.remove(conn, s) {
 					return
 				}
 			case msg := <-subscriber.messages:
 				for queue := range subscriber.clients {
+					if subscriber.replay != nil { //Wait for the client, or for it to leave
+						select {
+						case queue <- msg:
+						case s := <-subscriber.defunctClients:
+							if subscriber.remove(conn, s) {
+								return
+							}
+						}
+						continue
+					}
 					if len(queue) < queuelen { //Skip client if their queue is full
 						queue <- msg
 						continue
@@ -296,6 +333,25 @@ func (subscriber *Subscriber) Start(conn *NATSConnection) error {
 	return nil
 }
 
+//remove a client that went away, true when it was the last one and the subscriber is done
+func (subscriber *Subscriber) remove(conn *NATSConnection, s chan []byte) bool {
+	delete(subscriber.clients, s)
+	log.Info("Removed subscriber from: ", subscriber.topic)
+	if len(subscriber.clients) > 0 {
+		return false
+	}
+	log.Info("No more clients, removing subscriber") //No more clients to service, fully cleanup
+	if subscriber.sub != nil {
+		err := conn.DeleteSubscriber(subscriber)
+		if err != nil {
+			log.Error(err)
+			subscriber.errors <- err
+		}
+		log.Info("Connection cleaned up, exiting subscriber")
+	}
+	return true
+}
+
 //Subscribe to a given topic in NATS
 func (subscriber *Subscriber) Subscribe(conn *NATSConnection) (*nats.Subscription, error) {
 	log.Info("Initializing callback")
@@ -304,12 +360,24 @@ func (subscriber *Subscriber) Subscribe(conn *NATSConnection) (*nats.Subscriptio
 	if err != nil {
 		return nil, err
 	}
-	sub, err := js.Subscribe(streamName+"."+subscriber.topic, func(m *nats.Msg) {
+	subject := streamName + "." + subscriber.topic
+	opts := []nats.SubOpt{nats.DeliverNew()}
+	if subscriber.replay != nil {
+		if opts, err = subscriber.replay.SubOpts(js, subject); err != nil {
+			return nil, err
+		}
+	}
+	sub, err := js.Subscribe(subject, func(m *nats.Msg) {
 		meta, _ := m.Metadata()
 		log.Infof("Stream Sequence  : %v\n", meta.Sequence.Stream)
 		log.Infof("Consumer Sequence: %v\n", meta.Sequence.Consumer)
 		var msg Message
 		msg.Timestamp = meta.Timestamp.Unix()
+		msg.Sequence = meta.Sequence.Stream
+		msg.Device, msg.Channel = source(m.Subject)
+		if sent, err := strconv.ParseInt(m.Header.Get(deviceTimeHeader), 10, 64); err == nil {
+			msg.Timestamp = sent //Prefer the device time for readings replayed after an outage
+		}
 		msg.Datum = m.Data
 		data, err := json.Marshal(&msg)
 		if err != nil {
@@ -317,7 +385,7 @@ func (subscriber *Subscriber) Subscribe(conn *NATSConnection) (*nats.Subscriptio
 		} else {
 			subscriber.messages <- data
 		}
-	}, nats.DeliverNew())
+	}, opts...)
 	if err != nil {
 		return nil, err
 	}
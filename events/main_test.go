@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nats-io/nats-server/v2/server"
+	nats "github.com/nats-io/nats.go"
+)
+
+//testConn the connection of the tests to an embedded JetStream server holding the EVENTS stream
+var (
+	testConn *NATSConnection
+	testJS   nats.JetStreamContext
+)
+
+//TestMain run the tests against an embedded JetStream server with the EVENTS stream
+func TestMain(m *testing.M) {
+	os.Exit(runTests(m))
+}
+
+func runTests(m *testing.M) int {
+	log.SetOutput(ioutil.Discard)
+	gin.SetMode(gin.TestMode)
+	dir, err := ioutil.TempDir("", "events")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	ns, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: dir})
+	if err != nil {
+		panic(err)
+	}
+	go ns.Start()
+	defer ns.Shutdown()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		panic("embedded nats server didn't start")
+	}
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		panic(err)
+	}
+	defer nc.Close()
+	if testJS, err = nc.JetStream(); err != nil {
+		panic(err)
+	}
+	if _, err := testJS.AddStream(&nats.StreamConfig{Name: streamName, Subjects: []string{streamName + ".>"}}); err != nil {
+		panic(err)
+	}
+	testConn = &NATSConnection{Conn: nc, NatsHost: ns.ClientURL(), subscribers: make(map[string]*Subscriber)}
+	return m.Run()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+const lastEventIDHeader = "Last-Event-ID"
+
+var errReplayParams = errors.New("only one of since, last and seq can be given")
+
+//Replay where in the stream a subscriber starts instead of the next reading. Since starts at the first
+//reading at or after a time, Last at the last n readings of the topic and Seq at a stream sequence
+type Replay struct {
+	Since time.Time
+	Last  uint64
+	Seq   uint64
+}
+
+//replayFrom the replay a client asked for, nil to only get new readings. A browser reconnecting an
+//EventSource sends the id of the last event it saw, resuming right after it wins over the query so the
+//readings it already has aren't replayed again
+func replayFrom(c *gin.Context) (*Replay, error) {
+	if id := c.GetHeader(lastEventIDHeader); id != "" {
+		seq, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			return nil, errors.New(lastEventIDHeader + " must be a stream sequence")
+		}
+		return &Replay{Seq: seq + 1}, nil
+	}
+	var last, seq uint64
+	var err error
+	if val := c.Query("last"); val != "" {
+		if last, err = strconv.ParseUint(val, 10, 64); err != nil || last == 0 {
+			return nil, errors.New("last must be a number above 0")
+		}
+	}
+	if val := c.Query("seq"); val != "" {
+		if seq, err = strconv.ParseUint(val, 10, 64); err != nil || seq == 0 {
+			return nil, errors.New("seq must be a stream sequence above 0")
+		}
+	}
+	return newReplay(c.Query("since"), last, seq)
+}
+
+//newReplay the replay starting at one of since, the last n readings or a sequence, nil when none is given
+func newReplay(since string, last, seq uint64) (*Replay, error) {
+	replay := &Replay{Last: last, Seq: seq}
+	given := 0
+	if since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			return nil, errors.New("since must be an RFC3339 time")
+		}
+		replay.Since = t
+		given++
+	}
+	if last > 0 {
+		given++
+	}
+	if seq > 0 {
+		given++
+	}
+	switch given {
+	case 0:
+		return nil, nil
+	case 1:
+		return replay, nil
+	}
+	return nil, errReplayParams
+}
+
+//SubOpts the delivery policy of the replay on a subject of the stream. The last n readings can't be asked of
+//JetStream directly, where they start is looked up first
+func (r *Replay) SubOpts(js nats.JetStreamContext, subject string) ([]nats.SubOpt, error) {
+	opts := []nats.SubOpt{nats.AckNone()}
+	switch {
+	case !r.Since.IsZero():
+		return append(opts, nats.StartTime(r.Since)), nil
+	case r.Seq > 0:
+		return append(opts, nats.StartSequence(r.Seq)), nil
+	case r.Last == 1:
+		return append(opts, nats.DeliverLast()), nil
+	}
+	seq, err := startOfLast(js, subject, r.Last)
+	if err != nil {
+		return nil, err
+	}
+	if seq == 0 {
+		return append(opts, nats.DeliverAll()), nil
+	}
+	return append(opts, nats.StartSequence(seq)), nil
+}
+
+//startOfLast the stream sequence the last n messages on a subject start at, 0 when there aren't more than n.
+//The messages on a subject from a sequence on are counted by a consumer starting there, the latest sequence
+//still followed by n of them is searched for between the first and last of the stream
+func startOfLast(js nats.JetStreamContext, subject string, n uint64) (uint64, error) {
+	info, err := js.StreamInfo(streamName)
+	if err != nil {
+		return 0, err
+	}
+	low, high := info.State.FirstSeq, info.State.LastSeq
+	if total, err := pendingFrom(js, subject, low); err != nil || total <= n {
+		return 0, err
+	}
+	for low < high {
+		mid := low + (high-low+1)/2
+		pending, err := pendingFrom(js, subject, mid)
+		if err != nil {
+			return 0, err
+		}
+		if pending >= n {
+			low = mid
+		} else {
+			high = mid - 1
+		}
+	}
+	return low, nil
+}
+
+//pendingFrom how many messages on a subject the stream holds from a sequence on
+func pendingFrom(js nats.JetStreamContext, subject string, seq uint64) (uint64, error) {
+	name := "replay-" + nuid.Next()
+	info, err := js.AddConsumer(streamName, &nats.ConsumerConfig{
+		Durable:       name,
+		DeliverPolicy: nats.DeliverByStartSequencePolicy,
+		OptStartSeq:   seq,
+		AckPolicy:     nats.AckExplicitPolicy,
+		FilterSubject: subject,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := js.DeleteConsumer(streamName, name); err != nil {
+		log.Error(err)
+	}
+	return info.NumPending, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nats-io/nuid"
+)
+
+func TestReplayFrom(t *testing.T) {
+	since, _ := time.Parse(time.RFC3339, "2021-06-01T12:00:00Z")
+	for _, test := range []struct {
+		name, query, lastEventID string
+		replay                   *Replay
+		fails                    bool
+	}{
+		{"nothing to replay", "", "", nil, false},
+		{"since", "since=2021-06-01T12:00:00Z", "", &Replay{Since: since}, false},
+		{"last", "last=5", "", &Replay{Last: 5}, false},
+		{"seq", "seq=42", "", &Replay{Seq: 42}, false},
+		{"Last-Event-ID resumes after it", "", "41", &Replay{Seq: 42}, false},
+		{"Last-Event-ID wins over the query", "last=5&since=2021-06-01T12:00:00Z", "41", &Replay{Seq: 42}, false},
+		{"Last-Event-ID that isn't a sequence", "", "abc", nil, true},
+		{"since and last", "since=2021-06-01T12:00:00Z&last=5", "", nil, true},
+		{"last and seq", "last=5&seq=42", "", nil, true},
+		{"since that isn't RFC3339", "since=yesterday", "", nil, true},
+		{"last of 0", "last=0", "", nil, true},
+		{"negative last", "last=-1", "", nil, true},
+		{"seq of 0", "seq=0", "", nil, true},
+	} {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodGet, "/events/home/smoker?"+test.query, nil)
+		if test.lastEventID != "" {
+			c.Request.Header.Set(lastEventIDHeader, test.lastEventID)
+		}
+		replay, err := replayFrom(c)
+		if (err != nil) != test.fails {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		if (replay == nil) != (test.replay == nil) || replay != nil && *replay != *test.replay {
+			t.Fatalf("%v: replay %+v, want %+v", test.name, replay, test.replay)
+		}
+	}
+}
+
+func TestNewReplay(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		since     string
+		last, seq uint64
+		replay    *Replay
+		err       error
+	}{
+		{"nothing to replay", "", 0, 0, nil, nil},
+		{"last", "", 10, 0, &Replay{Last: 10}, nil},
+		{"seq", "", 0, 7, &Replay{Seq: 7}, nil},
+		{"all three", "2021-06-01T12:00:00Z", 10, 7, nil, errReplayParams},
+		{"since and seq", "2021-06-01T12:00:00Z", 0, 7, nil, errReplayParams},
+	} {
+		replay, err := newReplay(test.since, test.last, test.seq)
+		if err != test.err {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		if (replay == nil) != (test.replay == nil) || replay != nil && *replay != *test.replay {
+			t.Fatalf("%v: replay %+v, want %+v", test.name, replay, test.replay)
+		}
+	}
+}
+
+//publishReadings publish readings numbered from 0 to a subject of the stream
+func publishReadings(t *testing.T, subject string, count int) {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		if _, err := testJS.Publish(subject, []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReplayLast(t *testing.T) {
+	group := nuid.Next()
+	for i := 0; i < 10; i++ {
+		publishReadings(t, streamName+"."+group+".smoker.readings", 1)
+		publishReadings(t, streamName+"."+group+".other.readings", 3)
+	}
+	for _, test := range []struct {
+		subject string
+		last    uint64
+		first   string
+		pending uint64
+	}{
+		{"smoker.readings", 1, "0", 0},
+		{"smoker.readings", 3, "0", 2},
+		{"smoker.readings", 10, "0", 9},
+		{"smoker.readings", 50, "0", 9},
+		{"other.readings", 4, "2", 3},
+		{"*.readings", 5, "2", 4},
+		{"*.readings", 100, "0", 39},
+		{"missing.readings", 5, "", 0},
+	} {
+		subject := streamName + "." + group + "." + test.subject
+		opts, err := (&Replay{Last: test.last}).SubOpts(testJS, subject)
+		if err != nil {
+			t.Fatalf("last %d of %v: %v", test.last, test.subject, err)
+		}
+		sub, err := testJS.SubscribeSync(subject, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := sub.NextMsg(time.Second)
+		sub.Unsubscribe()
+		if test.first == "" {
+			if err == nil {
+				t.Fatalf("last %d of %v replayed %s", test.last, test.subject, m.Data)
+			}
+			continue
+		} else if err != nil {
+			t.Fatalf("last %d of %v: %v", test.last, test.subject, err)
+		}
+		meta, err := m.Metadata()
+		if err != nil || string(m.Data) != test.first || meta.NumPending != test.pending {
+			t.Fatalf("last %d of %v started at %s with %d pending, want %v with %d", test.last, test.subject, m.Data, meta.NumPending, test.first, test.pending)
+		}
+	}
+	info, err := testJS.StreamInfo(streamName)
+	if err != nil || info.State.Consumers != 0 {
+		t.Fatalf("consumers left behind looking up the start: %+v %v", info, err)
+	}
+}
@@ -3,45 +3,96 @@ package main
 import (
 	"encoding/json"
 	"io"
+	"net/http"
+	"strconv"
 	"strings"
 
+	"github.com/gin-contrib/sse"
 	"github.com/gin-gonic/gin"
 )
 
-//SubscribeSSE gin context to subscribe to an event stream returning json
+//eventID the id of a server sent event, the stream sequence of the message so a reconnecting EventSource
+//resumes after it with Last-Event-ID
+func eventID(message []byte) string {
+	var msg struct {
+		Sequence uint64 `json:"seq"`
+	}
+	if err := json.Unmarshal(message, &msg); err != nil || msg.Sequence == 0 {
+		return ""
+	}
+	return strconv.FormatUint(msg.Sequence, 10)
+}
+
+//subscription the topic and encoding a client asked for, aborting the request when it can't be served. The
+//device can only be left out of the path as a wildcard, /events/:group/* is every device of the group
+func subscription(c *gin.Context) (string, Encoding, bool) {
+	device, channel := c.Param("device"), c.Param("channel")
+	if channel == "" && device != wildcard {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "a channel is required unless the device is " + wildcard})
+		return "", "", false
+	}
+	topic, err := topicFor(c.Param("group"), device, channel)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return "", "", false
+	}
+	enc, err := negotiateEncoding(c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotAcceptable, gin.H{"error": err.Error()})
+		return "", "", false
+	}
+	return topic, enc, true
+}
+
+//SubscribeSSE gin context to subscribe to an event stream returning json unless the subscriber
+//negotiated protobuf or cbor
 func (env *Env) SubscribeSSE(c *gin.Context) {
 	realSSE := strings.Contains(c.FullPath(), "stream") //Check if we're looking for true SSE per the spec or streaming JSON
-	device := c.Param("device")
-	channel := c.Param("channel")
-	group := c.Param("group")
-	topic := group + "." + device + "." + channel
+	topic, enc, ok := subscription(c)
+	if !ok {
+		return
+	}
+	replay, err := replayFrom(c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	log.Info("Subscribing to topic: ", topic)
-	subscriber, err := env.natsConn.GetSubscriber(topic)
+	queue := make(chan []byte, queuelen)
+	errs := make(chan error, 1)
+	subscriber, err := env.natsConn.Subscribe(topic, replay, queue)
 	if err != nil {
 		c.AbortWithError(404, err)
 		return
 	}
 	log.Info("Got subscriber from NATS Connection")
-	queue := make(chan []byte, queuelen)
-	errs := make(chan error, 1)
-	subscriber.newClients <- queue //Add our new client to the recipient list
 	clientGone := c.Writer.CloseNotify()
 	c.Stream(func(w io.Writer) bool {
 		select {
 		case <-clientGone:
-			subscriber.defunctClients <- queue //Remove our client from the client list
+			subscriber.leave(queue) //Remove our client from the client list
 			return false
 		case message := <-queue:
+			data, err := enc.Encode(message)
+			if err != nil {
+				log.Error(err)
+				return true
+			}
 			if realSSE {
 				c.Writer.Header().Set("Content-Type", "text/event-stream")
-				c.SSEvent("message", json.RawMessage(message))
+				c.Render(-1, sse.Event{Id: eventID(message), Event: "message", Data: enc.SSEData(data)})
+				return true
+			}
+			if enc.Binary() {
+				c.Writer.Header().Set("Content-Type", enc.ContentType())
+				c.Writer.Write(enc.Frame(data))
 				return true
 			}
-			c.JSON(200, json.RawMessage(message))
+			c.JSON(200, json.RawMessage(data))
 			c.String(200, "\n")
 			return true
 		case err := <-errs:
-			subscriber.defunctClients <- queue //Remove our client from the client list
+			subscriber.leave(queue) //Remove our client from the client list
 			c.SSEvent("ERROR:", err.Error())
 			return false
 		case <-subscriber.errors:
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+const wildcard = "*"
+
+var (
+	errBadGroup = errors.New("group is required and can't contain '.', '*' or '>'")
+	errBadToken = errors.New("device and channel can't contain '.' or '>', and '*' only on its own")
+)
+
+//validToken whether a part of a topic maps onto a single NATS token, * stands for any
+func validToken(token string) bool {
+	return token == wildcard || (token != "" && !strings.ContainsAny(token, ".*> "))
+}
+
+//topicFor the topic of a group, device and channel. A device or channel that's left out or * matches all
+//of them, so a group on its own is every device of the group
+func topicFor(group, device, channel string) (string, error) {
+	if group == wildcard || !validToken(group) {
+		return "", errBadGroup
+	}
+	if device == "" {
+		device = wildcard
+	}
+	if channel == "" {
+		channel = wildcard
+	}
+	if !validToken(device) || !validToken(channel) {
+		return "", errBadToken
+	}
+	return group + "." + device + "." + channel, nil
+}
+
+//source the device and channel of a stream subject, EVENTS.<group>.<device>.<channel>
+func source(subject string) (string, string) {
+	parts := strings.Split(subject, ".")
+	if len(parts) != 4 {
+		return "", ""
+	}
+	return parts[2], parts[3]
+}
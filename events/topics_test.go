@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestTopicFor(t *testing.T) {
+	for _, test := range []struct {
+		name, group, device, channel string
+		topic                        string
+		err                          error
+	}{
+		{"device and channel", "home", "smoker", "readings", "home.smoker.readings", nil},
+		{"every channel of a device", "home", "smoker", "", "home.smoker.*", nil},
+		{"a channel of every device", "home", "*", "readings", "home.*.readings", nil},
+		{"the whole group", "home", "", "", "home.*.*", nil},
+		{"no group", "", "smoker", "readings", "", errBadGroup},
+		{"every group", "*", "smoker", "readings", "", errBadGroup},
+		{"group with a dot", "home.lab", "smoker", "readings", "", errBadGroup},
+		{"group with a full wildcard", ">", "", "", "", errBadGroup},
+		{"device with a dot", "home", "smoker.pi", "readings", "", errBadToken},
+		{"device with a wildcard in it", "home", "smoker*", "readings", "", errBadToken},
+		{"channel with a full wildcard", "home", "smoker", ">", "", errBadToken},
+		{"channel with a space", "home", "smoker", "pit temp", "", errBadToken},
+	} {
+		topic, err := topicFor(test.group, test.device, test.channel)
+		if topic != test.topic || err != test.err {
+			t.Fatalf("%v: %q %v", test.name, topic, err)
+		}
+	}
+}
+
+func TestSource(t *testing.T) {
+	for _, test := range []struct {
+		subject, device, channel string
+	}{
+		{"EVENTS.home.smoker.readings", "smoker", "readings"},
+		{"EVENTS.home.smoker", "", ""},
+		{"EVENTS.home.smoker.readings.extra", "", ""},
+	} {
+		if device, channel := source(test.subject); device != test.device || channel != test.channel {
+			t.Fatalf("source of %v: %q %q", test.subject, device, channel)
+		}
+	}
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
@@ -10,25 +13,24 @@ import (
 const (
 	readBuffer  = 1024
 	writeBuffer = 1024
+	writeWait   = time.Second
 )
 
-//SubscribeWSS gin context to subscribe to an event stream returning json
+//SubscribeWSS gin context to subscribe to an event stream returning json text frames, or binary frames
+//when the subscriber negotiated protobuf or cbor
 func (env *Env) SubscribeWSS(c *gin.Context) {
-	device := c.Param("device")
-	channel := c.Param("channel")
-	group := c.Param("group")
-	topic := group + "." + device + "." + channel
-	log.Info("Subscribing to topic: ", topic)
-	subscriber, err := env.natsConn.GetSubscriber(topic)
+	topic, enc, ok := subscription(c)
+	if !ok {
+		return
+	}
+	replay, err := replayFrom(c)
 	if err != nil {
-		log.Error(err)
-		c.AbortWithError(404, err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	log.Info("Got subscriber from NATS Connection")
+	log.Info("Subscribing to topic: ", topic)
 	queue := make(chan []byte, queuelen)
 	errs := make(chan error, 1)
-	subscriber.newClients <- queue //Add our new client to the recipient list
 	clientGone := c.Writer.CloseNotify()
 	conn, err := websocket.Upgrade(c.Writer, c.Request, nil, readBuffer, writeBuffer)
 	if err != nil {
@@ -36,16 +38,33 @@ func (env *Env) SubscribeWSS(c *gin.Context) {
 		c.AbortWithError(404, err)
 		return
 	}
+	//Subscribe once the socket is up, a replay subscriber would be left running if the upgrade failed
+	subscriber, err := env.natsConn.Subscribe(topic, replay, queue)
+	if err != nil {
+		log.Error(err)
+		closeWith(conn, websocket.CloseInternalServerErr, err.Error())
+		return
+	}
+	log.Info("Got subscriber from NATS Connection")
 	for {
 		select {
 		case <-clientGone:
-			subscriber.defunctClients <- queue //Remove our client from the client list
+			subscriber.leave(queue) //Remove our client from the client list
 			conn.Close()
 			return
 		case message := <-queue:
-			conn.WriteMessage(websocket.TextMessage, json.RawMessage(message))
+			data, err := enc.Encode(message)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			frame := websocket.TextMessage
+			if enc.Binary() {
+				frame = websocket.BinaryMessage
+			}
+			conn.WriteMessage(frame, data)
 		case <-errs:
-			subscriber.defunctClients <- queue //Remove our client from the client list
+			subscriber.leave(queue) //Remove our client from the client list
 			conn.Close()
 			return
 		case <-subscriber.errors:
@@ -54,3 +73,171 @@ func (env *Env) SubscribeWSS(c *gin.Context) {
 		}
 	}
 }
+
+//closeWith close a socket telling the client why
+func closeWith(conn *websocket.Conn, code int, reason string) {
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(writeWait))
+	conn.Close()
+}
+
+//MuxCommand a client of the multiplexed socket subscribing to or unsubscribing from a topic. A device or
+//channel left out is a wildcard, since, last and seq replay the stream like the query parameters do
+type MuxCommand struct {
+	Action  string `json:"action"`
+	Group   string `json:"group"`
+	Device  string `json:"device"`
+	Channel string `json:"channel"`
+	Since   string `json:"since"`
+	Last    uint64 `json:"last"`
+	Seq     uint64 `json:"seq"`
+}
+
+//MuxMessage sent to a client of the multiplexed socket, events carry the topic they were subscribed with
+type MuxMessage struct {
+	Type  string `json:"type"`
+	Topic string `json:"topic,omitempty"`
+	Error string `json:"error,omitempty"`
+	*Message
+}
+
+//muxSubscription a topic a multiplexed socket is subscribed to
+type muxSubscription struct {
+	subscriber *Subscriber
+	queue      chan []byte
+	stop       chan bool
+	done       chan bool
+}
+
+const maxMuxTopics = 64
+
+//forward the messages of a subscription to the socket until the client unsubscribes or leaves
+func (ms *muxSubscription) forward(topic string, out chan []byte) {
+	defer close(ms.done)
+	send := func(msg *MuxMessage) bool {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			log.Error(err)
+			return true
+		}
+		select {
+		case out <- data:
+			return true
+		case <-ms.stop:
+			ms.subscriber.leave(ms.queue) //Remove our client from the client list
+			return false
+		}
+	}
+	for {
+		select {
+		case <-ms.stop:
+			ms.subscriber.leave(ms.queue) //Remove our client from the client list
+			return
+		case message := <-ms.queue:
+			var msg Message
+			if err := json.Unmarshal(message, &msg); err != nil {
+				log.Error(err)
+				continue
+			}
+			if !send(&MuxMessage{Type: "event", Topic: topic, Message: &msg}) {
+				return
+			}
+		case <-ms.subscriber.errors:
+			send(&MuxMessage{Type: "error", Topic: topic, Error: "subscription lost"})
+			return
+		}
+	}
+}
+
+//SubscribeMux a single WebSocket subscribing to and unsubscribing from any number of topics with JSON
+//commands, events are sent as JSON text frames tagged with their topic
+func (env *Env) SubscribeMux(c *gin.Context) {
+	conn, err := websocket.Upgrade(c.Writer, c.Request, nil, readBuffer, writeBuffer)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithError(404, err)
+		return
+	}
+	out := make(chan []byte, queuelen)
+	closed := make(chan bool)
+	go func() {
+		for {
+			select {
+			case data := <-out:
+				conn.WriteMessage(websocket.TextMessage, data)
+			case <-closed:
+				return
+			}
+		}
+	}()
+	reply := func(msg *MuxMessage) {
+		data, _ := json.Marshal(msg)
+		out <- data
+	}
+	subs := make(map[string]*muxSubscription)
+	defer func() {
+		for _, ms := range subs {
+			close(ms.stop)
+			<-ms.done
+		}
+		close(closed)
+		conn.Close()
+	}()
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil { //Client went away
+			return
+		}
+		var cmd MuxCommand
+		if err := json.Unmarshal(data, &cmd); err != nil {
+			reply(&MuxMessage{Type: "error", Error: err.Error()})
+			continue
+		}
+		topic, err := topicFor(cmd.Group, cmd.Device, cmd.Channel)
+		if err != nil {
+			reply(&MuxMessage{Type: "error", Error: err.Error()})
+			continue
+		}
+		switch cmd.Action {
+		case "subscribe":
+			if ms, ok := subs[topic]; ok {
+				select {
+				case <-ms.done: //The subscription was lost, it can be made again
+				default:
+					reply(&MuxMessage{Type: "error", Topic: topic, Error: "already subscribed"})
+					continue
+				}
+			}
+			if len(subs) >= maxMuxTopics {
+				reply(&MuxMessage{Type: "error", Topic: topic, Error: fmt.Sprintf("at most %d topics per socket", maxMuxTopics)})
+				continue
+			}
+			replay, err := newReplay(cmd.Since, cmd.Last, cmd.Seq)
+			if err != nil {
+				reply(&MuxMessage{Type: "error", Topic: topic, Error: err.Error()})
+				continue
+			}
+			log.Info("Subscribing socket to topic: ", topic)
+			ms := &muxSubscription{queue: make(chan []byte, queuelen), stop: make(chan bool), done: make(chan bool)}
+			if ms.subscriber, err = env.natsConn.Subscribe(topic, replay, ms.queue); err != nil {
+				log.Error(err)
+				reply(&MuxMessage{Type: "error", Topic: topic, Error: err.Error()})
+				continue
+			}
+			subs[topic] = ms
+			reply(&MuxMessage{Type: "subscribed", Topic: topic})
+			go ms.forward(topic, out)
+		case "unsubscribe":
+			ms, ok := subs[topic]
+			if !ok {
+				reply(&MuxMessage{Type: "error", Topic: topic, Error: "not subscribed"})
+				continue
+			}
+			close(ms.stop)
+			<-ms.done
+			delete(subs, topic)
+			reply(&MuxMessage{Type: "unsubscribed", Topic: topic})
+		default:
+			reply(&MuxMessage{Type: "error", Topic: topic, Error: "action must be subscribe or unsubscribe"})
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nuid"
+)
+
+//dialMux open a multiplexed socket against the subscribers of the embedded server
+func dialMux(t *testing.T) *websocket.Conn {
+	t.Helper()
+	router := gin.New()
+	router.GET("/ws", (&Env{testConn}).SubscribeMux)
+	srv := httptest.NewServer(router)
+	t.Cleanup(srv.Close)
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+//muxCommand send a command and read the answer to it
+func muxCommand(t *testing.T, ws *websocket.Conn, cmd *MuxCommand) *MuxMessage {
+	t.Helper()
+	if err := ws.WriteJSON(cmd); err != nil {
+		t.Fatal(err)
+	}
+	return readMux(t, ws)
+}
+
+func readMux(t *testing.T, ws *websocket.Conn) *MuxMessage {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg MuxMessage
+	if err := ws.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	return &msg
+}
+
+func TestSubscribeMux(t *testing.T) {
+	group := nuid.Next()
+	publishReadings(t, streamName+"."+group+".smoker.readings", 3)
+	ws := dialMux(t)
+
+	subscribe := &MuxCommand{Action: "subscribe", Group: group, Device: "smoker", Channel: "readings", Last: 1}
+	topic := group + ".smoker.readings"
+	if msg := muxCommand(t, ws, subscribe); msg.Type != "subscribed" || msg.Topic != topic {
+		t.Fatalf("subscribe: %+v", msg)
+	}
+	if msg := readMux(t, ws); msg.Type != "event" || msg.Topic != topic || msg.Message == nil || string(msg.Datum) != "2" || msg.Device != "smoker" {
+		t.Fatalf("replayed event: %+v", msg)
+	}
+	if msg := muxCommand(t, ws, subscribe); msg.Type != "error" || msg.Error != "already subscribed" {
+		t.Fatalf("subscribe twice: %+v", msg)
+	}
+	publishReadings(t, streamName+"."+group+".smoker.readings", 1)
+	if msg := readMux(t, ws); msg.Type != "event" || string(msg.Datum) != "0" || msg.Sequence == 0 {
+		t.Fatalf("new event: %+v", msg)
+	}
+
+	for _, test := range []struct {
+		name string
+		cmd  *MuxCommand
+		err  string
+	}{
+		{"every group", &MuxCommand{Action: "subscribe", Group: "*"}, errBadGroup.Error()},
+		{"bad device", &MuxCommand{Action: "subscribe", Group: group, Device: "smoker.pi"}, errBadToken.Error()},
+		{"conflicting replay", &MuxCommand{Action: "subscribe", Group: group, Last: 1, Seq: 1}, errReplayParams.Error()},
+		{"unknown action", &MuxCommand{Action: "watch", Group: group}, "action must be subscribe or unsubscribe"},
+		{"not subscribed", &MuxCommand{Action: "unsubscribe", Group: group}, "not subscribed"},
+	} {
+		if msg := muxCommand(t, ws, test.cmd); msg.Type != "error" || msg.Error != test.err {
+			t.Fatalf("%v: %+v", test.name, msg)
+		}
+	}
+
+	unsubscribe := &MuxCommand{Action: "unsubscribe", Group: group, Device: "smoker", Channel: "readings"}
+	if msg := muxCommand(t, ws, unsubscribe); msg.Type != "unsubscribed" || msg.Topic != topic {
+		t.Fatalf("unsubscribe: %+v", msg)
+	}
+	publishReadings(t, streamName+"."+group+".smoker.readings", 1)
+	if msg := muxCommand(t, ws, unsubscribe); msg.Type != "error" || msg.Error != "not subscribed" {
+		t.Fatalf("event after unsubscribing or unsubscribe twice: %+v", msg)
+	}
+}
+
+func TestSubscribeMuxMaxTopics(t *testing.T) {
+	group := nuid.Next()
+	ws := dialMux(t)
+	for i := 0; i < maxMuxTopics; i++ {
+		cmd := &MuxCommand{Action: "subscribe", Group: group, Device: "smoker" + strconv.Itoa(i)}
+		if msg := muxCommand(t, ws, cmd); msg.Type != "subscribed" {
+			t.Fatalf("topic %d: %+v", i, msg)
+		}
+	}
+	msg := muxCommand(t, ws, &MuxCommand{Action: "subscribe", Group: group, Device: "one-too-many"})
+	if msg.Type != "error" || !strings.HasPrefix(msg.Error, "at most") {
+		t.Fatalf("topic past the limit: %+v", msg)
+	}
+	unsubscribe := &MuxCommand{Action: "unsubscribe", Group: group, Device: "smoker0"}
+	if msg := muxCommand(t, ws, unsubscribe); msg.Type != "unsubscribed" {
+		t.Fatalf("unsubscribe: %+v", msg)
+	}
+	if msg := muxCommand(t, ws, &MuxCommand{Action: "subscribe", Group: group, Device: "one-too-many"}); msg.Type != "subscribed" {
+		t.Fatalf("topic after making room: %+v", msg)
+	}
+}
@@ -2,7 +2,13 @@ package graph
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+
+	"github.com/charles-d-burton/grillbernetes/gateway/graph/model"
 
 	jsoniter "github.com/json-iterator/go"
 	"github.com/sirupsen/logrus"
@@ -24,3 +30,54 @@ var (
 	authURL    = "https://auth.home.rsmachiner.com"
 	controlURL = "https://control-hub.home.rsmachiner.com"
 )
+
+type authorizationKey struct{}
+
+//WithAuthorization keep the Authorization header of the caller so calls to control-hub can be made on their behalf
+func WithAuthorization(ctx context.Context, header string) context.Context {
+	return context.WithValue(ctx, authorizationKey{}, header)
+}
+
+func authorization(ctx context.Context) string {
+	header, _ := ctx.Value(authorizationKey{}).(string)
+	return header
+}
+
+//devicePage a page of the devices of a group as control-hub lists them
+type devicePage struct {
+	Devices    []*model.Device `json:"devices"`
+	NextCursor string          `json:"next_cursor"`
+}
+
+//fetchDevices one page of the devices of a group from control-hub, an empty cursor is the first page
+func fetchDevices(ctx context.Context, group, cursor string) (*devicePage, error) {
+	query := url.Values{"limit": {"500"}}
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+	req, err := http.NewRequest("GET", controlURL+"/devices/"+group+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if header := authorization(ctx); header != "" {
+		req.Header.Set("Authorization", header)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var page devicePage
+	if err := json.Unmarshal(body, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
@@ -139,33 +139,20 @@ func (r *mutationResolver) AddDevice(ctx context.Context, input model.SendData)
 }
 
 func (r *queryResolver) Devices(ctx context.Context) ([]*model.Device, error) {
-	url := controlURL + "/devices/home"
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", url, nil) //This is inefficient, should change to pool of handlers with re-usable buffers
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Warn(err)
-		return nil, err
-	}
 	devices := make([]*model.Device, 0)
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New(resp.Status)
-	}
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Warn(err)
-		return nil, err
-	}
-	err = json.Unmarshal(body, &devices)
-	if err != nil {
-		log.Warn(err)
-		return nil, err
+	var cursor string
+	for {
+		page, err := fetchDevices(ctx, "home", cursor)
+		if err != nil {
+			log.Warn(err)
+			return nil, err
+		}
+		devices = append(devices, page.Devices...)
+		if page.NextCursor == "" {
+			return devices, nil
+		}
+		cursor = page.NextCursor
 	}
-	return devices, nil
 }
 
 // Mutation returns generated.MutationResolver implementation.
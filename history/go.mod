@@ -0,0 +1,10 @@
+module github.com/charles-d-burton/grillbernetes/history
+
+go 1.14
+
+require (
+	github.com/gin-gonic/gin v1.7.2
+	github.com/nats-io/nats.go v1.11.0
+	github.com/sirupsen/logrus v1.8.1
+	go.etcd.io/bbolt v1.3.6
+)
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	nats "github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	streamName       = "EVENTS"
+	durableName      = "history"
+	deviceTimeHeader = "Device-Timestamp"
+	defaultWindow    = time.Hour
+	maxPoints        = 10000
+)
+
+var (
+	usageStr = `
+Usage: history [options]
+Options:
+	-nh, --nats-host       <NATS_HOST>     Start the consumer connecting to the defined NATS server
+	-db, --database        <Path>          Location of the history database file
+	-rt, --retention       <Duration>      How long readings are kept before being pruned
+`
+	log       = logrus.New()
+	store     *Store
+	retention time.Duration
+)
+
+//setup read the flags, open the database and attach the consumer
+func setup() {
+	log.SetFormatter(&logrus.JSONFormatter{})
+	var natsHost string
+	var dbPath string
+	flag.StringVar(&natsHost, "nh", "", "Start the consumer connecting to the defined NATS server")
+	flag.StringVar(&natsHost, "nats-host", "", "Start the consumer connecting to the defined NATS server")
+	flag.StringVar(&dbPath, "db", "/data/history.db", "Location of the history database file")
+	flag.StringVar(&dbPath, "database", "/data/history.db", "Location of the history database file")
+	flag.DurationVar(&retention, "rt", 30*24*time.Hour, "How long readings are kept before being pruned")
+	flag.DurationVar(&retention, "retention", 30*24*time.Hour, "How long readings are kept before being pruned")
+	flag.Parse()
+	if natsHost == "" {
+		natsHost = os.Getenv("NATS_HOST")
+		if natsHost == "" {
+			log.Fatal("NATS_HOST Undefined\n", usageStr)
+		}
+	}
+
+	var err error
+	store, err = OpenStore(dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Infof("connecting to nats host: %q", natsHost)
+	conn, err := nats.Connect(natsHost,
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			log.Error(err)
+		}),
+		nats.DisconnectHandler(func(_ *nats.Conn) {
+			log.Error("unexpectedly disconnected from nats")
+		}),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := Consume(js); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func main() {
+	setup()
+	store.Prune(retention)
+	router := gin.Default()
+	router.GET("/healthz", HealthCheck)
+	router.GET("/history/:group/:device/:channel", GetHistory)
+	router.Run(":7777")
+}
+
+//HealthCheck k8s healthcheck path
+func HealthCheck(c *gin.Context) {
+	if err := store.Ping(); err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "database died"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "alive"})
+}
+
+//Consume attach the durable consumer to the event stream, readings are acked once they're on disk
+func Consume(js nats.JetStreamContext) error {
+	_, err := js.Subscribe(streamName+".>", func(m *nats.Msg) {
+		meta, err := m.Metadata()
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		point := &Point{
+			Subject:   m.Subject,
+			Sequence:  meta.Sequence.Stream,
+			Timestamp: meta.Timestamp,
+			Data:      m.Data,
+		}
+		if sent, err := strconv.ParseInt(m.Header.Get(deviceTimeHeader), 10, 64); err == nil && validTime(time.Unix(sent, 0)) {
+			point.Timestamp = time.Unix(sent, 0)
+		}
+		store.Write(point, m)
+	}, nats.Durable(durableName), nats.ManualAck(), nats.AckExplicit(), nats.DeliverAll(), nats.MaxAckPending(maxPending))
+	return err
+}
+
+//GetHistory return the readings for a channel over a time range, downsampled when a bucket is given
+//Query parameters:
+//	from, to   RFC3339 times bounding the range, defaults to the last hour
+//	bucket     duration to downsample into, e.g. 1m
+//	field      numeric field of the reading to aggregate, defaults to f
+//	limit      max number of raw readings returned
+//	cursor     next cursor of the previous page to resume from
+func GetHistory(c *gin.Context) {
+	to := time.Now()
+	from := to.Add(-defaultWindow)
+	var err error
+	if val := c.Query("to"); val != "" {
+		if to, err = time.Parse(time.RFC3339, val); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if val := c.Query("from"); val != "" {
+		if from, err = time.Parse(time.RFC3339, val); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if !validTime(from) || !validTime(to) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": errTimeRange.Error()})
+		return
+	}
+	if !from.Before(to) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be before to"})
+		return
+	}
+	series := Series(c.Param("group"), c.Param("device"), c.Param("channel"))
+
+	if val := c.Query("bucket"); val != "" {
+		width, err := time.ParseDuration(val)
+		if err != nil || width <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid bucket " + val})
+			return
+		}
+		if to.Sub(from)/width > maxPoints {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "bucket too small for range"})
+			return
+		}
+		buckets, err := store.Downsample(series, from, to, width, c.DefaultQuery("field", "f"))
+		if err != nil {
+			log.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"series": series, "from": from, "to": to, "buckets": buckets})
+		return
+	}
+
+	limit := maxPoints
+	if val := c.Query("limit"); val != "" {
+		if limit, err = strconv.Atoi(val); err != nil || limit <= 0 || limit > maxPoints {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit " + val})
+			return
+		}
+	}
+	var after []byte
+	if val := c.Query("cursor"); val != "" {
+		if after, err = DecodeCursor(val); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	readings, next, err := store.Range(series, from, to, after, limit)
+	if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	res := gin.H{"series": series, "from": from, "to": to, "readings": readings, "truncated": next != nil}
+	if next != nil {
+		res["next"] = EncodeCursor(next)
+	}
+	c.JSON(http.StatusOK, res)
+}
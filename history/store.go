@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"strings"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	maxPending    = 1024
+	flushSize     = 256
+	flushInterval = time.Second
+	pruneInterval = time.Hour
+)
+
+var (
+	errNotNumeric = errors.New("field is not numeric")
+	errBadCursor  = errors.New("invalid cursor")
+	errTimeRange  = errors.New("times must fall between 1970 and 2262")
+
+	//minTime and maxTime bound the times a key can hold, keys are unsigned nanoseconds since the epoch
+	minTime = time.Unix(0, 0)
+	maxTime = time.Unix(0, math.MaxInt64)
+)
+
+//Point single reading pulled off the stream
+type Point struct {
+	Subject   string
+	Sequence  uint64
+	Timestamp time.Time
+	Data      json.RawMessage
+}
+
+//Reading a stored point as returned by the api
+type Reading struct {
+	Timestamp int64           `json:"timestamp"`
+	Sequence  uint64          `json:"seq"`
+	Data      json.RawMessage `json:"data"`
+}
+
+//Bucket aggregate of the readings that fall into one downsampling window
+type Bucket struct {
+	Start int64   `json:"start"`
+	Count int     `json:"count"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Avg   float64 `json:"avg"`
+}
+
+type pending struct {
+	point *Point
+	msg   *nats.Msg
+}
+
+//Store bbolt backed time-series store, one bucket per group.device.channel series keyed by
+//big endian timestamp and stream sequence so a cursor walks a series in time order
+type Store struct {
+	db     *bolt.DB
+	writes chan pending
+}
+
+//Series the name of the series a reading on group/device/channel lands in
+func Series(group, device, channel string) string {
+	return group + "." + device + "." + channel
+}
+
+//OpenStore open or create the database and start the write loop
+func OpenStore(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	store := &Store{
+		db:     db,
+		writes: make(chan pending, maxPending),
+	}
+	go store.writeLoop()
+	return store, nil
+}
+
+//Ping check the database is still open
+func (store *Store) Ping() error {
+	return store.db.View(func(tx *bolt.Tx) error {
+		return nil
+	})
+}
+
+//Write queue a point to be stored, the message is acked once the point is committed
+func (store *Store) Write(point *Point, msg *nats.Msg) {
+	store.writes <- pending{point: point, msg: msg}
+}
+
+//writeLoop batch points into a single transaction to keep fsyncs down at high message rates
+func (store *Store) writeLoop() {
+	ticker := time.NewTicker(flushInterval)
+	batch := make([]pending, 0, flushSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		err := store.db.Update(func(tx *bolt.Tx) error {
+			for _, p := range batch {
+				bucket, err := tx.CreateBucketIfNotExists([]byte(seriesOf(p.point.Subject)))
+				if err != nil {
+					return err
+				}
+				if err := bucket.Put(pointKey(p.point.Timestamp, p.point.Sequence), p.point.Data); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		for _, p := range batch {
+			if err != nil {
+				p.msg.Nak() //Let the stream redeliver
+				continue
+			}
+			p.msg.Ack()
+		}
+		if err != nil {
+			log.Error(err)
+		} else {
+			log.Debugf("stored %d readings", len(batch))
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case p := <-store.writes:
+			batch = append(batch, p)
+			if len(batch) >= flushSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+//seriesOf strip the stream name off of a subject
+func seriesOf(subject string) string {
+	return strings.TrimPrefix(subject, streamName+".")
+}
+
+//validTime whether a time fits in a key, earlier times would wrap around and sort after every other reading
+func validTime(ts time.Time) bool {
+	return !ts.Before(minTime) && !ts.After(maxTime)
+}
+
+func pointKey(ts time.Time, seq uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, uint64(ts.UnixNano()))
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
+
+func timeKey(ts time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(ts.UnixNano()))
+	return key
+}
+
+func keyTime(key []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(key)))
+}
+
+//EncodeCursor the cursor a range resumes from, the key of the first reading it didn't return
+func EncodeCursor(key []byte) string {
+	if key == nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(key)
+}
+
+//DecodeCursor the key a cursor resumes from
+func DecodeCursor(cursor string) ([]byte, error) {
+	key, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(key) != 16 || !validTime(keyTime(key)) {
+		return nil, errBadCursor
+	}
+	return key, nil
+}
+
+//scan walk the readings of a series from the key start up to to in time order until fn returns false
+func (store *Store) scan(series string, start []byte, to time.Time, fn func(key, value []byte) bool) error {
+	return store.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(series))
+		if bucket == nil {
+			return nil
+		}
+		end := timeKey(to)
+		c := bucket.Cursor()
+		for k, v := c.Seek(start); k != nil && bytes.Compare(k[:8], end) < 0; k, v = c.Next() {
+			if !fn(k, v) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+//Range the raw readings of a series in [from, to), at most limit of them. A range with more readings than
+//the limit returns the key of the next one to resume from with after, nil once the range is done
+func (store *Store) Range(series string, from, to time.Time, after []byte, limit int) ([]Reading, []byte, error) {
+	if !validTime(from) || !validTime(to) {
+		return nil, nil, errTimeRange
+	}
+	start := timeKey(from)
+	if bytes.Compare(after, start) > 0 {
+		start = after
+	}
+	readings := make([]Reading, 0)
+	var next []byte
+	err := store.scan(series, start, to, func(k, v []byte) bool {
+		if len(readings) == limit {
+			next = append([]byte(nil), k...)
+			return false
+		}
+		data := make([]byte, len(v)) //Values are only valid for the life of the transaction
+		copy(data, v)
+		readings = append(readings, Reading{
+			Timestamp: keyTime(k).Unix(),
+			Sequence:  binary.BigEndian.Uint64(k[8:]),
+			Data:      data,
+		})
+		return true
+	})
+	return readings, next, err
+}
+
+//Downsample aggregate a numeric field of a series into buckets of width over [from, to),
+//empty buckets are left out
+func (store *Store) Downsample(series string, from, to time.Time, width time.Duration, field string) ([]Bucket, error) {
+	if !validTime(from) || !validTime(to) {
+		return nil, errTimeRange
+	}
+	buckets := make([]Bucket, 0)
+	var current *Bucket
+	var sum float64
+	closeBucket := func() {
+		if current != nil {
+			current.Avg = sum / float64(current.Count)
+			buckets = append(buckets, *current)
+		}
+	}
+	err := store.scan(series, timeKey(from), to, func(k, v []byte) bool {
+		val, err := numericField(v, field)
+		if err != nil {
+			return true
+		}
+		start := from.Add(keyTime(k).Sub(from) / width * width).Unix()
+		if current == nil || current.Start != start {
+			closeBucket()
+			current = &Bucket{Start: start, Min: math.Inf(1), Max: math.Inf(-1)}
+			sum = 0
+		}
+		current.Count++
+		current.Min = math.Min(current.Min, val)
+		current.Max = math.Max(current.Max, val)
+		sum += val
+		return true
+	})
+	closeBucket()
+	return buckets, err
+}
+
+//numericField pull a number out of a JSON reading, nested fields are addressed with dots e.g. probe.f
+func numericField(data []byte, field string) (float64, error) {
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return 0, err
+	}
+	for _, part := range strings.Split(field, ".") {
+		obj, ok := doc.(map[string]interface{})
+		if !ok {
+			return 0, errNotNumeric
+		}
+		doc = obj[part]
+	}
+	val, ok := doc.(float64)
+	if !ok {
+		return 0, errNotNumeric
+	}
+	return val, nil
+}
+
+//Prune periodically drop readings older than the retention period
+func (store *Store) Prune(retention time.Duration) {
+	go func() {
+		ticker := time.NewTicker(pruneInterval)
+		for ; true; <-ticker.C {
+			cutoff := timeKey(time.Now().Add(-retention))
+			removed := 0
+			err := store.db.Update(func(tx *bolt.Tx) error {
+				return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+					var expired [][]byte //Deleting under a live cursor skips keys, collect first
+					c := bucket.Cursor()
+					for k, _ := c.First(); k != nil && bytes.Compare(k[:8], cutoff) < 0; k, _ = c.Next() {
+						expired = append(expired, append([]byte(nil), k...))
+					}
+					for _, k := range expired {
+						if err := bucket.Delete(k); err != nil {
+							return err
+						}
+					}
+					removed += len(expired)
+					return nil
+				})
+			})
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			log.Infof("pruned %d readings older than %v", removed, retention)
+		}
+	}()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+//openTestStore a store in a temporary directory holding a reading a second for n seconds from start
+func openTestStore(t *testing.T, series string, start time.Time, n int) *Store {
+	t.Helper()
+	store, err := OpenStore(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.db.Close() })
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(series))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			data := []byte(`{"f":` + strconv.Itoa(200+i) + `}`)
+			if err := bucket.Put(pointKey(start.Add(time.Duration(i)*time.Second), uint64(i+1)), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestRangePages(t *testing.T) {
+	start := time.Unix(1626000000, 0)
+	store := openTestStore(t, "g.d.readings", start, 25)
+	var seen []uint64
+	var after []byte
+	for pages := 1; ; pages++ {
+		readings, next, err := store.Range("g.d.readings", start, start.Add(time.Minute), after, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, reading := range readings {
+			seen = append(seen, reading.Sequence)
+		}
+		if next == nil {
+			if pages != 3 || len(readings) != 5 {
+				t.Fatalf("last page %d holds %d readings", pages, len(readings))
+			}
+			break
+		}
+		if len(readings) != 10 {
+			t.Fatalf("page %d holds %d readings", pages, len(readings))
+		}
+		if after, err = DecodeCursor(EncodeCursor(next)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, seq := range seen {
+		if seq != uint64(i+1) {
+			t.Fatalf("readings out of order or repeated: %v", seen)
+		}
+	}
+
+	readings, next, err := store.Range("g.d.readings", start, start.Add(10*time.Second), nil, 10)
+	if err != nil || len(readings) != 10 || next != nil {
+		t.Fatalf("range of exactly the limit: %d readings, next %v, %v", len(readings), next, err)
+	}
+}
+
+func TestRangeTimes(t *testing.T) {
+	start := time.Unix(1626000000, 0)
+	store := openTestStore(t, "g.d.readings", start, 5)
+	for _, from := range []time.Time{time.Unix(-1, 0), time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)} {
+		if _, _, err := store.Range("g.d.readings", from, start.Add(time.Minute), nil, 10); err != errTimeRange {
+			t.Fatalf("range from %v: %v", from, err)
+		}
+		if _, err := store.Downsample("g.d.readings", from, start.Add(time.Minute), time.Minute, "f"); err != errTimeRange {
+			t.Fatalf("downsample from %v: %v", from, err)
+		}
+	}
+	if _, _, err := store.Range("g.d.readings", start, time.Date(2300, 1, 1, 0, 0, 0, 0, time.UTC), nil, 10); err != errTimeRange {
+		t.Fatalf("range past 2262: %v", err)
+	}
+	for _, cursor := range []string{"nope!", "AAAA", EncodeCursor(pointKey(start, 1)[:8])} {
+		if _, err := DecodeCursor(cursor); err != errBadCursor {
+			t.Fatalf("cursor %v: %v", cursor, err)
+		}
+	}
+}
+
+func TestDownsample(t *testing.T) {
+	start := time.Unix(1626000000, 0)
+	store := openTestStore(t, "g.d.readings", start, 120)
+	buckets, err := store.Downsample("g.d.readings", start, start.Add(2*time.Minute), time.Minute, "f")
+	if err != nil || len(buckets) != 2 {
+		t.Fatalf("buckets: %+v %v", buckets, err)
+	}
+	if b := buckets[0]; b.Count != 60 || b.Min != 200 || b.Max != 259 || b.Avg != 229.5 {
+		t.Fatalf("first bucket: %+v", b)
+	}
+}
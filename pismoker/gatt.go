@@ -68,6 +68,7 @@ type WifiCreds struct {
 	Password string `json:"password"`
 	Username string `json:"username"`
 	UID      string `json:"uid"`
+	Token    string `json:"token"`
 }
 
 // MachineConfig store and manipulate the configuration of the machine you're working with
@@ -75,6 +76,7 @@ type MachineConfig struct {
 	Name         string
 	OwnerUID     string
 	DeviceSerial string
+	DeviceToken  string
 }
 
 type status struct {
@@ -258,6 +260,7 @@ func SetupConfig(data []byte) error {
 	}
 	machine.Name = strings.Replace(name, ".", "-", -1)
 	machine.OwnerUID = wificreds.UID
+	machine.DeviceToken = wificreds.Token
 
 	machineData, err := toml.Marshal(&machine)
 	if err != nil {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	"flag"
@@ -10,6 +11,8 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -39,11 +42,13 @@ Options:
 	-ct, --control-topic   <Topic>        Topic to listen for control messages
 	-ch, --control-host    <ControlHost>  Remote host that maintains control state
 	-dh, --data-host       <DataHost>     Remote host that accepts Readings
+	-eh, --events-host     <EventsHost>   Remote host streaming events, to switch off on an emergency stop right away
 	-ssr --sensor-sample-rate <Rate>      Rate to poll sensor for data
 	-st, --sensor-type     <Sensor Type>  The kind of sensor that's connected
 `
 	dataHost         = ""
 	controlHost      = ""
+	eventsHost       = ""
 	relayPwr         = ""
 	id               = ""
 	sensorType       = ""
@@ -52,11 +57,17 @@ Options:
 	machineConfig    MachineConfig
 	signalChan       = make(chan os.Signal, 1)
 	controlChan      = make(chan *ControlState, 5)
+	appliedChan      = make(chan ControlState, 5)
+	stopChan         = make(chan bool, 1)
 	readings         = make(chan Reading, 1000)
 	listeners        []chan Reading
 	finalizer        = make(chan bool, 1)
-	controlState     ControlState
 	powered          = abool.New()
+	relayOn          = abool.New()
+	lastReported     ReportedState
+	lastRevision     uint64
+	pitSensor        = "pit" //Name of the sensor in the pit, the one the PID loop follows
+	version          = "dev" //Set at build time with -ldflags "-X main.version=<version>"
 
 	json = jsoniter.ConfigCompatibleWithStandardLibrary
 )
@@ -70,6 +81,8 @@ func init() {
 	flag.StringVar(&dataHost, "data-host", "", "Start the controller connecting to the defined event consumer")
 	flag.StringVar(&controlHost, "ch", "", "Hostname:Port of the config enpoint")
 	flag.StringVar(&controlHost, "control-host", "", "Hostname:Port of the config enpoint")
+	flag.StringVar(&eventsHost, "eh", "", "Hostname:Port of the events endpoint to watch for emergency stops")
+	flag.StringVar(&eventsHost, "events-host", "", "Hostname:Port of the events endpoint to watch for emergency stops")
 	flag.IntVar(&sampleRate, "sr", 1, "Frequency in seconds to take a data sample")
 	flag.IntVar(&sampleRate, "sample-rate", 1, "Frequency in seconds to take a data sample")
 	flag.IntVar(&sensorSampleRate, "ssr", 100, "Frequency in ms to poll the sensor for data")
@@ -105,9 +118,19 @@ func init() {
 
 //ControlState Represent the runtime state of the smoker
 type ControlState struct {
-	Pwr     bool    `json:"pwr"`
-	Temp    float64 `json:"temp"`
-	RunTime int     `json:"run_time"`
+	Pwr      bool    `json:"pwr"`
+	Temp     float64 `json:"temp"`
+	RunTime  int     `json:"run_time"`
+	Revision uint64  `json:"-"` //Config revision the state came from, taken from the ETag
+}
+
+//ReportedState the state the smoker is actually running with, reported back to the control host so it
+//can tell whether a config change has been applied
+type ReportedState struct {
+	Pwr      bool    `json:"pwr"`
+	Temp     float64 `json:"temp"`
+	Relay    bool    `json:"relay"`
+	Firmware string  `json:"firmware"`
 }
 
 //PIDState Represent the state of the PID controller
@@ -148,8 +171,11 @@ func main() {
 	}
 	toml.Unmarshal(data, &machineConfig)
 	//controller.StartServer(natsHost, machineName+"-readings", machineName+"-control")
-	Fanout()       //Start the Fanout
-	PollRunState() //Start watching for runstate updates
+	Fanout()             //Start the Fanout
+	PollRunState()       //Start watching for runstate updates
+	ReportLoop()         //Start reporting the applied state back
+	WatchEmergencyStop() //Start switching off on emergency stops
+	Heartbeat()          //Start checking in with the device registry
 	er := PublishEvents()
 	listeners = append(listeners, er)
 	rp := PidLoop()
@@ -186,7 +212,12 @@ func PollRunState() {
 			select {
 			case <-ticker.C:
 				//log.Println(t)
-				resp, err := http.Get(controlHost + "/" + "config" + "/" + machineConfig.OwnerUID + "/" + machineConfig.DeviceSerial + "/configs")
+				req, err := http.NewRequest("GET", controlHost+"/"+"config"+"/"+machineConfig.OwnerUID+"/"+machineConfig.DeviceSerial+"/configs", nil)
+				if err != nil {
+					log.Println(err)
+					continue
+				}
+				resp, err := http.DefaultClient.Do(withDeviceToken(req))
 				if err != nil {
 					log.Println(err)
 					continue
@@ -198,19 +229,152 @@ func PollRunState() {
 					continue
 				}
 				log.Println("Got config: ", string(body))
-				err = json.Unmarshal(body, &controlState)
+				var state ControlState
+				err = json.Unmarshal(body, &state)
 				if err != nil {
 					log.Println(err)
 					continue
 				}
-				powered.SetTo(controlState.Pwr)
-				controlChan <- &controlState
+				state.Revision, _ = strconv.ParseUint(strings.Trim(resp.Header.Get("ETag"), `"`), 10, 64)
+				powered.SetTo(state.Pwr)
+				controlChan <- &state //Reported back once the PID loop applied it
+			}
+		}
+	}()
+}
 
+//WatchEmergencyStop follow the estop channel of the smoker on the events host and switch off as soon as an
+//emergency stop comes in instead of on the next poll, reconnecting whenever the stream drops
+func WatchEmergencyStop() {
+	if eventsHost == "" {
+		return
+	}
+	go func() {
+		wait := time.Second
+		for {
+			connected, err := watchEmergencyStop()
+			if err != nil {
+				log.Println(err)
+			}
+			if connected {
+				wait = time.Second
+			}
+			time.Sleep(wait)
+			if wait *= 2; wait > 30*time.Second {
+				wait = 30 * time.Second
 			}
 		}
 	}()
 }
 
+//watchEmergencyStop stream the estop channel until it drops, every event on it is a stop
+func watchEmergencyStop() (bool, error) {
+	req, err := http.NewRequest("GET", eventsHost+"/"+"events"+"/"+machineConfig.OwnerUID+"/"+machineConfig.DeviceSerial+"/estop", nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := http.DefaultClient.Do(withDeviceToken(req))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, errors.New("Watching for emergency stops failed: " + resp.Status)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		log.Println("Emergency stop: ", scanner.Text())
+		powered.UnSet()
+		select {
+		case stopChan <- true:
+		default: //A stop is already waiting on the PID loop
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return true, err
+	}
+	return true, errors.New("Emergency stop stream closed")
+}
+
+//Heartbeat tell the device registry what the smoker is at startup and every minute after
+func Heartbeat() {
+	ticker := time.NewTicker(time.Minute)
+	go func() {
+		for {
+			if err := sendHeartbeat(); err != nil {
+				log.Println(err)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+func sendHeartbeat() error {
+	data, err := json.Marshal(map[string]interface{}{
+		"model":        "pismoker",
+		"firmware":     version,
+		"channels":     []string{"readings"},
+		"capabilities": map[string]interface{}{"probes": 1, "actuator": "relay"},
+	})
+	if err != nil {
+		return err
+	}
+	url := controlHost + "/" + "registry" + "/" + machineConfig.OwnerUID + "/" + machineConfig.DeviceSerial + "/heartbeat"
+	resp, err := postReading(url, bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("Heartbeat failed: " + resp.Status)
+	}
+	return nil
+}
+
+//ReportLoop report every state the PID loop applied back to the control host
+func ReportLoop() {
+	go func() {
+		for applied := range appliedChan {
+			if err := reportState(&applied); err != nil {
+				log.Println(err)
+			}
+		}
+	}()
+}
+
+//reportState tell the control host which config revision was applied and what the smoker is running with,
+//only sent when the state or the revision changed since the last report
+func reportState(applied *ControlState) error {
+	state := ReportedState{
+		Pwr:      applied.Pwr,
+		Temp:     applied.Temp,
+		Relay:    relayOn.IsSet(),
+		Firmware: version,
+	}
+	if state == lastReported && applied.Revision == lastRevision {
+		return nil
+	}
+	data, err := json.Marshal(map[string]interface{}{"revision": applied.Revision, "reported": state})
+	if err != nil {
+		return err
+	}
+	url := controlHost + "/" + "config" + "/" + machineConfig.OwnerUID + "/" + machineConfig.DeviceSerial + "/configs/reported"
+	resp, err := postReading(url, bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("Reporting state failed: " + resp.Status)
+	}
+	lastReported = state
+	lastRevision = applied.Revision
+	return nil
+}
+
 //PublishEvents Push events to the data stream
 func PublishEvents() chan Reading {
 	log.Println("Starting Publish event loop")
@@ -237,7 +401,7 @@ func PublishEvents() chan Reading {
 				log.Println(err)
 			} else {
 				buf.Write(data)
-				resp, err := http.Post(eventStream, "application/json", &buf)
+				resp, err := postReading(eventStream, &buf)
 				if err != nil {
 					log.Println(err)
 				} else {
@@ -259,6 +423,25 @@ func PublishEvents() chan Reading {
 	return reads
 }
 
+//postReading send a reading to the data host, authenticating with the device token if one was provisioned
+func postReading(url string, body *bytes.Buffer) (*http.Response, error) {
+	req, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return http.DefaultClient.Do(withDeviceToken(req))
+}
+
+//withDeviceToken authenticate a request with the device token if one was provisioned, pub-hub and
+//control-hub both accept it
+func withDeviceToken(req *http.Request) *http.Request {
+	if machineConfig.DeviceToken != "" {
+		req.Header.Set("Authorization", "Bearer "+machineConfig.DeviceToken)
+	}
+	return req
+}
+
 //PidLoop Watch for changes to run state and execute the PID algorithm to control the software run state
 func PidLoop() chan Reading {
 	log.Println("Starting PID Control loop")
@@ -286,6 +469,18 @@ func PidLoop() chan Reading {
 				controlState.Pwr = state.Pwr
 				controlState.Temp = state.Temp
 				pid.Set(state.Temp)
+				select {
+				case appliedChan <- *state:
+				default: //The reporter is behind, the next poll catches it up
+				}
+			case <-stopChan: //Emergency stop, the relay goes off now and the next poll reports the stopped config
+				log.Println("Emergency stop, turning off relay")
+				controlState.Pwr = false
+				relayOn.UnSet()
+				if err := p.Out(gpio.Low); err != nil {
+					log.Println(err)
+					ResetPin(p)
+				}
 			case reading, ok := <-reads:
 				if !ok {
 					if err := p.Out(gpio.Low); err != nil {
@@ -301,6 +496,7 @@ func PidLoop() chan Reading {
 				if controlState.Pwr {
 					if update == 0 {
 						log.Println("Turning off relay")
+						relayOn.UnSet()
 						if err := p.Out(gpio.Low); err != nil {
 							log.Println(err)
 							ResetPin(p)
@@ -308,6 +504,7 @@ func PidLoop() chan Reading {
 
 					} else {
 						log.Println("Turning on relay")
+						relayOn.Set()
 						if err := p.Out(gpio.High); err != nil {
 							log.Println(err)
 							ResetPin(p)
@@ -316,6 +513,7 @@ func PidLoop() chan Reading {
 					}
 				} else {
 					log.Println("Relay Powered Off")
+					relayOn.UnSet()
 					if err := p.Out(gpio.Low); err != nil {
 						log.Println(err)
 
@@ -365,14 +563,14 @@ func ReadLoop() {
 					var err error
 					switch sensorType {
 					case "max31855":
-						reading.ID = id
+						reading.ID, reading.Name = id, pitSensor
 						reading.C, err = max31855.GetReadingCelsius()
 						reading.F, err = max31855.GetReadingFarenheit()
 						if err != nil {
 							return err
 						}
 					case "max31850":
-						reading.ID = id
+						reading.ID, reading.Name = id, pitSensor
 						reading.C, err = max31850.GetReadingCelsius()
 						reading.F, err = max31850.GetReadingFarenheit()
 						if err != nil {
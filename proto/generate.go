@@ -0,0 +1,4 @@
+//Package grillbernetes the Go code generated from the protobuf definitions shared by the services
+package grillbernetes
+
+//go:generate protoc -I . --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative reading.proto hub.proto
@@ -0,0 +1,8 @@
+module github.com/charles-d-burton/grillbernetes/proto
+
+go 1.14
+
+require (
+	google.golang.org/grpc v1.39.0
+	google.golang.org/protobuf v1.27.1
+)
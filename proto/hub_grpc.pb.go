@@ -0,0 +1,487 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+
+package grillbernetes
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// IngestClient is the client API for Ingest service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type IngestClient interface {
+	//Publish a single payload
+	Publish(ctx context.Context, in *PublishRequest, opts ...grpc.CallOption) (*PublishReply, error)
+	//PublishStream publish payloads as they're sent and answer with the outcome of each once the client closes
+	PublishStream(ctx context.Context, opts ...grpc.CallOption) (Ingest_PublishStreamClient, error)
+}
+
+type ingestClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewIngestClient(cc grpc.ClientConnInterface) IngestClient {
+	return &ingestClient{cc}
+}
+
+func (c *ingestClient) Publish(ctx context.Context, in *PublishRequest, opts ...grpc.CallOption) (*PublishReply, error) {
+	out := new(PublishReply)
+	err := c.cc.Invoke(ctx, "/grillbernetes.Ingest/Publish", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *ingestClient) PublishStream(ctx context.Context, opts ...grpc.CallOption) (Ingest_PublishStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Ingest_ServiceDesc.Streams[0], "/grillbernetes.Ingest/PublishStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &ingestPublishStreamClient{stream}
+	return x, nil
+}
+
+type Ingest_PublishStreamClient interface {
+	Send(*PublishRequest) error
+	CloseAndRecv() (*PublishSummary, error)
+	grpc.ClientStream
+}
+
+type ingestPublishStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *ingestPublishStreamClient) Send(m *PublishRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *ingestPublishStreamClient) CloseAndRecv() (*PublishSummary, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(PublishSummary)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// IngestServer is the server API for Ingest service.
+// All implementations must embed UnimplementedIngestServer
+// for forward compatibility
+type IngestServer interface {
+	//Publish a single payload
+	Publish(context.Context, *PublishRequest) (*PublishReply, error)
+	//PublishStream publish payloads as they're sent and answer with the outcome of each once the client closes
+	PublishStream(Ingest_PublishStreamServer) error
+	mustEmbedUnimplementedIngestServer()
+}
+
+// UnimplementedIngestServer must be embedded to have forward compatible implementations.
+type UnimplementedIngestServer struct {
+}
+
+func (UnimplementedIngestServer) Publish(context.Context, *PublishRequest) (*PublishReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Publish not implemented")
+}
+func (UnimplementedIngestServer) PublishStream(Ingest_PublishStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method PublishStream not implemented")
+}
+func (UnimplementedIngestServer) mustEmbedUnimplementedIngestServer() {}
+
+// UnsafeIngestServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to IngestServer will
+// result in compilation errors.
+type UnsafeIngestServer interface {
+	mustEmbedUnimplementedIngestServer()
+}
+
+func RegisterIngestServer(s grpc.ServiceRegistrar, srv IngestServer) {
+	s.RegisterService(&Ingest_ServiceDesc, srv)
+}
+
+func _Ingest_Publish_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PublishRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IngestServer).Publish(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/grillbernetes.Ingest/Publish",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IngestServer).Publish(ctx, req.(*PublishRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Ingest_PublishStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(IngestServer).PublishStream(&ingestPublishStreamServer{stream})
+}
+
+type Ingest_PublishStreamServer interface {
+	SendAndClose(*PublishSummary) error
+	Recv() (*PublishRequest, error)
+	grpc.ServerStream
+}
+
+type ingestPublishStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *ingestPublishStreamServer) SendAndClose(m *PublishSummary) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *ingestPublishStreamServer) Recv() (*PublishRequest, error) {
+	m := new(PublishRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Ingest_ServiceDesc is the grpc.ServiceDesc for Ingest service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Ingest_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "grillbernetes.Ingest",
+	HandlerType: (*IngestServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Publish",
+			Handler:    _Ingest_Publish_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "PublishStream",
+			Handler:       _Ingest_PublishStream_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "hub.proto",
+}
+
+// EventsClient is the client API for Events service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type EventsClient interface {
+	Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (Events_SubscribeClient, error)
+}
+
+type eventsClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewEventsClient(cc grpc.ClientConnInterface) EventsClient {
+	return &eventsClient{cc}
+}
+
+func (c *eventsClient) Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (Events_SubscribeClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Events_ServiceDesc.Streams[0], "/grillbernetes.Events/Subscribe", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &eventsSubscribeClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Events_SubscribeClient interface {
+	Recv() (*Event, error)
+	grpc.ClientStream
+}
+
+type eventsSubscribeClient struct {
+	grpc.ClientStream
+}
+
+func (x *eventsSubscribeClient) Recv() (*Event, error) {
+	m := new(Event)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// EventsServer is the server API for Events service.
+// All implementations must embed UnimplementedEventsServer
+// for forward compatibility
+type EventsServer interface {
+	Subscribe(*SubscribeRequest, Events_SubscribeServer) error
+	mustEmbedUnimplementedEventsServer()
+}
+
+// UnimplementedEventsServer must be embedded to have forward compatible implementations.
+type UnimplementedEventsServer struct {
+}
+
+func (UnimplementedEventsServer) Subscribe(*SubscribeRequest, Events_SubscribeServer) error {
+	return status.Errorf(codes.Unimplemented, "method Subscribe not implemented")
+}
+func (UnimplementedEventsServer) mustEmbedUnimplementedEventsServer() {}
+
+// UnsafeEventsServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to EventsServer will
+// result in compilation errors.
+type UnsafeEventsServer interface {
+	mustEmbedUnimplementedEventsServer()
+}
+
+func RegisterEventsServer(s grpc.ServiceRegistrar, srv EventsServer) {
+	s.RegisterService(&Events_ServiceDesc, srv)
+}
+
+func _Events_Subscribe_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(EventsServer).Subscribe(m, &eventsSubscribeServer{stream})
+}
+
+type Events_SubscribeServer interface {
+	Send(*Event) error
+	grpc.ServerStream
+}
+
+type eventsSubscribeServer struct {
+	grpc.ServerStream
+}
+
+func (x *eventsSubscribeServer) Send(m *Event) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Events_ServiceDesc is the grpc.ServiceDesc for Events service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Events_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "grillbernetes.Events",
+	HandlerType: (*EventsServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Subscribe",
+			Handler:       _Events_Subscribe_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "hub.proto",
+}
+
+// ControlClient is the client API for Control service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ControlClient interface {
+	GetConfig(ctx context.Context, in *ConfigKey, opts ...grpc.CallOption) (*Config, error)
+	SetConfig(ctx context.Context, in *Config, opts ...grpc.CallOption) (*Config, error)
+	//GetShadow desired state of a config next to what the device last reported
+	GetShadow(ctx context.Context, in *ConfigKey, opts ...grpc.CallOption) (*Shadow, error)
+	//ReportState called by a device once it applied a config
+	ReportState(ctx context.Context, in *ReportedState, opts ...grpc.CallOption) (*Shadow, error)
+}
+
+type controlClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewControlClient(cc grpc.ClientConnInterface) ControlClient {
+	return &controlClient{cc}
+}
+
+func (c *controlClient) GetConfig(ctx context.Context, in *ConfigKey, opts ...grpc.CallOption) (*Config, error) {
+	out := new(Config)
+	err := c.cc.Invoke(ctx, "/grillbernetes.Control/GetConfig", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) SetConfig(ctx context.Context, in *Config, opts ...grpc.CallOption) (*Config, error) {
+	out := new(Config)
+	err := c.cc.Invoke(ctx, "/grillbernetes.Control/SetConfig", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) GetShadow(ctx context.Context, in *ConfigKey, opts ...grpc.CallOption) (*Shadow, error) {
+	out := new(Shadow)
+	err := c.cc.Invoke(ctx, "/grillbernetes.Control/GetShadow", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) ReportState(ctx context.Context, in *ReportedState, opts ...grpc.CallOption) (*Shadow, error) {
+	out := new(Shadow)
+	err := c.cc.Invoke(ctx, "/grillbernetes.Control/ReportState", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ControlServer is the server API for Control service.
+// All implementations must embed UnimplementedControlServer
+// for forward compatibility
+type ControlServer interface {
+	GetConfig(context.Context, *ConfigKey) (*Config, error)
+	SetConfig(context.Context, *Config) (*Config, error)
+	//GetShadow desired state of a config next to what the device last reported
+	GetShadow(context.Context, *ConfigKey) (*Shadow, error)
+	//ReportState called by a device once it applied a config
+	ReportState(context.Context, *ReportedState) (*Shadow, error)
+	mustEmbedUnimplementedControlServer()
+}
+
+// UnimplementedControlServer must be embedded to have forward compatible implementations.
+type UnimplementedControlServer struct {
+}
+
+func (UnimplementedControlServer) GetConfig(context.Context, *ConfigKey) (*Config, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetConfig not implemented")
+}
+func (UnimplementedControlServer) SetConfig(context.Context, *Config) (*Config, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetConfig not implemented")
+}
+func (UnimplementedControlServer) GetShadow(context.Context, *ConfigKey) (*Shadow, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetShadow not implemented")
+}
+func (UnimplementedControlServer) ReportState(context.Context, *ReportedState) (*Shadow, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReportState not implemented")
+}
+func (UnimplementedControlServer) mustEmbedUnimplementedControlServer() {}
+
+// UnsafeControlServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ControlServer will
+// result in compilation errors.
+type UnsafeControlServer interface {
+	mustEmbedUnimplementedControlServer()
+}
+
+func RegisterControlServer(s grpc.ServiceRegistrar, srv ControlServer) {
+	s.RegisterService(&Control_ServiceDesc, srv)
+}
+
+func _Control_GetConfig_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ConfigKey)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).GetConfig(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/grillbernetes.Control/GetConfig",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).GetConfig(ctx, req.(*ConfigKey))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_SetConfig_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Config)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).SetConfig(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/grillbernetes.Control/SetConfig",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).SetConfig(ctx, req.(*Config))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_GetShadow_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ConfigKey)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).GetShadow(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/grillbernetes.Control/GetShadow",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).GetShadow(ctx, req.(*ConfigKey))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_ReportState_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReportedState)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).ReportState(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/grillbernetes.Control/ReportState",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).ReportState(ctx, req.(*ReportedState))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Control_ServiceDesc is the grpc.ServiceDesc for Control service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Control_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "grillbernetes.Control",
+	HandlerType: (*ControlServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetConfig",
+			Handler:    _Control_GetConfig_Handler,
+		},
+		{
+			MethodName: "SetConfig",
+			Handler:    _Control_SetConfig_Handler,
+		},
+		{
+			MethodName: "GetShadow",
+			Handler:    _Control_GetShadow_Handler,
+		},
+		{
+			MethodName: "ReportState",
+			Handler:    _Control_ReportState_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "hub.proto",
+}
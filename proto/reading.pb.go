@@ -0,0 +1,500 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.27.1
+// 	protoc        v3.17.3
+// source: reading.proto
+
+package grillbernetes
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// Reading a single sensor reading from a smoker, field for field the same as the JSON reading so
+// the services can translate between the two
+type Reading struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Id      string  `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Running bool    `protobuf:"varint,2,opt,name=running,proto3" json:"running,omitempty"`
+	Name    string  `protobuf:"bytes,3,opt,name=name,proto3" json:"name,omitempty"`
+	F       float64 `protobuf:"fixed64,4,opt,name=f,proto3" json:"f,omitempty"`
+	C       float64 `protobuf:"fixed64,5,opt,name=c,proto3" json:"c,omitempty"`
+}
+
+func (x *Reading) Reset() {
+	*x = Reading{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_reading_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Reading) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Reading) ProtoMessage() {}
+
+func (x *Reading) ProtoReflect() protoreflect.Message {
+	mi := &file_reading_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Reading.ProtoReflect.Descriptor instead.
+func (*Reading) Descriptor() ([]byte, []int) {
+	return file_reading_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Reading) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *Reading) GetRunning() bool {
+	if x != nil {
+		return x.Running
+	}
+	return false
+}
+
+func (x *Reading) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Reading) GetF() float64 {
+	if x != nil {
+		return x.F
+	}
+	return 0
+}
+
+func (x *Reading) GetC() float64 {
+	if x != nil {
+		return x.C
+	}
+	return 0
+}
+
+// BatchReading a reading within a batch, carries its own channel and device timestamp
+type BatchReading struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	MsgId         string   `protobuf:"bytes,1,opt,name=msg_id,json=msgId,proto3" json:"msg_id,omitempty"`
+	Channel       string   `protobuf:"bytes,2,opt,name=channel,proto3" json:"channel,omitempty"`
+	Timestamp     int64    `protobuf:"varint,3,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	SchemaVersion int32    `protobuf:"varint,4,opt,name=schema_version,json=schemaVersion,proto3" json:"schema_version,omitempty"`
+	Reading       *Reading `protobuf:"bytes,5,opt,name=reading,proto3" json:"reading,omitempty"`
+}
+
+func (x *BatchReading) Reset() {
+	*x = BatchReading{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_reading_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *BatchReading) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BatchReading) ProtoMessage() {}
+
+func (x *BatchReading) ProtoReflect() protoreflect.Message {
+	mi := &file_reading_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BatchReading.ProtoReflect.Descriptor instead.
+func (*BatchReading) Descriptor() ([]byte, []int) {
+	return file_reading_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *BatchReading) GetMsgId() string {
+	if x != nil {
+		return x.MsgId
+	}
+	return ""
+}
+
+func (x *BatchReading) GetChannel() string {
+	if x != nil {
+		return x.Channel
+	}
+	return ""
+}
+
+func (x *BatchReading) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+func (x *BatchReading) GetSchemaVersion() int32 {
+	if x != nil {
+		return x.SchemaVersion
+	}
+	return 0
+}
+
+func (x *BatchReading) GetReading() *Reading {
+	if x != nil {
+		return x.Reading
+	}
+	return nil
+}
+
+// ReadingBatch body of a protobuf batch publish
+type ReadingBatch struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Readings []*BatchReading `protobuf:"bytes,1,rep,name=readings,proto3" json:"readings,omitempty"`
+}
+
+func (x *ReadingBatch) Reset() {
+	*x = ReadingBatch{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_reading_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ReadingBatch) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ReadingBatch) ProtoMessage() {}
+
+func (x *ReadingBatch) ProtoReflect() protoreflect.Message {
+	mi := &file_reading_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ReadingBatch.ProtoReflect.Descriptor instead.
+func (*ReadingBatch) Descriptor() ([]byte, []int) {
+	return file_reading_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *ReadingBatch) GetReadings() []*BatchReading {
+	if x != nil {
+		return x.Readings
+	}
+	return nil
+}
+
+// Event a message streamed out of events, readings are sent typed and payloads of any other
+// channel are passed through as their JSON. Seq is the stream sequence to resume from, device and channel
+// say where it came from for wildcard topics
+type Event struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Timestamp int64 `protobuf:"varint,1,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	// Types that are assignable to Data:
+	//	*Event_Reading
+	//	*Event_Json
+	Data    isEvent_Data `protobuf_oneof:"data"`
+	Seq     uint64       `protobuf:"varint,4,opt,name=seq,proto3" json:"seq,omitempty"`
+	Device  string       `protobuf:"bytes,5,opt,name=device,proto3" json:"device,omitempty"`
+	Channel string       `protobuf:"bytes,6,opt,name=channel,proto3" json:"channel,omitempty"`
+}
+
+func (x *Event) Reset() {
+	*x = Event{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_reading_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Event) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Event) ProtoMessage() {}
+
+func (x *Event) ProtoReflect() protoreflect.Message {
+	mi := &file_reading_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Event.ProtoReflect.Descriptor instead.
+func (*Event) Descriptor() ([]byte, []int) {
+	return file_reading_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *Event) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+func (m *Event) GetData() isEvent_Data {
+	if m != nil {
+		return m.Data
+	}
+	return nil
+}
+
+func (x *Event) GetReading() *Reading {
+	if x, ok := x.GetData().(*Event_Reading); ok {
+		return x.Reading
+	}
+	return nil
+}
+
+func (x *Event) GetJson() []byte {
+	if x, ok := x.GetData().(*Event_Json); ok {
+		return x.Json
+	}
+	return nil
+}
+
+func (x *Event) GetSeq() uint64 {
+	if x != nil {
+		return x.Seq
+	}
+	return 0
+}
+
+func (x *Event) GetDevice() string {
+	if x != nil {
+		return x.Device
+	}
+	return ""
+}
+
+func (x *Event) GetChannel() string {
+	if x != nil {
+		return x.Channel
+	}
+	return ""
+}
+
+type isEvent_Data interface {
+	isEvent_Data()
+}
+
+type Event_Reading struct {
+	Reading *Reading `protobuf:"bytes,2,opt,name=reading,proto3,oneof"`
+}
+
+type Event_Json struct {
+	Json []byte `protobuf:"bytes,3,opt,name=json,proto3,oneof"`
+}
+
+func (*Event_Reading) isEvent_Data() {}
+
+func (*Event_Json) isEvent_Data() {}
+
+var File_reading_proto protoreflect.FileDescriptor
+
+var file_reading_proto_rawDesc = []byte{
+	0x0a, 0x0d, 0x72, 0x65, 0x61, 0x64, 0x69, 0x6e, 0x67, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12,
+	0x0d, 0x67, 0x72, 0x69, 0x6c, 0x6c, 0x62, 0x65, 0x72, 0x6e, 0x65, 0x74, 0x65, 0x73, 0x22, 0x63,
+	0x0a, 0x07, 0x52, 0x65, 0x61, 0x64, 0x69, 0x6e, 0x67, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x69, 0x64, 0x12, 0x18, 0x0a, 0x07, 0x72, 0x75, 0x6e,
+	0x6e, 0x69, 0x6e, 0x67, 0x18, 0x02, 0x20, 0x01, 0x28, 0x08, 0x52, 0x07, 0x72, 0x75, 0x6e, 0x6e,
+	0x69, 0x6e, 0x67, 0x12, 0x12, 0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x0c, 0x0a, 0x01, 0x66, 0x18, 0x04, 0x20, 0x01,
+	0x28, 0x01, 0x52, 0x01, 0x66, 0x12, 0x0c, 0x0a, 0x01, 0x63, 0x18, 0x05, 0x20, 0x01, 0x28, 0x01,
+	0x52, 0x01, 0x63, 0x22, 0xb6, 0x01, 0x0a, 0x0c, 0x42, 0x61, 0x74, 0x63, 0x68, 0x52, 0x65, 0x61,
+	0x64, 0x69, 0x6e, 0x67, 0x12, 0x15, 0x0a, 0x06, 0x6d, 0x73, 0x67, 0x5f, 0x69, 0x64, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x6d, 0x73, 0x67, 0x49, 0x64, 0x12, 0x18, 0x0a, 0x07, 0x63,
+	0x68, 0x61, 0x6e, 0x6e, 0x65, 0x6c, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x63, 0x68,
+	0x61, 0x6e, 0x6e, 0x65, 0x6c, 0x12, 0x1c, 0x0a, 0x09, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61,
+	0x6d, 0x70, 0x18, 0x03, 0x20, 0x01, 0x28, 0x03, 0x52, 0x09, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74,
+	0x61, 0x6d, 0x70, 0x12, 0x25, 0x0a, 0x0e, 0x73, 0x63, 0x68, 0x65, 0x6d, 0x61, 0x5f, 0x76, 0x65,
+	0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x04, 0x20, 0x01, 0x28, 0x05, 0x52, 0x0d, 0x73, 0x63, 0x68,
+	0x65, 0x6d, 0x61, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x30, 0x0a, 0x07, 0x72, 0x65,
+	0x61, 0x64, 0x69, 0x6e, 0x67, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x16, 0x2e, 0x67, 0x72,
+	0x69, 0x6c, 0x6c, 0x62, 0x65, 0x72, 0x6e, 0x65, 0x74, 0x65, 0x73, 0x2e, 0x52, 0x65, 0x61, 0x64,
+	0x69, 0x6e, 0x67, 0x52, 0x07, 0x72, 0x65, 0x61, 0x64, 0x69, 0x6e, 0x67, 0x22, 0x47, 0x0a, 0x0c,
+	0x52, 0x65, 0x61, 0x64, 0x69, 0x6e, 0x67, 0x42, 0x61, 0x74, 0x63, 0x68, 0x12, 0x37, 0x0a, 0x08,
+	0x72, 0x65, 0x61, 0x64, 0x69, 0x6e, 0x67, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x1b,
+	0x2e, 0x67, 0x72, 0x69, 0x6c, 0x6c, 0x62, 0x65, 0x72, 0x6e, 0x65, 0x74, 0x65, 0x73, 0x2e, 0x42,
+	0x61, 0x74, 0x63, 0x68, 0x52, 0x65, 0x61, 0x64, 0x69, 0x6e, 0x67, 0x52, 0x08, 0x72, 0x65, 0x61,
+	0x64, 0x69, 0x6e, 0x67, 0x73, 0x22, 0xbb, 0x01, 0x0a, 0x05, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x12,
+	0x1c, 0x0a, 0x09, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x18, 0x01, 0x20, 0x01,
+	0x28, 0x03, 0x52, 0x09, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x12, 0x32, 0x0a,
+	0x07, 0x72, 0x65, 0x61, 0x64, 0x69, 0x6e, 0x67, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x16,
+	0x2e, 0x67, 0x72, 0x69, 0x6c, 0x6c, 0x62, 0x65, 0x72, 0x6e, 0x65, 0x74, 0x65, 0x73, 0x2e, 0x52,
+	0x65, 0x61, 0x64, 0x69, 0x6e, 0x67, 0x48, 0x00, 0x52, 0x07, 0x72, 0x65, 0x61, 0x64, 0x69, 0x6e,
+	0x67, 0x12, 0x14, 0x0a, 0x04, 0x6a, 0x73, 0x6f, 0x6e, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0c, 0x48,
+	0x00, 0x52, 0x04, 0x6a, 0x73, 0x6f, 0x6e, 0x12, 0x10, 0x0a, 0x03, 0x73, 0x65, 0x71, 0x18, 0x04,
+	0x20, 0x01, 0x28, 0x04, 0x52, 0x03, 0x73, 0x65, 0x71, 0x12, 0x16, 0x0a, 0x06, 0x64, 0x65, 0x76,
+	0x69, 0x63, 0x65, 0x18, 0x05, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x64, 0x65, 0x76, 0x69, 0x63,
+	0x65, 0x12, 0x18, 0x0a, 0x07, 0x63, 0x68, 0x61, 0x6e, 0x6e, 0x65, 0x6c, 0x18, 0x06, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x07, 0x63, 0x68, 0x61, 0x6e, 0x6e, 0x65, 0x6c, 0x42, 0x06, 0x0a, 0x04, 0x64,
+	0x61, 0x74, 0x61, 0x42, 0x3f, 0x5a, 0x3d, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f,
+	0x6d, 0x2f, 0x63, 0x68, 0x61, 0x72, 0x6c, 0x65, 0x73, 0x2d, 0x64, 0x2d, 0x62, 0x75, 0x72, 0x74,
+	0x6f, 0x6e, 0x2f, 0x67, 0x72, 0x69, 0x6c, 0x6c, 0x62, 0x65, 0x72, 0x6e, 0x65, 0x74, 0x65, 0x73,
+	0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x3b, 0x67, 0x72, 0x69, 0x6c, 0x6c, 0x62, 0x65, 0x72, 0x6e,
+	0x65, 0x74, 0x65, 0x73, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_reading_proto_rawDescOnce sync.Once
+	file_reading_proto_rawDescData = file_reading_proto_rawDesc
+)
+
+func file_reading_proto_rawDescGZIP() []byte {
+	file_reading_proto_rawDescOnce.Do(func() {
+		file_reading_proto_rawDescData = protoimpl.X.CompressGZIP(file_reading_proto_rawDescData)
+	})
+	return file_reading_proto_rawDescData
+}
+
+var file_reading_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_reading_proto_goTypes = []interface{}{
+	(*Reading)(nil),      // 0: grillbernetes.Reading
+	(*BatchReading)(nil), // 1: grillbernetes.BatchReading
+	(*ReadingBatch)(nil), // 2: grillbernetes.ReadingBatch
+	(*Event)(nil),        // 3: grillbernetes.Event
+}
+var file_reading_proto_depIdxs = []int32{
+	0, // 0: grillbernetes.BatchReading.reading:type_name -> grillbernetes.Reading
+	1, // 1: grillbernetes.ReadingBatch.readings:type_name -> grillbernetes.BatchReading
+	0, // 2: grillbernetes.Event.reading:type_name -> grillbernetes.Reading
+	3, // [3:3] is the sub-list for method output_type
+	3, // [3:3] is the sub-list for method input_type
+	3, // [3:3] is the sub-list for extension type_name
+	3, // [3:3] is the sub-list for extension extendee
+	0, // [0:3] is the sub-list for field type_name
+}
+
+func init() { file_reading_proto_init() }
+func file_reading_proto_init() {
+	if File_reading_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_reading_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Reading); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_reading_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*BatchReading); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_reading_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ReadingBatch); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_reading_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Event); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	file_reading_proto_msgTypes[3].OneofWrappers = []interface{}{
+		(*Event_Reading)(nil),
+		(*Event_Json)(nil),
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_reading_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   4,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_reading_proto_goTypes,
+		DependencyIndexes: file_reading_proto_depIdxs,
+		MessageInfos:      file_reading_proto_msgTypes,
+	}.Build()
+	File_reading_proto = out.File
+	file_reading_proto_rawDesc = nil
+	file_reading_proto_goTypes = nil
+	file_reading_proto_depIdxs = nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	credentialPrefix = "credentials/"
+	signatureHeader  = "X-Signature"
+	timestampHeader  = "X-Timestamp"
+	maxClockSkew     = 5 * time.Minute
+	secretBytes      = 32
+)
+
+var (
+	errUnknownDevice    = errors.New("no credential issued for device")
+	errMissingAuth      = errors.New("missing device credential")
+	errBadCredential    = errors.New("device credential does not match")
+	errStaleSignature   = errors.New("signature timestamp outside of allowed window")
+	errAdminUnavailable = errors.New("admin api disabled, no admin token configured")
+	errReservedGroup    = errors.New("group name is reserved")
+)
+
+//reservedGroups the names that start the keys pub-hub and control-hub keep outside of any group. The devices
+//of a group live in a hash named after it, so a group named after one of them would share its keys
+var reservedGroups = map[string]bool{
+	"alarms": true, "assignments": true, "audit": true, "credentials": true, "deadletter": true,
+	"devicetypes": true, "heartbeats": true, "holds": true, "migrations": true, "presence": true,
+	"recipes": true, "registry": true, "revisions": true, "schedules": true, "schemas": true, "webhooks": true,
+}
+
+//DeviceCredential shared secret issued to a device, used either as a bearer token or an HMAC key
+type DeviceCredential struct {
+	Group   string `json:"group"`
+	Device  string `json:"device"`
+	Secret  string `json:"secret,omitempty"`
+	Created int64  `json:"created"`
+}
+
+func credentialKey(group string) string {
+	return credentialPrefix + group
+}
+
+//IssueCredential generate a new secret for the device, replacing any previous one. Devices can't be issued one
+//in a reserved group so nothing is ever published to it
+func IssueCredential(group, device string) (*DeviceCredential, error) {
+	if reservedGroups[group] {
+		return nil, errReservedGroup
+	}
+	buf := make([]byte, secretBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	cred := &DeviceCredential{
+		Group:   group,
+		Device:  device,
+		Secret:  hex.EncodeToString(buf),
+		Created: time.Now().Unix(),
+	}
+	data, err := json.Marshal(cred)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.PutCredential(group, device, data); err != nil {
+		return nil, err
+	}
+	return cred, nil
+}
+
+//GetCredential look up the credential issued to a device
+func GetCredential(group, device string) (*DeviceCredential, error) {
+	val, err := store.GetCredential(group, device)
+	if err == errNotFound {
+		return nil, errUnknownDevice
+	} else if err != nil {
+		return nil, err
+	}
+	var cred DeviceCredential
+	if err := json.Unmarshal(val, &cred); err != nil {
+		return nil, err
+	}
+	return &cred, nil
+}
+
+//RevokeCredential remove the credential for a device, returns false if none was issued
+func RevokeCredential(group, device string) (bool, error) {
+	return store.DeleteCredential(group, device)
+}
+
+//ListCredentials return the credentials issued in a group with the secrets removed
+func ListCredentials(group string) ([]DeviceCredential, error) {
+	vals, err := store.ListCredentials(group)
+	if err != nil {
+		return nil, err
+	}
+	creds := make([]DeviceCredential, 0, len(vals))
+	for _, val := range vals {
+		var cred DeviceCredential
+		if err := json.Unmarshal(val, &cred); err != nil {
+			log.Error(err)
+			continue
+		}
+		cred.Secret = ""
+		creds = append(creds, cred)
+	}
+	return creds, nil
+}
+
+//Verify check the request credentials against the device secret. Accepts either
+//"Authorization: Bearer <secret>" or an X-Signature header holding the hex encoded
+//HMAC-SHA256 of "<X-Timestamp>.<path>.<body>" keyed with the secret
+func (cred *DeviceCredential) Verify(r *http.Request, body []byte) error {
+	if token := bearerToken(r); token != "" {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(cred.Secret)) != 1 {
+			return errBadCredential
+		}
+		return nil
+	}
+	sig := strings.TrimPrefix(r.Header.Get(signatureHeader), "sha256=")
+	if sig == "" {
+		return errMissingAuth
+	}
+	ts, err := strconv.ParseInt(r.Header.Get(timestampHeader), 10, 64)
+	if err != nil {
+		return errStaleSignature
+	}
+	skew := time.Since(time.Unix(ts, 0))
+	if skew > maxClockSkew || skew < -maxClockSkew {
+		return errStaleSignature
+	}
+	expected, err := hex.DecodeString(sig)
+	if err != nil {
+		return errBadCredential
+	}
+	mac := hmac.New(sha256.New, []byte(cred.Secret))
+	mac.Write([]byte(strconv.FormatInt(ts, 10) + "." + r.URL.Path + "."))
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return errBadCredential
+	}
+	return nil
+}
+
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+}
+
+//DeviceAuth middleware that rejects publishes not carrying the credential of the :group/:device in the path
+func DeviceAuth(c *gin.Context) {
+	cred, err := GetCredential(c.Param("group"), c.Param("device"))
+	if err == errUnknownDevice {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		log.Error(err)
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	//The body is read whole to check its signature, hold it to the largest body any route takes
+	body, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxBatchBytes))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(body)) //Put the body back for the handler
+	if err := cred.Verify(c.Request, body); err != nil {
+		log.Warnf("rejected publish for %v/%v: %v", cred.Group, cred.Device, err)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	c.Next()
+}
+
+//AdminAuth middleware guarding the admin api with the configured admin token
+func AdminAuth(c *gin.Context) {
+	if adminToken == "" {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": errAdminUnavailable.Error()})
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(bearerToken(c.Request)), []byte(adminToken)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": errBadCredential.Error()})
+		return
+	}
+	c.Next()
+}
+
+//PostCredential issue a new credential for a device, the secret is only ever returned here
+func PostCredential(c *gin.Context) {
+	cred, err := IssueCredential(c.Param("group"), c.Param("device"))
+	if err == errReservedGroup {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	log.Infof("issued credential for %v/%v", cred.Group, cred.Device)
+	c.JSON(http.StatusCreated, cred)
+}
+
+//DeleteCredential revoke the credential of a device
+func DeleteCredential(c *gin.Context) {
+	removed, err := RevokeCredential(c.Param("group"), c.Param("device"))
+	if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	if !removed {
+		c.JSON(http.StatusNotFound, gin.H{"error": errUnknownDevice.Error()})
+		return
+	}
+	log.Infof("revoked credential for %v/%v", c.Param("group"), c.Param("device"))
+	c.JSON(http.StatusOK, gin.H{"status": "revoked"})
+}
+
+//PostVerifyCredential whether {"secret": ...} is the credential issued to the device, so control-hub can
+//accept device credentials without reading pub-hub's storage
+func PostVerifyCredential(c *gin.Context) {
+	var req struct {
+		Secret string `json:"secret" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	cred, err := GetCredential(c.Param("group"), c.Param("device"))
+	if err == errUnknownDevice {
+		c.JSON(http.StatusOK, gin.H{"valid": false})
+		return
+	} else if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	valid := cred.Secret != "" && subtle.ConstantTimeCompare([]byte(req.Secret), []byte(cred.Secret)) == 1
+	c.JSON(http.StatusOK, gin.H{"valid": valid})
+}
+
+//GetCredentials list the devices in a group that hold a credential
+func GetCredentials(c *gin.Context) {
+	creds, err := ListCredentials(c.Param("group"))
+	if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, creds)
+}
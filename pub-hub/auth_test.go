@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+//serve a request against the http api
+func serve(t *testing.T, method, path, token string, body []byte, headers map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for key, val := range headers {
+		req.Header.Set(key, val)
+	}
+	rec := httptest.NewRecorder()
+	routes().ServeHTTP(rec, req)
+	return rec
+}
+
+//issue a credential through the admin api
+func issue(t *testing.T, group, device string) *DeviceCredential {
+	t.Helper()
+	rec := serve(t, http.MethodPost, "/admin/credentials/"+group+"/"+device, testAdminToken, nil, nil)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("issue credential: %d %s", rec.Code, rec.Body)
+	}
+	var cred DeviceCredential
+	if err := json.Unmarshal(rec.Body.Bytes(), &cred); err != nil {
+		t.Fatal(err)
+	}
+	if cred.Secret == "" {
+		t.Fatal("issued credential has no secret")
+	}
+	return &cred
+}
+
+var reading = []byte(`{"data":{"temp":225}}`)
+
+func TestCredentialLifecycle(t *testing.T) {
+	cred := issue(t, "lifecycle", "smoker")
+	path := "/lifecycle/smoker/readings"
+	if rec := serve(t, http.MethodPost, path, "", reading, nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("publish without a credential: %d %s", rec.Code, rec.Body)
+	}
+	if rec := serve(t, http.MethodPost, path, "wrong", reading, nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("publish with the wrong secret: %d %s", rec.Code, rec.Body)
+	}
+	if rec := serve(t, http.MethodPost, path, cred.Secret, reading, nil); rec.Code != http.StatusOK {
+		t.Fatalf("publish with the bearer secret: %d %s", rec.Code, rec.Body)
+	}
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(cred.Secret))
+	mac.Write([]byte(ts + "." + path + "."))
+	mac.Write(reading)
+	signed := map[string]string{timestampHeader: ts, signatureHeader: "sha256=" + hex.EncodeToString(mac.Sum(nil))}
+	if rec := serve(t, http.MethodPost, path, "", reading, signed); rec.Code != http.StatusOK {
+		t.Fatalf("publish with an hmac signature: %d %s", rec.Code, rec.Body)
+	}
+	if rec := serve(t, http.MethodPost, path, "", []byte(`{"data":{"temp":0}}`), signed); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("publish of a body the signature wasn't made for: %d %s", rec.Code, rec.Body)
+	}
+
+	rec := serve(t, http.MethodGet, "/admin/credentials/lifecycle", testAdminToken, nil, nil)
+	var listed []DeviceCredential
+	if err := json.Unmarshal(rec.Body.Bytes(), &listed); err != nil || len(listed) != 1 || listed[0].Secret != "" {
+		t.Fatalf("listed credentials: %s %v", rec.Body, err)
+	}
+
+	if rec := serve(t, http.MethodDelete, "/admin/credentials/lifecycle/smoker", testAdminToken, nil, nil); rec.Code != http.StatusOK {
+		t.Fatalf("revoke: %d %s", rec.Code, rec.Body)
+	}
+	if rec := serve(t, http.MethodPost, path, cred.Secret, reading, nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("publish with a revoked credential: %d %s", rec.Code, rec.Body)
+	}
+	if rec := serve(t, http.MethodDelete, "/admin/credentials/lifecycle/smoker", testAdminToken, nil, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("second revoke: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestCredentialOtherDevice(t *testing.T) {
+	cred := issue(t, "mismatch", "smoker")
+	issue(t, "mismatch", "other")
+	issue(t, "elsewhere", "smoker")
+	for _, path := range []string{"/mismatch/other/readings", "/elsewhere/smoker/readings", "/mismatch/other"} {
+		if rec := serve(t, http.MethodPost, path, cred.Secret, reading, nil); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("publish to %v with the credential of mismatch/smoker: %d %s", path, rec.Code, rec.Body)
+		}
+	}
+	if rec := serve(t, http.MethodPost, "/mismatch/smoker/readings", cred.Secret, reading, nil); rec.Code != http.StatusOK {
+		t.Fatalf("publish to its own device: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestDeviceAuthBodyLimit(t *testing.T) {
+	cred := issue(t, "limit", "smoker")
+	body := bytes.Repeat([]byte(" "), maxBatchBytes+1)
+	if rec := serve(t, http.MethodPost, "/limit/smoker/readings", cred.Secret, body, nil); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("oversized body: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestReservedGroup(t *testing.T) {
+	for _, group := range []string{"devicetypes", "schedules", "credentials"} {
+		if rec := serve(t, http.MethodPost, "/admin/credentials/"+group+"/smoker", testAdminToken, nil, nil); rec.Code != http.StatusBadRequest {
+			t.Fatalf("issue a credential in %v: %d %s", group, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	if rec := serve(t, http.MethodPost, "/admin/credentials/admin/smoker", "", nil, nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("admin api without a token: %d %s", rec.Code, rec.Body)
+	}
+	if rec := serve(t, http.MethodPost, "/admin/credentials/admin/smoker", "wrong", nil, nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("admin api with the wrong token: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestVerifyCredential(t *testing.T) {
+	cred := issue(t, "verify", "smoker")
+	cases := []struct {
+		path, secret string
+		valid        bool
+	}{
+		{"/admin/credentials/verify/smoker/verify", cred.Secret, true},
+		{"/admin/credentials/verify/smoker/verify", "wrong", false},
+		{"/admin/credentials/verify/other/verify", cred.Secret, false},
+	}
+	for _, tc := range cases {
+		body, _ := json.Marshal(map[string]string{"secret": tc.secret})
+		rec := serve(t, http.MethodPost, tc.path, testAdminToken, body, nil)
+		var res struct {
+			Valid bool `json:"valid"`
+		}
+		if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &res) != nil || res.Valid != tc.valid {
+			t.Fatalf("verify %v: %d %s", tc.path, rec.Code, rec.Body)
+		}
+	}
+	if rec := serve(t, http.MethodPost, "/admin/credentials/verify/smoker/verify", testAdminToken, []byte(`{}`), nil); rec.Code != http.StatusBadRequest {
+		t.Fatalf("verify without a secret: %d %s", rec.Code, rec.Body)
+	}
+	if rec := serve(t, http.MethodPost, "/admin/credentials/verify/smoker/verify", cred.Secret, []byte(`{}`), nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("verify with a device credential: %d %s", rec.Code, rec.Body)
+	}
+}
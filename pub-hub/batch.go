@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	maxBatchMessages = 5000
+	maxBatchBytes    = 8 << 20
+	ndjsonType       = "application/x-ndjson"
+)
+
+var (
+	errEmptyBatch    = errors.New("batch contains no messages")
+	errBatchTooLarge = fmt.Errorf("batch exceeds %d messages", maxBatchMessages)
+	errBatchBytes    = fmt.Errorf("batch exceeds %d bytes", maxBatchBytes)
+)
+
+//BatchMessage single reading within a batch, carries its own channel and device timestamp
+type BatchMessage struct {
+	ID            string          `json:"msg_id,omitempty"`
+	Channel       string          `json:"channel"`
+	Timestamp     int64           `json:"timestamp"`
+	SchemaVersion int             `json:"schema_version,omitempty"`
+	Data          json.RawMessage `json:"data"`
+}
+
+//BatchResult outcome of publishing one message of a batch
+type BatchResult struct {
+	Index      int    `json:"index"`
+	Subject    string `json:"subject,omitempty"`
+	Status     string `json:"status"`
+	Sequence   uint64 `json:"seq,omitempty"`
+	Duplicate  bool   `json:"duplicate,omitempty"`
+	DeadLetter string `json:"dead_letter,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+//PostBatch publish a batch of readings for a device in any of the encodings decodeBatch understands,
+//the body may be gzip encoded
+func PostBatch(c *gin.Context) {
+	body := io.Reader(http.MaxBytesReader(c.Writer, c.Request.Body, maxBatchBytes))
+	if strings.EqualFold(c.GetHeader("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		defer gz.Close()
+		body = io.LimitReader(gz, maxBatchBytes+1) //A small body can inflate to any size
+	}
+	msgs, err := decodeBatch(body, c.ContentType())
+	var tooLarge *http.MaxBytesError
+	if err == errBatchBytes || errors.As(err, &tooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	group := c.Param("group")
+	device := c.Param("device")
+	results := make([]BatchResult, len(msgs))
+	waiting := make([]<-chan publishResult, len(msgs))
+	for i, msg := range msgs { //Queue everything first so the batch is in flight together
+		results[i], waiting[i] = submitBatchMessage(c.Request.URL.Path, group, device, i, msg)
+	}
+	failed, throttled := 0, 0
+	for i, done := range waiting {
+		if done != nil {
+			collectBatchResult(&results[i], <-done)
+		}
+		if results[i].Error != "" {
+			failed++
+		}
+		if results[i].Status == "throttled" {
+			throttled++
+		}
+	}
+	log.Infof("published batch of %d for %v/%v with %d failures", len(msgs), group, device, failed)
+	status := http.StatusOK
+	if throttled > 0 {
+		c.Header("Retry-After", retryAfter())
+		if throttled == failed && failed == len(msgs) {
+			status = http.StatusTooManyRequests
+		}
+	}
+	c.JSON(status, gin.H{
+		"accepted": len(msgs) - failed,
+		"failed":   failed,
+		"results":  results,
+	})
+}
+
+func submitBatchMessage(path, group, device string, index int, msg BatchMessage) (BatchResult, <-chan publishResult) {
+	result := BatchResult{Index: index}
+	if err := msg.Validate(); err != nil {
+		result.Status = "rejected"
+		result.Error = err.Error()
+		return result, nil
+	}
+	pub := msg.Publication(path, group, device)
+	result.Subject = pub.Subject()
+	done, err := PublishAsync(pub)
+	if err != nil {
+		result.Status = "rejected"
+		if err == errPoolSaturated {
+			result.Status = "throttled"
+		}
+		if dlerr, ok := err.(*DeadLetterError); ok {
+			result.Status = "dead_lettered"
+			result.DeadLetter = dlerr.ID
+		}
+		result.Error = err.Error()
+		return result, nil
+	}
+	return result, done
+}
+
+func collectBatchResult(result *BatchResult, res publishResult) {
+	if res.err != nil {
+		log.Error(res.err)
+		result.Status = "failed"
+		if dlerr, ok := res.err.(*DeadLetterError); ok {
+			result.DeadLetter = dlerr.ID //Failed all the same, the device should send it again
+		}
+		result.Error = res.err.Error()
+		return
+	}
+	result.Status = "accepted"
+	if res.ack.Duplicate {
+		result.Status = "duplicate"
+	}
+	result.Sequence = res.ack.Sequence
+	result.Duplicate = res.ack.Duplicate
+}
+
+//Publication the publication of the message for a device
+func (msg *BatchMessage) Publication(path, group, device string) *Publication {
+	pub := &Publication{
+		Path:          path,
+		Group:         group,
+		Device:        device,
+		Channel:       msg.Channel,
+		Data:          msg.Data,
+		MsgID:         msg.ID,
+		SchemaVersion: msg.SchemaVersion,
+	}
+	if msg.Timestamp > 0 {
+		pub.Sent = time.Unix(msg.Timestamp, 0)
+	}
+	return pub
+}
+
+//Validate make sure the message can be published to a subject of its own
+func (msg *BatchMessage) Validate() error {
+	if msg.Channel == "" {
+		return errors.New("message is missing a channel")
+	}
+	if strings.ContainsAny(msg.Channel, ".*> \t") {
+		return fmt.Errorf("invalid channel %q", msg.Channel)
+	}
+	if len(msg.Data) == 0 {
+		return errors.New("message is missing data")
+	}
+	return nil
+}
+
+//decodeBatch read a protobuf ReadingBatch, a CBOR array, a JSON array, or newline delimited JSON. JSON
+//falls back to sniffing the body when the content type doesn't say which
+func decodeBatch(r io.Reader, contentType string) ([]BatchMessage, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxBatchBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxBatchBytes {
+		return nil, errBatchBytes
+	}
+	var msgs []BatchMessage
+	switch {
+	case isProtobuf(contentType):
+		msgs, err = decodeProtobufBatch(data)
+	case contentType == cborType:
+		msgs, err = decodeCBORBatch(data)
+	default:
+		data = bytes.TrimSpace(data) //Only text can be trimmed, a protobuf batch starts with a newline byte
+		if len(data) == 0 {
+			return nil, errEmptyBatch
+		}
+		if contentType == ndjsonType || data[0] != '[' {
+			msgs, err = decodeNDJSON(data)
+		} else {
+			err = json.Unmarshal(data, &msgs)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		return nil, errEmptyBatch
+	}
+	if len(msgs) > maxBatchMessages {
+		return nil, errBatchTooLarge
+	}
+	return msgs, nil
+}
+
+func decodeNDJSON(data []byte) ([]BatchMessage, error) {
+	msgs := make([]BatchMessage, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), maxBatchBytes)
+	line := 0
+	for scanner.Scan() {
+		line++
+		raw := bytes.TrimSpace(scanner.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+		var msg BatchMessage
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, scanner.Err()
+}
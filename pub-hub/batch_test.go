@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"testing"
+)
+
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestBatchGzip(t *testing.T) {
+	cred := issue(t, "batch", "smoker")
+	headers := map[string]string{"Content-Encoding": "gzip", "Content-Type": ndjsonType}
+	batch := []byte("{\"channel\": \"readings\", \"data\": {\"f\": 225}}\n{\"channel\": \"readings\", \"data\": {\"f\": 226}}\n")
+	rec := serve(t, http.MethodPost, "/batch/smoker", cred.Secret, gzipped(t, batch), headers)
+	if rec.Code != http.StatusOK || !bytes.Contains(rec.Body.Bytes(), []byte(`"accepted":2`)) {
+		t.Fatalf("gzip batch: %d %s", rec.Code, rec.Body)
+	}
+
+	bomb := gzipped(t, bytes.Repeat([]byte(" "), maxBatchBytes+1))
+	if len(bomb) > maxBatchBytes {
+		t.Fatalf("compressed bomb is %d bytes", len(bomb))
+	}
+	if rec := serve(t, http.MethodPost, "/batch/smoker", cred.Secret, bomb, headers); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("batch inflating past the limit: %d %s", rec.Code, rec.Body)
+	}
+}
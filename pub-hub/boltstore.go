@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	devicesBucket     = []byte("devices")
+	groupsBucket      = []byte("groups")
+	credentialsBucket = []byte("credentials")
+	heartbeatsBucket  = []byte("heartbeats")
+	schemasBucket     = []byte("schemas")
+	deadLettersBucket = []byte("deadletters")
+	deadLetterTimes   = []byte("deadletter-times")
+)
+
+//boltStore keeps everything in a bbolt file. Devices, credentials and heartbeats have a bucket per group
+//keyed by device, groups is a bucket of group names and schemas a bucket per channel keyed by version whose
+//sequence is the version counter. Dead letters are keyed by id and indexed by the big endian timestamp
+//followed by the id in deadletter-times
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{devicesBucket, groupsBucket, credentialsBucket, heartbeatsBucket, schemasBucket, deadLettersBucket, deadLetterTimes} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+//get the value of a device in the bucket of its group, nil if there's none
+func (bs *boltStore) get(parent []byte, group, device string) ([]byte, error) {
+	var val []byte
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket(parent).Bucket([]byte(group)); bucket != nil {
+			if found := bucket.Get([]byte(device)); found != nil {
+				val = append([]byte(nil), found...)
+			}
+		}
+		return nil
+	})
+	return val, err
+}
+
+//put set the value of a device in the bucket of its group, true when it's new
+func (bs *boltStore) put(parent []byte, group, device string, val []byte) (bool, error) {
+	var added bool
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(parent).CreateBucketIfNotExists([]byte(group))
+		if err != nil {
+			return err
+		}
+		added = bucket.Get([]byte(device)) == nil
+		return bucket.Put([]byte(device), val)
+	})
+	return added, err
+}
+
+//remove delete a device from the bucket of its group, false if it wasn't there
+func (bs *boltStore) remove(parent []byte, group, device string) (bool, error) {
+	var removed bool
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(parent).Bucket([]byte(group))
+		if bucket == nil || bucket.Get([]byte(device)) == nil {
+			return nil
+		}
+		removed = true
+		return bucket.Delete([]byte(device))
+	})
+	return removed, err
+}
+
+//all every device of a group in a bucket and its value
+func (bs *boltStore) all(parent []byte, group string) (map[string][]byte, error) {
+	vals := make(map[string][]byte)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(parent).Bucket([]byte(group))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(key, val []byte) error {
+			vals[string(key)] = append([]byte(nil), val...)
+			return nil
+		})
+	})
+	return vals, err
+}
+
+func (bs *boltStore) GetDevice(group, device string) ([]byte, error) {
+	val, err := bs.get(devicesBucket, group, device)
+	if err == nil && val == nil {
+		return nil, errNotFound
+	}
+	return val, err
+}
+
+func (bs *boltStore) PutDevice(group, device string, entry []byte) (bool, error) {
+	return bs.put(devicesBucket, group, device, entry)
+}
+
+func (bs *boltStore) SwapDevice(group, device string, old, entry []byte) (bool, error) {
+	var swapped bool
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(devicesBucket).Bucket([]byte(group))
+		if bucket == nil && old == nil && entry != nil {
+			var err error
+			if bucket, err = tx.Bucket(devicesBucket).CreateBucket([]byte(group)); err != nil {
+				return err
+			}
+		}
+		if bucket == nil || !bytes.Equal(bucket.Get([]byte(device)), old) {
+			return nil
+		}
+		swapped = true
+		if entry == nil {
+			return bucket.Delete([]byte(device))
+		}
+		return bucket.Put([]byte(device), entry)
+	})
+	return swapped, err
+}
+
+func (bs *boltStore) ScanDevices(group string, cursor uint64, count int64) ([]DeviceEntry, uint64, error) {
+	vals, err := bs.all(devicesBucket, group)
+	if err != nil {
+		return nil, 0, err
+	}
+	keys := make([]string, 0, len(vals))
+	for device := range vals {
+		keys = append(keys, device)
+	}
+	devices, next := page(keys, cursor, count)
+	entries := make([]DeviceEntry, 0, len(devices))
+	for _, device := range devices {
+		entries = append(entries, DeviceEntry{Device: device, Entry: vals[device]})
+	}
+	return entries, next, nil
+}
+
+func (bs *boltStore) CountDevices(group string) (int64, error) {
+	var count int64
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket(devicesBucket).Bucket([]byte(group)); bucket != nil {
+			count = int64(bucket.Stats().KeyN)
+		}
+		return nil
+	})
+	return count, err
+}
+
+func (bs *boltStore) AddGroup(group string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(groupsBucket).Put([]byte(group), []byte{})
+	})
+}
+
+func (bs *boltStore) RemoveGroup(group string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(groupsBucket).Delete([]byte(group))
+	})
+}
+
+func (bs *boltStore) ScanGroups(cursor uint64, count int64) ([]string, uint64, error) {
+	groups := make([]string, 0)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(groupsBucket).ForEach(func(key, _ []byte) error {
+			groups = append(groups, string(key))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	groups, next := page(groups, cursor, count)
+	return groups, next, nil
+}
+
+func (bs *boltStore) PutCredential(group, device string, cred []byte) error {
+	_, err := bs.put(credentialsBucket, group, device, cred)
+	return err
+}
+
+func (bs *boltStore) GetCredential(group, device string) ([]byte, error) {
+	val, err := bs.get(credentialsBucket, group, device)
+	if err == nil && val == nil {
+		return nil, errNotFound
+	}
+	return val, err
+}
+
+func (bs *boltStore) DeleteCredential(group, device string) (bool, error) {
+	return bs.remove(credentialsBucket, group, device)
+}
+
+func (bs *boltStore) ListCredentials(group string) ([][]byte, error) {
+	vals, err := bs.all(credentialsBucket, group)
+	if err != nil {
+		return nil, err
+	}
+	creds := make([][]byte, 0, len(vals))
+	for _, val := range vals {
+		creds = append(creds, val)
+	}
+	return creds, nil
+}
+
+func (bs *boltStore) GetHeartbeat(group, device string) (int64, error) {
+	val, err := bs.get(heartbeatsBucket, group, device)
+	if err != nil {
+		return 0, err
+	}
+	if val == nil {
+		return 0, errNotFound
+	}
+	return strconv.ParseInt(string(val), 10, 64)
+}
+
+func (bs *boltStore) SetHeartbeat(group, device string, secs int64) error {
+	_, err := bs.put(heartbeatsBucket, group, device, []byte(strconv.FormatInt(secs, 10)))
+	return err
+}
+
+func (bs *boltStore) DeleteHeartbeat(group, device string) error {
+	_, err := bs.remove(heartbeatsBucket, group, device)
+	return err
+}
+
+func (bs *boltStore) Heartbeats(group string) (map[string]int64, error) {
+	vals, err := bs.all(heartbeatsBucket, group)
+	if err != nil {
+		return nil, err
+	}
+	timeouts := make(map[string]int64, len(vals))
+	for device, val := range vals {
+		if secs, err := strconv.ParseInt(string(val), 10, 64); err == nil {
+			timeouts[device] = secs
+		}
+	}
+	return timeouts, nil
+}
+
+func (bs *boltStore) SchemaChannels() ([]string, error) {
+	channels := make([]string, 0)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		schemas := tx.Bucket(schemasBucket)
+		return schemas.ForEach(func(channel, _ []byte) error {
+			if versions := schemas.Bucket(channel); versions != nil && versions.Stats().KeyN > 0 {
+				channels = append(channels, string(channel))
+			}
+			return nil
+		})
+	})
+	return channels, err
+}
+
+func (bs *boltStore) GetSchemas(channel string) ([][]byte, error) {
+	vals, err := bs.all(schemasBucket, channel)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([][]byte, 0, len(vals))
+	for _, val := range vals {
+		entries = append(entries, val)
+	}
+	return entries, nil
+}
+
+func (bs *boltStore) GetSchema(channel string, version int) ([]byte, error) {
+	val, err := bs.get(schemasBucket, channel, strconv.Itoa(version))
+	if err == nil && val == nil {
+		return nil, errNotFound
+	}
+	return val, err
+}
+
+//NextSchemaVersion the sequence of the channel bucket, which outlives the versions in it
+func (bs *boltStore) NextSchemaVersion(channel string) (int, error) {
+	var version uint64
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		versions, err := tx.Bucket(schemasBucket).CreateBucketIfNotExists([]byte(channel))
+		if err != nil {
+			return err
+		}
+		version, err = versions.NextSequence()
+		return err
+	})
+	return int(version), err
+}
+
+func (bs *boltStore) PutSchema(channel string, version int, entry []byte) error {
+	_, err := bs.put(schemasBucket, channel, strconv.Itoa(version), entry)
+	return err
+}
+
+func (bs *boltStore) DeleteSchema(channel string, version int) (bool, error) {
+	return bs.remove(schemasBucket, channel, strconv.Itoa(version))
+}
+
+//deadLetterTime the key of a dead letter in the time index
+func deadLetterTime(id string, timestamp int64) []byte {
+	key := make([]byte, 8, 8+len(id))
+	binary.BigEndian.PutUint64(key, uint64(timestamp))
+	return append(key, id...)
+}
+
+func (bs *boltStore) AddDeadLetter(id string, timestamp int64, entry []byte, max int64) (int64, error) {
+	var dropped int64
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		letters, times := tx.Bucket(deadLettersBucket), tx.Bucket(deadLetterTimes)
+		if err := letters.Put([]byte(id), entry); err != nil {
+			return err
+		}
+		if err := times.Put(deadLetterTime(id, timestamp), []byte(id)); err != nil {
+			return err
+		}
+		var count int64
+		times.ForEach(func(_, _ []byte) error {
+			count++
+			return nil
+		})
+		var oldest [][]byte
+		c := times.Cursor()
+		for key, val := c.First(); key != nil && count-int64(len(oldest)) > max; key, val = c.Next() {
+			oldest = append(oldest, append([]byte(nil), key...))
+			if err := letters.Delete(val); err != nil {
+				return err
+			}
+		}
+		for _, key := range oldest {
+			if err := times.Delete(key); err != nil {
+				return err
+			}
+		}
+		dropped = int64(len(oldest))
+		return nil
+	})
+	return dropped, err
+}
+
+func (bs *boltStore) SaveDeadLetter(id string, entry []byte) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(deadLettersBucket).Put([]byte(id), entry)
+	})
+}
+
+func (bs *boltStore) GetDeadLetter(id string) ([]byte, error) {
+	var entry []byte
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(deadLettersBucket).Get([]byte(id))
+		if val == nil {
+			return errNotFound
+		}
+		entry = append([]byte(nil), val...)
+		return nil
+	})
+	return entry, err
+}
+
+//DeleteDeadLetter looks the dead letter up in the time index by id, the index is small enough to walk
+func (bs *boltStore) DeleteDeadLetter(id string) (bool, error) {
+	var removed bool
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		letters, times := tx.Bucket(deadLettersBucket), tx.Bucket(deadLetterTimes)
+		removed = letters.Get([]byte(id)) != nil
+		if err := letters.Delete([]byte(id)); err != nil {
+			return err
+		}
+		c := times.Cursor()
+		for key, val := c.First(); key != nil; key, val = c.Next() {
+			if string(val) == id {
+				return c.Delete()
+			}
+		}
+		return nil
+	})
+	return removed, err
+}
+
+func (bs *boltStore) DeadLetters(start, count int64) ([][]byte, error) {
+	entries := make([][]byte, 0)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		letters := tx.Bucket(deadLettersBucket)
+		c := tx.Bucket(deadLetterTimes).Cursor()
+		var pos int64
+		for key, id := c.Last(); key != nil && pos < start+count; key, id = c.Prev() {
+			if pos++; pos <= start {
+				continue
+			}
+			if val := letters.Get(id); val != nil {
+				entries = append(entries, append([]byte(nil), val...))
+			}
+		}
+		return nil
+	})
+	return entries, err
+}
+
+func (bs *boltStore) CountDeadLetters() (int64, error) {
+	var count int64
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		count = int64(tx.Bucket(deadLetterTimes).Stats().KeyN)
+		return nil
+	})
+	return count, err
+}
+
+func (bs *boltStore) Ping() error {
+	return bs.db.View(func(tx *bolt.Tx) error { return nil })
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nats-io/nuid"
+)
+
+const (
+	deadLetterEntries = "deadletter/entries"
+	deadLetterIndex   = "deadletter/index"
+	maxDeadLetters    = 10000
+	defaultListLimit  = 100
+
+	outcomeFailed  = "failed"
+	outcomeUnknown = "unknown"
+)
+
+var errDeadLetterNotFound = errors.New("dead letter not found")
+
+//DeadLetter a reading that couldn't be published, kept in storage since the stream may be what failed.
+//Outcome is unknown when a publish timed out waiting for its ack, the stream may hold the reading already
+type DeadLetter struct {
+	ID            string          `json:"id"`
+	Reason        string          `json:"reason"`
+	Outcome       string          `json:"outcome"`
+	Path          string          `json:"path"`
+	Group         string          `json:"group"`
+	Device        string          `json:"device"`
+	Channel       string          `json:"channel"`
+	MsgID         string          `json:"msg_id,omitempty"`
+	SchemaVersion int             `json:"schema_version,omitempty"`
+	Sent          int64           `json:"sent,omitempty"`
+	Timestamp     int64           `json:"timestamp"`
+	Attempts      int             `json:"attempts"`
+	Data          json.RawMessage `json:"data"`
+}
+
+//DeadLetterError a publish failed but the reading was kept in the dead letter store
+type DeadLetterError struct {
+	ID  string
+	Err error
+}
+
+func (err *DeadLetterError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *DeadLetterError) Unwrap() error {
+	return err.Err
+}
+
+//Quarantined whether the reading was dead lettered for failing validation rather than because the publish
+//failed, sending it again won't help
+func (err *DeadLetterError) Quarantined() bool {
+	_, ok := err.Err.(*SchemaError)
+	return ok
+}
+
+//ReplayResult outcome of replaying one dead letter
+type ReplayResult struct {
+	ID       string `json:"id"`
+	Status   string `json:"status"`
+	Sequence uint64 `json:"seq,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+//deadLetterOutcome whether the stream is known to be without a reading that failed. A publish that timed out
+//waiting for its ack may have been stored all the same, replaying it keeps the message id so the stream drops
+//it inside the duplicate window
+func deadLetterOutcome(err error) string {
+	if errors.Is(err, errAckTimeout) {
+		return outcomeUnknown
+	}
+	return outcomeFailed
+}
+
+//WriteDeadLetter store a publication along with the reason it failed, returns the dead letter id
+func WriteDeadLetter(pub *Publication, reason error) (string, error) {
+	dl := &DeadLetter{
+		ID:            nuid.Next(),
+		Reason:        reason.Error(),
+		Outcome:       deadLetterOutcome(reason),
+		Path:          pub.Path,
+		Group:         pub.Group,
+		Device:        pub.Device,
+		Channel:       pub.Channel,
+		MsgID:         pub.MsgID,
+		SchemaVersion: pub.SchemaVersion,
+		Timestamp:     time.Now().Unix(),
+		Data:          pub.Data,
+	}
+	if !pub.Sent.IsZero() {
+		dl.Sent = pub.Sent.Unix()
+	}
+	data, err := json.Marshal(dl)
+	if err != nil {
+		return "", err
+	}
+	dropped, err := store.AddDeadLetter(dl.ID, dl.Timestamp, data, maxDeadLetters)
+	if err != nil {
+		return "", err
+	}
+	if dropped > 0 {
+		log.Warnf("dead letter store full, dropped %d oldest entries", dropped)
+	}
+	log.Warnf("dead lettered %v for %v: %v", dl.ID, pub.Subject(), reason)
+	return dl.ID, nil
+}
+
+func (dl *DeadLetter) save() error {
+	data, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	return store.SaveDeadLetter(dl.ID, data)
+}
+
+//Publication rebuild the publication the dead letter was made from
+func (dl *DeadLetter) Publication() *Publication {
+	pub := &Publication{
+		Group:         dl.Group,
+		Device:        dl.Device,
+		Channel:       dl.Channel,
+		Data:          dl.Data,
+		MsgID:         dl.MsgID,
+		SchemaVersion: dl.SchemaVersion,
+		Path:          dl.Path,
+		deadLetter:    dl.ID,
+	}
+	if dl.Sent > 0 {
+		pub.Sent = time.Unix(dl.Sent, 0)
+	}
+	return pub
+}
+
+//GetDeadLetter look up a single dead letter
+func GetDeadLetter(id string) (*DeadLetter, error) {
+	val, err := store.GetDeadLetter(id)
+	if err == errNotFound {
+		return nil, errDeadLetterNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var dl DeadLetter
+	if err := json.Unmarshal(val, &dl); err != nil {
+		return nil, err
+	}
+	return &dl, nil
+}
+
+//DeleteDeadLetter remove a dead letter, returns false if there was nothing to remove
+func DeleteDeadLetter(id string) (bool, error) {
+	return store.DeleteDeadLetter(id)
+}
+
+//ListDeadLetters newest first, optionally only those of a group and device
+func ListDeadLetters(group, device string, offset, limit int) ([]DeadLetter, error) {
+	total, err := store.CountDeadLetters()
+	if err != nil {
+		return nil, err
+	}
+	letters := make([]DeadLetter, 0)
+	for start := int64(0); start < total && len(letters) < offset+limit; start += int64(limit) {
+		vals, err := store.DeadLetters(start, int64(limit))
+		if err != nil {
+			return nil, err
+		}
+		for _, val := range vals {
+			var dl DeadLetter
+			if err := json.Unmarshal(val, &dl); err != nil {
+				log.Error(err)
+				continue
+			}
+			if (group != "" && dl.Group != group) || (device != "" && dl.Device != device) {
+				continue
+			}
+			letters = append(letters, dl)
+		}
+	}
+	if offset >= len(letters) {
+		return []DeadLetter{}, nil
+	}
+	letters = letters[offset:]
+	if len(letters) > limit {
+		letters = letters[:limit]
+	}
+	return letters, nil
+}
+
+//Replay publish a dead letter back into the stream, it's removed once the stream acks it and
+//updated with the new failure reason otherwise
+func (dl *DeadLetter) Replay() ReplayResult {
+	result := ReplayResult{ID: dl.ID}
+	ack, err := Publish(dl.Publication())
+	if err != nil {
+		dl.Attempts++
+		dl.Reason = err.Error()
+		if dl.Outcome != outcomeUnknown { //Once unknown it stays so, an earlier attempt may have been stored
+			dl.Outcome = deadLetterOutcome(err)
+		}
+		if serr := dl.save(); serr != nil {
+			log.Error(serr)
+		}
+		result.Status = "failed"
+		result.Error = err.Error()
+		return result
+	}
+	if _, err := DeleteDeadLetter(dl.ID); err != nil {
+		log.Error(err)
+	}
+	result.Status = "replayed"
+	if ack.Duplicate {
+		result.Status = "duplicate"
+	}
+	result.Sequence = ack.Sequence
+	return result
+}
+
+func pagination(c *gin.Context) (int, int, bool) {
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid offset"})
+		return 0, 0, false
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultListLimit)))
+	if err != nil || limit <= 0 || limit > maxDeadLetters {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+		return 0, 0, false
+	}
+	return offset, limit, true
+}
+
+//GetDeadLetters list dead letters, filterable by ?group= and ?device=
+func GetDeadLetters(c *gin.Context) {
+	offset, limit, ok := pagination(c)
+	if !ok {
+		return
+	}
+	letters, err := ListDeadLetters(c.Query("group"), c.Query("device"), offset, limit)
+	if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	total, err := store.CountDeadLetters()
+	if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"total": total, "dead_letters": letters})
+}
+
+//GetDeadLetterByID inspect a single dead letter
+func GetDeadLetterByID(c *gin.Context) {
+	dl, err := GetDeadLetter(c.Param("id"))
+	if err == errDeadLetterNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, dl)
+}
+
+//DeleteDeadLetterByID discard a dead letter without replaying it
+func DeleteDeadLetterByID(c *gin.Context) {
+	removed, err := DeleteDeadLetter(c.Param("id"))
+	if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	if !removed {
+		c.JSON(http.StatusNotFound, gin.H{"error": errDeadLetterNotFound.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
+//PostReplayDeadLetter replay a single dead letter into the stream
+func PostReplayDeadLetter(c *gin.Context) {
+	dl, err := GetDeadLetter(c.Param("id"))
+	if err == errDeadLetterNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	result := dl.Replay()
+	status := http.StatusOK
+	if result.Error != "" {
+		status = http.StatusConflict
+	}
+	c.JSON(status, result)
+}
+
+//PostReplayDeadLetters replay every dead letter matching ?group= and ?device=, oldest first so
+//readings land in the stream in the order they were taken
+func PostReplayDeadLetters(c *gin.Context) {
+	offset, limit, ok := pagination(c)
+	if !ok {
+		return
+	}
+	letters, err := ListDeadLetters(c.Query("group"), c.Query("device"), offset, limit)
+	if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	results := make([]ReplayResult, 0, len(letters))
+	failed := 0
+	for i := len(letters) - 1; i >= 0; i-- {
+		result := letters[i].Replay()
+		if result.Error != "" {
+			failed++
+		}
+		results = append(results, result)
+	}
+	log.Infof("replayed %d dead letters with %d failures", len(results), failed)
+	c.JSON(http.StatusOK, gin.H{
+		"replayed": len(results) - failed,
+		"failed":   failed,
+		"results":  results,
+	})
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	pb "github.com/charles-d-burton/grillbernetes/proto"
+	"github.com/fxamacker/cbor/v2"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	protobufType  = "application/protobuf"
+	xProtobufType = "application/x-protobuf"
+	cborType      = "application/cbor"
+)
+
+var (
+	//Readings keep every field so a zero temperature still satisfies the schema
+	readingJSON = protojson.MarshalOptions{UseProtoNames: true, EmitUnpopulated: true}
+	cborMode    cbor.DecMode
+)
+
+func init() {
+	var err error
+	cborMode, err = cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]interface{}(nil))}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+}
+
+//cborMessage CBOR form of a Message, data can be any CBOR document that has a JSON equivalent
+type cborMessage struct {
+	ID            string      `cbor:"msg_id"`
+	SchemaVersion int         `cbor:"schema_version"`
+	Data          interface{} `cbor:"data"`
+}
+
+//cborBatchMessage CBOR form of a BatchMessage
+type cborBatchMessage struct {
+	ID            string      `cbor:"msg_id"`
+	Channel       string      `cbor:"channel"`
+	Timestamp     int64       `cbor:"timestamp"`
+	SchemaVersion int         `cbor:"schema_version"`
+	Data          interface{} `cbor:"data"`
+}
+
+//isProtobuf whether the content type names protobuf, both the registered and the legacy x- type are seen in the wild
+func isProtobuf(contentType string) bool {
+	return contentType == protobufType || contentType == xProtobufType
+}
+
+//ReadingJSON translate a protobuf reading into the JSON the rest of the pipeline works with
+func ReadingJSON(reading *pb.Reading) (json.RawMessage, error) {
+	if reading == nil {
+		return nil, nil
+	}
+	data, err := readingJSON.Marshal(reading)
+	if err != nil {
+		return nil, err
+	}
+	var compact bytes.Buffer //protojson randomizes whitespace between runs
+	if err := json.Compact(&compact, data); err != nil {
+		return nil, err
+	}
+	return compact.Bytes(), nil
+}
+
+//cborJSON re-encode a decoded CBOR value as JSON
+func cborJSON(val interface{}) (json.RawMessage, error) {
+	if val == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(val)
+	if err != nil {
+		return nil, fmt.Errorf("cbor payload has no JSON equivalent: %v", err)
+	}
+	return data, nil
+}
+
+//decodeMessage read a single publish in the encoding named by its content type. Protobuf bodies are a bare
+//Reading with the message id and schema version in headers, CBOR bodies mirror the JSON envelope
+func decodeMessage(body []byte, contentType string) (*Message, error) {
+	var msg Message
+	switch {
+	case isProtobuf(contentType):
+		var reading pb.Reading
+		if err := proto.Unmarshal(body, &reading); err != nil {
+			return nil, err
+		}
+		data, err := ReadingJSON(&reading)
+		if err != nil {
+			return nil, err
+		}
+		msg.Data = data
+	case contentType == cborType:
+		var cm cborMessage
+		if err := cborMode.Unmarshal(body, &cm); err != nil {
+			return nil, err
+		}
+		data, err := cborJSON(cm.Data)
+		if err != nil {
+			return nil, err
+		}
+		msg = Message{ID: cm.ID, SchemaVersion: cm.SchemaVersion, Data: data}
+	default:
+		if err := json.Unmarshal(body, &msg); err != nil {
+			return nil, err
+		}
+	}
+	return &msg, nil
+}
+
+//decodeProtobufBatch read a ReadingBatch into batch messages
+func decodeProtobufBatch(data []byte) ([]BatchMessage, error) {
+	var batch pb.ReadingBatch
+	if err := proto.Unmarshal(data, &batch); err != nil {
+		return nil, err
+	}
+	msgs := make([]BatchMessage, 0, len(batch.Readings))
+	for i, br := range batch.Readings {
+		reading, err := ReadingJSON(br.Reading)
+		if err != nil {
+			return nil, fmt.Errorf("reading %d: %v", i, err)
+		}
+		msgs = append(msgs, BatchMessage{
+			ID:            br.MsgId,
+			Channel:       br.Channel,
+			Timestamp:     br.Timestamp,
+			SchemaVersion: int(br.SchemaVersion),
+			Data:          reading,
+		})
+	}
+	return msgs, nil
+}
+
+//decodeCBORBatch read a CBOR array of batch messages
+func decodeCBORBatch(data []byte) ([]BatchMessage, error) {
+	var batch []cborBatchMessage
+	if err := cborMode.Unmarshal(data, &batch); err != nil {
+		return nil, err
+	}
+	msgs := make([]BatchMessage, 0, len(batch))
+	for i, cm := range batch {
+		payload, err := cborJSON(cm.Data)
+		if err != nil {
+			return nil, fmt.Errorf("message %d: %v", i, err)
+		}
+		msgs = append(msgs, BatchMessage{
+			ID:            cm.ID,
+			Channel:       cm.Channel,
+			Timestamp:     cm.Timestamp,
+			SchemaVersion: cm.SchemaVersion,
+			Data:          payload,
+		})
+	}
+	return msgs, nil
+}
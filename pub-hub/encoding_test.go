@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	pb "github.com/charles-d-burton/grillbernetes/proto"
+	"github.com/fxamacker/cbor/v2"
+	"google.golang.org/protobuf/proto"
+)
+
+//sameJSON whether two JSON documents hold the same values whatever their formatting
+func sameJSON(t *testing.T, a, b []byte) bool {
+	t.Helper()
+	var va, vb interface{}
+	if err := json.Unmarshal(a, &va); err != nil {
+		t.Fatalf("%s: %v", a, err)
+	}
+	if err := json.Unmarshal(b, &vb); err != nil {
+		t.Fatalf("%s: %v", b, err)
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+func mustMarshal(t *testing.T, marshal func() ([]byte, error)) []byte {
+	t.Helper()
+	data, err := marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestDecodeMessage(t *testing.T) {
+	reading := &pb.Reading{Id: "28-0000", Running: true, Name: "pit", F: 225.5}
+	readingBody := mustMarshal(t, func() ([]byte, error) { return proto.Marshal(reading) })
+	cborBody := mustMarshal(t, func() ([]byte, error) {
+		return cbor.Marshal(&cborMessage{ID: "m1", SchemaVersion: 2, Data: map[string]interface{}{"f": 225.5, "probes": []interface{}{"a", "b"}}})
+	})
+	for _, test := range []struct {
+		name, contentType string
+		body              []byte
+		msg               Message
+	}{
+		{"json", "application/json", []byte(`{"msg_id": "m1", "schema_version": 2, "data": {"f": 225.5}}`), Message{ID: "m1", SchemaVersion: 2, Data: []byte(`{"f": 225.5}`)}},
+		{"protobuf", protobufType, readingBody, Message{Data: []byte(`{"id": "28-0000", "running": true, "name": "pit", "f": 225.5, "c": 0}`)}},
+		{"legacy protobuf type", xProtobufType, readingBody, Message{Data: []byte(`{"id": "28-0000", "running": true, "name": "pit", "f": 225.5, "c": 0}`)}},
+		{"cbor", cborType, cborBody, Message{ID: "m1", SchemaVersion: 2, Data: []byte(`{"f": 225.5, "probes": ["a", "b"]}`)}},
+	} {
+		msg, err := decodeMessage(test.body, test.contentType)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		if msg.ID != test.msg.ID || msg.SchemaVersion != test.msg.SchemaVersion || !sameJSON(t, msg.Data, test.msg.Data) {
+			t.Fatalf("%v: %+v %s", test.name, msg, msg.Data)
+		}
+	}
+
+	for _, contentType := range []string{"application/json", protobufType, cborType} {
+		if _, err := decodeMessage([]byte{0xff, 0x00, 0x12}, contentType); err == nil {
+			t.Fatalf("malformed %v body decoded", contentType)
+		}
+	}
+	binaryKeys := mustMarshal(t, func() ([]byte, error) {
+		return cbor.Marshal(map[string]interface{}{"data": map[interface{}]interface{}{1: "one"}})
+	})
+	if _, err := decodeMessage(binaryKeys, cborType); err == nil {
+		t.Fatal("cbor payload without a JSON equivalent decoded")
+	}
+}
+
+func TestDecodeProtobufBatch(t *testing.T) {
+	batch := &pb.ReadingBatch{Readings: []*pb.BatchReading{
+		{MsgId: "m1", Channel: "readings", Timestamp: 1601234567, SchemaVersion: 1, Reading: &pb.Reading{Name: "pit", F: 225}},
+		{MsgId: "m2", Channel: "readings", Timestamp: 1601234568, Reading: &pb.Reading{Name: "brisket", Running: true}},
+		{Channel: "empty"},
+	}}
+	msgs, err := decodeProtobufBatch(mustMarshal(t, func() ([]byte, error) { return proto.Marshal(batch) }))
+	if err != nil || len(msgs) != 3 {
+		t.Fatalf("batch: %+v %v", msgs, err)
+	}
+	if msgs[0].ID != "m1" || msgs[0].Channel != "readings" || msgs[0].Timestamp != 1601234567 || msgs[0].SchemaVersion != 1 {
+		t.Fatalf("first message: %+v", msgs[0])
+	}
+	if !sameJSON(t, msgs[1].Data, []byte(`{"id": "", "running": true, "name": "brisket", "f": 0, "c": 0}`)) {
+		t.Fatalf("second reading lost its zero values: %s", msgs[1].Data)
+	}
+	if msgs[2].Data != nil {
+		t.Fatalf("message without a reading: %s", msgs[2].Data)
+	}
+	if _, err := decodeProtobufBatch([]byte{0xff, 0xff}); err == nil {
+		t.Fatal("malformed protobuf batch decoded")
+	}
+}
+
+func TestDecodeCBORBatch(t *testing.T) {
+	batch := []cborBatchMessage{
+		{ID: "m1", Channel: "readings", Timestamp: 1601234567, SchemaVersion: 1, Data: map[string]interface{}{"f": 225}},
+		{Channel: "alarms", Data: "pit_high"},
+	}
+	msgs, err := decodeCBORBatch(mustMarshal(t, func() ([]byte, error) { return cbor.Marshal(batch) }))
+	if err != nil || len(msgs) != 2 {
+		t.Fatalf("batch: %+v %v", msgs, err)
+	}
+	if msgs[0].ID != "m1" || msgs[0].Timestamp != 1601234567 || msgs[0].SchemaVersion != 1 || !sameJSON(t, msgs[0].Data, []byte(`{"f": 225}`)) {
+		t.Fatalf("first message: %+v %s", msgs[0], msgs[0].Data)
+	}
+	if msgs[1].Channel != "alarms" || string(msgs[1].Data) != `"pit_high"` {
+		t.Fatalf("second message: %+v %s", msgs[1], msgs[1].Data)
+	}
+	if _, err := decodeCBORBatch(mustMarshal(t, func() ([]byte, error) { return cbor.Marshal("not a batch") })); err == nil {
+		t.Fatal("cbor that isn't an array decoded as a batch")
+	}
+}
+
+func TestPublishEncodings(t *testing.T) {
+	cred := issue(t, "encodings", "smoker")
+	reading := mustMarshal(t, func() ([]byte, error) { return proto.Marshal(&pb.Reading{Name: "pit", F: 225}) })
+	headers := map[string]string{"Content-Type": protobufType, msgIDHeader: "pb-1", schemaVersionHeader: "1"}
+	if rec := serve(t, http.MethodPost, "/encodings/smoker/readings", cred.Secret, reading, headers); rec.Code != http.StatusOK {
+		t.Fatalf("protobuf reading: %d %s", rec.Code, rec.Body)
+	}
+	single := mustMarshal(t, func() ([]byte, error) {
+		return cbor.Marshal(&cborMessage{ID: "cbor-1", Data: map[string]interface{}{"f": 225}})
+	})
+	if rec := serve(t, http.MethodPost, "/encodings/smoker/readings", cred.Secret, single, map[string]string{"Content-Type": cborType}); rec.Code != http.StatusOK {
+		t.Fatalf("cbor reading: %d %s", rec.Code, rec.Body)
+	}
+	for contentType, body := range map[string][]byte{
+		xProtobufType: mustMarshal(t, func() ([]byte, error) {
+			return proto.Marshal(&pb.ReadingBatch{Readings: []*pb.BatchReading{{Channel: "readings", Reading: &pb.Reading{F: 225}}, {Channel: "readings", Reading: &pb.Reading{F: 226}}}})
+		}),
+		cborType: mustMarshal(t, func() ([]byte, error) {
+			return cbor.Marshal([]cborBatchMessage{{Channel: "readings", Data: map[string]interface{}{"f": 225}}, {Channel: "readings", Data: map[string]interface{}{"f": 226}}})
+		}),
+	} {
+		rec := serve(t, http.MethodPost, "/encodings/smoker", cred.Secret, body, map[string]string{"Content-Type": contentType})
+		var result struct {
+			Accepted int `json:"accepted"`
+		}
+		if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &result) != nil || result.Accepted != 2 {
+			t.Fatalf("%v batch: %d %s", contentType, rec.Code, rec.Body)
+		}
+	}
+}
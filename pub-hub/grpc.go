@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	pb "github.com/charles-d-burton/grillbernetes/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const grpcAddr = ":7778"
+
+var errInvalidJSON = errors.New("json payload is not valid JSON")
+
+//ingestServer the Ingest api, backed by the same publish pool as the http endpoints
+type ingestServer struct {
+	pb.UnimplementedIngestServer
+}
+
+//ServeGRPC serve the Ingest api next to the http endpoints
+func ServeGRPC() {
+	lis, err := net.Listen("tcp", grpcAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	pb.RegisterIngestServer(srv, &ingestServer{})
+	log.Infof("serving grpc on %v", grpcAddr)
+	if err := srv.Serve(lis); err != nil {
+		log.Fatal(err)
+	}
+}
+
+//grpcAuth check the bearer credential in the call metadata against the device being published for
+func grpcAuth(ctx context.Context, group, device string) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var token string
+	if vals := md.Get("authorization"); len(vals) > 0 && strings.HasPrefix(vals[0], "Bearer ") {
+		token = strings.TrimSpace(strings.TrimPrefix(vals[0], "Bearer "))
+	}
+	if token == "" {
+		return status.Error(codes.Unauthenticated, errMissingAuth.Error())
+	}
+	cred, err := GetCredential(group, device)
+	if err == errUnknownDevice {
+		return status.Error(codes.Unauthenticated, err.Error())
+	} else if err != nil {
+		log.Error(err)
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(cred.Secret)) != 1 {
+		return status.Error(codes.Unauthenticated, errBadCredential.Error())
+	}
+	return nil
+}
+
+//grpcCode the status code matching the http status a failed publish would get
+func grpcCode(err error) codes.Code {
+	switch publishStatus(err) {
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return codes.InvalidArgument
+	}
+	return codes.Unavailable
+}
+
+//batchMessage translate a request into the message the batch endpoint would have decoded
+func batchMessage(req *pb.PublishRequest) (BatchMessage, error) {
+	msg := BatchMessage{
+		ID:            req.MsgId,
+		Channel:       req.Channel,
+		Timestamp:     req.Timestamp,
+		SchemaVersion: int(req.SchemaVersion),
+	}
+	switch data := req.Data.(type) {
+	case *pb.PublishRequest_Reading:
+		reading, err := ReadingJSON(data.Reading)
+		if err != nil {
+			return msg, err
+		}
+		msg.Data = reading
+	case *pb.PublishRequest_Json:
+		if !json.Valid(data.Json) {
+			return msg, errInvalidJSON
+		}
+		msg.Data = data.Json
+	}
+	return msg, msg.Validate()
+}
+
+//Publish a single payload and wait for the stream to ack it
+func (srv *ingestServer) Publish(ctx context.Context, req *pb.PublishRequest) (*pb.PublishReply, error) {
+	if err := grpcAuth(ctx, req.Group, req.Device); err != nil {
+		return nil, err
+	}
+	msg, err := batchMessage(req)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	method, _ := grpc.Method(ctx)
+	ack, err := Publish(msg.Publication(method, req.Group, req.Device))
+	if err != nil {
+		log.Error(err)
+		if dlerr, ok := err.(*DeadLetterError); ok && dlerr.Quarantined() {
+			return &pb.PublishReply{Status: "dead_lettered", DeadLetter: dlerr.ID}, nil
+		} else if ok {
+			return nil, status.Error(grpcCode(err), "dead letter "+dlerr.ID+": "+err.Error())
+		}
+		return nil, status.Error(grpcCode(err), err.Error())
+	}
+	reply := &pb.PublishReply{Status: "accepted", Stream: ack.Stream, Seq: ack.Sequence, Duplicate: ack.Duplicate}
+	if ack.Duplicate {
+		reply.Status = "duplicate"
+	}
+	return reply, nil
+}
+
+//PublishStream publish payloads as they arrive, the outcome of each is collected once the client closes
+//its side. A stream is held to the same message limit as a batch
+func (srv *ingestServer) PublishStream(stream pb.Ingest_PublishStreamServer) error {
+	method, _ := grpc.Method(stream.Context())
+	verified := make(map[string]bool)
+	results := make([]BatchResult, 0)
+	waiting := make([]<-chan publishResult, 0)
+	for index := 0; ; index++ {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if index >= maxBatchMessages {
+			return status.Error(codes.ResourceExhausted, errBatchTooLarge.Error())
+		}
+		if key := req.Group + "/" + req.Device; !verified[key] {
+			if err := grpcAuth(stream.Context(), req.Group, req.Device); err != nil {
+				return err
+			}
+			verified[key] = true
+		}
+		msg, err := batchMessage(req)
+		if err != nil {
+			results = append(results, BatchResult{Index: index, Status: "rejected", Error: err.Error()})
+			waiting = append(waiting, nil)
+			continue
+		}
+		result, done := submitBatchMessage(method, req.Group, req.Device, index, msg)
+		results = append(results, result)
+		waiting = append(waiting, done)
+	}
+	summary := &pb.PublishSummary{Results: make([]*pb.PublishResult, 0, len(results))}
+	for i, done := range waiting {
+		if done != nil {
+			collectBatchResult(&results[i], <-done)
+		}
+		if results[i].Error != "" {
+			summary.Failed++
+		}
+		summary.Results = append(summary.Results, &pb.PublishResult{
+			Index:      int32(results[i].Index),
+			Subject:    results[i].Subject,
+			Status:     results[i].Status,
+			Seq:        results[i].Sequence,
+			Duplicate:  results[i].Duplicate,
+			DeadLetter: results[i].DeadLetter,
+			Error:      results[i].Error,
+		})
+	}
+	summary.Accepted = int32(len(results)) - summary.Failed
+	log.Infof("published stream of %d with %d failures", len(results), summary.Failed)
+	return stream.SendAndClose(summary)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	pb "github.com/charles-d-burton/grillbernetes/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+//dialIngest a client of the Ingest api served over an in memory listener
+func dialIngest(t *testing.T) pb.IngestClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	pb.RegisterIngestServer(srv, &ingestServer{})
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewIngestClient(conn)
+}
+
+//bearer a call context carrying the token the way devices send it
+func bearer(token string) context.Context {
+	if token == "" {
+		return context.Background()
+	}
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+}
+
+//jsonRequest a request publishing a json payload
+func jsonRequest(group, device string, data []byte) *pb.PublishRequest {
+	return &pb.PublishRequest{Group: group, Device: device, Channel: "readings", Data: &pb.PublishRequest_Json{Json: data}}
+}
+
+func TestGRPCPublish(t *testing.T) {
+	client := dialIngest(t)
+	cred := issue(t, "grpc", "smoker")
+	for _, test := range []struct {
+		name  string
+		token string
+		req   *pb.PublishRequest
+		code  codes.Code
+	}{
+		{"no token", "", jsonRequest("grpc", "smoker", reading), codes.Unauthenticated},
+		{"wrong token", "wrong", jsonRequest("grpc", "smoker", reading), codes.Unauthenticated},
+		{"unknown device", cred.Secret, jsonRequest("grpc", "other", reading), codes.Unauthenticated},
+		{"invalid json", cred.Secret, jsonRequest("grpc", "smoker", []byte(`{"temp":`)), codes.InvalidArgument},
+		{"no channel", cred.Secret, &pb.PublishRequest{Group: "grpc", Device: "smoker", Data: &pb.PublishRequest_Json{Json: reading}}, codes.InvalidArgument},
+		{"valid", cred.Secret, jsonRequest("grpc", "smoker", reading), codes.OK},
+	} {
+		reply, err := client.Publish(bearer(test.token), test.req)
+		if code := status.Code(err); code != test.code {
+			t.Fatalf("%v: %v %v", test.name, code, err)
+		}
+		if test.code == codes.OK && (reply.Status != "accepted" || reply.Stream != streamName || reply.Seq == 0) {
+			t.Fatalf("%v: %+v", test.name, reply)
+		}
+	}
+}
+
+func TestGRPCPublishStream(t *testing.T) {
+	client := dialIngest(t)
+	cred := issue(t, "grpcstream", "smoker")
+	other := issue(t, "grpcstream", "other")
+
+	stream, err := client.PublishStream(bearer(cred.Secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range [][]byte{reading, []byte(`not json`), reading} {
+		if err := stream.Send(jsonRequest("grpcstream", "smoker", data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	summary, err := stream.CloseAndRecv()
+	if err != nil || summary.Accepted != 2 || summary.Failed != 1 || len(summary.Results) != 3 {
+		t.Fatalf("stream of one device: %+v %v", summary, err)
+	}
+	if rejected := summary.Results[1]; rejected.Status != "rejected" || rejected.Error != errInvalidJSON.Error() {
+		t.Fatalf("invalid json in a stream: %+v", rejected)
+	}
+
+	stream, err = client.PublishStream(bearer(cred.Secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Send(jsonRequest("grpcstream", "smoker", reading))
+	stream.Send(jsonRequest("grpcstream", "other", reading))
+	if _, err := stream.CloseAndRecv(); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("stream switching to a device of another credential: %v", err)
+	}
+
+	stream, err = client.PublishStream(bearer(other.Secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Send(jsonRequest("grpcstream", "other", reading))
+	if summary, err := stream.CloseAndRecv(); err != nil || summary.Accepted != 1 {
+		t.Fatalf("stream with the credential of the other device: %+v %v", summary, err)
+	}
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -14,7 +16,9 @@ import (
 )
 
 const (
-	streamName = "EVENTS"
+	streamName       = "EVENTS"
+	deviceTimeHeader = "Device-Timestamp"
+	msgIDHeader      = "Message-Id"
 )
 
 var (
@@ -23,21 +27,47 @@ Usage: pismoker [options]
 Options:
 	-nh, --nats-host       <NATS_HOST>     Start the controller connecting to the defined NATS Streaming server
 	-rd, --redis-host      <REDIS_HOST>    Start the controller connecting to the defined Redis Host
+	-at, --admin-token     <ADMIN_TOKEN>   Bearer token required to use the admin api
+	-ht, --heartbeat-timeout <Duration>    Default time without contact before a device is offline
+	-pa, --prune-after     <Duration>      Time without contact before a device is removed from its group
+	-pw, --publish-workers <Count>         Number of publish workers
+	-pq, --publish-queue   <Count>         Readings queued for the workers before ingest returns 429
+	-mi, --max-inflight    <Count>         Max publishes awaiting a JetStream ack
+	-ip, --invalid-payloads <Mode>         What to do with payloads failing schema validation, reject or quarantine to the dead letters
+	-st, --storage         <STORAGE>       Where everything is kept: redis, bolt or memory
+	-sp, --storage-path    <STORAGE_PATH>  File of the bolt storage
 `
-	log = logrus.New()
-	js  nats.JetStreamContext
-	rc  *redis.Client
+	log              = logrus.New()
+	js               nats.JetStreamContext
+	rc               *redis.Client
+	store            Store
+	adminToken       string
+	heartbeatTimeout time.Duration
+	pruneAfter       time.Duration
+	pool             *Pool
+	invalidPayloads  string
 )
 
+var errReservedChannel = errors.New("channels " + presenceChannel + ", " + alarmsChannel + ", " + stepsChannel + " and " + estopChannel + " are reserved for the events the hubs publish")
+
+//reservedChannels the channels devices can't publish to: pub-hub publishes presence transitions and control-hub
+//the alarms, recipe steps and emergency stops, webhooks and devices trust what's on them
+var reservedChannels = map[string]bool{presenceChannel: true, alarmsChannel: true, stepsChannel: true, estopChannel: true}
+
 //Message data to publish to server
 type Message struct {
-	Data json.RawMessage `json:"data"`
+	ID            string          `json:"msg_id,omitempty"`
+	SchemaVersion int             `json:"schema_version,omitempty"`
+	Data          json.RawMessage `json:"data"`
 }
 
+//HsetValue entry for a device in the group hashtable
 type HsetValue struct {
 	Device      string `json:"device"`
 	TimeSeconds int64  `json:"time_seconds"`
 	Channel     string `json:"channel"`
+	Presence    string `json:"presence,omitempty"`
+	Since       int64  `json:"presence_since,omitempty"`
 }
 
 //Device represents a device with timestamp for ttl
@@ -46,14 +76,35 @@ type Device struct {
 	LastContact int64  `json:"last_contact"`
 }
 
-func init() {
+//setup read the options and connect to nats and the storage
+func setup() {
 	log.SetFormatter(&logrus.JSONFormatter{})
 	var natsHost string
 	var redisHost string
+	var workers, queue, inflight int
+	var storage, storagePath string
 	flag.StringVar(&natsHost, "nh", "", "Start the controller connecting to the defined NATS Streaming server")
 	flag.StringVar(&natsHost, "nats-host", "", "Start the controller connecting to the defined NATS Streaming server")
 	flag.StringVar(&redisHost, "rd", "", "Start the controller connecting to the redis cluster")
 	flag.StringVar(&redisHost, "redis-host", "", "Start the controller connecting to the redis cluster")
+	flag.StringVar(&adminToken, "at", "", "Bearer token required to use the admin api")
+	flag.StringVar(&adminToken, "admin-token", "", "Bearer token required to use the admin api")
+	flag.DurationVar(&heartbeatTimeout, "ht", time.Minute, "Default time without contact before a device is offline")
+	flag.DurationVar(&heartbeatTimeout, "heartbeat-timeout", time.Minute, "Default time without contact before a device is offline")
+	flag.DurationVar(&pruneAfter, "pa", 24*time.Hour, "Time without contact before a device is removed from its group")
+	flag.DurationVar(&pruneAfter, "prune-after", 24*time.Hour, "Time without contact before a device is removed from its group")
+	flag.IntVar(&workers, "pw", 8, "Number of publish workers")
+	flag.IntVar(&workers, "publish-workers", 8, "Number of publish workers")
+	flag.IntVar(&queue, "pq", 1024, "Readings queued for the workers before ingest returns 429")
+	flag.IntVar(&queue, "publish-queue", 1024, "Readings queued for the workers before ingest returns 429")
+	flag.IntVar(&inflight, "mi", 256, "Max publishes awaiting a JetStream ack")
+	flag.IntVar(&inflight, "max-inflight", 256, "Max publishes awaiting a JetStream ack")
+	flag.StringVar(&invalidPayloads, "ip", invalidReject, "What to do with payloads failing schema validation, reject or quarantine")
+	flag.StringVar(&invalidPayloads, "invalid-payloads", invalidReject, "What to do with payloads failing schema validation, reject or quarantine")
+	flag.StringVar(&storage, "st", "", "Where everything is kept: redis, bolt or memory")
+	flag.StringVar(&storage, "storage", "", "Where everything is kept: redis, bolt or memory")
+	flag.StringVar(&storagePath, "sp", "", "File of the bolt storage")
+	flag.StringVar(&storagePath, "storage-path", "", "File of the bolt storage")
 	flag.Parse()
 	if natsHost == "" {
 		natsHost = os.Getenv("NATS_HOST")
@@ -61,12 +112,33 @@ func init() {
 			log.Fatal("NATS_HOST Undefined\n", usageStr)
 		}
 	}
+	if invalidPayloads != invalidReject && invalidPayloads != invalidQuarantine {
+		log.Fatal("invalid-payloads must be one of reject or quarantine\n", usageStr)
+	}
+	if storage == "" {
+		storage = os.Getenv("STORAGE")
+		if storage == "" {
+			storage = storageRedis
+		}
+	}
 	if redisHost == "" {
 		redisHost = os.Getenv("REDIS_HOST")
-		if redisHost == "" {
+		if redisHost == "" && storage == storageRedis { //Only redis storage needs it
 			log.Fatal("REDIS_HOST Undefined\n", usageStr)
 		}
 	}
+	if storagePath == "" {
+		storagePath = os.Getenv("STORAGE_PATH")
+		if storagePath == "" {
+			storagePath = "pub-hub.db"
+		}
+	}
+	if adminToken == "" {
+		adminToken = os.Getenv("ADMIN_TOKEN")
+		if adminToken == "" {
+			log.Warn("ADMIN_TOKEN Undefined, admin api is disabled")
+		}
+	}
 	log.Infof("connecting to nats host: %q", natsHost)
 	conn, err := nats.Connect(natsHost,
 		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
@@ -80,126 +152,235 @@ func init() {
 		log.Fatal(err)
 	}
 
-	js, err = conn.JetStream()
+	//Leave nats room for the acks the workers are still handing off so the pool applies the backpressure
+	js, err = conn.JetStream(nats.PublishAsyncMaxPending(inflight + workers))
 	if err != nil {
 		log.Fatal(err)
 	}
+	pool = NewPool(workers, queue, inflight)
 
-	rc = redis.NewClient(&redis.Options{
-		Addr:         redisHost,
-		Password:     "",
-		DB:           0,
-		MinIdleConns: 1,
-		MaxRetries:   5,
-	})
+	if storage == storageRedis {
+		rc = redis.NewClient(&redis.Options{
+			Addr:         redisHost,
+			Password:     "",
+			DB:           0,
+			MinIdleConns: 1,
+			MaxRetries:   5,
+		})
+	}
+	if store, err = openStore(storage, storagePath); err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("keeping everything in %v storage", storage)
 	ticker := time.NewTicker(1000 * time.Millisecond)
 	go func() {
 		for range ticker.C {
-			res, err := rc.Ping().Result()
-			if err != nil {
+			if err := store.Ping(); err != nil {
 				log.Fatal(err)
 			}
-			if res == "PONG" {
-				//log.Info(res)
-			}
 		}
 	}()
 }
 
 func main() {
-	//Sweep()
+	setup()
+	pool.Start()
+	registry.Watch()
+	Sweep()
+	go ServeGRPC()
+	routes().Run(":7777")
+}
+
+//routes the http api
+func routes() *gin.Engine {
 	router := gin.Default()
 	router.GET("/healthz", HealthCheck)
-	router.POST("/:group/:device/:channel", PostData)
-	router.Run(":7777")
+	router.POST("/:group/:device/:channel", DeviceAuth, PostData)
+	router.POST("/:group/:device", DeviceAuth, PostBatch)
+	admin := router.Group("/admin", AdminAuth)
+	admin.GET("/credentials/:group", GetCredentials)
+	admin.POST("/credentials/:group/:device", PostCredential)
+	admin.DELETE("/credentials/:group/:device", DeleteCredential)
+	admin.POST("/credentials/:group/:device/verify", PostVerifyCredential)
+	admin.GET("/devices/:group", GetDevices)
+	admin.GET("/devices/:group/count", GetDeviceCount)
+	admin.GET("/heartbeat/:group/:device", GetHeartbeat)
+	admin.PUT("/heartbeat/:group/:device", PutHeartbeat)
+	admin.DELETE("/heartbeat/:group/:device", DeleteHeartbeat)
+	admin.GET("/schemas/:channel", GetSchemas)
+	admin.POST("/schemas/:channel", PostSchema)
+	admin.GET("/schemas/:channel/:version", GetSchema)
+	admin.DELETE("/schemas/:channel/:version", DeleteSchema)
+	admin.GET("/deadletters", GetDeadLetters)
+	admin.POST("/deadletters/replay", PostReplayDeadLetters)
+	admin.GET("/deadletters/:id", GetDeadLetterByID)
+	admin.DELETE("/deadletters/:id", DeleteDeadLetterByID)
+	admin.POST("/deadletters/:id/replay", PostReplayDeadLetter)
+	return router
 }
 
 func HealthCheck(c *gin.Context) {
-	res, err := rc.Ping().Result()
-	if err != nil || res != "PONG" {
-		log.Error("redis connection failed")
-		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "redis died"})
+	if err := store.Ping(); err != nil {
+		log.Error("storage connection failed: ", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "storage died"})
+		return
 	}
 	c.JSON(http.StatusOK, gin.H{"status": "alive"})
 }
 
 //PostData post message data to NATS Streaming for event processing
 func PostData(c *gin.Context) {
-	var msg Message
-	if err := c.ShouldBindJSON(&msg); err != nil {
+	body, err := c.GetRawData()
+	if err != nil {
 		log.Error(err)
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-
-	log.Info("Publishing to: ", streamName+"."+c.Param("group")+"."+c.Param("device")+"."+c.Param("channel"))
-	//TODO: Need to thread this probably, a pool of workers would be a good idea here
-	log.Info("Msg: ", string(msg.Data))
-	_, err := js.Publish(streamName+"."+c.Param("group")+"."+c.Param("device")+"."+c.Param("channel"), msg.Data)
+	msg, err := decodeMessage(body, c.ContentType())
 	if err != nil {
 		log.Error(err)
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	var hval HsetValue
-	hval.Channel = c.Param("channel")
-	hval.Device = c.Param("device")
-	hval.TimeSeconds = time.Now().Unix()
-	err = hval.Update(c.Param("group"))
+	log.Info("Msg: ", string(msg.Data))
+	pub := &Publication{
+		Path:          c.Request.URL.Path,
+		Group:         c.Param("group"),
+		Device:        c.Param("device"),
+		Channel:       c.Param("channel"),
+		Data:          msg.Data,
+		MsgID:         msg.ID,
+		SchemaVersion: msg.SchemaVersion,
+	}
+	if id := c.GetHeader(msgIDHeader); id != "" {
+		pub.MsgID = id
+	}
+	version, err := schemaVersion(c)
 	if err != nil {
-		log.Error(err)
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"status": "accepted"})
+	if version > 0 {
+		pub.SchemaVersion = version
+	}
+	ack, err := Publish(pub)
+	if err != nil {
+		log.Error(err)
+		status := publishStatus(err)
+		if serr, ok := err.(*SchemaError); ok {
+			c.JSON(status, serr)
+			return
+		}
+		if dlerr, ok := err.(*DeadLetterError); ok && dlerr.Quarantined() {
+			c.JSON(status, gin.H{"status": "dead_lettered", "dead_letter": dlerr.ID, "error": err.Error()})
+			return
+		}
+		if status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable {
+			c.Header("Retry-After", retryAfter())
+		}
+		if dlerr, ok := err.(*DeadLetterError); ok { //Kept in case the device gives up, it should retry
+			c.JSON(status, gin.H{"error": err.Error(), "dead_letter": dlerr.ID})
+			return
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status":    "accepted",
+		"stream":    ack.Stream,
+		"seq":       ack.Sequence,
+		"duplicate": ack.Duplicate,
+	})
 }
 
-//Update update the device in a redis hashtable
-func (hval *HsetValue) Update(group string) error {
-	data, err := json.Marshal(&hval)
-	if err != nil {
-		return err
+//publishStatus the http status to answer a failed publish with, 429/503 tell devices to back off
+func publishStatus(err error) int {
+	switch err.(type) {
+	case *SchemaError:
+		return http.StatusUnprocessableEntity
+	case *DeadLetterError:
+		if err.(*DeadLetterError).Quarantined() {
+			return http.StatusAccepted
+		}
 	}
-	set, err := rc.HSet(group, hval.Device, string(data)).Result()
-	if err != nil {
-		return err
+	switch err {
+	case errPoolSaturated:
+		return http.StatusTooManyRequests
+	case errReservedChannel:
+		return http.StatusBadRequest
+	default:
+		return http.StatusServiceUnavailable
 	}
-	if set {
-		log.Infof("Device %v added to HSET %v", hval.Device, group)
+}
+
+//Publication a reading bound for the stream
+type Publication struct {
+	Group   string
+	Device  string
+	Channel string
+	Data    json.RawMessage
+	Sent    time.Time //Device timestamp of the reading, zero if unknown
+	MsgID   string    //Client supplied id used by JetStream to drop duplicates
+
+	SchemaVersion int    //Schema version the payload claims to follow, zero to accept any registered version
+	Path          string //Request path the reading came in on
+
+	deadLetter string //Id of the dead letter being replayed
+}
+
+//Subject the stream subject the publication is sent to
+func (pub *Publication) Subject() string {
+	return streamName + "." + pub.Group + "." + pub.Device + "." + pub.Channel
+}
+
+//Msg build the stream message and publish options for the publication
+func (pub *Publication) Msg() (*nats.Msg, []nats.PubOpt) {
+	msg := nats.NewMsg(pub.Subject())
+	msg.Data = pub.Data
+	if !pub.Sent.IsZero() {
+		msg.Header.Set(deviceTimeHeader, strconv.FormatInt(pub.Sent.Unix(), 10))
+	}
+	var opts []nats.PubOpt
+	if pub.MsgID != "" {
+		opts = append(opts, nats.MsgId(pub.StreamMsgID()))
 	}
-	return nil
+	return msg, opts
 }
 
-//Sweep Periodically clean up the set
-func Sweep() {
-	log.Info("Starting ttl cleanup")
-	go func() {
-		ticker := time.NewTicker(10 * time.Second)
-		var cursor uint64
-		for {
-			select {
-			case <-ticker.C:
-				log.Info("Running sweep")
-				for {
-					//var keys []string
-					//var err error
-					keys, cursor, err := rc.HScan("*", cursor, "*", 200).Result()
-					if err != nil {
-						panic(err)
-					}
-					for _, key := range keys { //TODO: Implement logic to cleanup old set entries
-						/*duration := rc.ObjectIdleTime(key)
-						idleTime := int64(duration.Val() / time.Second)
-						if idleTime > 86400 { //Delete keys that haven't been accessed in 24 hours
-							rc.Del(key)
-						}*/
-						log.Infof("KEY: %v", key)
-					}
-					if cursor == 0 {
-						break
-					}
-				}
+//StreamMsgID the Nats-Msg-Id the publication goes out with. Ids are only unique to a device so they're
+//namespaced by group and device, otherwise two devices picking the same id would drop each other's readings
+func (pub *Publication) StreamMsgID() string {
+	return pub.Group + "." + pub.Device + "." + pub.MsgID
+}
+
+//PublishAsync queue a reading for the publish pool, the device contact is recorded once it's acked
+func PublishAsync(pub *Publication) (<-chan publishResult, error) {
+	if reservedChannels[pub.Channel] {
+		return nil, errReservedChannel
+	}
+	if serr := registry.Validate(pub.Channel, pub.SchemaVersion, pub.Data); serr != nil {
+		if invalidPayloads == invalidQuarantine && pub.deadLetter == "" {
+			id, err := WriteDeadLetter(pub, serr)
+			if err != nil {
+				return nil, err
 			}
+			return nil, &DeadLetterError{ID: id, Err: serr}
 		}
-	}()
+		return nil, serr
+	}
+	log.Info("Publishing to: ", pub.Subject())
+	return pool.Submit(pub)
+}
+
+//Publish push a reading onto the stream and wait for the ack
+func Publish(pub *Publication) (*nats.PubAck, error) {
+	done, err := PublishAsync(pub)
+	if err != nil {
+		return nil, err
+	}
+	res := <-done
+	if res.err == nil && res.ack.Duplicate {
+		log.Infof("Dropped duplicate message %v on %v", pub.MsgID, pub.Subject())
+	}
+	return res.ack, res.err
 }
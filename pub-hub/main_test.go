@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis"
+	"github.com/nats-io/nats-server/v2/server"
+	nats "github.com/nats-io/nats.go"
+)
+
+const testAdminToken = "admin"
+
+//TestMain run the tests against an embedded JetStream server with the EVENTS stream and redis storage
+//backed by miniredis, the way pub-hub runs in production
+func TestMain(m *testing.M) {
+	os.Exit(runTests(m))
+}
+
+func runTests(m *testing.M) int {
+	log.SetOutput(ioutil.Discard)
+	gin.SetMode(gin.TestMode)
+	dir, err := ioutil.TempDir("", "pub-hub")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	ns, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: dir})
+	if err != nil {
+		panic(err)
+	}
+	go ns.Start()
+	defer ns.Shutdown()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		panic("embedded nats server didn't start")
+	}
+	conn, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+	if js, err = conn.JetStream(); err != nil {
+		panic(err)
+	}
+	if _, err := js.AddStream(&nats.StreamConfig{Name: streamName, Subjects: []string{streamName + ".>"}}); err != nil {
+		panic(err)
+	}
+	mr, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer mr.Close()
+	rc = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	store = &redisStore{rc: rc}
+	adminToken = testAdminToken
+	invalidPayloads = invalidReject
+	heartbeatTimeout = time.Minute
+	pruneAfter = 24 * time.Hour
+	pool = NewPool(4, 1024, 256)
+	pool.Start()
+	return m.Run()
+}
+
+func TestReservedChannels(t *testing.T) {
+	cred := issue(t, "reserved", "smoker")
+	for _, channel := range []string{presenceChannel, alarmsChannel, stepsChannel, estopChannel} {
+		if rec := serve(t, http.MethodPost, "/reserved/smoker/"+channel, cred.Secret, reading, nil); rec.Code != http.StatusBadRequest {
+			t.Fatalf("publish to %v: %d %s", channel, rec.Code, rec.Body)
+		}
+	}
+	batch := []byte(`[{"channel": "alarms", "data": {"alarm": "pit_high"}}]`)
+	rec := serve(t, http.MethodPost, "/reserved/smoker", cred.Secret, batch, nil)
+	if rec.Code != http.StatusOK || !bytes.Contains(rec.Body.Bytes(), []byte(`"failed":1`)) {
+		t.Fatalf("batch publish to alarms: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestMsgIDPerDevice(t *testing.T) {
+	headers := map[string]string{msgIDHeader: "reading-1"}
+	for _, device := range []string{"one", "two"} {
+		cred := issue(t, "msgid", device)
+		for i, duplicate := range []bool{false, true} {
+			rec := serve(t, http.MethodPost, "/msgid/"+device+"/readings", cred.Secret, reading, headers)
+			var ack struct {
+				Duplicate bool `json:"duplicate"`
+			}
+			if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &ack) != nil || ack.Duplicate != duplicate {
+				t.Fatalf("publish %d of %v: %d %s", i, device, rec.Code, rec.Body)
+			}
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+)
+
+//memoryStore keeps everything in memory, it's gone on restart
+type memoryStore struct {
+	sync.RWMutex
+	devices     map[string]map[string][]byte
+	groups      map[string]bool
+	credentials map[string]map[string][]byte
+	heartbeats  map[string]map[string]int64
+	schemas     map[string]map[int][]byte
+	schemaSeqs  map[string]int
+	deadLetters map[string][]byte
+	deadIndex   []deadLetterRef
+}
+
+//deadLetterRef where a dead letter sits in the time index, oldest first
+type deadLetterRef struct {
+	id        string
+	timestamp int64
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		devices:     make(map[string]map[string][]byte),
+		groups:      make(map[string]bool),
+		credentials: make(map[string]map[string][]byte),
+		heartbeats:  make(map[string]map[string]int64),
+		schemas:     make(map[string]map[int][]byte),
+		schemaSeqs:  make(map[string]int),
+		deadLetters: make(map[string][]byte),
+	}
+}
+
+func (ms *memoryStore) GetDevice(group, device string) ([]byte, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	entry, ok := ms.devices[group][device]
+	if !ok {
+		return nil, errNotFound
+	}
+	return entry, nil
+}
+
+func (ms *memoryStore) PutDevice(group, device string, entry []byte) (bool, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	devices, ok := ms.devices[group]
+	if !ok {
+		devices = make(map[string][]byte)
+		ms.devices[group] = devices
+	}
+	_, exists := devices[device]
+	devices[device] = append([]byte(nil), entry...)
+	return !exists, nil
+}
+
+func (ms *memoryStore) SwapDevice(group, device string, old, entry []byte) (bool, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	cur, ok := ms.devices[group][device]
+	if ok != (old != nil) || !bytes.Equal(cur, old) {
+		return false, nil
+	}
+	if entry == nil {
+		delete(ms.devices[group], device)
+		return true, nil
+	}
+	if ms.devices[group] == nil {
+		ms.devices[group] = make(map[string][]byte)
+	}
+	ms.devices[group][device] = append([]byte(nil), entry...)
+	return true, nil
+}
+
+func (ms *memoryStore) ScanDevices(group string, cursor uint64, count int64) ([]DeviceEntry, uint64, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	keys := make([]string, 0, len(ms.devices[group]))
+	for device := range ms.devices[group] {
+		keys = append(keys, device)
+	}
+	devices, next := page(keys, cursor, count)
+	entries := make([]DeviceEntry, 0, len(devices))
+	for _, device := range devices {
+		entries = append(entries, DeviceEntry{Device: device, Entry: ms.devices[group][device]})
+	}
+	return entries, next, nil
+}
+
+func (ms *memoryStore) CountDevices(group string) (int64, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	return int64(len(ms.devices[group])), nil
+}
+
+func (ms *memoryStore) AddGroup(group string) error {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.groups[group] = true
+	return nil
+}
+
+func (ms *memoryStore) RemoveGroup(group string) error {
+	ms.Lock()
+	defer ms.Unlock()
+	delete(ms.groups, group)
+	return nil
+}
+
+func (ms *memoryStore) ScanGroups(cursor uint64, count int64) ([]string, uint64, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	groups := make([]string, 0, len(ms.groups))
+	for group := range ms.groups {
+		groups = append(groups, group)
+	}
+	groups, next := page(groups, cursor, count)
+	return groups, next, nil
+}
+
+func (ms *memoryStore) PutCredential(group, device string, cred []byte) error {
+	ms.Lock()
+	defer ms.Unlock()
+	creds, ok := ms.credentials[group]
+	if !ok {
+		creds = make(map[string][]byte)
+		ms.credentials[group] = creds
+	}
+	creds[device] = append([]byte(nil), cred...)
+	return nil
+}
+
+func (ms *memoryStore) GetCredential(group, device string) ([]byte, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	cred, ok := ms.credentials[group][device]
+	if !ok {
+		return nil, errNotFound
+	}
+	return cred, nil
+}
+
+func (ms *memoryStore) DeleteCredential(group, device string) (bool, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	_, ok := ms.credentials[group][device]
+	delete(ms.credentials[group], device)
+	return ok, nil
+}
+
+func (ms *memoryStore) ListCredentials(group string) ([][]byte, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	creds := make([][]byte, 0, len(ms.credentials[group]))
+	for _, cred := range ms.credentials[group] {
+		creds = append(creds, cred)
+	}
+	return creds, nil
+}
+
+func (ms *memoryStore) GetHeartbeat(group, device string) (int64, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	secs, ok := ms.heartbeats[group][device]
+	if !ok {
+		return 0, errNotFound
+	}
+	return secs, nil
+}
+
+func (ms *memoryStore) SetHeartbeat(group, device string, secs int64) error {
+	ms.Lock()
+	defer ms.Unlock()
+	timeouts, ok := ms.heartbeats[group]
+	if !ok {
+		timeouts = make(map[string]int64)
+		ms.heartbeats[group] = timeouts
+	}
+	timeouts[device] = secs
+	return nil
+}
+
+func (ms *memoryStore) DeleteHeartbeat(group, device string) error {
+	ms.Lock()
+	defer ms.Unlock()
+	delete(ms.heartbeats[group], device)
+	return nil
+}
+
+func (ms *memoryStore) Heartbeats(group string) (map[string]int64, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	timeouts := make(map[string]int64, len(ms.heartbeats[group]))
+	for device, secs := range ms.heartbeats[group] {
+		timeouts[device] = secs
+	}
+	return timeouts, nil
+}
+
+func (ms *memoryStore) SchemaChannels() ([]string, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	channels := make([]string, 0, len(ms.schemas))
+	for channel, versions := range ms.schemas {
+		if len(versions) > 0 {
+			channels = append(channels, channel)
+		}
+	}
+	return channels, nil
+}
+
+func (ms *memoryStore) GetSchemas(channel string) ([][]byte, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	entries := make([][]byte, 0, len(ms.schemas[channel]))
+	for _, entry := range ms.schemas[channel] {
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (ms *memoryStore) GetSchema(channel string, version int) ([]byte, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	entry, ok := ms.schemas[channel][version]
+	if !ok {
+		return nil, errNotFound
+	}
+	return entry, nil
+}
+
+func (ms *memoryStore) NextSchemaVersion(channel string) (int, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.schemaSeqs[channel]++
+	return ms.schemaSeqs[channel], nil
+}
+
+func (ms *memoryStore) PutSchema(channel string, version int, entry []byte) error {
+	ms.Lock()
+	defer ms.Unlock()
+	versions, ok := ms.schemas[channel]
+	if !ok {
+		versions = make(map[int][]byte)
+		ms.schemas[channel] = versions
+	}
+	versions[version] = append([]byte(nil), entry...)
+	return nil
+}
+
+func (ms *memoryStore) DeleteSchema(channel string, version int) (bool, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	_, ok := ms.schemas[channel][version]
+	delete(ms.schemas[channel], version)
+	return ok, nil
+}
+
+func (ms *memoryStore) AddDeadLetter(id string, timestamp int64, entry []byte, max int64) (int64, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.deadLetters[id] = append([]byte(nil), entry...)
+	ref := deadLetterRef{id: id, timestamp: timestamp}
+	at := sort.Search(len(ms.deadIndex), func(i int) bool {
+		if ms.deadIndex[i].timestamp == timestamp {
+			return ms.deadIndex[i].id > id
+		}
+		return ms.deadIndex[i].timestamp > timestamp
+	})
+	ms.deadIndex = append(ms.deadIndex, deadLetterRef{})
+	copy(ms.deadIndex[at+1:], ms.deadIndex[at:])
+	ms.deadIndex[at] = ref
+	dropped := int64(len(ms.deadIndex)) - max
+	if dropped <= 0 {
+		return 0, nil
+	}
+	for _, oldest := range ms.deadIndex[:dropped] {
+		delete(ms.deadLetters, oldest.id)
+	}
+	ms.deadIndex = append([]deadLetterRef(nil), ms.deadIndex[dropped:]...)
+	return dropped, nil
+}
+
+func (ms *memoryStore) SaveDeadLetter(id string, entry []byte) error {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.deadLetters[id] = append([]byte(nil), entry...)
+	return nil
+}
+
+func (ms *memoryStore) GetDeadLetter(id string) ([]byte, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	entry, ok := ms.deadLetters[id]
+	if !ok {
+		return nil, errNotFound
+	}
+	return entry, nil
+}
+
+func (ms *memoryStore) DeleteDeadLetter(id string) (bool, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	_, ok := ms.deadLetters[id]
+	delete(ms.deadLetters, id)
+	for i, ref := range ms.deadIndex {
+		if ref.id == id {
+			ms.deadIndex = append(ms.deadIndex[:i], ms.deadIndex[i+1:]...)
+			break
+		}
+	}
+	return ok, nil
+}
+
+func (ms *memoryStore) DeadLetters(start, count int64) ([][]byte, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	entries := make([][]byte, 0)
+	last := int64(len(ms.deadIndex)) - 1 - start
+	for i := last; i >= 0 && i > last-count; i-- {
+		if entry, ok := ms.deadLetters[ms.deadIndex[i].id]; ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func (ms *memoryStore) CountDeadLetters() (int64, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	return int64(len(ms.deadIndex)), nil
+}
+
+func (ms *memoryStore) Ping() error {
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+)
+
+const (
+	ackTimeout    = 5 * time.Second
+	contactFlush  = time.Second
+	retryAfterSec = 1
+)
+
+var (
+	errPoolSaturated = errors.New("publish queue is full, back off and retry")
+	errAckTimeout    = errors.New("timed out waiting for publish ack")
+)
+
+type publishResult struct {
+	ack *nats.PubAck
+	err error
+}
+
+type publishJob struct {
+	pub  *Publication
+	done chan publishResult
+}
+
+type pendingAck struct {
+	job    *publishJob
+	future nats.PubAckFuture
+}
+
+//Pool publishes readings with JetStream async publish. Jobs are queued to a fixed set of workers that
+//hand the ack futures off to waiters, the number of unacked publishes is bounded by the size of the ack
+//queue so a slow stream backs up into the job queue and Submit starts refusing work
+type Pool struct {
+	jobs     chan *publishJob
+	acks     chan pendingAck
+	workers  int
+	contacts *contactBuffer
+}
+
+//NewPool create a pool with the given number of workers, job queue length, and max in flight publishes
+func NewPool(workers, queue, inflight int) *Pool {
+	return &Pool{
+		jobs:     make(chan *publishJob, queue),
+		acks:     make(chan pendingAck, inflight),
+		workers:  workers,
+		contacts: &contactBuffer{pending: make(map[string]contact)},
+	}
+}
+
+//Start spin up the workers, ack waiters, and the presence flusher
+func (pool *Pool) Start() {
+	for i := 0; i < pool.workers; i++ {
+		go pool.publishLoop()
+		go pool.ackLoop()
+	}
+	go pool.contacts.flushLoop()
+}
+
+//Submit queue a publication without blocking, fails with errPoolSaturated when the queue is full
+func (pool *Pool) Submit(pub *Publication) (<-chan publishResult, error) {
+	job := &publishJob{pub: pub, done: make(chan publishResult, 1)}
+	select {
+	case pool.jobs <- job:
+		return job.done, nil
+	default:
+		return nil, errPoolSaturated
+	}
+}
+
+func (pool *Pool) publishLoop() {
+	for job := range pool.jobs {
+		msg, opts := job.pub.Msg()
+		future, err := js.PublishMsgAsync(msg, opts...)
+		if err != nil {
+			pool.fail(job, err)
+			continue
+		}
+		pool.acks <- pendingAck{job: job, future: future}
+	}
+}
+
+func (pool *Pool) ackLoop() {
+	for pending := range pool.acks {
+		var res publishResult
+		select {
+		case ack := <-pending.future.Ok():
+			res.ack = ack
+		case err := <-pending.future.Err():
+			res.err = err
+		case <-time.After(ackTimeout):
+			res.err = errAckTimeout
+		}
+		if res.err != nil {
+			pool.fail(pending.job, res.err)
+			continue
+		}
+		//A replay isn't the device getting in touch, it mustn't bring a device back online
+		if pub := pending.job.pub; !res.ack.Duplicate && pub.deadLetter == "" {
+			pool.contacts.Touch(pub.Group, pub.Device, pub.Channel)
+		}
+		pending.job.done <- res
+	}
+}
+
+//fail hand a failed publish back to the caller, dead lettering it first so the reading isn't lost.
+//Replays already have a dead letter and update it themselves
+func (pool *Pool) fail(job *publishJob, err error) {
+	if job.pub.deadLetter == "" {
+		id, dlErr := WriteDeadLetter(job.pub, err)
+		if dlErr != nil {
+			log.Error(dlErr)
+		} else {
+			err = &DeadLetterError{ID: id, Err: err}
+		}
+	}
+	job.done <- publishResult{err: err}
+}
+
+type contact struct {
+	group   string
+	device  string
+	channel string
+}
+
+//contactBuffer coalesces device contacts so each device costs at most one redis update per flush
+type contactBuffer struct {
+	sync.Mutex
+	pending map[string]contact
+}
+
+//Touch note that a device was heard from
+func (buf *contactBuffer) Touch(group, device, channel string) {
+	buf.Lock()
+	buf.pending[group+"/"+device] = contact{group: group, device: device, channel: channel}
+	buf.Unlock()
+}
+
+func (buf *contactBuffer) flushLoop() {
+	ticker := time.NewTicker(contactFlush)
+	for range ticker.C {
+		buf.Lock()
+		pending := buf.pending
+		buf.pending = make(map[string]contact, len(pending))
+		buf.Unlock()
+		for _, c := range pending {
+			if err := RecordContact(c.group, c.device, c.channel); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+}
+
+//retryAfter value for the Retry-After header sent with 429/503 responses
+func retryAfter() string {
+	return strconv.Itoa(retryAfterSec)
+}
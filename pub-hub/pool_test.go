@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+var benchReading = json.RawMessage(`{"f": 225.4, "c": 107.4}`)
+
+func benchPublication() *Publication {
+	return &Publication{Group: "bench", Device: "smoker", Channel: "readings", Data: benchReading}
+}
+
+//BenchmarkPublish a synchronous publish through the pool, waiting on every ack before the next
+func BenchmarkPublish(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Publish(benchPublication()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+//BenchmarkPublishParallel synchronous publishes from many devices at once, the way ingest sees them
+func BenchmarkPublishParallel(b *testing.B) {
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := Publish(benchPublication()); err != nil && err != errPoolSaturated {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestDeadLetterOutcome(t *testing.T) {
+	for _, test := range []struct {
+		err     error
+		outcome string
+	}{
+		{errAckTimeout, outcomeUnknown},
+		{&DeadLetterError{ID: "dl", Err: errAckTimeout}, outcomeUnknown},
+		{errors.New("nats: no responders available for request"), outcomeFailed},
+	} {
+		pub := benchPublication()
+		pub.MsgID = "m1"
+		id, err := WriteDeadLetter(pub, test.err)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dl, err := GetDeadLetter(id)
+		if err != nil || dl.Outcome != test.outcome || dl.MsgID != "m1" || dl.Publication().MsgID != "m1" {
+			t.Fatalf("dead letter of %v: %+v %v", test.err, dl, err)
+		}
+	}
+}
+
+func TestPublishStatus(t *testing.T) {
+	for _, test := range []struct {
+		err    error
+		status int
+	}{
+		{&DeadLetterError{ID: "dl", Err: errAckTimeout}, http.StatusServiceUnavailable},
+		{&DeadLetterError{ID: "dl", Err: &SchemaError{Channel: "readings"}}, http.StatusAccepted},
+		{errPoolSaturated, http.StatusTooManyRequests},
+		{&SchemaError{Channel: "readings"}, http.StatusUnprocessableEntity},
+	} {
+		if status := publishStatus(test.err); status != test.status {
+			t.Fatalf("status of %v: %d", test.err, status)
+		}
+	}
+}
+
+func TestReplayNoContact(t *testing.T) {
+	pub := &Publication{Group: "replayed", Device: "smoker", Channel: "readings", Data: benchReading, deadLetter: "dl"}
+	if _, err := Publish(pub); err != nil {
+		t.Fatal(err)
+	}
+	pool.contacts.Lock()
+	_, touched := pool.contacts.pending["replayed/smoker"]
+	pool.contacts.Unlock()
+	if _, err := store.GetDevice("replayed", "smoker"); touched || err != errNotFound {
+		t.Fatalf("a replay recorded contact with the device: %v %v", touched, err)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	nats "github.com/nats-io/nats.go"
+)
+
+const (
+	presenceOnline  = "online"
+	presenceOffline = "offline"
+	presenceChannel = "presence"
+	alarmsChannel   = "alarms"
+	stepsChannel    = "steps"
+	estopChannel    = "estop"
+	groupsKey       = "presence/groups"
+	heartbeatPrefix = "heartbeats/"
+	sweepInterval   = 10 * time.Second
+	//defaultDevicePage and maxDevicePage bound a page of the device listing of the admin api
+	defaultDevicePage = 100
+	maxDevicePage     = 1000
+)
+
+//PresenceEvent published to EVENTS.<group>.<device>.presence whenever a device changes state
+type PresenceEvent struct {
+	Group       string `json:"group"`
+	Device      string `json:"device"`
+	State       string `json:"state"`
+	LastContact int64  `json:"last_contact"`
+	Timestamp   int64  `json:"timestamp"`
+}
+
+//DeviceListing a device of a group and its entry in the group hashtable
+type DeviceListing struct {
+	Device string          `json:"device"`
+	Entry  json.RawMessage `json:"entry"`
+}
+
+//DevicePage a page of the device listing of the admin api, next_cursor is empty on the last page
+type DevicePage struct {
+	Devices    []DeviceListing `json:"devices"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+}
+
+//RecordContact update the device entry in the group hashtable, bringing the device online if it wasn't. The
+//entry is swapped for the one it was read as and read again when another publish or the sweep changed it,
+//so a device brought online only announces it once and the sweep can't undo the contact
+func RecordContact(group, device, channel string) error {
+	for {
+		raw, err := store.GetDevice(group, device)
+		if err == errNotFound {
+			raw = nil
+		} else if err != nil {
+			return err
+		}
+		now := time.Now().Unix()
+		hval := HsetValue{
+			Device:      device,
+			Channel:     channel,
+			TimeSeconds: now,
+			Presence:    presenceOnline,
+			Since:       now,
+		}
+		var prev *HsetValue
+		if raw != nil {
+			prev = &HsetValue{}
+			if err := json.Unmarshal(raw, prev); err != nil {
+				return err
+			}
+		}
+		if prev != nil && prev.Presence == presenceOnline {
+			hval.Since = prev.Since
+		}
+		data, err := json.Marshal(&hval)
+		if err != nil {
+			return err
+		}
+		swapped, err := store.SwapDevice(group, device, raw, data)
+		if err != nil {
+			return err
+		} else if !swapped {
+			continue
+		}
+		if prev == nil {
+			log.Infof("Device %v added to group %v", device, group)
+		}
+		if err := store.AddGroup(group); err != nil {
+			return err
+		}
+		if prev == nil || prev.Presence != presenceOnline {
+			var since int64
+			if prev != nil {
+				since = prev.Since
+			}
+			//Keyed on the offline transition so a retried publish only announces the device once
+			id := fmt.Sprintf("%v.%v.%v.%d", group, device, presenceOnline, since)
+			return publishPresence(group, hval, id)
+		}
+		return nil
+	}
+}
+
+func getHsetValue(group, device string) (*HsetValue, error) {
+	val, err := store.GetDevice(group, device)
+	if err == errNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var hval HsetValue
+	if err := json.Unmarshal(val, &hval); err != nil {
+		return nil, err
+	}
+	return &hval, nil
+}
+
+func publishPresence(group string, hval HsetValue, id string) error {
+	event := PresenceEvent{
+		Group:       group,
+		Device:      hval.Device,
+		State:       hval.Presence,
+		LastContact: hval.TimeSeconds,
+		Timestamp:   time.Now().Unix(),
+	}
+	data, err := json.Marshal(&event)
+	if err != nil {
+		return err
+	}
+	subject := streamName + "." + group + "." + hval.Device + "." + presenceChannel
+	log.Infof("Device %v/%v is %v", group, hval.Device, hval.Presence)
+	_, err = js.Publish(subject, data, nats.MsgId(id))
+	return err
+}
+
+//HeartbeatTimeout how long a device may go without contact before it's considered offline
+func HeartbeatTimeout(group, device string) (time.Duration, error) {
+	secs, err := store.GetHeartbeat(group, device)
+	if err == errNotFound {
+		return heartbeatTimeout, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return time.Duration(secs) * time.Second, nil
+}
+
+//Sweep Periodically mark silent devices offline and clean up the set
+func Sweep() {
+	log.Info("Starting presence sweep")
+	go func() {
+		ticker := time.NewTicker(sweepInterval)
+		for range ticker.C {
+			var cursor uint64
+			for {
+				groups, next, err := store.ScanGroups(cursor, 100)
+				if err != nil {
+					log.Error(err)
+					break
+				}
+				for _, group := range groups {
+					if err := sweepGroup(group); err != nil {
+						log.Error(err)
+					}
+				}
+				cursor = next
+				if cursor == 0 {
+					break
+				}
+			}
+		}
+	}()
+}
+
+func sweepGroup(group string) error {
+	timeouts, err := store.Heartbeats(group)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	var cursor uint64
+	for {
+		entries, next, err := store.ScanDevices(group, cursor, 200)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := sweepDevice(group, entry.Device, entry.Entry, timeouts, now); err != nil {
+				log.Error(err)
+			}
+		}
+		cursor = next
+		if cursor == 0 {
+			break
+		}
+	}
+	size, err := store.CountDevices(group)
+	if err != nil {
+		return err
+	}
+	if size == 0 {
+		return store.RemoveGroup(group)
+	}
+	return nil
+}
+
+func sweepDevice(group, device string, raw []byte, timeouts map[string]int64, now time.Time) error {
+	var hval HsetValue
+	if err := json.Unmarshal(raw, &hval); err != nil {
+		return err
+	}
+	idle := now.Sub(time.Unix(hval.TimeSeconds, 0))
+	if idle > pruneAfter {
+		log.Infof("Pruning device %v from %v, last contact %v ago", device, group, idle)
+		_, err := store.SwapDevice(group, device, raw, nil)
+		return err
+	}
+	timeout := heartbeatTimeout
+	if secs, ok := timeouts[device]; ok {
+		timeout = time.Duration(secs) * time.Second
+	}
+	if hval.Presence == presenceOffline || idle <= timeout {
+		return nil
+	}
+	onlineSince := hval.Since
+	hval.Presence = presenceOffline
+	hval.Since = now.Unix()
+	data, err := json.Marshal(&hval)
+	if err != nil {
+		return err
+	}
+	swapped, err := store.SwapDevice(group, device, raw, data)
+	if err != nil || !swapped { //A reading arrived while sweeping, the device is still around
+		return err
+	}
+	id := fmt.Sprintf("%v.%v.%v.%d", group, device, presenceOffline, onlineSince)
+	return publishPresence(group, hval, id)
+}
+
+//PutHeartbeat override the heartbeat timeout for a device
+func PutHeartbeat(c *gin.Context) {
+	var req struct {
+		TimeoutSeconds int64 `json:"timeout_seconds" binding:"required,min=1"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	err := store.SetHeartbeat(c.Param("group"), c.Param("device"), req.TimeoutSeconds)
+	if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "updated", "timeout_seconds": req.TimeoutSeconds})
+}
+
+//DeleteHeartbeat restore the default heartbeat timeout for a device
+func DeleteHeartbeat(c *gin.Context) {
+	err := store.DeleteHeartbeat(c.Param("group"), c.Param("device"))
+	if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "reset", "timeout_seconds": int64(heartbeatTimeout / time.Second)})
+}
+
+//GetHeartbeat show the heartbeat timeout in effect for a device
+func GetHeartbeat(c *gin.Context) {
+	timeout, err := HeartbeatTimeout(c.Param("group"), c.Param("device"))
+	if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"timeout_seconds": int64(timeout / time.Second)})
+}
+
+//GetDevices a page of the devices of a group with their entries, straight through the scan of the group. Lets
+//control-hub list devices whatever storage pub-hub runs with
+func GetDevices(c *gin.Context) {
+	limit, err := strconv.ParseInt(c.DefaultQuery("limit", strconv.Itoa(defaultDevicePage)), 10, 64)
+	if err != nil || limit < 1 || limit > maxDevicePage {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and " + strconv.Itoa(maxDevicePage)})
+		return
+	}
+	var cursor uint64
+	if val := c.Query("cursor"); val != "" {
+		if cursor, err = strconv.ParseUint(val, 10, 64); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cursor"})
+			return
+		}
+	}
+	entries, next, err := store.ScanDevices(c.Param("group"), cursor, limit)
+	if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	page := DevicePage{Devices: make([]DeviceListing, len(entries))}
+	for i, entry := range entries {
+		page.Devices[i] = DeviceListing{Device: entry.Device, Entry: entry.Entry}
+	}
+	if next != 0 {
+		page.NextCursor = strconv.FormatUint(next, 10)
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+//GetDeviceCount how many devices a group has
+func GetDeviceCount(c *gin.Context) {
+	total, err := store.CountDevices(c.Param("group"))
+	if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"total": total})
+}
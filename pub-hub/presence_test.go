@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRecordContact(t *testing.T) {
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- RecordContact("contact", "smoker", "readings")
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	hval, err := getHsetValue("contact", "smoker")
+	if err != nil || hval == nil || hval.Presence != presenceOnline {
+		t.Fatalf("entry after concurrent contacts: %+v %v", hval, err)
+	}
+
+	hval.TimeSeconds -= 2 * int64(heartbeatTimeout/time.Second)
+	stale, _ := json.Marshal(hval)
+	if _, err := store.PutDevice("contact", "smoker", stale); err != nil {
+		t.Fatal(err)
+	}
+	if err := RecordContact("contact", "smoker", "readings"); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(2 * heartbeatTimeout)
+	if err := sweepDevice("contact", "smoker", stale, nil, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if hval, _ := getHsetValue("contact", "smoker"); hval.Presence != presenceOnline {
+		t.Fatal("the sweep undid a contact it didn't read")
+	}
+
+	raw, _ := store.GetDevice("contact", "smoker")
+	if err := sweepDevice("contact", "smoker", raw, nil, later); err != nil {
+		t.Fatal(err)
+	}
+	offline, _ := getHsetValue("contact", "smoker")
+	if offline.Presence != presenceOffline {
+		t.Fatalf("entry after the sweep: %+v", offline)
+	}
+	if err := RecordContact("contact", "smoker", "readings"); err != nil {
+		t.Fatal(err)
+	}
+	var online HsetValue
+	raw, _ = store.GetDevice("contact", "smoker")
+	if err := json.Unmarshal(raw, &online); err != nil || online.Presence != presenceOnline || online.Since < hval.Since {
+		t.Fatalf("entry back online: %+v %v", online, err)
+	}
+}
+
+func TestGetDevices(t *testing.T) {
+	want := make([]string, 25)
+	for i := range want {
+		want[i] = "smoker" + strconv.Itoa(i)
+		if err := RecordContact("listing", want[i], "readings"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sort.Strings(want)
+	var got []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > len(want) {
+			t.Fatal("the listing never ended")
+		}
+		rec := serve(t, http.MethodGet, "/admin/devices/listing?limit=10&cursor="+cursor, testAdminToken, nil, nil)
+		var page DevicePage
+		if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &page) != nil {
+			t.Fatalf("device page: %d %s", rec.Code, rec.Body)
+		}
+		for _, device := range page.Devices {
+			var hval HsetValue
+			if err := json.Unmarshal(device.Entry, &hval); err != nil || hval.Presence != presenceOnline {
+				t.Fatalf("entry of %v: %s %v", device.Device, device.Entry, err)
+			}
+			got = append(got, device.Device)
+		}
+		if cursor = page.NextCursor; cursor == "" {
+			break
+		}
+	}
+	sort.Strings(got)
+	if len(got) != len(want) {
+		t.Fatalf("listed %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("listed %v, want %v", got, want)
+		}
+	}
+
+	rec := serve(t, http.MethodGet, "/admin/devices/listing/count", testAdminToken, nil, nil)
+	var count struct {
+		Total int64 `json:"total"`
+	}
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &count) != nil || count.Total != int64(len(want)) {
+		t.Fatalf("device count: %d %s", rec.Code, rec.Body)
+	}
+	for _, query := range []string{"?limit=0", "?limit=1001", "?cursor=nope"} {
+		if rec := serve(t, http.MethodGet, "/admin/devices/listing"+query, testAdminToken, nil, nil); rec.Code != http.StatusBadRequest {
+			t.Fatalf("device listing %v: %d %s", query, rec.Code, rec.Body)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis"
+)
+
+//casScript replaces a hash field only if it still holds the value the caller read, an empty value is a
+//field that isn't there and an empty replacement deletes the field. Keeps the sweep and publishes from
+//clobbering each other
+var casScript = redis.NewScript(`
+local cur = redis.call('HGET', KEYS[1], ARGV[1])
+if cur == false then
+	cur = ''
+end
+if cur ~= ARGV[2] then
+	return 0
+end
+if ARGV[3] == '' then
+	redis.call('HDEL', KEYS[1], ARGV[1])
+else
+	redis.call('HSET', KEYS[1], ARGV[1], ARGV[3])
+end
+return 1
+`)
+
+//redisStore keeps the registry in the hashes control-hub reads: a hash per group named after the group,
+//credentials/<group> and heartbeats/<group>, and the set of groups at presence/groups. Schemas are a hash
+//per channel at schemas/<channel> keyed by version with the version counter at schemas/<channel>/seq, dead
+//letters the hash deadletter/entries indexed by time in the sorted set deadletter/index
+type redisStore struct {
+	rc *redis.Client
+}
+
+func (rs *redisStore) GetDevice(group, device string) ([]byte, error) {
+	val, err := rs.rc.HGet(group, device).Bytes()
+	if err == redis.Nil {
+		return nil, errNotFound
+	}
+	return val, err
+}
+
+func (rs *redisStore) PutDevice(group, device string, entry []byte) (bool, error) {
+	return rs.rc.HSet(group, device, string(entry)).Result()
+}
+
+func (rs *redisStore) SwapDevice(group, device string, old, entry []byte) (bool, error) {
+	swapped, err := casScript.Run(rs.rc, []string{group}, device, string(old), string(entry)).Int()
+	return swapped == 1, err
+}
+
+func (rs *redisStore) ScanDevices(group string, cursor uint64, count int64) ([]DeviceEntry, uint64, error) {
+	fields, next, err := rs.rc.HScan(group, cursor, "*", count).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	entries := make([]DeviceEntry, 0, len(fields)/2)
+	for i := 0; i+1 < len(fields); i += 2 {
+		entries = append(entries, DeviceEntry{Device: fields[i], Entry: []byte(fields[i+1])})
+	}
+	return entries, next, nil
+}
+
+func (rs *redisStore) CountDevices(group string) (int64, error) {
+	return rs.rc.HLen(group).Result()
+}
+
+func (rs *redisStore) AddGroup(group string) error {
+	return rs.rc.SAdd(groupsKey, group).Err()
+}
+
+func (rs *redisStore) RemoveGroup(group string) error {
+	return rs.rc.SRem(groupsKey, group).Err()
+}
+
+func (rs *redisStore) ScanGroups(cursor uint64, count int64) ([]string, uint64, error) {
+	return rs.rc.SScan(groupsKey, cursor, "*", count).Result()
+}
+
+func (rs *redisStore) PutCredential(group, device string, cred []byte) error {
+	return rs.rc.HSet(credentialKey(group), device, string(cred)).Err()
+}
+
+func (rs *redisStore) GetCredential(group, device string) ([]byte, error) {
+	val, err := rs.rc.HGet(credentialKey(group), device).Bytes()
+	if err == redis.Nil {
+		return nil, errNotFound
+	}
+	return val, err
+}
+
+func (rs *redisStore) DeleteCredential(group, device string) (bool, error) {
+	removed, err := rs.rc.HDel(credentialKey(group), device).Result()
+	return removed > 0, err
+}
+
+func (rs *redisStore) ListCredentials(group string) ([][]byte, error) {
+	vals, err := rs.rc.HVals(credentialKey(group)).Result()
+	if err != nil {
+		return nil, err
+	}
+	creds := make([][]byte, 0, len(vals))
+	for _, val := range vals {
+		creds = append(creds, []byte(val))
+	}
+	return creds, nil
+}
+
+func (rs *redisStore) GetHeartbeat(group, device string) (int64, error) {
+	secs, err := rs.rc.HGet(heartbeatPrefix+group, device).Int64()
+	if err == redis.Nil {
+		return 0, errNotFound
+	}
+	return secs, err
+}
+
+func (rs *redisStore) SetHeartbeat(group, device string, secs int64) error {
+	return rs.rc.HSet(heartbeatPrefix+group, device, secs).Err()
+}
+
+func (rs *redisStore) DeleteHeartbeat(group, device string) error {
+	return rs.rc.HDel(heartbeatPrefix+group, device).Err()
+}
+
+func (rs *redisStore) Heartbeats(group string) (map[string]int64, error) {
+	vals, err := rs.rc.HGetAll(heartbeatPrefix + group).Result()
+	if err != nil {
+		return nil, err
+	}
+	timeouts := make(map[string]int64, len(vals))
+	for device, val := range vals {
+		if secs, err := strconv.ParseInt(val, 10, 64); err == nil {
+			timeouts[device] = secs
+		}
+	}
+	return timeouts, nil
+}
+
+func (rs *redisStore) SchemaChannels() ([]string, error) {
+	channels := make([]string, 0)
+	var cursor uint64
+	for {
+		keys, next, err := rs.rc.Scan(cursor, schemaPrefix+"*", 100).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if !strings.HasSuffix(key, schemaSequenceSuffix) {
+				channels = append(channels, key[len(schemaPrefix):])
+			}
+		}
+		if cursor = next; cursor == 0 {
+			return channels, nil
+		}
+	}
+}
+
+func (rs *redisStore) GetSchemas(channel string) ([][]byte, error) {
+	vals, err := rs.rc.HVals(schemaKey(channel)).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([][]byte, 0, len(vals))
+	for _, val := range vals {
+		entries = append(entries, []byte(val))
+	}
+	return entries, nil
+}
+
+func (rs *redisStore) GetSchema(channel string, version int) ([]byte, error) {
+	val, err := rs.rc.HGet(schemaKey(channel), strconv.Itoa(version)).Bytes()
+	if err == redis.Nil {
+		return nil, errNotFound
+	}
+	return val, err
+}
+
+func (rs *redisStore) NextSchemaVersion(channel string) (int, error) {
+	version, err := rs.rc.Incr(schemaKey(channel) + schemaSequenceSuffix).Result()
+	return int(version), err
+}
+
+func (rs *redisStore) PutSchema(channel string, version int, entry []byte) error {
+	return rs.rc.HSet(schemaKey(channel), strconv.Itoa(version), string(entry)).Err()
+}
+
+func (rs *redisStore) DeleteSchema(channel string, version int) (bool, error) {
+	removed, err := rs.rc.HDel(schemaKey(channel), strconv.Itoa(version)).Result()
+	return removed > 0, err
+}
+
+func (rs *redisStore) AddDeadLetter(id string, timestamp int64, entry []byte, max int64) (int64, error) {
+	pipe := rs.rc.TxPipeline()
+	pipe.HSet(deadLetterEntries, id, string(entry))
+	pipe.ZAdd(deadLetterIndex, redis.Z{Score: float64(timestamp), Member: id})
+	count := pipe.ZCard(deadLetterIndex)
+	if _, err := pipe.Exec(); err != nil {
+		return 0, err
+	}
+	if count.Val() <= max {
+		return 0, nil
+	}
+	oldest, err := rs.rc.ZRange(deadLetterIndex, 0, count.Val()-max-1).Result()
+	if err != nil || len(oldest) == 0 {
+		return 0, err
+	}
+	pipe = rs.rc.TxPipeline()
+	pipe.HDel(deadLetterEntries, oldest...)
+	pipe.ZRem(deadLetterIndex, toMembers(oldest)...)
+	_, err = pipe.Exec()
+	return int64(len(oldest)), err
+}
+
+func toMembers(ids []string) []interface{} {
+	members := make([]interface{}, len(ids))
+	for i, id := range ids {
+		members[i] = id
+	}
+	return members
+}
+
+func (rs *redisStore) SaveDeadLetter(id string, entry []byte) error {
+	return rs.rc.HSet(deadLetterEntries, id, string(entry)).Err()
+}
+
+func (rs *redisStore) GetDeadLetter(id string) ([]byte, error) {
+	val, err := rs.rc.HGet(deadLetterEntries, id).Bytes()
+	if err == redis.Nil {
+		return nil, errNotFound
+	}
+	return val, err
+}
+
+func (rs *redisStore) DeleteDeadLetter(id string) (bool, error) {
+	pipe := rs.rc.TxPipeline()
+	removed := pipe.HDel(deadLetterEntries, id)
+	pipe.ZRem(deadLetterIndex, id)
+	if _, err := pipe.Exec(); err != nil {
+		return false, err
+	}
+	return removed.Val() > 0, nil
+}
+
+func (rs *redisStore) DeadLetters(start, count int64) ([][]byte, error) {
+	ids, err := rs.rc.ZRevRange(deadLetterIndex, start, start+count-1).Result()
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	vals, err := rs.rc.HMGet(deadLetterEntries, ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([][]byte, 0, len(vals))
+	for _, val := range vals {
+		if raw, ok := val.(string); ok {
+			entries = append(entries, []byte(raw))
+		}
+	}
+	return entries, nil
+}
+
+func (rs *redisStore) CountDeadLetters() (int64, error) {
+	return rs.rc.ZCard(deadLetterIndex).Result()
+}
+
+func (rs *redisStore) Ping() error {
+	return rs.rc.Ping().Err()
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/charles-d-burton/grillbernetes/validation"
+	"github.com/gin-gonic/gin"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+const (
+	schemaPrefix         = "schemas/"
+	schemaVersionHeader  = "Schema-Version"
+	schemaRefresh        = 30 * time.Second
+	invalidReject        = "reject"
+	invalidQuarantine    = "quarantine"
+	schemaSequenceSuffix = "/seq"
+)
+
+var errBadSchemaVersion = errors.New(schemaVersionHeader + " must be a schema version above 0")
+
+//SchemaVersion a JSON schema registered for a channel, devices pick the version they were built against
+type SchemaVersion struct {
+	Channel string          `json:"channel"`
+	Version int             `json:"version"`
+	Schema  json.RawMessage `json:"schema"`
+	Created int64           `json:"created"`
+}
+
+//SchemaError payload failed validation against the schemas of its channel
+type SchemaError struct {
+	Channel string                 `json:"channel"`
+	Version int                    `json:"version,omitempty"`
+	Reason  string                 `json:"error"`
+	Details []validation.Violation `json:"details,omitempty"`
+}
+
+func (err *SchemaError) Error() string {
+	if err.Version > 0 {
+		return fmt.Sprintf("payload does not match %v schema v%d: %v", err.Channel, err.Version, err.Reason)
+	}
+	return fmt.Sprintf("payload does not match any %v schema: %v", err.Channel, err.Reason)
+}
+
+//SchemaRegistry in memory copy of the compiled schemas, newest version first for each channel
+type SchemaRegistry struct {
+	*validation.Registry
+}
+
+var registry = &SchemaRegistry{validation.NewRegistry(loadDefinitions, func(err error) { log.Error(err) })}
+
+func schemaKey(channel string) string {
+	return schemaPrefix + channel
+}
+
+func compileSchema(channel string, version int, schema []byte) (*jsonschema.Schema, error) {
+	return validation.Compile(fmt.Sprintf("%v%v/%d.json", schemaPrefix, channel, version), schema)
+}
+
+//loadDefinitions every schema version of every channel from storage, keyed by channel
+func loadDefinitions() ([]validation.Definition, error) {
+	channels, err := store.SchemaChannels()
+	if err != nil {
+		return nil, err
+	}
+	var defs []validation.Definition
+	for _, channel := range channels {
+		versions, err := loadSchemas(channel)
+		if err != nil {
+			return nil, err
+		}
+		for _, sv := range versions {
+			defs = append(defs, validation.Definition{Key: channel, Version: sv.Version, Schema: sv.Schema})
+		}
+	}
+	return defs, nil
+}
+
+//Watch keep the registry in step with schemas registered through other replicas
+func (reg *SchemaRegistry) Watch() {
+	reg.Registry.Watch(schemaRefresh)
+}
+
+//Validate check a payload against the schemas of its channel. Channels without a schema accept anything,
+//a payload that names its schema version is held to that version, otherwise any registered version will do
+func (reg *SchemaRegistry) Validate(channel string, version int, data []byte) *SchemaError {
+	versions, _ := reg.Schemas(channel)
+	if len(versions) == 0 {
+		return nil
+	}
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return &SchemaError{Channel: channel, Version: version, Reason: err.Error()}
+	}
+	var first *SchemaError
+	for _, cs := range versions {
+		if version > 0 && cs.Version != version {
+			continue
+		}
+		err := cs.Validate(doc)
+		if err == nil {
+			return nil
+		}
+		if first == nil {
+			first = &SchemaError{Channel: channel, Reason: err.Error(), Details: validation.Violations(err)}
+			if len(first.Details) > 0 {
+				first.Reason = first.Details[0].Error
+			}
+		}
+	}
+	if first == nil {
+		return &SchemaError{Channel: channel, Version: version, Reason: "unknown schema version"}
+	}
+	first.Version = version
+	return first
+}
+
+func loadSchemas(channel string) ([]SchemaVersion, error) {
+	vals, err := store.GetSchemas(channel)
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]SchemaVersion, 0, len(vals))
+	for _, val := range vals {
+		var sv SchemaVersion
+		if err := json.Unmarshal(val, &sv); err != nil {
+			return nil, err
+		}
+		versions = append(versions, sv)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Version > versions[j].Version
+	})
+	return versions, nil
+}
+
+//schemaVersion the schema version a request declared in its header, 0 if none
+func schemaVersion(c *gin.Context) (int, error) {
+	val := c.GetHeader(schemaVersionHeader)
+	if val == "" {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(val)
+	if err != nil || version < 1 {
+		return 0, errBadSchemaVersion
+	}
+	return version, nil
+}
+
+//GetSchemas list the schema versions registered for a channel
+func GetSchemas(c *gin.Context) {
+	versions, err := loadSchemas(c.Param("channel"))
+	if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, versions)
+}
+
+//GetSchema fetch a single schema version
+func GetSchema(c *gin.Context) {
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "schema version not found"})
+		return
+	}
+	val, err := store.GetSchema(c.Param("channel"), version)
+	if err == errNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "schema version not found"})
+		return
+	} else if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	c.Data(http.StatusOK, "application/json", val)
+}
+
+//PostSchema register the request body as the next schema version of a channel
+func PostSchema(c *gin.Context) {
+	channel := c.Param("channel")
+	schema, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := compileSchema(channel, 0, schema); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	version, err := store.NextSchemaVersion(channel)
+	if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	sv := SchemaVersion{
+		Channel: channel,
+		Version: version,
+		Schema:  schema,
+		Created: time.Now().Unix(),
+	}
+	data, err := json.Marshal(&sv)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := store.PutSchema(channel, sv.Version, data); err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	if err := registry.Refresh(); err != nil {
+		log.Error(err)
+	}
+	log.Infof("registered %v schema v%d", channel, sv.Version)
+	c.JSON(http.StatusCreated, sv)
+}
+
+//DeleteSchema retire a schema version once no firmware uses it anymore
+func DeleteSchema(c *gin.Context) {
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "schema version not found"})
+		return
+	}
+	removed, err := store.DeleteSchema(c.Param("channel"), version)
+	if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	if !removed {
+		c.JSON(http.StatusNotFound, gin.H{"error": "schema version not found"})
+		return
+	}
+	if err := registry.Refresh(); err != nil {
+		log.Error(err)
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
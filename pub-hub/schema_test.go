@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+//registerSchemas register versions of a channel's schema, retired again once the test is over
+func registerSchemas(t *testing.T, channel string, schemas ...string) {
+	t.Helper()
+	for i, schema := range schemas {
+		rec := serve(t, http.MethodPost, "/admin/schemas/"+channel, testAdminToken, []byte(schema), nil)
+		var sv SchemaVersion
+		if rec.Code != http.StatusCreated || json.Unmarshal(rec.Body.Bytes(), &sv) != nil || sv.Version != i+1 {
+			t.Fatalf("register %v schema v%d: %d %s", channel, i+1, rec.Code, rec.Body)
+		}
+	}
+	t.Cleanup(func() {
+		for i := range schemas {
+			serve(t, http.MethodDelete, "/admin/schemas/"+channel+"/"+strconv.Itoa(i+1), testAdminToken, nil, nil)
+		}
+	})
+}
+
+//Version 1 of the probes channel reports °F as temp, version 2 as f and c
+var probeSchemas = []string{
+	`{"type": "object", "required": ["temp"], "properties": {"temp": {"type": "number"}}, "additionalProperties": false}`,
+	`{"type": "object", "required": ["f", "c"], "properties": {"f": {"type": "number"}, "c": {"type": "number"}}, "additionalProperties": false}`,
+}
+
+func TestSchemaIngest(t *testing.T) {
+	registerSchemas(t, "probes", probeSchemas...)
+	cred := issue(t, "ingest", "smoker")
+	v1, v2 := []byte(`{"data": {"temp": 225}}`), []byte(`{"data": {"f": 225, "c": 107}}`)
+	for _, test := range []struct {
+		name    string
+		body    []byte
+		version string
+		code    int
+		pinned  int
+	}{
+		{"old firmware", v1, "", http.StatusOK, 0},
+		{"new firmware", v2, "", http.StatusOK, 0},
+		{"matching neither version", []byte(`{"data": {"temp": "hot"}}`), "", http.StatusUnprocessableEntity, 0},
+		{"pinned to its version", v2, "2", http.StatusOK, 0},
+		{"pinned to another version", v2, "1", http.StatusUnprocessableEntity, 1},
+		{"pinned in the body", []byte(`{"schema_version": 1, "data": {"f": 225, "c": 107}}`), "", http.StatusUnprocessableEntity, 1},
+		{"header wins over the body", []byte(`{"schema_version": 1, "data": {"f": 225, "c": 107}}`), "2", http.StatusOK, 0},
+		{"unknown version", v1, "7", http.StatusUnprocessableEntity, 7},
+		{"version that isn't a number", v1, "v1", http.StatusBadRequest, 0},
+		{"version 0", v1, "0", http.StatusBadRequest, 0},
+		{"negative version", v1, "-1", http.StatusBadRequest, 0},
+	} {
+		var headers map[string]string
+		if test.version != "" {
+			headers = map[string]string{schemaVersionHeader: test.version}
+		}
+		rec := serve(t, http.MethodPost, "/ingest/smoker/probes", cred.Secret, test.body, headers)
+		if rec.Code != test.code {
+			t.Fatalf("%v: %d %s", test.name, rec.Code, rec.Body)
+		}
+		if test.code != http.StatusUnprocessableEntity {
+			continue
+		}
+		var serr SchemaError
+		if json.Unmarshal(rec.Body.Bytes(), &serr) != nil || serr.Channel != "probes" || serr.Version != test.pinned || serr.Reason == "" {
+			t.Fatalf("%v: schema error %s", test.name, rec.Body)
+		}
+		if test.pinned == 7 && serr.Reason != "unknown schema version" {
+			t.Fatalf("%v: reason %q", test.name, serr.Reason)
+		}
+	}
+	if rec := serve(t, http.MethodPost, "/ingest/smoker/untyped", cred.Secret, []byte(`{"data": "anything"}`), nil); rec.Code != http.StatusOK {
+		t.Fatalf("channel without a schema: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestSchemaQuarantine(t *testing.T) {
+	registerSchemas(t, "quarantined", probeSchemas...)
+	cred := issue(t, "quarantine", "smoker")
+	invalidPayloads = invalidQuarantine
+	defer func() { invalidPayloads = invalidReject }()
+
+	headers := map[string]string{schemaVersionHeader: "1"}
+	rec := serve(t, http.MethodPost, "/quarantine/smoker/quarantined", cred.Secret, []byte(`{"data": {"f": 225, "c": 107}}`), headers)
+	var body struct {
+		Status     string `json:"status"`
+		DeadLetter string `json:"dead_letter"`
+	}
+	if rec.Code != http.StatusAccepted || json.Unmarshal(rec.Body.Bytes(), &body) != nil || body.Status != "dead_lettered" || body.DeadLetter == "" {
+		t.Fatalf("invalid payload: %d %s", rec.Code, rec.Body)
+	}
+	rec = serve(t, http.MethodGet, "/admin/deadletters/"+body.DeadLetter, testAdminToken, nil, nil)
+	var dl DeadLetter
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &dl) != nil {
+		t.Fatalf("dead letter: %d %s", rec.Code, rec.Body)
+	}
+	if dl.Channel != "quarantined" || dl.Device != "smoker" || dl.SchemaVersion != 1 || string(dl.Data) != `{"f":225,"c":107}` {
+		t.Fatalf("dead letter doesn't hold the reading: %+v", dl)
+	}
+	if rec := serve(t, http.MethodPost, "/quarantine/smoker/quarantined", cred.Secret, []byte(`{"data": {"temp": 225}}`), headers); rec.Code != http.StatusOK {
+		t.Fatalf("valid payload while quarantining: %d %s", rec.Code, rec.Body)
+	}
+	if rec := serve(t, http.MethodPost, "/quarantine/smoker/quarantined", cred.Secret, []byte(`{"data": {"temp": 225}}`), map[string]string{schemaVersionHeader: "one"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("malformed version while quarantining: %d %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+const (
+	storageRedis  = "redis"
+	storageBolt   = "bolt"
+	storageMemory = "memory"
+)
+
+var errNotFound = errors.New("not found")
+
+//DeviceEntry a device of a group and its JSON entry
+type DeviceEntry struct {
+	Device string
+	Entry  []byte
+}
+
+//Store everything pub-hub keeps: the entry of each device of a group with its last contact and presence, the
+//groups the sweep walks, the credentials issued to devices and their heartbeat timeouts, the schemas of each
+//channel and the dead letters. Redis is shared by every replica and control-hub, a bbolt file or memory only
+//suit a single replica
+type Store interface {
+	//GetDevice the entry of a device, errNotFound if the group doesn't have it
+	GetDevice(group, device string) ([]byte, error)
+	//PutDevice replace the entry of a device, true when the device is new to the group
+	PutDevice(group, device string, entry []byte) (bool, error)
+	//SwapDevice replace the entry of a device only if it's still old, a nil old only adds a device the group
+	//doesn't have and a nil entry removes the device
+	SwapDevice(group, device string, old, entry []byte) (bool, error)
+	//ScanDevices a batch of the devices of a group and the cursor of the next batch, 0 once done
+	ScanDevices(group string, cursor uint64, count int64) ([]DeviceEntry, uint64, error)
+	//CountDevices how many devices a group has
+	CountDevices(group string) (int64, error)
+	//AddGroup remember a group for the sweep
+	AddGroup(group string) error
+	//RemoveGroup forget a group
+	RemoveGroup(group string) error
+	//ScanGroups a batch of the groups and the cursor of the next batch, 0 once done
+	ScanGroups(cursor uint64, count int64) ([]string, uint64, error)
+	//PutCredential replace the credential of a device
+	PutCredential(group, device string, cred []byte) error
+	//GetCredential the credential of a device, errNotFound if none was issued
+	GetCredential(group, device string) ([]byte, error)
+	//DeleteCredential remove the credential of a device, false if none was issued
+	DeleteCredential(group, device string) (bool, error)
+	//ListCredentials every credential issued in a group
+	ListCredentials(group string) ([][]byte, error)
+	//GetHeartbeat the heartbeat timeout of a device in seconds, errNotFound if it has the default
+	GetHeartbeat(group, device string) (int64, error)
+	//SetHeartbeat override the heartbeat timeout of a device
+	SetHeartbeat(group, device string, secs int64) error
+	//DeleteHeartbeat restore the default heartbeat timeout of a device
+	DeleteHeartbeat(group, device string) error
+	//Heartbeats every heartbeat timeout overridden in a group
+	Heartbeats(group string) (map[string]int64, error)
+
+	//SchemaChannels every channel with a schema registered
+	SchemaChannels() ([]string, error)
+	//GetSchemas every schema version of a channel in no particular order
+	GetSchemas(channel string) ([][]byte, error)
+	//GetSchema a single schema version of a channel, errNotFound if there's none
+	GetSchema(channel string, version int) ([]byte, error)
+	//NextSchemaVersion reserve the next version number of a channel, numbers are never handed out twice
+	NextSchemaVersion(channel string) (int, error)
+	//PutSchema store a schema version of a channel
+	PutSchema(channel string, version int, entry []byte) error
+	//DeleteSchema remove a schema version, false if there was none
+	DeleteSchema(channel string, version int) (bool, error)
+
+	//AddDeadLetter store a new dead letter, dropping the oldest ones once there are more than max. Returns
+	//how many were dropped
+	AddDeadLetter(id string, timestamp int64, entry []byte, max int64) (int64, error)
+	//SaveDeadLetter replace the entry of a dead letter
+	SaveDeadLetter(id string, entry []byte) error
+	//GetDeadLetter a single dead letter, errNotFound if there's none
+	GetDeadLetter(id string) ([]byte, error)
+	//DeleteDeadLetter remove a dead letter, false if there was none
+	DeleteDeadLetter(id string) (bool, error)
+	//DeadLetters the dead letters at positions start to start+count of the index, newest first
+	DeadLetters(start, count int64) ([][]byte, error)
+	//CountDeadLetters how many dead letters there are
+	CountDeadLetters() (int64, error)
+
+	//Ping whether the store can be reached
+	Ping() error
+}
+
+//openStore the store named by --storage, path is the file of the bbolt store
+func openStore(kind, path string) (Store, error) {
+	switch kind {
+	case storageRedis:
+		return &redisStore{rc: rc}, nil
+	case storageBolt:
+		return openBoltStore(path)
+	case storageMemory:
+		return newMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("storage must be one of %v, %v or %v", storageRedis, storageBolt, storageMemory)
+}
+
+//page the batch of sorted keys a scan cursor points at for the stores that don't have a native scan,
+//the cursor is how many keys came before
+func page(keys []string, cursor uint64, count int64) ([]string, uint64) {
+	sort.Strings(keys)
+	if cursor >= uint64(len(keys)) {
+		return nil, 0
+	}
+	end := cursor + uint64(count)
+	if count <= 0 || end >= uint64(len(keys)) {
+		return keys[cursor:], 0
+	}
+	return keys[cursor:end], end
+}
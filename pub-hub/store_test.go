@@ -0,0 +1,252 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+)
+
+//stores every Store implementation, each test runs against a fresh one of every kind
+var stores = []struct {
+	name string
+	open func(t *testing.T) Store
+}{
+	{storageRedis, func(t *testing.T) Store {
+		mr, err := miniredis.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(mr.Close)
+		return &redisStore{rc: redis.NewClient(&redis.Options{Addr: mr.Addr()})}
+	}},
+	{storageBolt, func(t *testing.T) Store {
+		bs, err := openBoltStore(filepath.Join(t.TempDir(), "pub-hub.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { bs.db.Close() })
+		return bs
+	}},
+	{storageMemory, func(t *testing.T) Store {
+		return newMemoryStore()
+	}},
+}
+
+//conformance run a test against every kind of store
+func conformance(t *testing.T, test func(t *testing.T, s Store)) {
+	for _, kind := range stores {
+		t.Run(kind.name, func(t *testing.T) {
+			test(t, kind.open(t))
+		})
+	}
+}
+
+func TestStoreDevices(t *testing.T) {
+	conformance(t, func(t *testing.T, s Store) {
+		if _, err := s.GetDevice("g", "d"); err != errNotFound {
+			t.Fatalf("missing device: %v", err)
+		}
+		if added, err := s.PutDevice("g", "d", []byte("a")); err != nil || !added {
+			t.Fatalf("put: %v %v", added, err)
+		}
+		if added, err := s.PutDevice("g", "d", []byte("b")); err != nil || added {
+			t.Fatalf("second put: %v %v", added, err)
+		}
+		if swapped, err := s.SwapDevice("g", "d", []byte("a"), []byte("c")); err != nil || swapped {
+			t.Fatalf("swap of a stale entry: %v %v", swapped, err)
+		}
+		if swapped, err := s.SwapDevice("g", "d", []byte("b"), []byte("c")); err != nil || !swapped {
+			t.Fatalf("swap: %v %v", swapped, err)
+		}
+		if entry, err := s.GetDevice("g", "d"); err != nil || string(entry) != "c" {
+			t.Fatalf("entry: %s %v", entry, err)
+		}
+		for i := 0; i < 9; i++ {
+			if _, err := s.PutDevice("g", strconv.Itoa(i), []byte("x")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if count, err := s.CountDevices("g"); err != nil || count != 10 {
+			t.Fatalf("count: %d %v", count, err)
+		}
+		seen := make(map[string]bool)
+		var cursor uint64
+		for {
+			entries, next, err := s.ScanDevices("g", cursor, 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, entry := range entries {
+				seen[entry.Device] = true
+			}
+			if cursor = next; cursor == 0 {
+				break
+			}
+		}
+		if len(seen) != 10 {
+			t.Fatalf("scan saw %d devices", len(seen))
+		}
+		if swapped, err := s.SwapDevice("g", "d", []byte("c"), nil); err != nil || !swapped {
+			t.Fatalf("swap to remove: %v %v", swapped, err)
+		}
+		if _, err := s.GetDevice("g", "d"); err != errNotFound {
+			t.Fatalf("removed device: %v", err)
+		}
+		if swapped, err := s.SwapDevice("new", "d", nil, []byte("a")); err != nil || !swapped {
+			t.Fatalf("swap to add: %v %v", swapped, err)
+		}
+		if swapped, err := s.SwapDevice("new", "d", nil, []byte("b")); err != nil || swapped {
+			t.Fatalf("swap to add a device that's there: %v %v", swapped, err)
+		}
+		if entry, err := s.GetDevice("new", "d"); err != nil || string(entry) != "a" {
+			t.Fatalf("added entry: %s %v", entry, err)
+		}
+	})
+}
+
+func TestStoreGroups(t *testing.T) {
+	conformance(t, func(t *testing.T, s Store) {
+		for _, group := range []string{"a", "b", "c"} {
+			if err := s.AddGroup(group); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.RemoveGroup("b"); err != nil {
+			t.Fatal(err)
+		}
+		groups, _, err := s.ScanGroups(0, 100)
+		sort.Strings(groups)
+		if err != nil || len(groups) != 2 || groups[0] != "a" || groups[1] != "c" {
+			t.Fatalf("groups: %v %v", groups, err)
+		}
+	})
+}
+
+func TestStoreCredentialsAndHeartbeats(t *testing.T) {
+	conformance(t, func(t *testing.T, s Store) {
+		if _, err := s.GetCredential("g", "d"); err != errNotFound {
+			t.Fatalf("missing credential: %v", err)
+		}
+		if err := s.PutCredential("g", "d", []byte(`{"secret":"s"}`)); err != nil {
+			t.Fatal(err)
+		}
+		if cred, err := s.GetCredential("g", "d"); err != nil || string(cred) != `{"secret":"s"}` {
+			t.Fatalf("credential: %s %v", cred, err)
+		}
+		if creds, err := s.ListCredentials("g"); err != nil || len(creds) != 1 {
+			t.Fatalf("credentials: %v %v", creds, err)
+		}
+		if removed, err := s.DeleteCredential("g", "d"); err != nil || !removed {
+			t.Fatalf("delete: %v %v", removed, err)
+		}
+		if removed, err := s.DeleteCredential("g", "d"); err != nil || removed {
+			t.Fatalf("second delete: %v %v", removed, err)
+		}
+		if _, err := s.GetHeartbeat("g", "d"); err != errNotFound {
+			t.Fatalf("default heartbeat: %v", err)
+		}
+		if err := s.SetHeartbeat("g", "d", 90); err != nil {
+			t.Fatal(err)
+		}
+		if timeouts, err := s.Heartbeats("g"); err != nil || timeouts["d"] != 90 {
+			t.Fatalf("heartbeats: %v %v", timeouts, err)
+		}
+		if err := s.DeleteHeartbeat("g", "d"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.GetHeartbeat("g", "d"); err != errNotFound {
+			t.Fatalf("deleted heartbeat: %v", err)
+		}
+	})
+}
+
+func TestStoreSchemas(t *testing.T) {
+	conformance(t, func(t *testing.T, s Store) {
+		for i := 1; i <= 2; i++ {
+			version, err := s.NextSchemaVersion("temp")
+			if err != nil || version != i {
+				t.Fatalf("version %d: %d %v", i, version, err)
+			}
+			if err := s.PutSchema("temp", version, []byte(strconv.Itoa(version))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if channels, err := s.SchemaChannels(); err != nil || len(channels) != 1 || channels[0] != "temp" {
+			t.Fatalf("channels: %v %v", channels, err)
+		}
+		if entries, err := s.GetSchemas("temp"); err != nil || len(entries) != 2 {
+			t.Fatalf("schemas: %v %v", entries, err)
+		}
+		if entry, err := s.GetSchema("temp", 2); err != nil || string(entry) != "2" {
+			t.Fatalf("schema: %s %v", entry, err)
+		}
+		for _, version := range []int{1, 2} {
+			if removed, err := s.DeleteSchema("temp", version); err != nil || !removed {
+				t.Fatalf("delete %d: %v %v", version, removed, err)
+			}
+		}
+		if _, err := s.GetSchema("temp", 2); err != errNotFound {
+			t.Fatalf("deleted schema: %v", err)
+		}
+		if channels, err := s.SchemaChannels(); err != nil || len(channels) != 0 {
+			t.Fatalf("channels without schemas: %v %v", channels, err)
+		}
+		if version, err := s.NextSchemaVersion("temp"); err != nil || version != 3 {
+			t.Fatalf("a version was handed out twice: %d %v", version, err)
+		}
+	})
+}
+
+func TestStoreDeadLetters(t *testing.T) {
+	conformance(t, func(t *testing.T, s Store) {
+		for i := 0; i < 5; i++ {
+			id := "dl" + strconv.Itoa(i)
+			dropped, err := s.AddDeadLetter(id, int64(100+i), []byte(id), 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := int64(0)
+			if i >= 3 {
+				want = 1
+			}
+			if dropped != want {
+				t.Fatalf("dead letter %d dropped %d", i, dropped)
+			}
+		}
+		if count, err := s.CountDeadLetters(); err != nil || count != 3 {
+			t.Fatalf("count: %d %v", count, err)
+		}
+		if _, err := s.GetDeadLetter("dl0"); err != errNotFound {
+			t.Fatalf("oldest dead letter wasn't dropped: %v", err)
+		}
+		entries, err := s.DeadLetters(0, 2)
+		if err != nil || len(entries) != 2 || string(entries[0]) != "dl4" || string(entries[1]) != "dl3" {
+			t.Fatalf("newest: %q %v", entries, err)
+		}
+		if entries, err := s.DeadLetters(2, 2); err != nil || len(entries) != 1 || string(entries[0]) != "dl2" {
+			t.Fatalf("second page: %q %v", entries, err)
+		}
+		if err := s.SaveDeadLetter("dl2", []byte("retried")); err != nil {
+			t.Fatal(err)
+		}
+		if entry, err := s.GetDeadLetter("dl2"); err != nil || string(entry) != "retried" {
+			t.Fatalf("saved: %s %v", entry, err)
+		}
+		if removed, err := s.DeleteDeadLetter("dl2"); err != nil || !removed {
+			t.Fatalf("delete: %v %v", removed, err)
+		}
+		if removed, err := s.DeleteDeadLetter("dl2"); err != nil || removed {
+			t.Fatalf("second delete: %v %v", removed, err)
+		}
+		if count, err := s.CountDeadLetters(); err != nil || count != 2 {
+			t.Fatalf("count after delete: %d %v", count, err)
+		}
+		if err := s.Ping(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
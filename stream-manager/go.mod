@@ -0,0 +1,12 @@
+module github.com/charles-d-burton/grillbernetes/stream-manager
+
+go 1.16
+
+require (
+	github.com/gin-gonic/gin v1.7.2
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/nats-io/nats-server/v2 v2.2.6
+	github.com/nats-io/nats.go v1.12.0
+	github.com/sirupsen/logrus v1.8.1
+	gopkg.in/yaml.v2 v2.4.0
+)
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/subtle"
+	"flag"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	nats "github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	usageStr = `
+Usage: stream-manager [options]
+Options:
+	-nh, --nats-host          <NATS_HOST>     Connect to the defined NATS server
+	-c,  --config             <Path>          Location of the streams file
+	-ri, --reconcile-interval <Duration>      How often the streams are checked against the file
+	-at, --admin-token        <ADMIN_TOKEN>   Bearer token required to use the admin api
+`
+	log        = logrus.New()
+	nc         *nats.Conn
+	js         nats.JetStreamContext
+	manager    *Manager
+	adminToken string
+	interval   time.Duration
+)
+
+//Status outcome of the last reconcile of a stream
+type Status struct {
+	Stream  string   `json:"stream"`
+	Action  string   `json:"action,omitempty"`
+	Changed []string `json:"changed,omitempty"`
+	Error   string   `json:"error,omitempty"`
+	Checked int64    `json:"checked"`
+}
+
+//StreamReport the declared and live state of a managed stream
+type StreamReport struct {
+	Spec      StreamSpec         `json:"spec"`
+	Reconcile *Status            `json:"reconcile,omitempty"`
+	Config    *nats.StreamConfig `json:"config,omitempty"`
+	State     *nats.StreamState  `json:"state,omitempty"`
+	Cluster   *nats.ClusterInfo  `json:"cluster,omitempty"`
+	Error     string             `json:"error,omitempty"`
+}
+
+//Manager keeps the streams in the manifest in line with their spec
+type Manager struct {
+	sync.RWMutex
+	reconciling sync.Mutex //Startup, the ticker, reconnects, and the api can all trigger a reconcile
+	path        string
+	manifest    *Manifest
+	statuses    map[string]*Status
+}
+
+func init() {
+	log.SetFormatter(&logrus.JSONFormatter{})
+}
+
+func main() {
+	var natsHost string
+	var configPath string
+	flag.StringVar(&natsHost, "nh", "", "Connect to the defined NATS server")
+	flag.StringVar(&natsHost, "nats-host", "", "Connect to the defined NATS server")
+	flag.StringVar(&configPath, "c", "/etc/stream-manager/streams.yaml", "Location of the streams file")
+	flag.StringVar(&configPath, "config", "/etc/stream-manager/streams.yaml", "Location of the streams file")
+	flag.DurationVar(&interval, "ri", 5*time.Minute, "How often the streams are checked against the file")
+	flag.DurationVar(&interval, "reconcile-interval", 5*time.Minute, "How often the streams are checked against the file")
+	flag.StringVar(&adminToken, "at", "", "Bearer token required to use the admin api")
+	flag.StringVar(&adminToken, "admin-token", "", "Bearer token required to use the admin api")
+	flag.Parse()
+	if natsHost == "" {
+		natsHost = os.Getenv("NATS_HOST")
+		if natsHost == "" {
+			log.Fatal("NATS_HOST Undefined\n", usageStr)
+		}
+	}
+	if adminToken == "" {
+		adminToken = os.Getenv("ADMIN_TOKEN")
+		if adminToken == "" {
+			log.Warn("ADMIN_TOKEN Undefined, admin api is disabled")
+		}
+	}
+
+	manager = &Manager{path: configPath, statuses: make(map[string]*Status)}
+	if err := manager.Load(); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Infof("connecting to nats host: %q", natsHost)
+	var err error
+	nc, err = nats.Connect(natsHost,
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			log.Error(err)
+		}),
+		nats.ReconnectHandler(func(_ *nats.Conn) {
+			log.Info("reconnected to nats, reconciling streams")
+			manager.ReconcileAll()
+		}),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	js, err = nc.JetStream()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	manager.ReconcileAll()
+	go func() {
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			manager.ReconcileAll()
+		}
+	}()
+	router := gin.Default()
+	router.GET("/healthz", HealthCheck)
+	admin := router.Group("/admin", AdminAuth)
+	admin.GET("/streams", GetStreams)
+	admin.GET("/streams/:stream", GetStream)
+	admin.POST("/reconcile", PostReconcile)
+	router.Run(":7777")
+}
+
+//Load read the streams file, the previous manifest is kept if the new one is invalid
+func (m *Manager) Load() error {
+	manifest, err := LoadManifest(m.path)
+	if err != nil {
+		return err
+	}
+	m.Lock()
+	m.manifest = manifest
+	m.Unlock()
+	log.Infof("loaded %d streams from %v", len(manifest.Streams), m.path)
+	return nil
+}
+
+//ReconcileAll bring every declared stream in line with its spec, a stream that fails doesn't
+//hold up the rest
+func (m *Manager) ReconcileAll() []*Status {
+	m.reconciling.Lock()
+	defer m.reconciling.Unlock()
+	m.RLock()
+	specs := m.manifest.Streams
+	m.RUnlock()
+	statuses := make([]*Status, 0, len(specs))
+	for i := range specs {
+		status, err := Reconcile(js, &specs[i])
+		if err != nil {
+			log.Errorf("reconciling stream %v: %v", specs[i].Name, err)
+			status.Error = err.Error()
+		}
+		statuses = append(statuses, status)
+		m.Lock()
+		m.statuses[status.Stream] = status
+		m.Unlock()
+	}
+	return statuses
+}
+
+//Report gather the spec, last reconcile, and live stats of a stream
+func (m *Manager) Report(spec StreamSpec) StreamReport {
+	m.RLock()
+	report := StreamReport{Spec: spec, Reconcile: m.statuses[spec.Name]}
+	m.RUnlock()
+	info, err := js.StreamInfo(spec.Name)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	report.Config = &info.Config
+	report.State = &info.State
+	report.Cluster = info.Cluster
+	return report
+}
+
+//HealthCheck k8s healthcheck path, reconcile failures are reported through the admin api rather
+//than failing the probe since restarting won't fix a bad spec
+func HealthCheck(c *gin.Context) {
+	if !nc.IsConnected() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "nats disconnected"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "alive"})
+}
+
+//AdminAuth middleware guarding the admin api with the configured admin token
+func AdminAuth(c *gin.Context) {
+	if adminToken == "" {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin api disabled, no admin token configured"})
+		return
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer "))
+	if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "bad admin token"})
+		return
+	}
+	c.Next()
+}
+
+//GetStreams report on every managed stream
+func GetStreams(c *gin.Context) {
+	manager.RLock()
+	specs := manager.manifest.Streams
+	manager.RUnlock()
+	reports := make([]StreamReport, 0, len(specs))
+	for _, spec := range specs {
+		reports = append(reports, manager.Report(spec))
+	}
+	c.JSON(http.StatusOK, reports)
+}
+
+//GetStream report on a single managed stream
+func GetStream(c *gin.Context) {
+	manager.RLock()
+	specs := manager.manifest.Streams
+	manager.RUnlock()
+	for _, spec := range specs {
+		if spec.Name == c.Param("stream") {
+			c.JSON(http.StatusOK, manager.Report(spec))
+			return
+		}
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "stream is not managed"})
+}
+
+//PostReconcile reload the streams file and reconcile now rather than waiting for the next interval
+func PostReconcile(c *gin.Context) {
+	if err := manager.Load(); err != nil {
+		log.Error(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, manager.ReconcileAll())
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	nats "github.com/nats-io/nats.go"
+)
+
+//TestMain run the tests against an embedded JetStream server
+func TestMain(m *testing.M) {
+	os.Exit(runTests(m))
+}
+
+func runTests(m *testing.M) int {
+	log.SetOutput(ioutil.Discard)
+	dir, err := ioutil.TempDir("", "stream-manager")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	ns, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: dir})
+	if err != nil {
+		panic(err)
+	}
+	go ns.Start()
+	defer ns.Shutdown()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		panic("embedded nats server didn't start")
+	}
+	if nc, err = nats.Connect(ns.ClientURL()); err != nil {
+		panic(err)
+	}
+	defer nc.Close()
+	if js, err = nc.JetStream(); err != nil {
+		panic(err)
+	}
+	return m.Run()
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	retentionPolicies = map[string]nats.RetentionPolicy{
+		"":          nats.LimitsPolicy,
+		"limits":    nats.LimitsPolicy,
+		"interest":  nats.InterestPolicy,
+		"workqueue": nats.WorkQueuePolicy,
+	}
+	storageTypes = map[string]nats.StorageType{
+		"":       nats.FileStorage,
+		"file":   nats.FileStorage,
+		"memory": nats.MemoryStorage,
+	}
+	discardPolicies = map[string]nats.DiscardPolicy{
+		"":    nats.DiscardOld,
+		"old": nats.DiscardOld,
+		"new": nats.DiscardNew,
+	}
+	errImmutable = errors.New("storage and retention can't be changed on an existing stream, it has to be recreated by hand")
+)
+
+//StreamSpec declared configuration of a stream, limits left at zero are unlimited
+type StreamSpec struct {
+	Name              string   `yaml:"name" json:"name"`
+	Description       string   `yaml:"description" json:"description,omitempty"`
+	Subjects          []string `yaml:"subjects" json:"subjects,omitempty"`
+	Retention         string   `yaml:"retention" json:"retention,omitempty"`
+	Storage           string   `yaml:"storage" json:"storage,omitempty"`
+	Discard           string   `yaml:"discard" json:"discard,omitempty"`
+	Replicas          int      `yaml:"replicas" json:"replicas,omitempty"`
+	MaxAge            string   `yaml:"max_age" json:"max_age,omitempty"`
+	MaxBytes          int64    `yaml:"max_bytes" json:"max_bytes,omitempty"`
+	MaxMsgs           int64    `yaml:"max_msgs" json:"max_msgs,omitempty"`
+	MaxMsgsPerSubject int64    `yaml:"max_msgs_per_subject" json:"max_msgs_per_subject,omitempty"`
+	MaxMsgSize        int32    `yaml:"max_msg_size" json:"max_msg_size,omitempty"`
+	DuplicateWindow   string   `yaml:"duplicate_window" json:"duplicate_window,omitempty"`
+}
+
+//Manifest the set of streams the manager owns
+type Manifest struct {
+	Streams []StreamSpec `yaml:"streams" json:"streams"`
+}
+
+//LoadManifest read and validate the streams file
+func LoadManifest(path string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var manifest Manifest
+	if err := yaml.UnmarshalStrict(data, &manifest); err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(manifest.Streams))
+	for _, spec := range manifest.Streams {
+		if spec.Name == "" {
+			return nil, errors.New("stream without a name")
+		}
+		if seen[spec.Name] {
+			return nil, fmt.Errorf("stream %v declared twice", spec.Name)
+		}
+		seen[spec.Name] = true
+		if _, err := spec.Config(); err != nil {
+			return nil, fmt.Errorf("stream %v: %v", spec.Name, err)
+		}
+	}
+	return &manifest, nil
+}
+
+//Config translate the spec into the JetStream config, unlimited values are normalized to the -1
+//the server reports so a stream that matches its spec compares equal
+func (spec *StreamSpec) Config() (*nats.StreamConfig, error) {
+	retention, ok := retentionPolicies[spec.Retention]
+	if !ok {
+		return nil, fmt.Errorf("unknown retention %q, must be limits, interest or workqueue", spec.Retention)
+	}
+	storage, ok := storageTypes[spec.Storage]
+	if !ok {
+		return nil, fmt.Errorf("unknown storage %q, must be file or memory", spec.Storage)
+	}
+	discard, ok := discardPolicies[spec.Discard]
+	if !ok {
+		return nil, fmt.Errorf("unknown discard %q, must be old or new", spec.Discard)
+	}
+	maxAge, err := parseDuration(spec.MaxAge)
+	if err != nil {
+		return nil, fmt.Errorf("max_age: %v", err)
+	}
+	duplicates, err := parseDuration(spec.DuplicateWindow)
+	if err != nil {
+		return nil, fmt.Errorf("duplicate_window: %v", err)
+	}
+	subjects := spec.Subjects
+	if len(subjects) == 0 {
+		subjects = []string{spec.Name + ".>"}
+	}
+	config := &nats.StreamConfig{
+		Name:              spec.Name,
+		Description:       spec.Description,
+		Subjects:          subjects,
+		Retention:         retention,
+		Storage:           storage,
+		Discard:           discard,
+		Replicas:          spec.Replicas,
+		MaxConsumers:      -1,
+		MaxAge:            maxAge,
+		MaxBytes:          unlimited(spec.MaxBytes),
+		MaxMsgs:           unlimited(spec.MaxMsgs),
+		MaxMsgsPerSubject: unlimited(spec.MaxMsgsPerSubject),
+		MaxMsgSize:        int32(unlimited(int64(spec.MaxMsgSize))),
+		Duplicates:        duplicates,
+	}
+	if config.Replicas == 0 {
+		config.Replicas = 1
+	}
+	if config.Duplicates == 0 {
+		config.Duplicates = 2 * time.Minute //Server default, pub-hub dedupes on Nats-Msg-Id within this window
+	}
+	return config, nil
+}
+
+func parseDuration(val string) (time.Duration, error) {
+	if val == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(val)
+}
+
+func unlimited(val int64) int64 {
+	if val <= 0 {
+		return -1
+	}
+	return val
+}
+
+//drift names of the managed settings where the live config differs from the declared one. Limits the
+//server reports as 0 are unlimited like -1, servers from before a limit existed leave it out
+func drift(want, have *nats.StreamConfig) []string {
+	changed := make([]string, 0)
+	compare := func(name string, a, b interface{}) {
+		if !reflect.DeepEqual(a, b) {
+			changed = append(changed, name)
+		}
+	}
+	wantSubjects := append([]string(nil), want.Subjects...)
+	haveSubjects := append([]string(nil), have.Subjects...)
+	sort.Strings(wantSubjects)
+	sort.Strings(haveSubjects)
+	compare("subjects", wantSubjects, haveSubjects)
+	compare("description", want.Description, have.Description)
+	compare("retention", want.Retention, have.Retention)
+	compare("storage", want.Storage, have.Storage)
+	compare("discard", want.Discard, have.Discard)
+	compare("replicas", want.Replicas, have.Replicas)
+	compare("max_age", want.MaxAge, have.MaxAge)
+	compare("max_bytes", want.MaxBytes, unlimited(have.MaxBytes))
+	compare("max_msgs", want.MaxMsgs, unlimited(have.MaxMsgs))
+	compare("max_msgs_per_subject", want.MaxMsgsPerSubject, unlimited(have.MaxMsgsPerSubject))
+	compare("max_msg_size", want.MaxMsgSize, int32(unlimited(int64(have.MaxMsgSize))))
+	compare("duplicate_window", want.Duplicates, have.Duplicates)
+	return changed
+}
+
+//Reconcile create the stream if it's missing or update it to match the spec
+func Reconcile(js nats.JetStreamContext, spec *StreamSpec) (*Status, error) {
+	status := &Status{Stream: spec.Name, Checked: time.Now().Unix()}
+	want, err := spec.Config()
+	if err != nil {
+		return status, err
+	}
+	info, err := js.StreamInfo(spec.Name)
+	if err == nats.ErrStreamNotFound {
+		log.Infof("creating stream %v", spec.Name)
+		if _, err := js.AddStream(want); err != nil {
+			return status, err
+		}
+		status.Action = "created"
+		return status, nil
+	} else if err != nil {
+		return status, err
+	}
+	status.Changed = drift(want, &info.Config)
+	if len(status.Changed) == 0 {
+		status.Action = "unchanged"
+		return status, nil
+	}
+	if want.Storage != info.Config.Storage || want.Retention != info.Config.Retention {
+		return status, errImmutable
+	}
+	log.Infof("updating stream %v, changed %v", spec.Name, status.Changed)
+	if _, err := js.UpdateStream(want); err != nil {
+		return status, err
+	}
+	status.Action = "updated"
+	return status, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+)
+
+func TestLoadManifest(t *testing.T) {
+	manifest, err := LoadManifest("streams.yaml")
+	if err != nil || len(manifest.Streams) != 2 || manifest.Streams[0].Name != "EVENTS" {
+		t.Fatalf("shipped streams file: %+v %v", manifest, err)
+	}
+	dir := t.TempDir()
+	for _, test := range []struct {
+		name, yaml, err string
+	}{
+		{"minimal", "streams:\n- name: EVENTS\n", ""},
+		{"no streams", "streams: []\n", ""},
+		{"stream without a name", "streams:\n- subjects: [EVENTS.>]\n", "stream without a name"},
+		{"stream declared twice", "streams:\n- name: EVENTS\n- name: EVENTS\n", "stream EVENTS declared twice"},
+		{"unknown setting", "streams:\n- name: EVENTS\n  max_age_days: 30\n", "max_age_days"},
+		{"unknown retention", "streams:\n- name: EVENTS\n  retention: forever\n", "stream EVENTS: unknown retention"},
+		{"unknown storage", "streams:\n- name: EVENTS\n  storage: tape\n", "stream EVENTS: unknown storage"},
+		{"bad max_age", "streams:\n- name: EVENTS\n  max_age: 30d\n", "stream EVENTS: max_age"},
+		{"bad duplicate_window", "streams:\n- name: EVENTS\n  duplicate_window: soon\n", "stream EVENTS: duplicate_window"},
+	} {
+		path := filepath.Join(dir, "streams.yaml")
+		if err := ioutil.WriteFile(path, []byte(test.yaml), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadManifest(path)
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+	}
+	if _, err := LoadManifest(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Fatal("missing streams file loaded")
+	}
+}
+
+func TestStreamSpecConfig(t *testing.T) {
+	config, err := (&StreamSpec{Name: "EVENTS"}).Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaults := &nats.StreamConfig{
+		Name:              "EVENTS",
+		Subjects:          []string{"EVENTS.>"},
+		Retention:         nats.LimitsPolicy,
+		Storage:           nats.FileStorage,
+		Discard:           nats.DiscardOld,
+		Replicas:          1,
+		MaxConsumers:      -1,
+		MaxBytes:          -1,
+		MaxMsgs:           -1,
+		MaxMsgsPerSubject: -1,
+		MaxMsgSize:        -1,
+		Duplicates:        2 * time.Minute,
+	}
+	if !reflect.DeepEqual(config, defaults) {
+		t.Fatalf("defaults %+v, want %+v", config, defaults)
+	}
+
+	spec := &StreamSpec{
+		Name:              "AUDIT",
+		Subjects:          []string{"AUDIT.a.>", "AUDIT.b.>"},
+		Retention:         "interest",
+		Storage:           "memory",
+		Discard:           "new",
+		Replicas:          3,
+		MaxAge:            "720h",
+		MaxBytes:          1024,
+		MaxMsgs:           -5,
+		MaxMsgsPerSubject: 10,
+		MaxMsgSize:        512,
+		DuplicateWindow:   "30s",
+	}
+	if config, err = spec.Config(); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Subjects) != 2 || config.Retention != nats.InterestPolicy || config.Storage != nats.MemoryStorage || config.Discard != nats.DiscardNew || config.Replicas != 3 {
+		t.Fatalf("declared policies not kept: %+v", config)
+	}
+	if config.MaxAge != 720*time.Hour || config.MaxBytes != 1024 || config.MaxMsgs != -1 || config.MaxMsgsPerSubject != 10 || config.MaxMsgSize != 512 || config.Duplicates != 30*time.Second {
+		t.Fatalf("declared limits not kept: %+v", config)
+	}
+}
+
+func TestDrift(t *testing.T) {
+	want, err := (&StreamSpec{Name: "EVENTS", Subjects: []string{"EVENTS.a.>", "EVENTS.b.>"}, MaxAge: "1h"}).Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	same := *want
+	same.Subjects = []string{"EVENTS.b.>", "EVENTS.a.>"}
+	same.MaxMsgsPerSubject, same.MaxMsgSize = 0, 0
+	if changed := drift(want, &same); len(changed) != 0 {
+		t.Fatalf("reordered subjects and limits reported as 0 drifted: %v", changed)
+	}
+	have := *want
+	have.Subjects = []string{"EVENTS.a.>"}
+	have.Description = "edited by hand"
+	have.MaxAge = 2 * time.Hour
+	have.MaxBytes = 1024
+	have.Storage = nats.MemoryStorage
+	changed := drift(want, &have)
+	if want := []string{"subjects", "description", "storage", "max_age", "max_bytes"}; !reflect.DeepEqual(changed, want) {
+		t.Fatalf("drift %v, want %v", changed, want)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	spec := &StreamSpec{Name: "RECONCILE", MaxAge: "1h", MaxMsgs: 100}
+	for i, action := range []string{"created", "unchanged"} {
+		status, err := Reconcile(js, spec)
+		if err != nil || status.Action != action || len(status.Changed) != 0 {
+			t.Fatalf("reconcile %d: %+v %v", i, status, err)
+		}
+	}
+	info, err := js.StreamInfo("RECONCILE")
+	if err != nil || info.Config.MaxAge != time.Hour || info.Config.MaxMsgs != 100 || info.Config.Subjects[0] != "RECONCILE.>" {
+		t.Fatalf("created stream: %+v %v", info, err)
+	}
+
+	spec.MaxAge, spec.MaxMsgs = "2h", 0
+	status, err := Reconcile(js, spec)
+	if err != nil || status.Action != "updated" || !reflect.DeepEqual(status.Changed, []string{"max_age", "max_msgs"}) {
+		t.Fatalf("update: %+v %v", status, err)
+	}
+	if info, err := js.StreamInfo("RECONCILE"); err != nil || info.Config.MaxAge != 2*time.Hour || info.Config.MaxMsgs != -1 {
+		t.Fatalf("updated stream: %+v %v", info, err)
+	}
+
+	for _, immutable := range []*StreamSpec{
+		{Name: "RECONCILE", MaxAge: "2h", Storage: "memory"},
+		{Name: "RECONCILE", MaxAge: "2h", Retention: "workqueue"},
+	} {
+		status, err := Reconcile(js, immutable)
+		if err != errImmutable || status.Action != "" {
+			t.Fatalf("immutable change %+v: %+v %v", immutable, status, err)
+		}
+	}
+	if info, err := js.StreamInfo("RECONCILE"); err != nil || info.Config.Storage != nats.FileStorage || info.Config.Retention != nats.LimitsPolicy {
+		t.Fatalf("stream after refusing immutable changes: %+v %v", info, err)
+	}
+
+	if status, err := Reconcile(js, &StreamSpec{Name: "RECONCILE", Retention: "forever"}); err == nil || status.Action != "" {
+		t.Fatalf("invalid spec: %+v %v", status, err)
+	}
+}
@@ -0,0 +1,5 @@
+module github.com/charles-d-burton/grillbernetes/validation
+
+go 1.14
+
+require github.com/santhosh-tekuri/jsonschema/v5 v5.3.1
@@ -0,0 +1,121 @@
+//Package validation the JSON schema registry shared by pub-hub, which holds payloads to the schemas of
+//their channel, and control-hub, which holds configs to the schemas of their device type
+package validation
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+//Definition a schema as it's stored, a key holds any number of schemas told apart by name or version
+type Definition struct {
+	Key     string
+	Name    string
+	Version int
+	Schema  []byte
+}
+
+//Schema a compiled definition
+type Schema struct {
+	Name    string
+	Version int
+	*jsonschema.Schema
+}
+
+//Violation a single field of a document that broke the schema, field is a JSON pointer
+type Violation struct {
+	Field string `json:"field"`
+	Error string `json:"error"`
+}
+
+//Compile a schema, the url names it in errors and only has to be unique
+func Compile(url string, schema []byte) (*jsonschema.Schema, error) {
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource(url, bytes.NewReader(schema)); err != nil {
+		return nil, err
+	}
+	return compiler.Compile(url)
+}
+
+//Violations flatten the error of a failed validation into the failures of individual fields
+func Violations(err error) []Violation {
+	ve, ok := err.(*jsonschema.ValidationError)
+	if !ok {
+		return nil
+	}
+	details := make([]Violation, 0)
+	for _, be := range ve.BasicOutput().Errors {
+		if be.KeywordLocation == "" { //Root wrapper, only says the document didn't validate
+			continue
+		}
+		field := be.InstanceLocation
+		if field == "" {
+			field = "/"
+		}
+		details = append(details, Violation{Field: field, Error: be.Error})
+	}
+	return details
+}
+
+//Registry in memory copy of compiled schemas, reloaded from wherever load reads the definitions. A
+//definition that doesn't compile is reported to onError and left out
+type Registry struct {
+	sync.RWMutex
+	load    func() ([]Definition, error)
+	onError func(error)
+	schemas map[string][]*Schema
+}
+
+//NewRegistry an empty registry, filled by Refresh or Watch
+func NewRegistry(load func() ([]Definition, error), onError func(error)) *Registry {
+	return &Registry{load: load, onError: onError, schemas: make(map[string][]*Schema)}
+}
+
+//Refresh reload every definition, the schemas of a key keep the order load gave them in
+func (reg *Registry) Refresh() error {
+	defs, err := reg.load()
+	if err != nil {
+		return err
+	}
+	schemas := make(map[string][]*Schema)
+	for _, def := range defs {
+		url := fmt.Sprintf("%v/%v/%d.json", def.Key, def.Name, def.Version)
+		compiled, err := Compile(url, def.Schema)
+		if err != nil {
+			reg.onError(fmt.Errorf("skipping schema %v: %v", url, err))
+			continue
+		}
+		schemas[def.Key] = append(schemas[def.Key], &Schema{Name: def.Name, Version: def.Version, Schema: compiled})
+	}
+	reg.Lock()
+	reg.schemas = schemas
+	reg.Unlock()
+	return nil
+}
+
+//Watch keep the registry in step with definitions written through other replicas
+func (reg *Registry) Watch(interval time.Duration) {
+	if err := reg.Refresh(); err != nil {
+		reg.onError(err)
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			if err := reg.Refresh(); err != nil {
+				reg.onError(err)
+			}
+		}
+	}()
+}
+
+//Schemas the compiled schemas of a key, false when the key has none
+func (reg *Registry) Schemas(key string) ([]*Schema, bool) {
+	reg.RLock()
+	defer reg.RUnlock()
+	schemas, ok := reg.schemas[key]
+	return schemas, ok
+}
@@ -0,0 +1,83 @@
+package validation
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+const rangeSchema = `{"type": "object", "properties": {"temp": {"type": "number", "maximum": 500}}, "required": ["temp"]}`
+
+func TestRegistry(t *testing.T) {
+	var reported []error
+	defs := []Definition{
+		{Key: "readings", Version: 2, Schema: []byte(rangeSchema)},
+		{Key: "readings", Version: 1, Schema: []byte(`{"type": "object"}`)},
+		{Key: "broken", Version: 1, Schema: []byte(`{"type": 12}`)},
+	}
+	reg := NewRegistry(func() ([]Definition, error) { return defs, nil }, func(err error) { reported = append(reported, err) })
+	if err := reg.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	schemas, ok := reg.Schemas("readings")
+	if !ok || len(schemas) != 2 || schemas[0].Version != 2 || schemas[1].Version != 1 {
+		t.Fatalf("readings schemas = %+v, want v2 then v1", schemas)
+	}
+	if _, ok := reg.Schemas("broken"); ok {
+		t.Error("a schema that doesn't compile was registered")
+	}
+	if len(reported) != 1 {
+		t.Errorf("reported %d errors, want 1", len(reported))
+	}
+}
+
+func TestRefreshKeepsSchemasOnError(t *testing.T) {
+	fail := false
+	reg := NewRegistry(func() ([]Definition, error) {
+		if fail {
+			return nil, errors.New("store down")
+		}
+		return []Definition{{Key: "configs", Name: "configs", Schema: []byte(rangeSchema)}}, nil
+	}, func(error) {})
+	if err := reg.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	fail = true
+	if err := reg.Refresh(); err == nil {
+		t.Fatal("refresh didn't fail")
+	}
+	if _, ok := reg.Schemas("configs"); !ok {
+		t.Error("a failed refresh dropped the schemas")
+	}
+}
+
+func TestViolations(t *testing.T) {
+	tests := []struct {
+		doc   string
+		field string
+	}{
+		{`{"temp": 900}`, "/temp"},
+		{`{"temp": "hot"}`, "/temp"},
+		{`{}`, "/"},
+	}
+	schema, err := Compile("test.json", []byte(rangeSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		var doc interface{}
+		json.Unmarshal([]byte(tt.doc), &doc)
+		err := schema.Validate(doc)
+		if err == nil {
+			t.Errorf("%v passed", tt.doc)
+			continue
+		}
+		details := Violations(err)
+		if len(details) == 0 || details[0].Field != tt.field {
+			t.Errorf("%v violations = %+v, want field %v", tt.doc, details, tt.field)
+		}
+	}
+	if Violations(errors.New("not a validation error")) != nil {
+		t.Error("violations of a plain error")
+	}
+}